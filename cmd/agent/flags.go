@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/antonminaichev/metricscollector/internal/agent"
 	"github.com/antonminaichev/metricscollector/internal/conf"
@@ -11,7 +13,7 @@ import (
 
 // NewConfig initialises new agent configuration.
 func NewConfig() (*agent.Config, error) {
-	cfg := &agent.Config{Address: "localhost:8080", ReportInterval: 2, PollInterval: 2, RateLimit: 30}
+	cfg := &agent.Config{Address: "localhost:8080", ReportInterval: 2, PollInterval: 2, RateLimit: 30, BatchSize: 100}
 
 	configPath := conf.PickConfigPathFromArgs(os.Args[1:])
 	if configPath == "" {
@@ -34,6 +36,15 @@ func NewConfig() (*agent.Config, error) {
 	rateLimit := flag.Int("l", cfg.RateLimit, "Max concurrent requests")
 	hashKey := flag.String("k", cfg.HashKey, "Hash key")
 	cryptoKey := flag.String("crypto-key", cfg.CryptoKey, "Path to public key")
+	batchSize := flag.Int("b", cfg.BatchSize, "Max metrics per batch request, 0 disables splitting")
+	grpcAddress := flag.String("grpc-address", cfg.GRPCAddress, "{Host:port} of gRPC server, pushes via gRPC instead of HTTP when set")
+	tlsCA := flag.String("tls-ca", cfg.TLSCA, "Path to CA bundle for server certificate, enables TLS")
+	tlsCert := flag.String("tls-cert", cfg.TLSCert, "Path to client certificate for mutual TLS")
+	tlsKey := flag.String("tls-key", cfg.TLSKey, "Path to client certificate private key")
+	instanceID := flag.String("instance", cfg.InstanceID, "Agent instance ID attached to metrics, defaults to hostname")
+	histogramBuckets := flag.String("histogram-buckets", formatBuckets(cfg.HistogramBuckets), "Comma separated bucket bounds of agent histograms, seconds")
+	statsdAddress := flag.String("statsd-address", cfg.StatsDAddress, "{Host:port} of UDP StatsD listener, empty disables it")
+	statsdSocket := flag.String("statsd-socket", cfg.StatsDSocket, "Path of Unix datagram StatsD socket, empty disables it")
 	_ = flag.String("c", configPath, "Path to config file (JSON)")
 
 	flag.Parse()
@@ -44,5 +55,27 @@ func NewConfig() (*agent.Config, error) {
 	cfg.RateLimit = *rateLimit
 	cfg.HashKey = *hashKey
 	cfg.CryptoKey = *cryptoKey
+	cfg.BatchSize = *batchSize
+	cfg.GRPCAddress = *grpcAddress
+	cfg.TLSCA = *tlsCA
+	cfg.TLSCert = *tlsCert
+	cfg.TLSKey = *tlsKey
+	cfg.InstanceID = *instanceID
+	cfg.StatsDAddress = *statsdAddress
+	cfg.StatsDSocket = *statsdSocket
+	buckets, err := agent.ParseHistogramBuckets(*histogramBuckets)
+	if err != nil {
+		return nil, err
+	}
+	cfg.HistogramBuckets = buckets
 	return cfg, nil
 }
+
+// formatBuckets renders bucket bounds as a flag value.
+func formatBuckets(bounds []float64) string {
+	parts := make([]string, len(bounds))
+	for i, b := range bounds {
+		parts[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
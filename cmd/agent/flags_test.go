@@ -17,4 +17,9 @@ func TestNewConfigDefaults(t *testing.T) {
 	assert.Equal(t, 2, cfg.PollInterval)
 	assert.Equal(t, 2, cfg.ReportInterval)
 	assert.Equal(t, 30, cfg.RateLimit)
+	assert.Equal(t, 100, cfg.BatchSize)
+	assert.Empty(t, cfg.InstanceID)
+	assert.Empty(t, cfg.HistogramBuckets)
+	assert.Empty(t, cfg.StatsDAddress)
+	assert.Empty(t, cfg.StatsDSocket)
 }
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 
 	"github.com/antonminaichev/metricscollector/internal/agent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 var (
@@ -51,6 +57,22 @@ func run() error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	agent.SetInstanceID(cfg.InstanceID)
+	if err := agent.SetHistogramBuckets(cfg.HistogramBuckets); err != nil {
+		return err
+	}
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return err
+	}
+	transportCreds := insecure.NewCredentials()
+	if tlsCfg != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsCfg}
+		transportCreds = credentials.NewTLS(tlsCfg)
+		if !strings.Contains(cfg.Address, "://") {
+			cfg.Address = "https://" + cfg.Address
+		}
+	}
 	jobs := make(chan agent.Metrics, cfg.RateLimit*3)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -67,12 +89,33 @@ func run() error {
 		agent.CollectSystemMetrics(ctx, cfg.PollInterval, jobs)
 	}()
 
+	if err := startStatsD(ctx, cfg, jobs, &collectWG); err != nil {
+		return err
+	}
+
+	pending := agent.NewPendingCounters()
+	batches := make(chan []agent.Metrics, cfg.RateLimit)
+	go agent.BatchMetrics(jobs, cfg.ReportInterval, cfg.BatchSize, pending, batches)
+
+	var conn *grpc.ClientConn
+	if cfg.GRPCAddress != "" {
+		conn, err = grpc.NewClient(cfg.GRPCAddress, grpc.WithTransportCredentials(transportCreds))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+	}
+
 	var wg sync.WaitGroup
-	wg.Add(cfg.RateLimit - 1)
+	wg.Add(cfg.RateLimit)
 	for i := 0; i < cfg.RateLimit; i++ {
 		go func() {
 			defer wg.Done()
-			agent.MetricWorker(client, cfg.Address, cfg.HashKey, jobs, cfg.ReportInterval, cfg.CryptoKey)
+			if conn != nil {
+				agent.GRPCMetricWorker(conn, cfg.HashKey, batches, pending)
+				return
+			}
+			agent.MetricWorker(client, cfg.Address, cfg.HashKey, batches, cfg.CryptoKey, pending)
 		}()
 	}
 
@@ -89,3 +132,60 @@ func run() error {
 	log.Println("agent stopped")
 	return nil
 }
+
+// startStatsD opens configured StatsD sockets, aggregated metrics are sent to jobs until ctx is done.
+// The Unix socket file is removed when ctx is done.
+func startStatsD(ctx context.Context, cfg *agent.Config, jobs chan<- agent.Metrics, wg *sync.WaitGroup) error {
+	var conns []net.PacketConn
+	if cfg.StatsDAddress != "" {
+		conn, err := net.ListenPacket("udp", cfg.StatsDAddress)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	if cfg.StatsDSocket != "" {
+		// Сокет мог остаться от предыдущего запуска
+		if err := os.Remove(cfg.StatsDSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		conn, err := net.ListenPacket("unixgram", cfg.StatsDSocket)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return nil
+	}
+
+	statsd := agent.NewStatsD()
+	for _, conn := range conns {
+		log.Printf("StatsD listener started on %s", conn.LocalAddr())
+		go func() {
+			if err := statsd.Serve(conn); err != nil {
+				log.Printf("StatsD listener failed: %v", err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		// Закрытие датаграммного сокета не удаляет его файл
+		if cfg.StatsDSocket != "" {
+			if err := os.Remove(cfg.StatsDSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("failed to remove StatsD socket: %v", err)
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		statsd.Run(ctx, cfg.ReportInterval, jobs)
+	}()
+	return nil
+}
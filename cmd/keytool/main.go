@@ -0,0 +1,332 @@
+// Keytool generates and inspects RSA keys used for agent payload encryption
+// and issues local TLS certificates.
+//
+// Usage:
+//
+//	keytool generate [-bits 2048] [-out .] [-name key]
+//	keytool inspect <key.pem>
+//	keytool convert -in <pkcs1.pem> -out <pkcs8.pem>
+//	keytool verify -pub <public.pem> -priv <private.pem>
+//	keytool ca [-cn metrics-ca] [-days 365] [-out .] [-name ca]
+//	keytool cert -ca <ca.crt> -ca-key <ca.pem> -cn <name> [-hosts h1,h2] [-client] [-days 365] [-out .] [-name cn]
+//
+// generate writes <name>.pem with a PKCS#8 private key for the server -crypto-key
+// and <name>.pub.pem with a PKIX public key for the agent -crypto-key.
+// ca and cert write <name>.crt with a certificate and <name>.pem with its private key.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+)
+
+const usage = `usage:
+  keytool generate [-bits 2048] [-out .] [-name key]
+  keytool inspect <key.pem>
+  keytool convert -in <key.pem> -out <converted.pem>
+  keytool verify -pub <public.pem> -priv <private.pem>
+  keytool ca [-cn metrics-ca] [-days 365] [-out .] [-name ca]
+  keytool cert -ca <ca.crt> -ca-key <ca.pem> -cn <name> [-hosts h1,h2] [-client] [-days 365] [-out .] [-name cn]`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "generate":
+		return generate(args[1:], out)
+	case "inspect":
+		return inspect(args[1:], out)
+	case "convert":
+		return convert(args[1:], out)
+	case "verify":
+		return verify(args[1:], out)
+	case "ca":
+		return newCA(args[1:], out)
+	case "cert":
+		return issueCert(args[1:], out)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func generate(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	bits := fs.Int("bits", 2048, "RSA key size in bits")
+	dir := fs.String("out", ".", "Output directory")
+	name := fs.String("name", "key", "Base name of key files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *bits < 2048 {
+		return errors.New("key size must be at least 2048 bits")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return err
+	}
+	privPEM, err := crypto.EncodePrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	pubPEM, err := crypto.EncodePublicKeyPEM(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	privPath := filepath.Join(*dir, *name+".pem")
+	pubPath := filepath.Join(*dir, *name+".pub.pem")
+	if err := writeNew(privPath, privPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeNew(pubPath, pubPEM, 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "private key: %s\n", privPath)
+	fmt.Fprintf(out, "public key:  %s\n", pubPath)
+	return printKeyInfo(out, &key.PublicKey)
+}
+
+func inspect(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: keytool inspect <key.pem>")
+	}
+	priv, pub, format, err := readKey(args[0])
+	if err != nil {
+		return err
+	}
+	if priv != nil {
+		pub = &priv.PublicKey
+	}
+
+	fmt.Fprintf(out, "format:      %s\n", format)
+	fmt.Fprintf(out, "bits:        %d\n", pub.N.BitLen())
+	switch format {
+	case crypto.PKCS1PrivateKeyType:
+		fmt.Fprintln(out, "note:        server requires PKCS#8, run keytool convert")
+	case crypto.PKCS1PublicKeyType:
+		fmt.Fprintln(out, "note:        agent requires PKIX, run keytool convert")
+	}
+	return printKeyInfo(out, pub)
+}
+
+func convert(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	in := fs.String("in", "", "Input key file")
+	dst := fs.String("out", "", "Output key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" || *dst == "" {
+		return errors.New("usage: keytool convert -in <key.pem> -out <converted.pem>")
+	}
+
+	priv, pub, _, err := readKey(*in)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	var perm os.FileMode
+	if priv != nil {
+		data, err = crypto.EncodePrivateKeyPEM(priv)
+		perm = 0600
+	} else {
+		data, err = crypto.EncodePublicKeyPEM(pub)
+		perm = 0644
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeNew(*dst, data, perm); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "written:     %s\n", *dst)
+	if priv != nil {
+		pub = &priv.PublicKey
+	}
+	return printKeyInfo(out, pub)
+}
+
+func verify(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	pubPath := fs.String("pub", "", "Public key file")
+	privPath := fs.String("priv", "", "Private key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *pubPath == "" || *privPath == "" {
+		return errors.New("usage: keytool verify -pub <public.pem> -priv <private.pem>")
+	}
+
+	_, pub, _, err := readKey(*pubPath)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return fmt.Errorf("%s is not a public key", *pubPath)
+	}
+	priv, _, _, err := readKey(*privPath)
+	if err != nil {
+		return err
+	}
+	if priv == nil {
+		return fmt.Errorf("%s is not a private key", *privPath)
+	}
+
+	if !pub.Equal(&priv.PublicKey) {
+		return errors.New("keys do not match")
+	}
+	fmt.Fprintln(out, "keys match")
+	return printKeyInfo(out, pub)
+}
+
+func newCA(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("ca", flag.ContinueOnError)
+	cn := fs.String("cn", "metrics-ca", "CA common name")
+	days := fs.Int("days", 365, "Validity in days")
+	dir := fs.String("out", ".", "Output directory")
+	name := fs.String("name", "ca", "Base name of certificate files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cert, key, err := crypto.NewCA(*cn, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	return writeCertificate(out, *dir, *name, cert, key)
+}
+
+func issueCert(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("cert", flag.ContinueOnError)
+	caPath := fs.String("ca", "", "CA certificate file")
+	caKeyPath := fs.String("ca-key", "", "CA private key file")
+	cn := fs.String("cn", "", "Common name, agent identity for client certificates")
+	hosts := fs.String("hosts", "", "Comma-separated DNS names and IP addresses")
+	client := fs.Bool("client", false, "Issue a client certificate for mutual TLS")
+	days := fs.Int("days", 365, "Validity in days")
+	dir := fs.String("out", ".", "Output directory")
+	name := fs.String("name", "", "Base name of certificate files, defaults to common name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *caPath == "" || *caKeyPath == "" || *cn == "" {
+		return errors.New("usage: keytool cert -ca <ca.crt> -ca-key <ca.pem> -cn <name>")
+	}
+	if *name == "" {
+		*name = *cn
+	}
+
+	pair, err := tls.LoadX509KeyPair(*caPath, *caKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load CA: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	caKey, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("CA key is not an RSA key")
+	}
+
+	usage := crypto.CertServer
+	if *client {
+		usage = crypto.CertClient
+	}
+	var hostList []string
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hostList = append(hostList, h)
+		}
+	}
+
+	cert, key, err := crypto.IssueCertificate(ca, caKey, *cn, hostList, usage, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	return writeCertificate(out, *dir, *name, cert, key)
+}
+
+func writeCertificate(out io.Writer, dir, name string, cert *x509.Certificate, key *rsa.PrivateKey) error {
+	keyPEM, err := crypto.EncodePrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".pem")
+	if err := writeNew(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeNew(certPath, crypto.EncodeCertificatePEM(cert), 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "certificate: %s\n", certPath)
+	fmt.Fprintf(out, "private key: %s\n", keyPath)
+	fmt.Fprintf(out, "subject:     %s\n", cert.Subject.CommonName)
+	fmt.Fprintf(out, "expires:     %s\n", cert.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+func readKey(path string) (*rsa.PrivateKey, *rsa.PublicKey, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	priv, pub, format, err := crypto.ParseKeyPEM(data)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	return priv, pub, format, nil
+}
+
+func printKeyInfo(out io.Writer, pub *rsa.PublicKey) error {
+	fp, err := crypto.Fingerprint(pub)
+	if err != nil {
+		return err
+	}
+	id, err := crypto.KeyID(pub)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "fingerprint: SHA256:%s\n", fp)
+	fmt.Fprintf(out, "key id:      %s\n", id)
+	return nil
+}
+
+// writeNew writes data to a file that must not exist yet, so keys are never overwritten.
+func writeNew(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+
+	err := run([]string{"generate", "-out", dir, "-name", "test"}, &out)
+	require.NoError(t, err)
+
+	priv, err := crypto.LoadPrivateKey(filepath.Join(dir, "test.pem"))
+	require.NoError(t, err)
+	pub, err := crypto.LoadPublicKey(filepath.Join(dir, "test.pub.pem"))
+	require.NoError(t, err)
+	assert.True(t, pub.Equal(&priv.PublicKey))
+
+	keyID, err := crypto.KeyID(pub)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), keyID)
+
+	t.Run("does not overwrite existing keys", func(t *testing.T) {
+		err := run([]string{"generate", "-out", dir, "-name", "test"}, &out)
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects weak keys", func(t *testing.T) {
+		err := run([]string{"generate", "-bits", "1024", "-out", dir, "-name", "weak"}, &out)
+		assert.Error(t, err)
+	})
+}
+
+func TestConvertAndInspect(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	pkcs1 := filepath.Join(dir, "pkcs1.pem")
+	require.NoError(t, os.WriteFile(pkcs1, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+
+	_, err = crypto.LoadPrivateKey(pkcs1)
+	require.Error(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"inspect", pkcs1}, &out))
+	assert.Contains(t, out.String(), "RSA PRIVATE KEY")
+	assert.Contains(t, out.String(), "keytool convert")
+
+	pkcs8 := filepath.Join(dir, "pkcs8.pem")
+	out.Reset()
+	require.NoError(t, run([]string{"convert", "-in", pkcs1, "-out", pkcs8}, &out))
+
+	converted, err := crypto.LoadPrivateKey(pkcs8)
+	require.NoError(t, err)
+	assert.True(t, key.Equal(converted))
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"generate", "-out", dir, "-name", "a"}, &out))
+	require.NoError(t, run([]string{"generate", "-out", dir, "-name", "b"}, &out))
+
+	out.Reset()
+	err := run([]string{"verify", "-pub", filepath.Join(dir, "a.pub.pem"), "-priv", filepath.Join(dir, "a.pem")}, &out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "keys match")
+
+	err = run([]string{"verify", "-pub", filepath.Join(dir, "a.pub.pem"), "-priv", filepath.Join(dir, "b.pem")}, &out)
+	assert.Error(t, err)
+}
+
+func TestCAAndCert(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"ca", "-out", dir}, &out))
+
+	caArgs := []string{"-ca", filepath.Join(dir, "ca.crt"), "-ca-key", filepath.Join(dir, "ca.pem"), "-out", dir}
+	require.NoError(t, run(append([]string{"cert", "-cn", "server", "-hosts", "localhost,127.0.0.1"}, caArgs...), &out))
+	require.NoError(t, run(append([]string{"cert", "-cn", "agent-1", "-client"}, caArgs...), &out))
+	assert.Contains(t, out.String(), "agent-1")
+
+	// Сертификаты пригодны для mTLS
+	serverCfg, err := crypto.ServerTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.pem"), filepath.Join(dir, "ca.crt"))
+	require.NoError(t, err)
+	assert.NotNil(t, serverCfg.ClientCAs)
+	_, err = crypto.ClientTLSConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "agent-1.crt"), filepath.Join(dir, "agent-1.pem"))
+	require.NoError(t, err)
+
+	t.Run("requires CA and common name", func(t *testing.T) {
+		assert.Error(t, run([]string{"cert", "-cn", "x"}, &out))
+		assert.Error(t, run(append([]string{"cert"}, caArgs...), &out))
+	})
+}
+
+func TestUnknownCommand(t *testing.T) {
+	assert.Error(t, run(nil, &bytes.Buffer{}))
+	assert.Error(t, run([]string{"nope"}, &bytes.Buffer{}))
+}
@@ -11,7 +11,7 @@ import (
 
 // NewConfig initialises new server configuration.
 func NewConfig() (*server.Config, error) {
-	cfg := &server.Config{Address: "localhost:8080", LogLevel: "INFO", StoreInterval: 300, FileStoragePath: "./metrics/metrics.json", Restore: true}
+	cfg := &server.Config{Address: "localhost:8080", LogLevel: "INFO", StoreInterval: 300, FileStoragePath: "./metrics/metrics.json", Restore: true, HashMaxSkew: 300, HashPolicy: "optional", RollupRetentionMinute: 86400, RollupRetentionHour: 2592000}
 
 	configPath := conf.PickConfigPathFromArgs(os.Args[1:])
 	if configPath == "" {
@@ -36,7 +36,22 @@ func NewConfig() (*server.Config, error) {
 	restore := flag.Bool("r", cfg.Restore, "Restore metrics from file")
 	databaseConnection := flag.String("d", cfg.DatabaseConnection, "Database connection string")
 	hashkey := flag.String("k", "", "Hash key")
-	cryptoKey := flag.String("crypto-key", cfg.CryptoKey, "Path to private key")
+	cryptoKey := flag.String("crypto-key", cfg.CryptoKey, "Path to private key, keys directory or comma-separated list of them")
+	hashMaxSkew := flag.Int("hash-max-skew", cfg.HashMaxSkew, "Allowed signed request timestamp skew in seconds")
+	hashPolicy := flag.String("hash-policy", cfg.HashPolicy, "Which requests must be signed: optional, writes or all")
+	trustedSubnet := flag.String("t", cfg.TrustedSubnet, "Trusted agent subnet in CIDR notation, comma-separated list allowed")
+	grpcAddress := flag.String("grpc-address", cfg.GRPCAddress, "{Host:port} for gRPC server, empty disables it")
+	tlsCert := flag.String("tls-cert", cfg.TLSCert, "Path to TLS certificate, enables HTTPS and gRPC over TLS")
+	tlsKey := flag.String("tls-key", cfg.TLSKey, "Path to TLS private key")
+	tlsClientCA := flag.String("tls-client-ca", cfg.TLSClientCA, "Path to CA bundle for client certificates, enables mutual TLS")
+	historyRetention := flag.Int("history-retention", cfg.HistoryRetention, "How long metric history is kept in seconds, 0 disables history")
+	rollupRetentionMinute := flag.Int("rollup-retention-1m", cfg.RollupRetentionMinute, "How long 1-minute database rollups are kept in seconds, 0 disables them")
+	rollupRetentionHour := flag.Int("rollup-retention-1h", cfg.RollupRetentionHour, "How long 1-hour database rollups are kept in seconds, 0 disables them")
+	graphiteAddress := flag.String("graphite-address", cfg.GraphiteAddress, "{Host:port} for Graphite plaintext listener, empty disables it")
+	graphiteCounters := flag.String("graphite-counters", cfg.GraphiteCounters, "Comma-separated Graphite path patterns written as counters, other paths are gauges")
+	influxCounters := flag.String("influx-counters", cfg.InfluxCounters, "Comma-separated metric name patterns of cumulative InfluxDB line protocol fields written as counters")
+	influxNameTags := flag.String("influx-name-tags", cfg.InfluxNameTags, "Comma-separated InfluxDB tags put into metric names instead of labels")
+	influxToken := flag.String("influx-token", cfg.InfluxToken, "Token InfluxDB clients pass in the Authorization header, must differ from the hash key")
 	_ = flag.String("c", configPath, "Path to config file (JSON)")
 
 	flag.Parse()
@@ -52,6 +67,21 @@ func NewConfig() (*server.Config, error) {
 		cfg.HashKey = *hashkey
 	}
 	cfg.CryptoKey = *cryptoKey
+	cfg.HashMaxSkew = *hashMaxSkew
+	cfg.HashPolicy = *hashPolicy
+	cfg.TrustedSubnet = *trustedSubnet
+	cfg.GRPCAddress = *grpcAddress
+	cfg.TLSCert = *tlsCert
+	cfg.TLSKey = *tlsKey
+	cfg.TLSClientCA = *tlsClientCA
+	cfg.HistoryRetention = *historyRetention
+	cfg.RollupRetentionMinute = *rollupRetentionMinute
+	cfg.RollupRetentionHour = *rollupRetentionHour
+	cfg.GraphiteAddress = *graphiteAddress
+	cfg.GraphiteCounters = *graphiteCounters
+	cfg.InfluxCounters = *influxCounters
+	cfg.InfluxNameTags = *influxNameTags
+	cfg.InfluxToken = *influxToken
 
 	return cfg, nil
 }
@@ -4,7 +4,10 @@ import (
 	"os"
 	"testing"
 
+	"github.com/antonminaichev/metricscollector/internal/conf"
+	"github.com/antonminaichev/metricscollector/internal/server"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewServerConfigDefaults(t *testing.T) {
@@ -16,4 +19,18 @@ func TestNewServerConfigDefaults(t *testing.T) {
 	assert.Equal(t, "localhost:8080", cfg.Address)
 	assert.Equal(t, "./metrics/metrics.json", cfg.FileStoragePath)
 	assert.True(t, cfg.Restore)
+	assert.Equal(t, 300, cfg.HashMaxSkew)
+	assert.Equal(t, "optional", cfg.HashPolicy)
+	assert.Zero(t, cfg.HistoryRetention)
+	assert.Equal(t, 86400, cfg.RollupRetentionMinute)
+	assert.Equal(t, 2592000, cfg.RollupRetentionHour)
+	assert.Empty(t, cfg.GraphiteAddress)
+}
+
+func TestSampleConfig(t *testing.T) {
+	// Неизвестные поля отклоняются, поэтому имена ключей должны совпадать с полями Config
+	var cfg server.Config
+	require.NoError(t, conf.LoadJSONConfig("config/config.json", &cfg))
+	assert.Equal(t, 15, cfg.StoreInterval)
+	assert.Empty(t, cfg.TrustedSubnet)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/antonminaichev/metricscollector/internal/logger"
 	"github.com/antonminaichev/metricscollector/internal/server"
@@ -51,11 +52,16 @@ func run() error {
 		return err
 	}
 
-	storage, err := server.SetupStorage(cfg.DatabaseConnection, cfg.FileStoragePath, cfg.Restore, cfg.StoreInterval)
+	storage, err := server.SetupStorage(cfg.DatabaseConnection, cfg.FileStoragePath, cfg.Restore, cfg.StoreInterval,
+		time.Duration(cfg.HistoryRetention)*time.Second,
+		server.RollupRetention{
+			Minute: time.Duration(cfg.RollupRetentionMinute) * time.Second,
+			Hour:   time.Duration(cfg.RollupRetentionHour) * time.Second,
+		})
 	if err != nil {
 		return err
 	}
 
 	logger.Log.Info("Starting server", zap.String("address", cfg.Address))
-	return server.StartServer(cfg.Address, storage, cfg.HashKey, cfg.CryptoKey)
+	return server.StartServer(cfg, storage)
 }
@@ -6,19 +6,31 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/headers"
 	"github.com/antonminaichev/metricscollector/internal/retry"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/mem"
@@ -26,43 +38,51 @@ import (
 
 // Metrics stores single metric value and type.
 type Metrics struct {
-	ID       string   `json:"id"`              // имя метрики
-	MType    string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta    *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value    *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID    string   `json:"id"`              // имя метрики
+	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
+	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
+	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	// Labels are key/value dimensions, agent labels are added to every metric on send.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Histogram carries observations of a histogram metric.
+	Histogram *Histogram `json:"histogram,omitempty"`
+	// Member is a single member of a set metric, members are folded into Set before sending.
+	Member *string `json:"member,omitempty"`
+	// Set carries members of a set metric.
+	Set      *Set `json:"set,omitempty"`
 	getValue func(*runtime.MemStats) float64
 }
 
 var metrics = []Metrics{
-	{"Alloc", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Alloc) }},
-	{"BuckHashSys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.BuckHashSys) }},
-	{"Frees", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Frees) }},
-	{"GCCPUFraction", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return m.GCCPUFraction }},
-	{"GCSys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.GCSys) }},
-	{"HeapAlloc", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapAlloc) }},
-	{"HeapIdle", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapIdle) }},
-	{"HeapInuse", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapInuse) }},
-	{"HeapObjects", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapObjects) }},
-	{"HeapReleased", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapReleased) }},
-	{"HeapSys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapSys) }},
-	{"LastGC", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.LastGC) }},
-	{"Lookups", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Lookups) }},
-	{"MCacheInuse", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MCacheInuse) }},
-	{"MCacheSys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MCacheSys) }},
-	{"MSpanInuse", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MSpanInuse) }},
-	{"MSpanSys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MSpanSys) }},
-	{"Mallocs", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Mallocs) }},
-	{"NextGC", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.NextGC) }},
-	{"NumForcedGC", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.NumForcedGC) }},
-	{"NumGC", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.NumGC) }},
-	{"OtherSys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.OtherSys) }},
-	{"PauseTotalNs", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.PauseTotalNs) }},
-	{"StackInuse", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.StackInuse) }},
-	{"StackSys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.StackSys) }},
-	{"Sys", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Sys) }},
-	{"TotalAlloc", "gauge", nil, nil, func(m *runtime.MemStats) float64 { return float64(m.TotalAlloc) }},
-	{"PollCount", "counter", new(int64), nil, nil},
-	{"RandomValue", "gauge", nil, nil, nil},
+	{"Alloc", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Alloc) }},
+	{"BuckHashSys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.BuckHashSys) }},
+	{"Frees", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Frees) }},
+	{"GCCPUFraction", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return m.GCCPUFraction }},
+	{"GCSys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.GCSys) }},
+	{"HeapAlloc", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapAlloc) }},
+	{"HeapIdle", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapIdle) }},
+	{"HeapInuse", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapInuse) }},
+	{"HeapObjects", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapObjects) }},
+	{"HeapReleased", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapReleased) }},
+	{"HeapSys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.HeapSys) }},
+	{"LastGC", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.LastGC) }},
+	{"Lookups", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Lookups) }},
+	{"MCacheInuse", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MCacheInuse) }},
+	{"MCacheSys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MCacheSys) }},
+	{"MSpanInuse", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MSpanInuse) }},
+	{"MSpanSys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.MSpanSys) }},
+	{"Mallocs", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Mallocs) }},
+	{"NextGC", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.NextGC) }},
+	{"NumForcedGC", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.NumForcedGC) }},
+	{"NumGC", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.NumGC) }},
+	{"OtherSys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.OtherSys) }},
+	{"PauseTotalNs", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.PauseTotalNs) }},
+	{"StackInuse", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.StackInuse) }},
+	{"StackSys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.StackSys) }},
+	{"Sys", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.Sys) }},
+	{"TotalAlloc", "gauge", nil, nil, nil, nil, nil, nil, func(m *runtime.MemStats) float64 { return float64(m.TotalAlloc) }},
+	{"PollCount", "counter", new(int64), nil, nil, nil, nil, nil, nil},
+	{"RandomValue", "gauge", nil, nil, nil, nil, nil, nil, nil},
 }
 
 // Config stores agent setting.
@@ -73,41 +93,82 @@ type Config struct {
 	RateLimit      int    `env:"RATE_LIMIT"`
 	HashKey        string `env:"KEY"`
 	CryptoKey      string `env:"CRYPTO_KEY"`
+	BatchSize      int    `env:"BATCH_SIZE"`
+	GRPCAddress    string `env:"GRPC_ADDRESS"`
+	TLSCA          string `env:"TLS_CA"`
+	TLSCert        string `env:"TLS_CERT"`
+	TLSKey         string `env:"TLS_KEY"`
+	// InstanceID identifies the agent in metric labels and batch IDs, the hostname is used when empty.
+	InstanceID string `env:"INSTANCE_ID"`
+	// HistogramBuckets are bucket bounds of agent histograms, DefaultHistogramBuckets are used when empty.
+	HistogramBuckets []float64 `env:"HISTOGRAM_BUCKETS"`
+	// StatsDAddress is the UDP {host:port} of the StatsD listener, empty disables it.
+	StatsDAddress string `env:"STATSD_ADDRESS"`
+	// StatsDSocket is the Unix datagram socket path of the StatsD listener, empty disables it.
+	StatsDSocket string `env:"STATSD_SOCKET"`
 }
 
-func calculateHash(buf *bytes.Buffer, key string) string {
-	mac := hmac.New(sha256.New, []byte(key))
-	mac.Write(buf.Bytes())
-	return hex.EncodeToString(mac.Sum(nil))
+// TLSConfig returns client TLS settings, nil means TLS is not configured.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCA == "" && c.TLSCert == "" && c.TLSKey == "" {
+		return nil, nil
+	}
+	return crypto.ClientTLSConfig(c.TLSCA, c.TLSCert, c.TLSKey)
 }
 
-// checkServerAvailability is used for checking server availability
-func checkServerAvailability(host string) bool {
-	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
-		host = "http://" + host
+// agentID identifies the agent so the server can recognise replayed batches.
+// It is the instance ID, so it stays the same after a restart, see SetInstanceID.
+var agentID = newAgentID(agentLabels)
+
+// batchSeq numbers batches sent by the agent. It starts at the process start time in nanoseconds,
+// so batches of a restarted agent are not taken for replays of batches sent before the restart.
+// Unacknowledged batches are kept in memory only and are lost when the agent exits.
+var batchSeq = newBatchSeq(time.Now())
+
+// newAgentID returns the instance label, a random ID is used when neither instance ID nor hostname are known.
+func newAgentID(labels map[string]string) string {
+	if id := labels[InstanceLabel]; id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
+	return hex.EncodeToString(b)
+}
 
-	err := retry.Do(retry.DefaultRetryConfig(), func() error {
-		resp, err := http.Get(host + "/health")
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				log.Printf("failed to close response body: %v", err)
-			}
-		}()
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("server returned status code %d", resp.StatusCode)
-		}
-		return nil
-	})
+func newBatchSeq(start time.Time) *atomic.Uint64 {
+	seq := &atomic.Uint64{}
+	seq.Store(uint64(start.UnixNano()))
+	return seq
+}
 
-	if err != nil {
-		log.Printf("Server availability check failed: %v", err)
-		return false
+// setBatchHeaders stamps a request with agent ID and batch sequence number.
+func setBatchHeaders(req *http.Request, seq uint64) {
+	req.Header.Set(headers.AgentID, agentID)
+	req.Header.Set(headers.BatchSeq, strconv.FormatUint(seq, 10))
+}
+
+// calculateHash returns hex encoded request signature, see crypto.SignRequest.
+func calculateHash(key, method, path, timestamp, nonce string, body []byte) string {
+	return hex.EncodeToString(crypto.SignRequest(key, method, path, timestamp, nonce, body))
+}
+
+// signRequest stamps a request with a fresh timestamp and nonce and signs it.
+func signRequest(req *http.Request, body []byte, key string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newNonce()
+	req.Header.Set(crypto.TimestampHeader, timestamp)
+	req.Header.Set(crypto.NonceHeader, nonce)
+	req.Header.Set(crypto.HashHeader, calculateHash(key, req.Method, req.URL.Path, timestamp, nonce, body))
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
-	return true
+	return hex.EncodeToString(b)
 }
 
 // CollectMetrics collects metrics.
@@ -115,7 +176,6 @@ func CollectMetrics(ctx context.Context, pollInterval int, jobs chan<- Metrics)
 	ticker := time.NewTicker(time.Duration(pollInterval) * time.Second)
 	defer ticker.Stop()
 	var rt runtime.MemStats
-	var pc int64
 
 	for {
 		select {
@@ -138,9 +198,8 @@ func CollectMetrics(ctx context.Context, pollInterval int, jobs chan<- Metrics)
 				}
 			}
 
-			// send counter
-			pc++
-			delta := pc
+			// send counter increment for this poll
+			delta := int64(1)
 			jobs <- Metrics{ID: "PollCount", MType: "counter", Delta: &delta}
 		}
 	}
@@ -168,15 +227,255 @@ func CollectSystemMetrics(ctx context.Context, pollInterval int, jobs chan<- Met
 			if pct, err := cpu.Percent(0, true); err == nil {
 				for i := 0; i < cpuCount && i < len(pct); i++ {
 					v := pct[i]
-					jobs <- Metrics{ID: fmt.Sprintf("CPUutilization%d", i), MType: "gauge", Value: &v}
+					jobs <- Metrics{ID: "CPUutilization", MType: "gauge", Value: &v, Labels: map[string]string{"cpu": strconv.Itoa(i)}}
 				}
 			}
 		}
 	}
 }
 
-// MetricWorker initialises worker for metric collection.
-func MetricWorker(client *http.Client, host, hashkey string, jobs <-chan Metrics, reportInterval int, cryptoKeyPath string) {
+// PendingCounters keeps counter increments, histogram observations and set members that were not acknowledged
+// by the server yet.
+// It is safe for concurrent use.
+type PendingCounters struct {
+	mu     sync.Mutex
+	deltas map[string]Metrics
+}
+
+// NewPendingCounters creates an empty set of pending counter increments.
+func NewPendingCounters() *PendingCounters {
+	return &PendingCounters{deltas: make(map[string]Metrics)}
+}
+
+// Restore returns counter increments of a batch that failed to be delivered,
+// so they are included into the next report.
+func (p *PendingCounters) Restore(batch []Metrics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range batch {
+		switch {
+		case m.MType == "counter" && m.Delta != nil:
+			p.add(m.ID, m.Labels, *m.Delta)
+		case m.MType == "histogram" && m.Histogram != nil:
+			p.addHistogram(m.ID, m.Labels, m.Histogram)
+		case m.MType == "set" && m.Set != nil:
+			key := metricKey(m)
+			m.Set = p.deltas[key].Set.merge(m.Set)
+			p.deltas[key] = m
+		}
+	}
+}
+
+// Add records an increment of the counter id, it is reported with the next batch.
+func (p *PendingCounters) Add(id string, delta int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.add(id, nil, delta)
+}
+
+// Observe records v into the histogram id with the configured buckets, it is reported with the next batch.
+func (p *PendingCounters) Observe(id string, v float64) {
+	h := NewHistogram(histogramBuckets)
+	h.Observe(v)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addHistogram(id, nil, h)
+}
+
+// addHistogram merges observations of the same histogram series, the caller must hold the lock.
+func (p *PendingCounters) addHistogram(id string, labels map[string]string, h *Histogram) {
+	m := Metrics{ID: id, MType: "histogram", Labels: labels}
+	key := metricKey(m)
+	m.Histogram = p.deltas[key].Histogram.merge(h)
+	p.deltas[key] = m
+}
+
+// add sums increments of the same counter series, the caller must hold the lock.
+func (p *PendingCounters) add(id string, labels map[string]string, delta int64) {
+	m := Metrics{ID: id, MType: "counter", Labels: labels}
+	key := metricKey(m)
+	if pending, ok := p.deltas[key]; ok {
+		delta += *pending.Delta
+	}
+	m.Delta = &delta
+	p.deltas[key] = m
+}
+
+// take removes and returns all pending increments ordered by metric ID and labels.
+func (p *PendingCounters) take() []Metrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.deltas))
+	for key := range p.deltas {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	taken := make([]Metrics, 0, len(keys))
+	for _, key := range keys {
+		taken = append(taken, p.deltas[key])
+	}
+	p.deltas = make(map[string]Metrics)
+	return taken
+}
+
+// metricKey identifies a metric series by type, ID and labels.
+func metricKey(m Metrics) string {
+	key := m.MType + ":" + m.ID
+	if len(m.Labels) == 0 {
+		return key
+	}
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key += "," + name + "=" + strconv.Quote(m.Labels[name])
+	}
+	return key
+}
+
+// Labels the agent attaches to every metric it sends.
+const (
+	InstanceLabel = "instance"
+	HostLabel     = "host"
+)
+
+// agentLabels are attached to every metric the agent sends.
+var agentLabels = instanceLabels("")
+
+// SetInstanceID sets the instance ID reported with every metric, an empty ID falls back to the hostname.
+// The instance ID is also the agent ID of batches, so it must be unique among agents of a server.
+func SetInstanceID(id string) {
+	agentLabels = instanceLabels(id)
+	agentID = newAgentID(agentLabels)
+}
+
+// instanceLabels returns the instance and host labels of this agent.
+func instanceLabels(id string) map[string]string {
+	labels := make(map[string]string, 2)
+	if host, err := os.Hostname(); err == nil && host != "" {
+		labels[HostLabel] = host
+	}
+	if id == "" {
+		id = labels[HostLabel]
+	}
+	if id != "" {
+		labels[InstanceLabel] = id
+	}
+	return labels
+}
+
+// withAgentLabels returns a copy of the batch with agent labels added, labels set on a metric take precedence.
+func withAgentLabels(batch []Metrics) []Metrics {
+	if len(agentLabels) == 0 {
+		return batch
+	}
+	labelled := make([]Metrics, len(batch))
+	for i, m := range batch {
+		labels := make(map[string]string, len(agentLabels)+len(m.Labels))
+		for k, v := range agentLabels {
+			labels[k] = v
+		}
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		m.Labels = labels
+		labelled[i] = m
+	}
+	return labelled
+}
+
+// BatchMetrics accumulates metrics from jobs and emits them as a single batch once per report interval.
+// Gauges keep the last collected value, counter increments are summed and set members are counted in a sketch,
+// so every metric is reported once per window.
+// Increments restored into pending after failed deliveries are added to the next batch.
+// Batches larger than batchSize are split, batchSize <= 0 disables splitting.
+// When jobs is closed the pending metrics are flushed and batches is closed.
+func BatchMetrics(jobs <-chan Metrics, reportInterval, batchSize int, pending *PendingCounters, batches chan<- []Metrics) {
+	defer close(batches)
+
+	if reportInterval <= 0 {
+		reportInterval = 1
+	}
+	ticker := time.NewTicker(time.Duration(reportInterval) * time.Second)
+	defer ticker.Stop()
+
+	var window []Metrics
+	index := make(map[string]int)
+
+	add := func(m Metrics) {
+		// Каждое значение сводки - отдельное наблюдение, они не объединяются
+		if m.MType == "summary" {
+			window = append(window, m)
+			return
+		}
+		if m.MType == "set" && m.Member != nil {
+			m.Set = m.Set.merge(newSet(*m.Member))
+			m.Member = nil
+		}
+		key := metricKey(m)
+		i, seen := index[key]
+		if !seen {
+			index[key] = len(window)
+			window = append(window, m)
+			return
+		}
+		if m.Delta != nil && window[i].Delta != nil {
+			sum := *window[i].Delta + *m.Delta
+			window[i].Delta = &sum
+		} else if m.Histogram != nil && window[i].Histogram != nil {
+			window[i].Histogram = window[i].Histogram.merge(m.Histogram)
+		} else if m.Set != nil && window[i].Set != nil {
+			window[i].Set = window[i].Set.merge(m.Set)
+		} else {
+			window[i] = m
+		}
+	}
+
+	flush := func() {
+		for _, m := range pending.take() {
+			add(m)
+		}
+		for _, batch := range splitBatch(window, batchSize) {
+			batches <- batch
+		}
+		window = nil
+		index = make(map[string]int)
+	}
+
+	for {
+		select {
+		case m, ok := <-jobs:
+			if !ok {
+				flush()
+				return
+			}
+			add(m)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// splitBatch splits metrics into chunks of at most size elements.
+func splitBatch(metrics []Metrics, size int) [][]Metrics {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if size <= 0 || len(metrics) <= size {
+		return [][]Metrics{metrics}
+	}
+	chunks := make([][]Metrics, 0, (len(metrics)+size-1)/size)
+	for len(metrics) > size {
+		chunks = append(chunks, metrics[:size:size])
+		metrics = metrics[size:]
+	}
+	return append(chunks, metrics)
+}
+
+// MetricWorker initialises worker that pushes metric batches to the server, see deliverBatches.
+func MetricWorker(client *http.Client, host, hashkey string, batches <-chan []Metrics, cryptoKeyPath string, pending *PendingCounters) {
 	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
 		host = "http://" + host
 	}
@@ -184,72 +483,321 @@ func MetricWorker(client *http.Client, host, hashkey string, jobs <-chan Metrics
 	if err != nil {
 		log.Fatalf("MetricWorker: failed to load public key: %v", err)
 	}
-	for m := range jobs {
+	deliverBatches(batches, pending, func(batch []Metrics, seq uint64) error {
 		buf := bytes.NewBuffer(nil)
 		gw, _ := gzip.NewWriterLevel(buf, gzip.BestSpeed)
-		data, _ := json.Marshal(m)
+		data, err := json.Marshal(withAgentLabels(batch))
+		if err != nil {
+			return &encodeError{err: fmt.Errorf("failed to marshal metrics batch: %w", err)}
+		}
 		if _, err := gw.Write(data); err != nil {
-			log.Printf("failed to write gzip data: %v", err)
-			continue
+			return &encodeError{err: fmt.Errorf("failed to write gzip data: %w", err)}
 		}
 		if err := gw.Close(); err != nil {
-			log.Printf("failed to close gzip writer: %v", err)
-			continue
+			return &encodeError{err: fmt.Errorf("failed to close gzip writer: %w", err)}
 		}
 
 		if pubKey != nil {
-			sendEncrypted(client, host, hashkey, buf, pubKey)
-		} else {
-			sendPlain(client, host, hashkey, buf)
+			return sendEncrypted(client, host, hashkey, buf, pubKey, seq)
 		}
+		return sendPlain(client, host, hashkey, buf, seq)
+	})
+}
 
-		time.Sleep(time.Duration(reportInterval) * time.Second)
-	}
+// sentBatch is a batch with the sequence number it was sent with.
+type sentBatch struct {
+	metrics []Metrics
+	seq     uint64
 }
 
-func sendEncrypted(client *http.Client, host, hashkey string, buf *bytes.Buffer, pubKey *rsa.PublicKey) {
-	encrypted, err := crypto.EncryptRSA(pubKey, buf.Bytes())
-	if err != nil {
-		log.Printf("encryption failed: %v", err)
+// deliverBatches sends batches from the channel with send until it is closed.
+// If the server may have applied a failed batch, for example when the response was lost,
+// the batch is kept and sent again unchanged with the same sequence number before the next batch,
+// so the server recognises the replay. Until it is acknowledged next batches are not sent,
+// their increments are restored into pending. Increments of batches the server rejected
+// are restored into pending as well, except histograms: a histogram the server refuses,
+// for example for its bounds, would be sent again and rejected with every next batch. A batch not acknowledged when the channel is closed
+// is sent once more and then dropped. Increments restored after the last batch was received are sent
+// in a final batch before returning, no window of BatchMetrics would pick them up.
+func deliverBatches(batches <-chan []Metrics, pending *PendingCounters, send func(batch []Metrics, seq uint64) error) {
+	// restored reports whether increments were returned into pending after the last batch was received.
+	var restored bool
+	// deliver sends a batch and reports whether it is settled: acknowledged or rejected by the server.
+	deliver := func(b *sentBatch) bool {
+		start := time.Now()
+		err := send(b.metrics, b.seq)
+		pending.Observe(reportDurationMetric, time.Since(start).Seconds())
+		if err == nil {
+			return true
+		}
+		recordFailure(pending, err)
+		if rejected(err) {
+			pending.Restore(withoutHistograms(b.metrics))
+			restored = true
+			return true
+		}
+		return false
+	}
+
+	var unacked *sentBatch
+	for batch := range batches {
+		// Вернувшиеся ранее приращения BatchMetrics уже добавил в этот пакет
+		restored = false
+		if unacked != nil {
+			if !deliver(unacked) {
+				// Новый пакет не отправлялся, поэтому его приращения можно вернуть в pending
+				pending.Restore(batch)
+				restored = true
+				continue
+			}
+			unacked = nil
+		}
+		b := &sentBatch{metrics: batch, seq: batchSeq.Add(1)}
+		if !deliver(b) {
+			unacked = b
+		}
+	}
+	if unacked != nil && !deliver(unacked) {
+		log.Printf("batch %d was not acknowledged, its metrics are dropped", unacked.seq)
+	}
+	// Последнее окно BatchMetrics уже отправлено, поэтому вернувшиеся после него приращения отправляются здесь
+	if !restored {
 		return
 	}
+	if rest := pending.take(); len(rest) > 0 {
+		final := &sentBatch{metrics: rest, seq: batchSeq.Add(1)}
+		if !deliver(final) && !deliver(final) {
+			log.Printf("batch %d was not acknowledged, its metrics are dropped", final.seq)
+		}
+	}
+}
 
-	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/update", host), bytes.NewBuffer(encrypted))
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("Content-Encoding", "gzip")
-	if hashkey != "" {
-		req.Header.Set("HashSHA256", calculateHash(buf, hashkey))
+// withoutHistograms returns metrics of batch except histograms.
+func withoutHistograms(batch []Metrics) []Metrics {
+	kept := make([]Metrics, 0, len(batch))
+	for _, m := range batch {
+		if m.MType != "histogram" {
+			kept = append(kept, m)
+		}
 	}
+	return kept
+}
 
-	if err := doRequest(client, req); err != nil {
-		log.Printf("metric push failed (encrypted): %v", err)
+// recordFailure logs a failed push and counts the failure in agent self-metrics.
+func recordFailure(pending *PendingCounters, err error) {
+	log.Printf("metric push failed: %v", err)
+	pending.Add(sendErrorsMetric, 1)
+	if errors.As(err, new(*signatureError)) {
+		pending.Add(signatureErrorsMetric, 1)
 	}
 }
 
-func sendPlain(client *http.Client, host, hashkey string, buf *bytes.Buffer) {
-	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/update", host), buf)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
-	if hashkey != "" {
-		req.Header.Set("HashSHA256", calculateHash(buf, hashkey))
+// rejected reports whether the batch is known not to be applied by the server,
+// so its increments may be sent again in another batch.
+func rejected(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return !se.IsRetryable()
 	}
+	var ge *grpcError
+	if errors.As(err, &ge) {
+		return ge.rejected()
+	}
+	return errors.As(err, new(*encodeError))
+}
 
-	if err := doRequest(client, req); err != nil {
-		log.Printf("metric push failed (plain): %v", err)
+func sendEncrypted(client *http.Client, host, hashkey string, buf *bytes.Buffer, pubKey *rsa.PublicKey, seq uint64) error {
+	encrypted, err := crypto.EncryptEnvelope(pubKey, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
 	}
+	keyID, _ := crypto.KeyID(pubKey)
+
+	return doRequest(client, hashkey, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/updates/", host), bytes.NewReader(encrypted))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set(crypto.EncryptionHeader, crypto.EncryptionV2)
+		if keyID != "" {
+			req.Header.Set(crypto.KeyIDHeader, keyID)
+		}
+		setBatchHeaders(req, seq)
+		if hashkey != "" {
+			// Сервер проверяет подпись до расшифровки, поэтому подписываем шифротекст
+			signRequest(req, encrypted, hashkey)
+		}
+		return req, nil
+	})
 }
 
-func doRequest(client *http.Client, req *http.Request) error {
-	return retry.Do(retry.DefaultRetryConfig(), func() error {
-		resp, err := client.Do(req)
+func sendPlain(client *http.Client, host, hashkey string, buf *bytes.Buffer, seq uint64) error {
+	body := buf.Bytes()
+
+	return doRequest(client, hashkey, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/updates/", host), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		setBatchHeaders(req, seq)
+		if hashkey != "" {
+			signRequest(req, body, hashkey)
+		}
+		return req, nil
+	})
+}
+
+// Agent self-metrics reported along with collected metrics.
+const (
+	sendErrorsMetric      = "AgentSendErrors"
+	signatureErrorsMetric = "AgentResponseSignatureErrors"
+	// reportDurationMetric is a histogram of batch push latency in seconds, retries included.
+	reportDurationMetric = "AgentReportDuration"
+)
+
+// sendRetryConfig returns retry settings for pushing metrics.
+var sendRetryConfig = retry.DefaultRetryConfig
+
+// statusError is returned when the server answers with a non-2xx status.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned status code %d", e.code)
+}
+
+// IsRetryable reports whether repeating the request may succeed.
+func (e *statusError) IsRetryable() bool {
+	return e.code >= http.StatusInternalServerError || e.code == http.StatusTooManyRequests
+}
+
+// transportError is returned when no response is received. The server may have applied
+// the batch, so the request is repeated with the same batch sequence number.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// IsRetryable reports whether repeating the request may succeed.
+func (e *transportError) IsRetryable() bool {
+	return true
+}
+
+// encodeError is returned when a batch cannot be encoded, such a batch is never sent.
+type encodeError struct {
+	err error
+}
+
+func (e *encodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *encodeError) Unwrap() error {
+	return e.err
+}
+
+// signatureError is returned when the response signature does not match its body.
+type signatureError struct{}
+
+func (e *signatureError) Error() string {
+	return "response signature mismatch"
+}
+
+// IsRetryable reports whether repeating the request may succeed.
+func (e *signatureError) IsRetryable() bool {
+	return true
+}
+
+// doRequest sends a request built by newRequest, building a fresh one for every attempt
+// so that each retry carries its own body reader and signature nonce.
+// Non-2xx responses are errors, and if hashkey is set the response must be signed with it.
+func doRequest(client *http.Client, hashkey string, newRequest func() (*http.Request, error)) error {
+	return retry.Do(sendRetryConfig(), func() error {
+		req, err := newRequest()
 		if err != nil {
 			return err
 		}
+		// Сервер подписывает сжатое тело, поэтому отключаем прозрачную распаковку в транспорте
+		req.Header.Set("Accept-Encoding", "gzip")
+		if ip := outboundIP(req.URL); ip != "" {
+			req.Header.Set("X-Real-IP", ip)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return &transportError{err: err}
+		}
 		defer func() {
 			if cerr := resp.Body.Close(); cerr != nil {
 				log.Printf("failed to close response body: %v", cerr)
 			}
 		}()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return &transportError{err: err}
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return &statusError{code: resp.StatusCode}
+		}
+		if hashkey != "" && !verifyResponse(hashkey, body, resp.Header.Get(crypto.HashHeader)) {
+			log.Printf("response signature mismatch for %s", req.URL.Path)
+			return &signatureError{}
+		}
 		return nil
 	})
 }
+
+// outboundIP returns the local address the agent uses to reach the server, or empty string if it is unknown.
+// Dialing UDP sends no packets, it only selects the outgoing interface.
+func outboundIP(u *url.URL) string {
+	defaultPort := "80"
+	if u.Scheme == "https" {
+		defaultPort = "443"
+	}
+	return outboundIPForHost(u.Host, defaultPort)
+}
+
+// outboundIPForHost is outboundIP for a host[:port] address, defaultPort is used if the address has none.
+func outboundIPForHost(hostport, defaultPort string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), defaultPort
+	}
+	if port == "" {
+		port = "80"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// verifyResponse checks the HMAC-SHA256 signature of a response body.
+func verifyResponse(key string, body []byte, signature string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
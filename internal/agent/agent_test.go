@@ -2,16 +2,32 @@ package agent
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/retry"
+	"github.com/antonminaichev/metricscollector/internal/server/middleware"
+	"github.com/antonminaichev/metricscollector/internal/server/router"
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -173,11 +189,11 @@ func TestCollectSystemMetrics_ContextCancellation(t *testing.T) {
 
 func TestCalculateHash(t *testing.T) {
 	t.Run("calculates hash correctly", func(t *testing.T) {
-		buf := bytes.NewBufferString("test data")
+		body := []byte("test data")
 		key := "secret_key"
 
-		hash1 := calculateHash(buf, key)
-		hash2 := calculateHash(buf, key)
+		hash1 := calculateHash(key, http.MethodPost, "/updates/", "1700000000", "nonce", body)
+		hash2 := calculateHash(key, http.MethodPost, "/updates/", "1700000000", "nonce", body)
 
 		assert.NotEmpty(t, hash1)
 		assert.Equal(t, hash1, hash2) // Хеш должен быть детерминированным
@@ -185,78 +201,47 @@ func TestCalculateHash(t *testing.T) {
 	})
 
 	t.Run("different data produces different hash", func(t *testing.T) {
-		buf1 := bytes.NewBufferString("test data 1")
-		buf2 := bytes.NewBufferString("test data 2")
 		key := "secret_key"
 
-		hash1 := calculateHash(buf1, key)
-		hash2 := calculateHash(buf2, key)
+		hash1 := calculateHash(key, http.MethodPost, "/updates/", "1700000000", "nonce", []byte("test data 1"))
+		hash2 := calculateHash(key, http.MethodPost, "/updates/", "1700000000", "nonce", []byte("test data 2"))
 
 		assert.NotEqual(t, hash1, hash2)
 	})
 
 	t.Run("different key produces different hash", func(t *testing.T) {
-		buf := bytes.NewBufferString("test data")
-		key1 := "secret_key_1"
-		key2 := "secret_key_2"
+		body := []byte("test data")
 
-		hash1 := calculateHash(buf, key1)
-		hash2 := calculateHash(buf, key2)
+		hash1 := calculateHash("secret_key_1", http.MethodPost, "/updates/", "1700000000", "nonce", body)
+		hash2 := calculateHash("secret_key_2", http.MethodPost, "/updates/", "1700000000", "nonce", body)
 
 		assert.NotEqual(t, hash1, hash2)
 	})
-}
 
-func TestCheckServerAvailability(t *testing.T) {
-	t.Run("successful health check", func(t *testing.T) {
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path == "/health" {
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte(`{"status": "ok"}`))
-			} else {
-				w.WriteHeader(http.StatusNotFound)
-			}
-		}))
-		defer server.Close()
+	t.Run("signature covers path, timestamp and nonce", func(t *testing.T) {
+		key := "secret_key"
+		body := []byte("test data")
+		base := calculateHash(key, http.MethodPost, "/updates/", "1700000000", "nonce", body)
 
-		available := checkServerAvailability(server.URL)
-		assert.True(t, available)
+		assert.NotEqual(t, base, calculateHash(key, http.MethodPost, "/update/", "1700000000", "nonce", body))
+		assert.NotEqual(t, base, calculateHash(key, http.MethodPost, "/updates/", "1700000001", "nonce", body))
+		assert.NotEqual(t, base, calculateHash(key, http.MethodPost, "/updates/", "1700000000", "other", body))
 	})
+}
 
-	t.Run("server returns error status", func(t *testing.T) {
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusInternalServerError)
-		}))
-		defer server.Close()
-
-		available := checkServerAvailability(server.URL)
-		assert.False(t, available)
-	})
+func TestSignRequest(t *testing.T) {
+	body := []byte("test data")
+	req1 := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	req2 := httptest.NewRequest(http.MethodPost, "/updates/", nil)
 
-	t.Run("server is unreachable", func(t *testing.T) {
-		available := checkServerAvailability("http://localhost:99999")
-		assert.False(t, available)
-	})
+	signRequest(req1, body, "secret_key")
+	signRequest(req2, body, "secret_key")
 
-	t.Run("adds http prefix if missing", func(t *testing.T) {
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path == "/health" {
-				w.WriteHeader(http.StatusOK)
-			}
-		}))
-		defer server.Close()
-
-		// Убираем http:// из URL
-		hostWithoutProtocol := server.URL[7:] // убираем "http://"
-		available := checkServerAvailability(hostWithoutProtocol)
-		assert.True(t, available)
-	})
-
-	t.Run("preserves https prefix", func(t *testing.T) {
-		available := checkServerAvailability("https://httpbin.org")
-		// Может быть true или false в зависимости от доступности, главное что не паникует
-		_ = available
-	})
+	assert.NotEmpty(t, req1.Header.Get(crypto.TimestampHeader))
+	assert.NotEqual(t, req1.Header.Get(crypto.NonceHeader), req2.Header.Get(crypto.NonceHeader))
+	assert.Equal(t,
+		calculateHash("secret_key", http.MethodPost, "/updates/", req1.Header.Get(crypto.TimestampHeader), req1.Header.Get(crypto.NonceHeader), body),
+		req1.Header.Get(crypto.HashHeader))
 }
 
 func TestDoRequest(t *testing.T) {
@@ -267,19 +252,26 @@ func TestDoRequest(t *testing.T) {
 		defer server.Close()
 
 		client := &http.Client{}
-		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
-		require.NoError(t, err)
-
-		err = doRequest(client, req)
+		err := doRequest(client, "", func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, server.URL, nil)
+		})
 		assert.NoError(t, err)
 	})
 
 	t.Run("failed request", func(t *testing.T) {
+		noRetryDelays(t)
 		client := &http.Client{}
-		req, err := http.NewRequest(http.MethodGet, "http://localhost:99999", nil)
-		require.NoError(t, err)
+		err := doRequest(client, "", func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, "http://localhost:99999", nil)
+		})
+		assert.ErrorAs(t, err, new(*transportError))
+	})
 
-		err = doRequest(client, req)
+	t.Run("request build error", func(t *testing.T) {
+		client := &http.Client{}
+		err := doRequest(client, "", func() (*http.Request, error) {
+			return nil, fmt.Errorf("build failed")
+		})
 		assert.Error(t, err)
 	})
 }
@@ -291,7 +283,7 @@ func TestSendPlain(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		requestReceived = true
 		receivedHeaders = r.Header
-		w.WriteHeader(http.StatusOK)
+		writeSigned(w, "secret_key", http.StatusOK, []byte("[]"))
 	}))
 	defer server.Close()
 
@@ -299,12 +291,29 @@ func TestSendPlain(t *testing.T) {
 	buf := bytes.NewBufferString("test data")
 	hashkey := "secret_key"
 
-	sendPlain(client, server.URL, hashkey, buf)
+	err := sendPlain(client, server.URL, hashkey, buf, 1)
+	require.NoError(t, err)
 
 	assert.True(t, requestReceived)
 	assert.Equal(t, "application/json", receivedHeaders.Get("Content-Type"))
 	assert.Equal(t, "gzip", receivedHeaders.Get("Content-Encoding"))
 	assert.NotEmpty(t, receivedHeaders.Get("HashSHA256"))
+	assert.Equal(t, agentID, receivedHeaders.Get("X-Agent-ID"))
+	assert.Equal(t, "1", receivedHeaders.Get("X-Batch-Seq"))
+	assert.Equal(t, "127.0.0.1", receivedHeaders.Get("X-Real-IP"))
+}
+
+func TestOutboundIP(t *testing.T) {
+	u, err := url.Parse("http://127.0.0.1:8080/updates/")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", outboundIP(u))
+
+	u, err = url.Parse("http://[::1]/updates/")
+	require.NoError(t, err)
+	// IPv6 может быть недоступен в окружении, главное что не паникует
+	if ip := outboundIP(u); ip != "" {
+		assert.Equal(t, "::1", ip)
+	}
 }
 
 func TestSendPlain_NoHashKey(t *testing.T) {
@@ -321,7 +330,7 @@ func TestSendPlain_NoHashKey(t *testing.T) {
 	client := &http.Client{}
 	buf := bytes.NewBufferString("test data")
 
-	sendPlain(client, server.URL, "", buf)
+	sendPlain(client, server.URL, "", buf, 1)
 
 	assert.True(t, requestReceived)
 	assert.Equal(t, "application/json", receivedHeaders.Get("Content-Type"))
@@ -330,30 +339,46 @@ func TestSendPlain_NoHashKey(t *testing.T) {
 }
 
 func TestSendEncrypted(t *testing.T) {
+	// Генерируем ключи для теста
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
 	requestReceived := false
 	var receivedHeaders http.Header
+	var decrypted []byte
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		requestReceived = true
 		receivedHeaders = r.Header
-		w.WriteHeader(http.StatusOK)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t,
+			calculateHash("secret_key", r.Method, r.URL.Path, r.Header.Get(crypto.TimestampHeader), r.Header.Get(crypto.NonceHeader), body),
+			r.Header.Get("HashSHA256"))
+		decrypted, err = crypto.DecryptEnvelope(privateKey, body)
+		require.NoError(t, err)
+		writeSigned(w, "secret_key", http.StatusOK, []byte("[]"))
 	}))
 	defer server.Close()
 
-	// Генерируем ключи для теста
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	require.NoError(t, err)
-
 	client := &http.Client{}
-	buf := bytes.NewBufferString("test data")
+	// Полезная нагрузка больше размера ключа
+	payload := bytes.Repeat([]byte("test data "), 100)
+	buf := bytes.NewBuffer(payload)
 	hashkey := "secret_key"
 
-	sendEncrypted(client, server.URL, hashkey, buf, &privateKey.PublicKey)
+	err = sendEncrypted(client, server.URL, hashkey, buf, &privateKey.PublicKey, 1)
+	require.NoError(t, err)
 
 	assert.True(t, requestReceived)
 	assert.Equal(t, "application/octet-stream", receivedHeaders.Get("Content-Type"))
 	assert.Equal(t, "gzip", receivedHeaders.Get("Content-Encoding"))
+	assert.Equal(t, crypto.EncryptionV2, receivedHeaders.Get(crypto.EncryptionHeader))
+	keyID, err := crypto.KeyID(&privateKey.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, keyID, receivedHeaders.Get(crypto.KeyIDHeader))
 	assert.NotEmpty(t, receivedHeaders.Get("HashSHA256"))
+	assert.Equal(t, payload, decrypted)
 }
 
 func TestSendEncrypted_NoHashKey(t *testing.T) {
@@ -373,7 +398,7 @@ func TestSendEncrypted_NoHashKey(t *testing.T) {
 	client := &http.Client{}
 	buf := bytes.NewBufferString("test data")
 
-	sendEncrypted(client, server.URL, "", buf, &privateKey.PublicKey)
+	sendEncrypted(client, server.URL, "", buf, &privateKey.PublicKey, 1)
 
 	assert.True(t, requestReceived)
 	assert.Equal(t, "application/octet-stream", receivedHeaders.Get("Content-Type"))
@@ -382,25 +407,52 @@ func TestSendEncrypted_NoHashKey(t *testing.T) {
 }
 
 func TestMetricWorker(t *testing.T) {
-	t.Run("processes metrics without encryption", func(t *testing.T) {
+	t.Run("sends each batch in a single request", func(t *testing.T) {
 		requestCount := 0
+		var paths []string
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			requestCount++
+			paths = append(paths, r.URL.Path)
 			w.WriteHeader(http.StatusOK)
 		}))
 		defer server.Close()
 
 		client := &http.Client{}
-		jobs := make(chan Metrics, 2)
+		batches := make(chan []Metrics, 2)
 
-		// Добавляем несколько метрик
-		jobs <- Metrics{ID: "test1", MType: "gauge", Value: ptrFloat64(1.0)}
-		jobs <- Metrics{ID: "test2", MType: "counter", Delta: ptrInt64(5)}
-		close(jobs)
+		// Добавляем несколько батчей
+		batches <- []Metrics{
+			{ID: "test1", MType: "gauge", Value: ptrFloat64(1.0)},
+			{ID: "test2", MType: "counter", Delta: ptrInt64(5)},
+		}
+		batches <- []Metrics{{ID: "test3", MType: "gauge", Value: ptrFloat64(2.0)}}
+		close(batches)
 
-		MetricWorker(client, server.URL, "", jobs, 0, "")
+		MetricWorker(client, server.URL, "", batches, "", NewPendingCounters())
 
 		assert.Equal(t, 2, requestCount)
+		assert.Equal(t, []string{"/updates/", "/updates/"}, paths)
+	})
+
+	t.Run("numbers batches monotonically", func(t *testing.T) {
+		var seqs []uint64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seq, err := strconv.ParseUint(r.Header.Get("X-Batch-Seq"), 10, 64)
+			require.NoError(t, err)
+			seqs = append(seqs, seq)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		batches := make(chan []Metrics, 2)
+		batches <- []Metrics{{ID: "a", MType: "gauge", Value: ptrFloat64(1)}}
+		batches <- []Metrics{{ID: "b", MType: "gauge", Value: ptrFloat64(2)}}
+		close(batches)
+
+		MetricWorker(&http.Client{}, server.URL, "", batches, "", NewPendingCounters())
+
+		require.Len(t, seqs, 2)
+		assert.Less(t, seqs[0], seqs[1])
 	})
 
 	t.Run("processes metrics with encryption", func(t *testing.T) {
@@ -428,11 +480,11 @@ func TestMetricWorker(t *testing.T) {
 		defer server.Close()
 
 		client := &http.Client{}
-		jobs := make(chan Metrics, 1)
-		jobs <- Metrics{ID: "test", MType: "gauge", Value: ptrFloat64(1.0)}
-		close(jobs)
+		batches := make(chan []Metrics, 1)
+		batches <- []Metrics{{ID: "test", MType: "gauge", Value: ptrFloat64(1.0)}}
+		close(batches)
 
-		MetricWorker(client, server.URL, "", jobs, 0, keyFile)
+		MetricWorker(client, server.URL, "", batches, keyFile, NewPendingCounters())
 
 		assert.Equal(t, 1, requestCount)
 	})
@@ -446,16 +498,545 @@ func TestMetricWorker(t *testing.T) {
 		defer server.Close()
 
 		client := &http.Client{}
-		jobs := make(chan Metrics, 1)
-		jobs <- Metrics{ID: "test", MType: "gauge", Value: ptrFloat64(1.0)}
-		close(jobs)
+		batches := make(chan []Metrics, 1)
+		batches <- []Metrics{{ID: "test", MType: "gauge", Value: ptrFloat64(1.0)}}
+		close(batches)
 
 		// Убираем http:// из URL
 		hostWithoutProtocol := server.URL[7:]
-		MetricWorker(client, hostWithoutProtocol, "", jobs, 0, "")
+		MetricWorker(client, hostWithoutProtocol, "", batches, "", NewPendingCounters())
 
 		assert.Equal(t, 1, requestCount)
 	})
+
+	t.Run("payload is a gzipped JSON array", func(t *testing.T) {
+		var received []Metrics
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gr, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.NewDecoder(gr).Decode(&received))
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		batches := make(chan []Metrics, 1)
+		batches <- []Metrics{
+			{ID: "Alloc", MType: "gauge", Value: ptrFloat64(42)},
+			{ID: "PollCount", MType: "counter", Delta: ptrInt64(3)},
+		}
+		close(batches)
+
+		MetricWorker(&http.Client{}, server.URL, "", batches, "", NewPendingCounters())
+
+		require.Len(t, received, 2)
+		assert.Equal(t, "Alloc", received[0].ID)
+		assert.Equal(t, 42.0, *received[0].Value)
+		assert.Equal(t, "PollCount", received[1].ID)
+		assert.Equal(t, int64(3), *received[1].Delta)
+	})
+}
+
+func TestBatchMetrics(t *testing.T) {
+	t.Run("coalesces metrics of a report window", func(t *testing.T) {
+		jobs := make(chan Metrics, 10)
+		batches := make(chan []Metrics, 10)
+
+		jobs <- Metrics{ID: "Alloc", MType: "gauge", Value: ptrFloat64(1)}
+		jobs <- Metrics{ID: "PollCount", MType: "counter", Delta: ptrInt64(1)}
+		jobs <- Metrics{ID: "Alloc", MType: "gauge", Value: ptrFloat64(2)}
+		jobs <- Metrics{ID: "PollCount", MType: "counter", Delta: ptrInt64(1)}
+		close(jobs)
+
+		BatchMetrics(jobs, 10, 0, NewPendingCounters(), batches)
+
+		var got [][]Metrics
+		for b := range batches {
+			got = append(got, b)
+		}
+		require.Len(t, got, 1)
+		require.Len(t, got[0], 2)
+		assert.Equal(t, "Alloc", got[0][0].ID)
+		assert.Equal(t, 2.0, *got[0][0].Value)
+		assert.Equal(t, "PollCount", got[0][1].ID)
+		assert.Equal(t, int64(2), *got[0][1].Delta)
+	})
+
+	t.Run("keeps labelled series apart", func(t *testing.T) {
+		jobs := make(chan Metrics, 10)
+		batches := make(chan []Metrics, 10)
+
+		jobs <- Metrics{ID: "CPUutilization", MType: "gauge", Value: ptrFloat64(1), Labels: map[string]string{"cpu": "0"}}
+		jobs <- Metrics{ID: "CPUutilization", MType: "gauge", Value: ptrFloat64(2), Labels: map[string]string{"cpu": "1"}}
+		jobs <- Metrics{ID: "CPUutilization", MType: "gauge", Value: ptrFloat64(3), Labels: map[string]string{"cpu": "0"}}
+		close(jobs)
+
+		BatchMetrics(jobs, 10, 0, NewPendingCounters(), batches)
+
+		batch := <-batches
+		require.Len(t, batch, 2)
+		values := map[string]float64{}
+		for _, m := range batch {
+			values[m.Labels["cpu"]] = *m.Value
+		}
+		assert.Equal(t, map[string]float64{"0": 3, "1": 2}, values)
+	})
+
+	t.Run("keeps every summary observation", func(t *testing.T) {
+		jobs := make(chan Metrics, 10)
+		batches := make(chan []Metrics, 10)
+
+		jobs <- Metrics{ID: "RequestTime", MType: "summary", Value: ptrFloat64(0.1)}
+		jobs <- Metrics{ID: "RequestTime", MType: "summary", Value: ptrFloat64(0.2)}
+		close(jobs)
+
+		BatchMetrics(jobs, 10, 0, NewPendingCounters(), batches)
+
+		batch := <-batches
+		require.Len(t, batch, 2)
+		assert.Equal(t, 0.1, *batch[0].Value)
+		assert.Equal(t, 0.2, *batch[1].Value)
+	})
+
+	t.Run("counts set members in a sketch", func(t *testing.T) {
+		jobs := make(chan Metrics, 10)
+		batches := make(chan []Metrics, 10)
+
+		for _, member := range []string{"alice", "bob", "alice"} {
+			jobs <- Metrics{ID: "Users", MType: "set", Member: &member}
+		}
+		close(jobs)
+
+		BatchMetrics(jobs, 10, 0, NewPendingCounters(), batches)
+
+		var sets []Metrics
+		for _, m := range <-batches {
+			if m.MType == "set" {
+				sets = append(sets, m)
+			}
+		}
+		require.Len(t, sets, 1)
+		assert.Nil(t, sets[0].Member)
+		require.NotNil(t, sets[0].Set)
+		assert.Equal(t, uint64(2), sets[0].Set.Sketch.Estimate())
+	})
+
+	t.Run("splits oversized batches", func(t *testing.T) {
+		jobs := make(chan Metrics, 10)
+		batches := make(chan []Metrics, 10)
+
+		for i := 0; i < 5; i++ {
+			jobs <- Metrics{ID: fmt.Sprintf("g%d", i), MType: "gauge", Value: ptrFloat64(float64(i))}
+		}
+		close(jobs)
+
+		BatchMetrics(jobs, 10, 2, NewPendingCounters(), batches)
+
+		var sizes []int
+		for b := range batches {
+			sizes = append(sizes, len(b))
+		}
+		assert.Equal(t, []int{2, 2, 1}, sizes)
+	})
+
+	t.Run("flushes on report interval", func(t *testing.T) {
+		jobs := make(chan Metrics)
+		batches := make(chan []Metrics, 1)
+		go BatchMetrics(jobs, 1, 0, NewPendingCounters(), batches)
+
+		jobs <- Metrics{ID: "Alloc", MType: "gauge", Value: ptrFloat64(1)}
+
+		select {
+		case b := <-batches:
+			require.Len(t, b, 1)
+			assert.Equal(t, "Alloc", b[0].ID)
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for batch")
+		}
+		close(jobs)
+	})
+
+	t.Run("no batch for empty window", func(t *testing.T) {
+		jobs := make(chan Metrics)
+		batches := make(chan []Metrics, 1)
+		close(jobs)
+
+		BatchMetrics(jobs, 1, 0, NewPendingCounters(), batches)
+
+		_, ok := <-batches
+		assert.False(t, ok)
+	})
+}
+
+func TestPendingCounters(t *testing.T) {
+	p := NewPendingCounters()
+	p.Restore([]Metrics{
+		{ID: "PollCount", MType: "counter", Delta: ptrInt64(2)},
+		{ID: "Alloc", MType: "gauge", Value: ptrFloat64(1)},
+	})
+	p.Restore([]Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(3)}})
+
+	taken := p.take()
+	require.Len(t, taken, 1)
+	assert.Equal(t, "PollCount", taken[0].ID)
+	assert.Equal(t, int64(5), *taken[0].Delta)
+	assert.Empty(t, p.take())
+}
+
+func TestPendingCounters_Sets(t *testing.T) {
+	p := NewPendingCounters()
+	p.Restore([]Metrics{{ID: "Users", MType: "set", Set: newSet("alice")}})
+	p.Restore([]Metrics{{ID: "Users", MType: "set", Set: newSet("bob")}})
+
+	taken := p.take()
+	require.Len(t, taken, 1)
+	assert.Equal(t, uint64(2), taken[0].Set.Sketch.Estimate())
+}
+
+func TestPendingCounters_Labels(t *testing.T) {
+	p := NewPendingCounters()
+	p.Restore([]Metrics{
+		{ID: "Requests", MType: "counter", Delta: ptrInt64(1), Labels: map[string]string{"code": "200"}},
+		{ID: "Requests", MType: "counter", Delta: ptrInt64(2), Labels: map[string]string{"code": "500"}},
+		{ID: "Requests", MType: "counter", Delta: ptrInt64(3), Labels: map[string]string{"code": "200"}},
+	})
+
+	taken := p.take()
+	require.Len(t, taken, 2)
+	assert.Equal(t, "200", taken[0].Labels["code"])
+	assert.Equal(t, int64(4), *taken[0].Delta)
+	assert.Equal(t, "500", taken[1].Labels["code"])
+	assert.Equal(t, int64(2), *taken[1].Delta)
+}
+
+func TestWithAgentLabels(t *testing.T) {
+	orig := agentLabels
+	agentLabels = map[string]string{"host": "agent-1"}
+	t.Cleanup(func() { agentLabels = orig })
+
+	batch := []Metrics{
+		{ID: "Alloc", MType: "gauge", Value: ptrFloat64(1)},
+		{ID: "CPUutilization", MType: "gauge", Value: ptrFloat64(2), Labels: map[string]string{"cpu": "0", "host": "custom"}},
+	}
+	labelled := withAgentLabels(batch)
+
+	assert.Equal(t, map[string]string{"host": "agent-1"}, labelled[0].Labels)
+	// Метки метрики важнее меток агента
+	assert.Equal(t, map[string]string{"cpu": "0", "host": "custom"}, labelled[1].Labels)
+	// Исходный батч не изменяется
+	assert.Nil(t, batch[0].Labels)
+}
+
+func TestSetInstanceID(t *testing.T) {
+	orig, origID := agentLabels, agentID
+	t.Cleanup(func() { agentLabels, agentID = orig, origID })
+
+	host, err := os.Hostname()
+	require.NoError(t, err)
+
+	SetInstanceID("agent-7")
+	assert.Equal(t, "agent-7", agentLabels[InstanceLabel])
+	assert.Equal(t, host, agentLabels[HostLabel])
+	// ID агента не меняется после перезапуска, поэтому сервер распознает повторы пакетов
+	assert.Equal(t, "agent-7", agentID)
+
+	// Без явного ID используется имя хоста
+	SetInstanceID("")
+	assert.Equal(t, host, agentLabels[InstanceLabel])
+	assert.Equal(t, host, agentID)
+}
+
+func TestNewBatchSeq(t *testing.T) {
+	start := time.Now()
+	before := newBatchSeq(start)
+	last := before.Add(1000)
+
+	// Номера пакетов перезапущенного агента больше номеров, отправленных до перезапуска
+	restarted := newBatchSeq(start.Add(time.Second))
+	assert.Greater(t, restarted.Add(1), last)
+}
+
+func TestBatchMetrics_ResendsRestoredIncrements(t *testing.T) {
+	jobs := make(chan Metrics, 1)
+	batches := make(chan []Metrics, 1)
+	pending := NewPendingCounters()
+	pending.Restore([]Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(4)}})
+
+	jobs <- Metrics{ID: "PollCount", MType: "counter", Delta: ptrInt64(1)}
+	close(jobs)
+	BatchMetrics(jobs, 10, 0, pending, batches)
+
+	batch := <-batches
+	require.Len(t, batch, 1)
+	assert.Equal(t, int64(5), *batch[0].Delta)
+}
+
+func TestMetricWorker_RestoresRejectedBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	batches := make(chan []Metrics, 1)
+	batches <- []Metrics{
+		{ID: "PollCount", MType: "counter", Delta: ptrInt64(2)},
+		{ID: "Alloc", MType: "gauge", Value: ptrFloat64(1)},
+		{ID: "Latency", MType: "histogram", Histogram: &Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}},
+	}
+	close(batches)
+
+	pending := NewPendingCounters()
+	MetricWorker(&http.Client{}, server.URL, "", batches, "", pending)
+
+	// Отклоненная гистограмма не возвращается, иначе она отклоняла бы каждый следующий пакет.
+	// Вернувшиеся приращения отправляются еще раз перед завершением и снова отклоняются
+	taken := pending.take()
+	require.Len(t, taken, 3)
+	assert.Equal(t, sendErrorsMetric, taken[0].ID)
+	assert.Equal(t, int64(2), *taken[0].Delta)
+	assert.Equal(t, "PollCount", taken[1].ID)
+	assert.Equal(t, int64(2), *taken[1].Delta)
+	// Длительность отправки учитывается и для неудачных попыток
+	assert.Equal(t, reportDurationMetric, taken[2].ID)
+	assert.Equal(t, uint64(1), taken[2].Histogram.Count)
+}
+
+// TestMetricWorker_ResponseLost checks that a batch applied by the server is not counted twice
+// when its response is lost and the batch is sent again.
+func TestMetricWorker_ResponseLost(t *testing.T) {
+	noRetryDelays(t)
+	s := ms.NewMemoryStorage()
+	handler := middleware.GzipHandler(router.NewRouter(s))
+
+	var (
+		mu       sync.Mutex
+		requests int
+		seqs     []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		lost := requests <= 3
+		seqs = append(seqs, r.Header.Get("X-Batch-Seq"))
+		mu.Unlock()
+		if !lost {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		// Сервер применяет пакет, но ответ до агента не доходит
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		require.Equal(t, http.StatusOK, rec.Code)
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	batches := make(chan []Metrics, 2)
+	batches <- []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(2)}}
+	batches <- []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(3)}}
+	close(batches)
+
+	pending := NewPendingCounters()
+	MetricWorker(&http.Client{}, server.URL, "", batches, "", pending)
+
+	delta, _, err := s.GetMetric(context.Background(), storage.SeriesKey("PollCount", agentLabels), storage.Counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *delta)
+
+	// Все попытки первого пакета, включая повтор перед вторым пакетом, идут с одним номером
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, seqs, 5)
+	for _, seq := range seqs[1:4] {
+		assert.Equal(t, seqs[0], seq)
+	}
+	assert.NotEqual(t, seqs[0], seqs[4])
+
+	// Неподтвержденный пакет не возвращается в pending, иначе приращения были бы отправлены дважды
+	assert.Equal(t, []Metrics{{ID: sendErrorsMetric, MType: "counter", Delta: ptrInt64(1)}}, takeCounters(pending))
+}
+
+func TestDoRequest_Response(t *testing.T) {
+	noRetryDelays(t)
+	key := "secret_key"
+	newRequest := func(url string) func() (*http.Request, error) {
+		return func() (*http.Request, error) {
+			return http.NewRequest(http.MethodPost, url+"/updates/", nil)
+		}
+	}
+
+	t.Run("client error is not retried", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		err := doRequest(&http.Client{}, "", newRequest(server.URL))
+		var se *statusError
+		require.ErrorAs(t, err, &se)
+		assert.Equal(t, http.StatusBadRequest, se.code)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("server error is retried", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		err := doRequest(&http.Client{}, "", newRequest(server.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("valid signature over gzipped body", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			gw.Write([]byte(`[{"id":"PollCount"}]`))
+			gw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			writeSigned(w, key, http.StatusOK, buf.Bytes())
+		}))
+		defer server.Close()
+
+		err := doRequest(&http.Client{}, key, newRequest(server.URL))
+		assert.NoError(t, err)
+	})
+
+	t.Run("transport error is retried", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				panic(http.ErrAbortHandler)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		err := doRequest(&http.Client{}, "", newRequest(server.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("signature mismatch", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeSigned(w, "other_key", http.StatusOK, []byte("[]"))
+		}))
+		defer server.Close()
+
+		err := doRequest(&http.Client{}, key, newRequest(server.URL))
+		assert.ErrorAs(t, err, new(*signatureError))
+	})
+
+	t.Run("missing signature", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		err := doRequest(&http.Client{}, key, newRequest(server.URL))
+		assert.ErrorAs(t, err, new(*signatureError))
+	})
+}
+
+func TestMetricWorker_CountsSignatureErrors(t *testing.T) {
+	noRetryDelays(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeSigned(w, "other_key", http.StatusOK, []byte("[]"))
+	}))
+	defer server.Close()
+
+	batches := make(chan []Metrics, 1)
+	batches <- []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(1)}}
+	close(batches)
+
+	pending := NewPendingCounters()
+	MetricWorker(&http.Client{}, server.URL, "secret_key", batches, "", pending)
+
+	deltas := make(map[string]int64)
+	for _, m := range takeCounters(pending) {
+		deltas[m.ID] = *m.Delta
+	}
+	// Сервер мог применить пакет, поэтому он не возвращается в pending,
+	// а отправляется повторно перед завершением работы
+	assert.Equal(t, map[string]int64{
+		sendErrorsMetric:      2,
+		signatureErrorsMetric: 2,
+	}, deltas)
+}
+
+// TestPollCountDeliveredExactly checks that the server-side PollCount total equals
+// the number of polls even when some reports fail and are re-sent.
+func TestPollCountDeliveredExactly(t *testing.T) {
+	noRetryDelays(t)
+	s := ms.NewMemoryStorage()
+	handler := middleware.GzipHandler(router.NewRouter(s))
+
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		switch {
+		case n == 1:
+			// Первый пакет применяется, но ответ до агента не доходит
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			panic(http.ErrAbortHandler)
+		case n <= 6:
+			// Повторы первого пакета не доходят до хранилища, второй пакет возвращается в pending
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case n == 10:
+			// Пакет последнего окна отклоняется, его приращения возвращаются в pending уже после закрытия канала
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	pending := NewPendingCounters()
+	batches := make(chan []Metrics)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MetricWorker(&http.Client{}, server.URL, "", batches, "", pending)
+	}()
+
+	// Каждое окно отчета, как и BatchMetrics, дополняется приращениями из pending
+	var polls int64
+	for window := int64(1); window <= 5; window++ {
+		polls += window
+		batch := []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(window)}}
+		batches <- append(batch, pending.take()...)
+	}
+	// Как и при остановке агента, закрытие канала завершает воркер без дополнительных отправок
+	close(batches)
+	<-done
+
+	delta, _, err := s.GetMetric(context.Background(), storage.SeriesKey("PollCount", agentLabels), storage.Counter)
+	require.NoError(t, err)
+	assert.Equal(t, polls, *delta)
+	for _, m := range takeCounters(pending) {
+		assert.NotEqual(t, "PollCount", m.ID)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Greater(t, requests, 10)
 }
 
 func TestMetrics_Structure(t *testing.T) {
@@ -487,6 +1068,35 @@ func TestMetrics_Structure(t *testing.T) {
 
 // Helper functions
 
+// takeCounters takes pending increments and drops histograms such as the report duration.
+func takeCounters(p *PendingCounters) []Metrics {
+	var counters []Metrics
+	for _, m := range p.take() {
+		if m.MType == "counter" {
+			counters = append(counters, m)
+		}
+	}
+	return counters
+}
+
+// writeSigned writes a response signed the same way as the server does.
+func writeSigned(w http.ResponseWriter, key string, status int, body []byte) {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	w.Header().Set(crypto.HashHeader, hex.EncodeToString(mac.Sum(nil)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// noRetryDelays makes doRequest retry immediately for the duration of the test.
+func noRetryDelays(t *testing.T) {
+	orig := sendRetryConfig
+	sendRetryConfig = func() *retry.RetryConfig {
+		return &retry.RetryConfig{MaxAttempts: 3}
+	}
+	t.Cleanup(func() { sendRetryConfig = orig })
+}
+
 func ptrFloat64(v float64) *float64 {
 	return &v
 }
@@ -532,17 +1142,17 @@ func BenchmarkCollectMetricsLoop(b *testing.B) {
 				jobs <- Metrics{ID: mDef.ID, MType: mDef.MType, Value: &val}
 			}
 		}
-		delta := int64(i + 1)
+		delta := int64(1)
 		jobs <- Metrics{ID: "PollCount", MType: "counter", Delta: &delta}
 	}
 }
 
 func BenchmarkCalculateHash(b *testing.B) {
-	buf := bytes.NewBufferString("test data for benchmark")
+	body := []byte("test data for benchmark")
 	key := "secret_key"
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = calculateHash(buf, key)
+		_ = calculateHash(key, http.MethodPost, "/updates/", "1700000000", "nonce", body)
 	}
 }
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	pb "github.com/antonminaichev/metricscollector/internal/proto"
+	"github.com/antonminaichev/metricscollector/internal/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcTimeout limits a single gRPC call.
+const grpcTimeout = 10 * time.Second
+
+// grpcError wraps gRPC call errors so transient ones are retried.
+type grpcError struct {
+	err error
+}
+
+func (e *grpcError) Error() string {
+	return e.err.Error()
+}
+
+func (e *grpcError) Unwrap() error {
+	return e.err
+}
+
+// IsRetryable reports whether repeating the call may succeed.
+func (e *grpcError) IsRetryable() bool {
+	switch status.Code(e.err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// rejected reports whether the server refused the call before applying the batch.
+func (e *grpcError) rejected() bool {
+	switch status.Code(e.err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+		return true
+	default:
+		return false
+	}
+}
+
+// GRPCMetricWorker sends batches from the batches channel to the gRPC server, see deliverBatches.
+// It is the gRPC counterpart of MetricWorker, payload encryption is left to the transport.
+func GRPCMetricWorker(conn *grpc.ClientConn, hashkey string, batches <-chan []Metrics, pending *PendingCounters) {
+	client := pb.NewMetricsClient(conn)
+	realIP := outboundIPForHost(grpcTargetHost(conn.Target()), "")
+
+	deliverBatches(batches, pending, func(batch []Metrics, seq uint64) error {
+		return sendGRPC(client, hashkey, realIP, &pb.UpdateMetricsRequest{
+			Metrics: toProto(withAgentLabels(batch)),
+			BatchId: agentID + "/" + strconv.FormatUint(seq, 10),
+		})
+	})
+}
+
+// sendGRPC pushes a batch, signing every attempt with a fresh nonce and verifying the response signature.
+func sendGRPC(client pb.MetricsClient, hashkey, realIP string, req *pb.UpdateMetricsRequest) error {
+	marshal := proto.MarshalOptions{Deterministic: true}
+	body, err := marshal.Marshal(req)
+	if err != nil {
+		return &encodeError{err: err}
+	}
+
+	return retry.Do(sendRetryConfig(), func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+		defer cancel()
+
+		md := metadata.MD{}
+		if realIP != "" {
+			md.Set("X-Real-IP", realIP)
+		}
+		if hashkey != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			nonce := newNonce()
+			md.Set(crypto.TimestampHeader, timestamp)
+			md.Set(crypto.NonceHeader, nonce)
+			md.Set(crypto.HashHeader, calculateHash(hashkey, crypto.GRPCMethod,
+				pb.Metrics_UpdateMetrics_FullMethodName, timestamp, nonce, body))
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+
+		var header metadata.MD
+		resp, err := client.UpdateMetrics(ctx, req, grpc.Header(&header))
+		if err != nil {
+			return &grpcError{err: err}
+		}
+		if hashkey == "" {
+			return nil
+		}
+		respBody, err := marshal.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		var signature string
+		if vals := header.Get(crypto.HashHeader); len(vals) > 0 {
+			signature = vals[0]
+		}
+		if !verifyResponse(hashkey, respBody, signature) {
+			log.Printf("response signature mismatch for %s", pb.Metrics_UpdateMetrics_FullMethodName)
+			return &signatureError{}
+		}
+		return nil
+	})
+}
+
+func toProto(batch []Metrics) []*pb.Metric {
+	metrics := make([]*pb.Metric, 0, len(batch))
+	for _, m := range batch {
+		pm := &pb.Metric{Id: m.ID, Delta: m.Delta, Value: m.Value, Labels: m.Labels, Member: m.Member}
+		switch m.MType {
+		case "counter":
+			pm.Type = pb.Metric_COUNTER
+		case "gauge":
+			pm.Type = pb.Metric_GAUGE
+		case "histogram":
+			pm.Type = pb.Metric_HISTOGRAM
+		case "summary":
+			pm.Type = pb.Metric_SUMMARY
+		case "set":
+			pm.Type = pb.Metric_SET
+		}
+		if h := m.Histogram; h != nil {
+			pm.Histogram = &pb.Histogram{Bounds: h.Bounds, Counts: h.Counts, Sum: h.Sum, Count: h.Count}
+		}
+		if st := m.Set; st != nil && st.Sketch != nil {
+			pm.Set = &pb.Set{Sketch: &pb.HyperLogLog{Precision: uint32(st.Sketch.Precision), Registers: st.Sketch.Registers}}
+		}
+		metrics = append(metrics, pm)
+	}
+	return metrics
+}
+
+// grpcTargetHost strips the resolver scheme from a gRPC target.
+func grpcTargetHost(target string) string {
+	if i := strings.Index(target, ":///"); i >= 0 {
+		return target[i+4:]
+	}
+	return target
+}
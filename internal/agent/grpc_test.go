@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	pb "github.com/antonminaichev/metricscollector/internal/proto"
+	"github.com/antonminaichev/metricscollector/internal/server/grpcserver"
+	"github.com/antonminaichev/metricscollector/internal/server/middleware"
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCConn starts an in-memory gRPC server signing with serverKey and returns a client connection to it.
+func newGRPCConn(t *testing.T, s storage.Storage, serverKey string) *grpc.ClientConn {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpcserver.NewServer(s, grpc.ChainUnaryInterceptor(
+		middleware.HashInterceptor(middleware.HashConfig{Key: serverKey, Policy: middleware.SignWrites}, grpcserver.IsWriteMethod),
+	))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCMetricWorker(t *testing.T) {
+	t.Run("pushes signed batches", func(t *testing.T) {
+		s := ms.NewMemoryStorage()
+		conn := newGRPCConn(t, s, "secret_key")
+
+		batches := make(chan []Metrics, 2)
+		batches <- []Metrics{
+			{ID: "PollCount", MType: "counter", Delta: ptrInt64(2)},
+			{ID: "Alloc", MType: "gauge", Value: ptrFloat64(10)},
+		}
+		batches <- []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(3)}}
+		close(batches)
+
+		pending := NewPendingCounters()
+		GRPCMetricWorker(conn, "secret_key", batches, pending)
+
+		assert.Empty(t, takeCounters(pending))
+		delta, _, err := s.GetMetric(context.Background(), storage.SeriesKey("PollCount", agentLabels), storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), *delta)
+		_, value, err := s.GetMetric(context.Background(), storage.SeriesKey("Alloc", agentLabels), storage.Gauge)
+		require.NoError(t, err)
+		assert.Equal(t, 10.0, *value)
+	})
+
+	t.Run("unsigned push is rejected and restored", func(t *testing.T) {
+		noRetryDelays(t)
+		conn := newGRPCConn(t, ms.NewMemoryStorage(), "secret_key")
+
+		batches := make(chan []Metrics, 1)
+		batches <- []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(2)}}
+		close(batches)
+
+		pending := NewPendingCounters()
+		GRPCMetricWorker(conn, "", batches, pending)
+
+		deltas := make(map[string]int64)
+		for _, m := range takeCounters(pending) {
+			deltas[m.ID] = *m.Delta
+		}
+		// Перед завершением воркер еще раз отправляет вернувшиеся приращения
+		assert.Equal(t, map[string]int64{"PollCount": 2, sendErrorsMetric: 2}, deltas)
+	})
+
+	t.Run("server with another key rejects the request", func(t *testing.T) {
+		noRetryDelays(t)
+		conn := newGRPCConn(t, ms.NewMemoryStorage(), "other_key")
+
+		err := sendGRPC(pb.NewMetricsClient(conn), "secret_key", "", &pb.UpdateMetricsRequest{})
+		// Сервер отклоняет подпись чужим ключом раньше, чем агент проверит ответ
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestGRPCError(t *testing.T) {
+	assert.True(t, (&grpcError{err: status.Error(codes.Unavailable, "down")}).IsRetryable())
+	assert.True(t, (&grpcError{err: status.Error(codes.Internal, "failed")}).IsRetryable())
+	assert.False(t, (&grpcError{err: status.Error(codes.InvalidArgument, "bad")}).IsRetryable())
+
+	// Внутренняя ошибка сервера могла случиться после применения пакета
+	assert.False(t, (&grpcError{err: status.Error(codes.Internal, "failed")}).rejected())
+	assert.True(t, (&grpcError{err: status.Error(codes.InvalidArgument, "bad")}).rejected())
+}
+
+func TestGRPCTargetHost(t *testing.T) {
+	assert.Equal(t, "localhost:3200", grpcTargetHost("localhost:3200"))
+	assert.Equal(t, "localhost:3200", grpcTargetHost("dns:///localhost:3200"))
+}
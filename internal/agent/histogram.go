@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultHistogramBuckets are upper bounds in seconds used for latency histograms.
+var DefaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogramBuckets are bucket bounds of histograms recorded by the agent.
+var histogramBuckets = DefaultHistogramBuckets
+
+// SetHistogramBuckets sets bucket bounds of histograms recorded by the agent, empty bounds keep the defaults.
+func SetHistogramBuckets(bounds []float64) error {
+	if len(bounds) == 0 {
+		histogramBuckets = DefaultHistogramBuckets
+		return nil
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return fmt.Errorf("histogram buckets must be increasing")
+		}
+	}
+	histogramBuckets = slices.Clone(bounds)
+	return nil
+}
+
+// ParseHistogramBuckets parses a comma separated list of bucket bounds.
+func ParseHistogramBuckets(s string) ([]float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var bounds []float64
+	for _, part := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram bucket %q: %w", part, err)
+		}
+		bounds = append(bounds, b)
+	}
+	return bounds, nil
+}
+
+// Histogram counts observations over fixed buckets, it is sent as the histogram of a metric.
+// Counts are per bucket, the last bucket has no upper bound.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// NewHistogram creates an empty histogram with the given bucket bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{Bounds: slices.Clone(bounds), Counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe adds v to the first bucket whose bound is not less than v.
+func (h *Histogram) Observe(v float64) {
+	h.observeN(v, 1)
+}
+
+// observeN adds n observations of v, it is used for sampled values.
+func (h *Histogram) observeN(v float64, n uint64) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, v)] += n
+	h.Sum += v * float64(n)
+	h.Count += n
+}
+
+// merge returns h with observations of other added, histograms with different bounds are not mergeable
+// and the newer one wins.
+func (h *Histogram) merge(other *Histogram) *Histogram {
+	if h == nil || !slices.Equal(h.Bounds, other.Bounds) {
+		return other.clone()
+	}
+	merged := h.clone()
+	for i, c := range other.Counts {
+		merged.Counts[i] += c
+	}
+	merged.Sum += other.Sum
+	merged.Count += other.Count
+	return merged
+}
+
+func (h *Histogram) clone() *Histogram {
+	return &Histogram{Bounds: slices.Clone(h.Bounds), Counts: slices.Clone(h.Counts), Sum: h.Sum, Count: h.Count}
+}
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram_Observe(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	// Значение на границе попадает в бакет этой границы
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	assert.Equal(t, []uint64{2, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(4), h.Count)
+	assert.InDelta(t, 3.65, h.Sum, 1e-9)
+}
+
+func TestParseHistogramBuckets(t *testing.T) {
+	bounds, err := ParseHistogramBuckets("0.1, 0.5,1")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.1, 0.5, 1}, bounds)
+
+	bounds, err = ParseHistogramBuckets("")
+	require.NoError(t, err)
+	assert.Nil(t, bounds)
+
+	_, err = ParseHistogramBuckets("0.1,x")
+	assert.Error(t, err)
+}
+
+func TestSetHistogramBuckets(t *testing.T) {
+	t.Cleanup(func() { histogramBuckets = DefaultHistogramBuckets })
+
+	require.NoError(t, SetHistogramBuckets([]float64{1, 2}))
+	assert.Equal(t, []float64{1, 2}, histogramBuckets)
+
+	assert.Error(t, SetHistogramBuckets([]float64{2, 1}))
+
+	require.NoError(t, SetHistogramBuckets(nil))
+	assert.Equal(t, DefaultHistogramBuckets, histogramBuckets)
+}
+
+func TestPendingCounters_Observe(t *testing.T) {
+	t.Cleanup(func() { histogramBuckets = DefaultHistogramBuckets })
+	require.NoError(t, SetHistogramBuckets([]float64{1}))
+
+	p := NewPendingCounters()
+	p.Observe("Latency", 0.5)
+	p.Observe("Latency", 2)
+	// Наблюдения из недоставленного батча возвращаются и объединяются
+	p.Restore([]Metrics{{ID: "Latency", MType: "histogram", Histogram: &Histogram{
+		Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.25, Count: 1,
+	}}})
+
+	taken := p.take()
+	require.Len(t, taken, 1)
+	assert.Equal(t, "histogram", taken[0].MType)
+	assert.Equal(t, []uint64{2, 1}, taken[0].Histogram.Counts)
+	assert.Equal(t, 2.75, taken[0].Histogram.Sum)
+}
@@ -0,0 +1,27 @@
+package agent
+
+import "github.com/antonminaichev/metricscollector/internal/hll"
+
+// Set carries members of a set metric counted in a HyperLogLog sketch, the server merges sketches
+// of all reports and only keeps the estimated number of unique members.
+type Set struct {
+	Sketch *hll.Sketch `json:"sketch"`
+}
+
+// newSet creates a set with a single member.
+func newSet(member string) *Set {
+	s := &Set{Sketch: hll.New()}
+	s.Sketch.Add(member)
+	return s
+}
+
+// merge returns s with members of other added, s may be nil.
+func (s *Set) merge(other *Set) *Set {
+	if s == nil {
+		return &Set{Sketch: other.Sketch.Clone()}
+	}
+	merged := &Set{Sketch: s.Sketch.Clone()}
+	// Агент строит все скетчи с одной точностью
+	_ = merged.Sketch.Merge(other.Sketch)
+	return merged
+}
@@ -0,0 +1,300 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStatsDPacket is the largest datagram read by the StatsD listener.
+const maxStatsDPacket = 64 * 1024
+
+// statsdIdleWindows is how many report windows a gauge or a counter remainder is kept without updates.
+const statsdIdleWindows = 10
+
+// statsdEpsilon is the counter remainder treated as zero, so rounding errors do not keep counters forever.
+const statsdEpsilon = 1e-9
+
+// statsdLogInterval is the minimum interval between logged invalid packets, others are only counted.
+const statsdLogInterval = 10 * time.Second
+
+// statsdTagRe matches tag names accepted by the server as label names, names starting with "__" are reserved.
+var statsdTagRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// StatsD aggregates StatsD packets per report window. Counters are summed with sample rates applied,
+// gauges keep the last value, timers (ms, converted to seconds), histograms and distributions are
+// counted in histograms with the agent buckets and set members are counted in a sketch.
+// DogStatsD tags "|#tag:value" become labels, lines with tag names that are not valid label names are rejected.
+// It is safe for concurrent use.
+type StatsD struct {
+	mu      sync.Mutex
+	entries map[string]*statsdEntry
+}
+
+// statsdEntry is the state of a single series in the current window.
+type statsdEntry struct {
+	metric Metrics
+	// count keeps the counter sum, the fraction left after rounding is carried to the next window.
+	count float64
+	// gauge is kept between windows, so relative updates apply to the last value.
+	gauge   float64
+	updated bool
+	// idle counts flushes since the last update of a gauge or a counter.
+	idle      int
+	histogram *Histogram
+	set       *Set
+}
+
+// NewStatsD creates an empty StatsD aggregator.
+func NewStatsD() *StatsD {
+	return &StatsD{entries: make(map[string]*statsdEntry)}
+}
+
+// Serve reads packets from conn until it is closed.
+// Invalid packets are logged at most once per statsdLogInterval with the number of skipped ones.
+func (s *StatsD) Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxStatsDPacket)
+	limiter := logLimiter{interval: statsdLogInterval}
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if n > 0 {
+			if perr := s.Handle(buf[:n]); perr != nil {
+				if skipped, ok := limiter.allow(time.Now()); ok {
+					log.Printf("invalid statsd packet: %v (%d invalid packets not logged)", perr, skipped)
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// logLimiter allows a log message once per interval and counts the suppressed ones.
+type logLimiter struct {
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+// allow reports whether a message may be logged at now and returns the number of messages suppressed since the last one.
+func (l *logLimiter) allow(now time.Time) (int, bool) {
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return 0, false
+	}
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+	return suppressed, true
+}
+
+// Handle aggregates all lines of a packet, invalid lines are skipped and the first error is returned.
+func (s *StatsD) Handle(packet []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := s.handleLine(line); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%q: %w", line, err)
+		}
+	}
+	return firstErr
+}
+
+// handleLine aggregates a "name:value|type|@rate|#tags" line, the caller must hold the lock.
+func (s *StatsD) handleLine(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return errors.New("missing metric name")
+	}
+	if strings.ContainsAny(name, "{}") {
+		return errors.New("metric name must not contain braces")
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 || parts[0] == "" {
+		return errors.New("want name:value|type")
+	}
+	value, typ := parts[0], parts[1]
+	rate := 1.0
+	var labels map[string]string
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			r, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %q", part[1:])
+			}
+			rate = r
+		case strings.HasPrefix(part, "#"):
+			var err error
+			if labels, err = parseStatsDTags(part[1:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	var mType string
+	switch typ {
+	case "c":
+		mType = "counter"
+	case "g":
+		mType = "gauge"
+	case "ms", "h", "d":
+		mType = "histogram"
+	case "s":
+		mType = "set"
+	default:
+		return fmt.Errorf("unknown metric type %q", typ)
+	}
+	m := Metrics{ID: name, MType: mType, Labels: labels}
+	key := metricKey(m)
+	e, seen := s.entries[key]
+	if !seen {
+		e = &statsdEntry{metric: m}
+	}
+
+	if mType == "set" {
+		e.set = e.set.merge(newSet(value))
+		s.entries[key] = e
+		return nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	e.idle = 0
+	switch typ {
+	case "c":
+		e.count += v / rate
+	case "g":
+		// Значение со знаком изменяет датчик относительно последнего значения
+		if value[0] == '+' || value[0] == '-' {
+			e.gauge += v
+		} else {
+			e.gauge = v
+		}
+		e.updated = true
+	default:
+		if typ == "ms" {
+			v /= 1000
+		}
+		if e.histogram == nil {
+			e.histogram = NewHistogram(histogramBuckets)
+		}
+		e.histogram.observeN(v, uint64(max(1, math.Round(1/rate))))
+	}
+	s.entries[key] = e
+	return nil
+}
+
+// parseStatsDTags parses comma separated "name:value" tags, tags without a value are skipped.
+// Tag names must be valid label names, the server would otherwise drop the whole series.
+func parseStatsDTags(s string) (map[string]string, error) {
+	var labels map[string]string
+	for _, tag := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok || name == "" || value == "" {
+			continue
+		}
+		if !statsdTagRe.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid tag name %q", name)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// Flush returns metrics aggregated since the previous flush ordered by type, name and labels.
+// Gauges and counter remainders not updated for statsdIdleWindows flushes are forgotten,
+// so a relative update of a forgotten gauge starts from zero.
+func (s *StatsD) Flush() []Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var flushed []Metrics
+	for _, key := range keys {
+		e := s.entries[key]
+		m := e.metric
+		switch m.MType {
+		case "counter":
+			delta := math.Round(e.count)
+			if delta != 0 {
+				d := int64(delta)
+				m.Delta = &d
+				flushed = append(flushed, m)
+				e.count -= delta
+			}
+			if e.idle++; math.Abs(e.count) < statsdEpsilon || e.idle > statsdIdleWindows {
+				delete(s.entries, key)
+			}
+		case "gauge":
+			if e.updated {
+				v := e.gauge
+				m.Value = &v
+				flushed = append(flushed, m)
+				e.updated = false
+			}
+			if e.idle++; e.idle > statsdIdleWindows {
+				delete(s.entries, key)
+			}
+		case "histogram":
+			m.Histogram = e.histogram
+			flushed = append(flushed, m)
+			delete(s.entries, key)
+		case "set":
+			m.Set = e.set
+			flushed = append(flushed, m)
+			delete(s.entries, key)
+		}
+	}
+	return flushed
+}
+
+// Run sends aggregated metrics to jobs once per report interval until ctx is done,
+// the last window is flushed before return.
+func (s *StatsD) Run(ctx context.Context, reportInterval int, jobs chan<- Metrics) {
+	if reportInterval <= 0 {
+		reportInterval = 1
+	}
+	ticker := time.NewTicker(time.Duration(reportInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, m := range s.Flush() {
+				jobs <- m
+			}
+			return
+		case <-ticker.C:
+			for _, m := range s.Flush() {
+				jobs <- m
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsD_Handle(t *testing.T) {
+	s := NewStatsD()
+	require.NoError(t, s.Handle([]byte("requests:1|c\nrequests:2|c|@0.5\n\nlogins:1|c|#env:prod,region:eu")))
+	require.NoError(t, s.Handle([]byte("temperature:20|g\ntemperature:+5|g\ntemperature:-3|g")))
+	require.NoError(t, s.Handle([]byte("latency:20|ms\nlatency:300|ms|@0.1\nsize:7|h")))
+	require.NoError(t, s.Handle([]byte("users:alice|s\nusers:bob|s\nusers:alice|s")))
+
+	flushed := s.Flush()
+	byKey := make(map[string]Metrics, len(flushed))
+	for _, m := range flushed {
+		byKey[metricKey(m)] = m
+	}
+	require.Len(t, byKey, 6)
+
+	// Значение с частотой выборки 0.5 соответствует двум событиям
+	assert.Equal(t, int64(5), *byKey["counter:requests"].Delta)
+	logins := byKey[`counter:logins,env="prod",region="eu"`]
+	require.NotNil(t, logins.Delta)
+	assert.Equal(t, int64(1), *logins.Delta)
+	assert.Equal(t, 22.0, *byKey["gauge:temperature"].Value)
+
+	latency := byKey["histogram:latency"].Histogram
+	require.NotNil(t, latency)
+	assert.Equal(t, uint64(11), latency.Count)
+	assert.InDelta(t, 3.02, latency.Sum, 1e-9)
+	assert.Equal(t, uint64(1), byKey["histogram:size"].Histogram.Count)
+
+	assert.Equal(t, uint64(2), byKey["set:users"].Set.Sketch.Estimate())
+
+	t.Run("next window", func(t *testing.T) {
+		require.NoError(t, s.Handle([]byte("temperature:+1|g")))
+		flushed := s.Flush()
+		// Неизменившиеся метрики не отправляются повторно
+		require.Len(t, flushed, 1)
+		assert.Equal(t, 23.0, *flushed[0].Value)
+		assert.Empty(t, s.Flush())
+	})
+}
+
+func TestStatsD_CounterRemainder(t *testing.T) {
+	s := NewStatsD()
+	require.NoError(t, s.Handle([]byte("hits:1|c|@0.4")))
+	flushed := s.Flush()
+	require.Len(t, flushed, 1)
+	assert.Equal(t, int64(3), *flushed[0].Delta)
+
+	// Ошибка округления переносится в следующее окно, в сумме 2.5 + 2.5 события
+	require.NoError(t, s.Handle([]byte("hits:1|c|@0.4")))
+	flushed = s.Flush()
+	require.Len(t, flushed, 1)
+	assert.Equal(t, int64(2), *flushed[0].Delta)
+	assert.Empty(t, s.Flush())
+}
+
+func TestStatsD_ForgetsIdleSeries(t *testing.T) {
+	t.Run("counter rounding error", func(t *testing.T) {
+		s := NewStatsD()
+		// Сумма девяти событий с частотой 0.3 равна 29.999999999999996
+		require.NoError(t, s.Handle([]byte(strings.Repeat("hits:1|c|@0.3\n", 9))))
+		require.NotZero(t, 30-s.entries["counter:hits"].count)
+		flushed := s.Flush()
+		require.Len(t, flushed, 1)
+		assert.Equal(t, int64(30), *flushed[0].Delta)
+		// Остаток порядка 1e-15 считается нулем
+		assert.Empty(t, s.entries)
+	})
+
+	t.Run("counter remainder", func(t *testing.T) {
+		s := NewStatsD()
+		require.NoError(t, s.Handle([]byte("hits:1|c|@0.4")))
+		for i := 0; i <= statsdIdleWindows; i++ {
+			s.Flush()
+		}
+		assert.Empty(t, s.entries)
+	})
+
+	t.Run("gauge", func(t *testing.T) {
+		s := NewStatsD()
+		require.NoError(t, s.Handle([]byte("temperature:20|g")))
+		for i := 0; i < statsdIdleWindows; i++ {
+			s.Flush()
+		}
+		// Датчик помнит значение, пока простаивает не дольше statsdIdleWindows окон
+		require.NoError(t, s.Handle([]byte("temperature:+1|g")))
+		flushed := s.Flush()
+		require.Len(t, flushed, 1)
+		assert.Equal(t, 21.0, *flushed[0].Value)
+
+		for i := 0; i < statsdIdleWindows; i++ {
+			assert.Empty(t, s.Flush())
+		}
+		assert.Empty(t, s.entries)
+
+		// Относительное изменение забытого датчика отсчитывается от нуля
+		require.NoError(t, s.Handle([]byte("temperature:+1|g")))
+		flushed = s.Flush()
+		require.Len(t, flushed, 1)
+		assert.Equal(t, 1.0, *flushed[0].Value)
+	})
+}
+
+func TestStatsD_InvalidLines(t *testing.T) {
+	for _, line := range []string{
+		"novalue",
+		":1|c",
+		"requests:1",
+		"requests:abc|c",
+		"requests:1|x",
+		"requests:1|c|@2",
+		"temperature:NaN|g",
+		"requests{host=\"a\"}:1|c",
+		"requests:1|c|#host-name:a",
+		"requests:1|c|#1host:a",
+		"requests:1|c|#__name__:other",
+	} {
+		t.Run(line, func(t *testing.T) {
+			assert.Error(t, NewStatsD().Handle([]byte(line)))
+		})
+	}
+
+	// Корректные строки пакета учитываются несмотря на ошибки
+	s := NewStatsD()
+	assert.Error(t, s.Handle([]byte("bad\nrequests:1|c")))
+	assert.Len(t, s.Flush(), 1)
+}
+
+func TestLogLimiter(t *testing.T) {
+	now := time.Now()
+	l := logLimiter{interval: time.Second}
+
+	skipped, ok := l.allow(now)
+	assert.True(t, ok)
+	assert.Zero(t, skipped)
+	for i := 0; i < 3; i++ {
+		_, ok = l.allow(now.Add(time.Duration(i) * 100 * time.Millisecond))
+		assert.False(t, ok)
+	}
+	// После интервала сообщается число пропущенных сообщений
+	skipped, ok = l.allow(now.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 3, skipped)
+}
+
+func TestStatsD_Serve(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address func(t *testing.T) string
+	}{
+		{"udp", "udp", func(t *testing.T) string { return "127.0.0.1:0" }},
+		{"unixgram", "unixgram", func(t *testing.T) string { return filepath.Join(t.TempDir(), "statsd.sock") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket(tt.network, tt.address(t))
+			require.NoError(t, err)
+
+			s := NewStatsD()
+			done := make(chan error, 1)
+			go func() { done <- s.Serve(conn) }()
+
+			client, err := net.Dial(tt.network, conn.LocalAddr().String())
+			require.NoError(t, err)
+			defer client.Close()
+			_, err = client.Write([]byte("requests:3|c"))
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			jobs := make(chan Metrics, 10)
+			require.Eventually(t, func() bool {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return len(s.entries) == 1
+			}, time.Second, 10*time.Millisecond)
+			cancel()
+			// После отмены контекста последнее окно отправляется в jobs
+			s.Run(ctx, 10, jobs)
+
+			require.Len(t, jobs, 1)
+			m := <-jobs
+			assert.Equal(t, "requests", m.ID)
+			assert.Equal(t, int64(3), *m.Delta)
+
+			require.NoError(t, conn.Close())
+			assert.NoError(t, <-done)
+		})
+	}
+}
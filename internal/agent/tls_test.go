@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/headers"
+	"github.com/antonminaichev/metricscollector/internal/server/grpcserver"
+	"github.com/antonminaichev/metricscollector/internal/server/middleware"
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// writeTestPKI issues a CA, a server certificate for 127.0.0.1 and a client certificate for agent-1.
+// Files are written into a temp dir as ca.crt, server.crt/.pem and agent.crt/.pem.
+func writeTestPKI(t *testing.T) string {
+	dir := t.TempDir()
+	ca, caKey, err := crypto.NewCA("test-ca", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.crt"), crypto.EncodeCertificatePEM(ca), 0644))
+
+	for name, usage := range map[string]crypto.CertUsage{"server": crypto.CertServer, "agent": crypto.CertClient} {
+		cn := name
+		if usage == crypto.CertClient {
+			cn = "agent-1"
+		}
+		cert, key, err := crypto.IssueCertificate(ca, caKey, cn, []string{"127.0.0.1", "bufnet"}, usage, time.Hour)
+		require.NoError(t, err)
+		keyPEM, err := crypto.EncodePrivateKeyPEM(key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), crypto.EncodeCertificatePEM(cert), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), keyPEM, 0600))
+	}
+	return dir
+}
+
+func serverTLS(t *testing.T, dir string) *tls.Config {
+	cfg, err := crypto.ServerTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.pem"), filepath.Join(dir, "ca.crt"))
+	require.NoError(t, err)
+	return cfg
+}
+
+func TestConfigTLSConfig(t *testing.T) {
+	dir := writeTestPKI(t)
+
+	cfg, err := (&Config{}).TLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, cfg)
+
+	cfg, err = (&Config{TLSCA: filepath.Join(dir, "ca.crt")}).TLSConfig()
+	require.NoError(t, err)
+	assert.NotNil(t, cfg.RootCAs)
+	assert.Empty(t, cfg.Certificates)
+
+	_, err = (&Config{TLSCert: filepath.Join(dir, "agent.crt")}).TLSConfig()
+	assert.Error(t, err)
+}
+
+func TestMetricWorker_MutualTLS(t *testing.T) {
+	dir := writeTestPKI(t)
+
+	var identity string
+	server := httptest.NewUnstartedServer(middleware.ClientCertIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = r.Header.Get(headers.AgentID)
+		w.WriteHeader(http.StatusOK)
+	})))
+	server.TLS = serverTLS(t, dir)
+	server.StartTLS()
+	defer server.Close()
+
+	tlsCfg, err := (&Config{
+		TLSCA:   filepath.Join(dir, "ca.crt"),
+		TLSCert: filepath.Join(dir, "agent.crt"),
+		TLSKey:  filepath.Join(dir, "agent.pem"),
+	}).TLSConfig()
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+
+	batches := make(chan []Metrics, 1)
+	batches <- []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(1)}}
+	close(batches)
+
+	pending := NewPendingCounters()
+	MetricWorker(client, server.URL, "", batches, "", pending)
+
+	assert.Empty(t, takeCounters(pending))
+	assert.Equal(t, "agent-1/"+agentID, identity)
+}
+
+func TestGRPCMetricWorker_MutualTLS(t *testing.T) {
+	dir := writeTestPKI(t)
+	s := ms.NewMemoryStorage()
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpcserver.NewServer(s, grpc.Creds(credentials.NewTLS(serverTLS(t, dir))))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	tlsCfg, err := (&Config{
+		TLSCA:   filepath.Join(dir, "ca.crt"),
+		TLSCert: filepath.Join(dir, "agent.crt"),
+		TLSKey:  filepath.Join(dir, "agent.pem"),
+	}).TLSConfig()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	batches := make(chan []Metrics, 1)
+	batches <- []Metrics{{ID: "PollCount", MType: "counter", Delta: ptrInt64(4)}}
+	close(batches)
+
+	pending := NewPendingCounters()
+	GRPCMetricWorker(conn, "", batches, pending)
+
+	assert.Empty(t, takeCounters(pending))
+	delta, _, err := s.GetMetric(context.Background(), storage.SeriesKey("PollCount", agentLabels), storage.Counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *delta)
+}
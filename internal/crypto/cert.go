@@ -0,0 +1,104 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+// CertificateType is the PEM block type of X.509 certificates.
+const CertificateType = "CERTIFICATE"
+
+// CertUsage selects extended key usage of an issued certificate.
+type CertUsage int
+
+// Certificate usages.
+const (
+	CertServer CertUsage = iota
+	CertClient
+)
+
+// certKeyBits is the RSA key size of generated certificates.
+const certKeyBits = 2048
+
+// NewCA creates a self-signed CA certificate for issuing server and agent certificates.
+func NewCA(commonName string, validFor time.Duration) (*x509.Certificate, *rsa.PrivateKey, error) {
+	template, err := certTemplate(commonName, validFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	return createCertificate(template, nil, nil)
+}
+
+// IssueCertificate issues a certificate signed by the CA.
+// Hosts are added as IP or DNS subject alternative names.
+func IssueCertificate(ca *x509.Certificate, caKey *rsa.PrivateKey, commonName string, hosts []string, usage CertUsage, validFor time.Duration) (*x509.Certificate, *rsa.PrivateKey, error) {
+	template, err := certTemplate(commonName, validFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	switch usage {
+	case CertClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	return createCertificate(template, ca, caKey)
+}
+
+// EncodeCertificatePEM encodes a certificate to PEM.
+func EncodeCertificatePEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: CertificateType, Bytes: cert.Raw})
+}
+
+func certTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+// createCertificate signs template with parent, nil parent means a self-signed certificate.
+func createCertificate(template, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, certKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
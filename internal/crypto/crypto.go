@@ -1,14 +1,30 @@
 package crypto
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"os"
 )
 
+// Encryption scheme versions sent in EncryptionHeader.
+// A request without the header is treated as EncryptionV1.
+const (
+	EncryptionHeader = "X-Encryption-Version"
+	EncryptionV1     = "1" // raw RSA PKCS#1 v1.5 over the whole body
+	EncryptionV2     = "2" // AES-256-GCM body with RSA-OAEP wrapped key
+)
+
+// KeyIDHeader carries KeyID of the public key the request body was encrypted with.
+const KeyIDHeader = "X-Key-ID"
+
+const envelopeKeySize = 32
+
 func LoadPublicKey(path string) (*rsa.PublicKey, error) {
 	if path == "" {
 		return nil, nil // отключаем шифрование
@@ -22,6 +38,9 @@ func LoadPublicKey(path string) (*rsa.PublicKey, error) {
 	if block == nil {
 		return nil, errors.New("invalid public key PEM")
 	}
+	if block.Type == PKCS1PublicKeyType {
+		return nil, errors.New("PKCS#1 public key is not supported, export it as PKIX with keytool convert")
+	}
 	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
 		return nil, err
@@ -43,10 +62,17 @@ func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
 	if err != nil {
 		return nil, err
 	}
+	return parsePrivateKeyPEM(data)
+}
+
+func parsePrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, errors.New("invalid private key PEM")
 	}
+	if block.Type == PKCS1PrivateKeyType {
+		return nil, errors.New("PKCS#1 private key is not supported, convert it to PKCS#8 with keytool convert")
+	}
 	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
 		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
 			return rsaKey, nil
@@ -55,6 +81,16 @@ func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
 	return nil, errors.New("not a valid RSA private key")
 }
 
+// KeyID returns a short identifier of the public key.
+// It is the first 16 bytes of the SHA-256 fingerprint of the PKIX encoded key in hex.
+func KeyID(pub *rsa.PublicKey) (string, error) {
+	fp, err := Fingerprint(pub)
+	if err != nil {
+		return "", err
+	}
+	return fp[:32], nil
+}
+
 func EncryptRSA(pub *rsa.PublicKey, data []byte) ([]byte, error) {
 	return rsa.EncryptPKCS1v15(rand.Reader, pub, data)
 }
@@ -62,3 +98,60 @@ func EncryptRSA(pub *rsa.PublicKey, data []byte) ([]byte, error) {
 func DecryptRSA(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
 	return rsa.DecryptPKCS1v15(rand.Reader, priv, data)
 }
+
+// EncryptEnvelope encrypts data of any size with a random AES-256-GCM key wrapped by RSA-OAEP.
+// The result is the wrapped key followed by the GCM nonce and the sealed data.
+func EncryptEnvelope(pub *rsa.PublicKey, data []byte) ([]byte, error) {
+	key := make([]byte, envelopeKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(wrapped)+len(nonce)+len(data)+gcm.Overhead())
+	out = append(out, wrapped...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, nil), nil
+}
+
+// DecryptEnvelope decrypts data produced by EncryptEnvelope.
+func DecryptEnvelope(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
+	keyLen := priv.Size()
+	if len(data) < keyLen {
+		return nil, errors.New("envelope is too short")
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, data[:keyLen], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	rest := data[keyLen:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("envelope is too short")
+	}
+	return gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,160 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyRing holds private keys indexed by KeyID of their public part.
+// It is safe for concurrent use.
+type KeyRing struct {
+	source string
+	mu     sync.RWMutex
+	keys   map[string]*rsa.PrivateKey
+}
+
+// NewKeyRing creates a key ring from already loaded keys.
+func NewKeyRing(keys ...*rsa.PrivateKey) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[string]*rsa.PrivateKey, len(keys))}
+	for _, key := range keys {
+		id, err := KeyID(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = key
+	}
+	return kr, nil
+}
+
+// LoadKeyRing loads private keys from a comma-separated list of paths.
+// A path may point to a PEM file or to a directory, in which case every *.pem file
+// holding a private key is loaded. Empty source disables decryption and returns nil.
+func LoadKeyRing(source string) (*KeyRing, error) {
+	if source == "" {
+		return nil, nil // отключаем шифрование
+	}
+	kr := &KeyRing{source: source}
+	if err := kr.Reload(); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Reload reads keys from the source again, so added keys become available
+// and removed keys are retired. On error the current keys are kept.
+func (kr *KeyRing) Reload() error {
+	if kr.source == "" {
+		return nil
+	}
+	keys, err := loadKeys(kr.source)
+	if err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.mu.Unlock()
+	return nil
+}
+
+// Get returns the private key with the given KeyID.
+func (kr *KeyRing) Get(id string) (*rsa.PrivateKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[id]
+	return key, ok
+}
+
+// IDs returns sorted IDs of all keys in the ring.
+func (kr *KeyRing) IDs() []string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.sortedIDs()
+}
+
+// Keys returns all keys ordered by their IDs.
+func (kr *KeyRing) Keys() []*rsa.PrivateKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	ids := kr.sortedIDs()
+	keys := make([]*rsa.PrivateKey, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, kr.keys[id])
+	}
+	return keys
+}
+
+// sortedIDs returns sorted key IDs, the caller must hold the lock.
+func (kr *KeyRing) sortedIDs() []string {
+	ids := make([]string, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func loadKeys(source string) (map[string]*rsa.PrivateKey, error) {
+	keys := make(map[string]*rsa.PrivateKey)
+	add := func(key *rsa.PrivateKey) error {
+		id, err := KeyID(&key.PublicKey)
+		if err != nil {
+			return err
+		}
+		keys[id] = key
+		return nil
+	}
+
+	for _, path := range strings.Split(source, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			key, err := LoadPrivateKey(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if err := add(key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		files, err := filepath.Glob(filepath.Join(path, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			// В каталоге рядом с приватными ключами могут лежать публичные
+			if !strings.Contains(string(data), "PRIVATE KEY-----") {
+				continue
+			}
+			key, err := parsePrivateKeyPEM(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			if err := add(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no private keys found")
+	}
+	return keys, nil
+}
@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// PEM block types of supported key formats.
+const (
+	PKCS8PrivateKeyType = "PRIVATE KEY"
+	PKCS1PrivateKeyType = "RSA PRIVATE KEY"
+	PKIXPublicKeyType   = "PUBLIC KEY"
+	PKCS1PublicKeyType  = "RSA PUBLIC KEY"
+)
+
+// EncodePrivateKeyPEM encodes the key as PKCS#8 PEM expected by LoadPrivateKey.
+func EncodePrivateKeyPEM(key *rsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PKCS8PrivateKeyType, Bytes: der}), nil
+}
+
+// EncodePublicKeyPEM encodes the key as PKIX PEM expected by LoadPublicKey.
+func EncodePublicKeyPEM(pub *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PKIXPublicKeyType, Bytes: der}), nil
+}
+
+// Fingerprint returns the hex SHA-256 digest of the PKIX encoded public key.
+func Fingerprint(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ParseKeyPEM parses an RSA key in any supported PEM format.
+// Exactly one of the returned keys is set, format is the PEM block type.
+func ParseKeyPEM(data []byte) (priv *rsa.PrivateKey, pub *rsa.PublicKey, format string, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, "", errors.New("invalid key PEM")
+	}
+
+	switch block.Type {
+	case PKCS8PrivateKeyType:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, "", errors.New("not RSA private key")
+		}
+		return rsaKey, nil, block.Type, nil
+	case PKCS1PrivateKeyType:
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return key, nil, block.Type, nil
+	case PKIXPublicKeyType:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, nil, "", errors.New("not RSA public key")
+		}
+		return nil, rsaKey, block.Type, nil
+	case PKCS1PublicKeyType:
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return nil, key, block.Type, nil
+	default:
+		return nil, nil, "", fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
@@ -0,0 +1,31 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// Request signature headers.
+// The signature covers method, path, timestamp, nonce and body, so a captured
+// request can not be replayed outside of the timestamp window or twice within it.
+const (
+	HashHeader      = "HashSHA256"
+	TimestampHeader = "X-Signature-Timestamp"
+	NonceHeader     = "X-Signature-Nonce"
+)
+
+// GRPCMethod is used as the request method when signing gRPC calls,
+// the path is the full gRPC method name and the body is the deterministically marshaled request.
+const GRPCMethod = "GRPC"
+
+// SignRequest returns HMAC-SHA256 of the canonical request representation.
+// Timestamp is a decimal Unix time in seconds.
+func SignRequest(key, method, path, timestamp, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	for _, part := range []string{method, path, timestamp, nonce} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{'\n'})
+	}
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes <name>.crt and <name>.pem into dir.
+func writeCert(t *testing.T, dir, name string, cert *x509.Certificate, key *rsa.PrivateKey) {
+	keyPEM, err := EncodePrivateKeyPEM(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), EncodeCertificatePEM(cert), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), keyPEM, 0600))
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, err := NewCA("test-ca", time.Hour)
+	require.NoError(t, err)
+	writeCert(t, dir, "ca", ca, caKey)
+	cert, key, err := IssueCertificate(ca, caKey, "server", []string{"127.0.0.1", "localhost"}, CertServer, time.Hour)
+	require.NoError(t, err)
+	writeCert(t, dir, "server", cert, key)
+	cert, key, err = IssueCertificate(ca, caKey, "agent-1", nil, CertClient, time.Hour)
+	require.NoError(t, err)
+	writeCert(t, dir, "agent", cert, key)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	serverCfg, err := ServerTLSConfig(path("server.crt"), path("server.pem"), path("ca.crt"))
+	require.NoError(t, err)
+
+	var identity string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = ClientIdentity(r.TLS)
+	}))
+	server.TLS = serverCfg
+	server.StartTLS()
+	defer server.Close()
+
+	t.Run("client certificate identifies agent", func(t *testing.T) {
+		clientCfg, err := ClientTLSConfig(path("ca.crt"), path("agent.crt"), path("agent.pem"))
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "agent-1", identity)
+	})
+
+	t.Run("client without certificate is rejected", func(t *testing.T) {
+		clientCfg, err := ClientTLSConfig(path("ca.crt"), "", "")
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+
+		_, err = client.Get(server.URL)
+		assert.Error(t, err)
+	})
+
+	t.Run("client without CA does not trust server", func(t *testing.T) {
+		clientCfg, err := ClientTLSConfig("", path("agent.crt"), path("agent.pem"))
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+
+		_, err = client.Get(server.URL)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		_, err := ServerTLSConfig(path("missing.crt"), path("server.pem"), "")
+		assert.Error(t, err)
+		_, err = ServerTLSConfig(path("server.crt"), path("server.pem"), path("server.pem"))
+		assert.Error(t, err)
+		_, err = ClientTLSConfig("", path("agent.crt"), "")
+		assert.Error(t, err)
+	})
+
+	t.Run("no identity without verified chain", func(t *testing.T) {
+		assert.Empty(t, ClientIdentity(nil))
+	})
+}
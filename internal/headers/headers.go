@@ -0,0 +1,9 @@
+// Package headers defines HTTP headers shared by the agent, the server handlers and middleware.
+package headers
+
+// Headers identifying a batch for idempotent ingestion.
+const (
+	IdempotencyKey = "Idempotency-Key"
+	AgentID        = "X-Agent-ID"
+	BatchSeq       = "X-Batch-Seq"
+)
@@ -0,0 +1,105 @@
+// Hll package implements HyperLogLog sketches for approximate counting of unique values.
+// The agent and the server hash members the same way, so their sketches can be merged.
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Precision is the number of index bits of sketches, it gives 4096 registers
+// and a standard error of about 1.6%.
+const Precision = 12
+
+// ErrPrecisionMismatch is returned when sketches of different precision are merged.
+var ErrPrecisionMismatch = errors.New("hll: sketches have different precision")
+
+// Sketch is a HyperLogLog sketch, registers keep the maximum rank seen per index.
+type Sketch struct {
+	Precision uint8  `json:"precision"`
+	Registers []byte `json:"registers"`
+}
+
+// New creates an empty sketch.
+func New() *Sketch {
+	return &Sketch{Precision: Precision, Registers: make([]byte, 1<<Precision)}
+}
+
+// Validate checks that the sketch has the supported precision and register count.
+func (s *Sketch) Validate() error {
+	if s.Precision != Precision {
+		return fmt.Errorf("hll: precision %d is not supported, want %d", s.Precision, Precision)
+	}
+	if len(s.Registers) != 1<<Precision {
+		return fmt.Errorf("hll: sketch has %d registers, want %d", len(s.Registers), 1<<Precision)
+	}
+	return nil
+}
+
+// Add counts member in the sketch.
+func (s *Sketch) Add(member string) {
+	x := hash(member)
+	idx := x >> (64 - s.Precision)
+	// Младший бит гарантирует конечный ранг для нулевого остатка
+	rank := byte(bits.LeadingZeros64(x<<s.Precision|1<<(s.Precision-1)) + 1)
+	if rank > s.Registers[idx] {
+		s.Registers[idx] = rank
+	}
+}
+
+// Merge adds members counted by other to the sketch.
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.Precision != other.Precision || len(s.Registers) != len(other.Registers) {
+		return ErrPrecisionMismatch
+	}
+	for i, r := range other.Registers {
+		if r > s.Registers[i] {
+			s.Registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the sketch.
+func (s *Sketch) Clone() *Sketch {
+	registers := make([]byte, len(s.Registers))
+	copy(registers, s.Registers)
+	return &Sketch{Precision: s.Precision, Registers: registers}
+}
+
+// Estimate returns the approximate number of unique members.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(len(s.Registers))
+	var sum float64
+	var zeros int
+	for _, r := range s.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Для малых множеств точнее линейный подсчет по пустым регистрам
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// hash returns a well mixed 64-bit hash of member, it is stable across processes.
+func hash(member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	x := h.Sum64()
+	// Финализатор MurmurHash3 перемешивает биты FNV
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,58 @@
+package hll
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketch_Estimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			s := New()
+			for i := 0; i < n; i++ {
+				s.Add("user-" + strconv.Itoa(i))
+				// Повторы не увеличивают оценку
+				s.Add("user-" + strconv.Itoa(i))
+			}
+			if n == 0 {
+				assert.Equal(t, uint64(0), s.Estimate())
+				return
+			}
+			assert.InEpsilon(t, n, s.Estimate(), 0.05)
+		})
+	}
+}
+
+func TestSketch_Merge(t *testing.T) {
+	a, b := New(), New()
+	for i := 0; i < 3000; i++ {
+		a.Add(strconv.Itoa(i))
+	}
+	for i := 2000; i < 5000; i++ {
+		b.Add(strconv.Itoa(i))
+	}
+
+	require.NoError(t, a.Merge(b))
+	assert.InEpsilon(t, 5000, a.Estimate(), 0.05)
+
+	other := &Sketch{Precision: 10, Registers: make([]byte, 1<<10)}
+	assert.ErrorIs(t, a.Merge(other), ErrPrecisionMismatch)
+	assert.Error(t, other.Validate())
+}
+
+func TestSketch_JSON(t *testing.T) {
+	s := New()
+	s.Add("a")
+	s.Add("b")
+
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+	var decoded Sketch
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.NoError(t, decoded.Validate())
+	assert.Equal(t, s.Estimate(), decoded.Estimate())
+}
@@ -2,10 +2,13 @@
 package logger
 
 import (
+	"context"
 	"net/http"
 	"time"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 )
 
 var Log *zap.Logger = zap.NewNop()
@@ -83,3 +86,17 @@ func WithLogging(h http.Handler) http.Handler {
 	}
 	return http.HandlerFunc(logFn)
 }
+
+// UnaryLoggingInterceptor is the gRPC counterpart of WithLogging.
+func UnaryLoggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	Log.Info("GRPC REQUEST",
+		zap.String("method", info.FullMethod),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("code", status.Code(err).String()),
+	)
+	return resp, err
+}
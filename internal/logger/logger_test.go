@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -8,6 +9,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestInitialize(t *testing.T) {
@@ -200,6 +204,25 @@ func TestWithLogging(t *testing.T) {
 	})
 }
 
+func TestUnaryLoggingInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/metrics.Metrics/ListMetrics"}
+
+	t.Run("passes response through", func(t *testing.T) {
+		resp, err := UnaryLoggingInterceptor(context.Background(), "req", info, func(ctx context.Context, req any) (any, error) {
+			return "resp", nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "resp", resp)
+	})
+
+	t.Run("passes error through", func(t *testing.T) {
+		_, err := UnaryLoggingInterceptor(context.Background(), "req", info, func(ctx context.Context, req any) (any, error) {
+			return nil, status.Error(codes.NotFound, "missing")
+		})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
 func TestResponseData(t *testing.T) {
 	t.Run("initial values", func(t *testing.T) {
 		rd := &responseData{}
@@ -0,0 +1,5 @@
+// Package proto contains the gRPC contract of the metrics service.
+// The code is generated by protoc and plugins of versions pinned in the Makefile.
+package proto
+
+//go:generate make -C ../.. proto
@@ -28,6 +28,7 @@ func DefaultRetryConfig() *RetryConfig {
 }
 
 // IsRetryableError checks if error is retryable.
+// Besides connection errors, deadlocks and serialization failures of concurrent transactions are retried.
 func IsRetryableError(err error) bool {
 	if err == nil {
 		return false
@@ -36,7 +37,11 @@ func IsRetryableError(err error) bool {
 	// PG errors
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
-		return pgErr.Code == pgerrcode.ConnectionException
+		switch pgErr.Code {
+		case pgerrcode.ConnectionException, pgerrcode.DeadlockDetected, pgerrcode.SerializationFailure:
+			return true
+		}
+		return false
 	}
 
 	// Non PG errors
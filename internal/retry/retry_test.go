@@ -47,6 +47,11 @@ func TestIsRetryableError(t *testing.T) {
 		assert.True(t, IsRetryableError(pgErr))
 	})
 
+	t.Run("postgres deadlock and serialization failure are retryable", func(t *testing.T) {
+		assert.True(t, IsRetryableError(&pgconn.PgError{Code: pgerrcode.DeadlockDetected}))
+		assert.True(t, IsRetryableError(&pgconn.PgError{Code: pgerrcode.SerializationFailure}))
+	})
+
 	t.Run("postgres non-connection error is not retryable", func(t *testing.T) {
 		pgErr := &pgconn.PgError{
 			Code: pgerrcode.UniqueViolation,
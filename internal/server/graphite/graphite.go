@@ -0,0 +1,296 @@
+// Package graphite implements a listener for the Graphite plaintext protocol.
+// Every line "path value timestamp" is written to storage.Storage as a gauge, paths matching
+// counter rules are written as counter increments. Graphite tags "path;tag=value" become metric labels.
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/antonminaichev/metricscollector/internal/logger"
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	"go.uber.org/zap"
+)
+
+// Listener limits.
+const (
+	// maxLineLength is the longest accepted line, longer lines are dropped.
+	maxLineLength = 64 * 1024
+	// maxBatchSize limits metrics written to the storage at once.
+	maxBatchSize = 1000
+)
+
+// ErrServerClosed is returned by Serve after Stop.
+var ErrServerClosed = errors.New("graphite: server closed")
+
+// CounterRules decide which Graphite paths are counters. Rules are glob patterns matched
+// against dot separated path nodes, so "stats_counts.*.requests" matches "stats_counts.api.requests"
+// but not "stats_counts.api.v1.requests".
+type CounterRules struct {
+	patterns [][]string
+}
+
+// ParseCounterRules parses a comma separated list of path patterns.
+func ParseCounterRules(s string) (*CounterRules, error) {
+	rules := &CounterRules{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nodes := strings.Split(part, ".")
+		for _, node := range nodes {
+			if _, err := path.Match(node, ""); err != nil {
+				return nil, fmt.Errorf("invalid graphite counter pattern %q: %w", part, err)
+			}
+		}
+		rules.patterns = append(rules.patterns, nodes)
+	}
+	return rules, nil
+}
+
+// Match reports whether the metric path p is a counter, nil rules match nothing.
+func (r *CounterRules) Match(p string) bool {
+	if r == nil {
+		return false
+	}
+	nodes := strings.Split(p, ".")
+	for _, pattern := range r.patterns {
+		if matchNodes(pattern, nodes) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNodes(pattern, nodes []string) bool {
+	if len(pattern) != len(nodes) {
+		return false
+	}
+	for i, node := range nodes {
+		// Шаблоны проверены при разборе правил
+		if ok, _ := path.Match(pattern[i], node); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLine parses a plaintext protocol line into a metric.
+// Counter values must be integers, they are added to the counter. The timestamp is checked
+// but not used, storages keep the latest values.
+func ParseLine(line string, rules *CounterRules) (storage.Metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return storage.Metric{}, fmt.Errorf("want \"path value timestamp\", got %d fields", len(fields))
+	}
+	if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+		return storage.Metric{}, fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+
+	name, labels, err := parsePath(fields[0])
+	if err != nil {
+		return storage.Metric{}, err
+	}
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return storage.Metric{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+
+	m := storage.Metric{ID: name, MType: storage.Gauge, Labels: labels}
+	if rules.Match(name) {
+		if v != math.Trunc(v) || math.Abs(v) >= math.MaxInt64 {
+			return storage.Metric{}, fmt.Errorf("counter value %q is not an integer", fields[1])
+		}
+		delta := int64(v)
+		m.MType = storage.Counter
+		m.Delta = &delta
+	} else {
+		m.Value = &v
+	}
+	return m, m.Validate()
+}
+
+// parsePath splits a tagged path "name;tag1=value1;tag2=value2" into the name and labels.
+func parsePath(p string) (string, map[string]string, error) {
+	parts := strings.Split(p, ";")
+	name := parts[0]
+	if name == "" {
+		return "", nil, errors.New("empty metric path")
+	}
+	var labels map[string]string
+	for _, tag := range parts[1:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return "", nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(parts)-1)
+		}
+		labels[k] = v
+	}
+	if err := storage.ValidateSeries(name, labels); err != nil {
+		return "", nil, err
+	}
+	return name, labels, nil
+}
+
+// Server accepts Graphite plaintext connections and writes received metrics to a storage.
+type Server struct {
+	storage storage.Storage
+	rules   *CounterRules
+	subnets []*net.IPNet
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a Graphite server writing to s.
+// Non-empty subnets restrict clients to these networks.
+func NewServer(s storage.Storage, rules *CounterRules, subnets []*net.IPNet) *Server {
+	return &Server{storage: s, rules: rules, subnets: subnets, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections on lis until Stop is called, it always returns a non-nil error.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		lis.Close()
+		return ErrServerClosed
+	}
+	s.listener = lis
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.trusted(conn.RemoteAddr()) {
+			logger.Log.Warn("Graphite connection from untrusted address", zap.String("remote", conn.RemoteAddr().String()))
+			conn.Close()
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.handle(conn)
+	}
+}
+
+// Stop closes the listener and all connections and waits for connection handlers,
+// metrics of lines read before are still written.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *Server) trusted(addr net.Addr) bool {
+	if len(s.subnets) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, subnet := range s.subnets {
+		if subnet.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle reads lines of a connection, metrics are written in batches of lines received together.
+func (s *Server) handle(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	remote := conn.RemoteAddr().String()
+	r := bufio.NewReaderSize(conn, maxLineLength)
+	var batch []storage.Metric
+	for {
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			logger.Log.Warn("Graphite line is too long", zap.String("remote", remote))
+			// Остаток длинной строки пропускаем
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = r.ReadSlice('\n')
+			}
+			line = nil
+		}
+		if len(strings.TrimSpace(string(line))) > 0 {
+			if m, perr := ParseLine(string(line), s.rules); perr != nil {
+				logger.Log.Debug("Invalid graphite line", zap.String("remote", remote), zap.Error(perr))
+			} else {
+				batch = append(batch, m)
+			}
+		}
+		if err != nil || r.Buffered() == 0 || len(batch) >= maxBatchSize {
+			s.write(batch)
+			batch = batch[:0]
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Log.Warn("Graphite connection error", zap.String("remote", remote), zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) write(batch []storage.Metric) {
+	if len(batch) == 0 {
+		return
+	}
+	// Соединение могло быть закрыто остановкой сервера, полученные метрики все равно записываем
+	if _, err := s.storage.UpdateMetrics(context.Background(), "", batch); err != nil {
+		logger.Log.Error("Failed to write graphite metrics", zap.Int("count", len(batch)), zap.Error(err))
+	}
+}
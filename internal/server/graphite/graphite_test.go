@@ -0,0 +1,153 @@
+package graphite
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterRules(t *testing.T) {
+	rules, err := ParseCounterRules("stats_counts.*, *.requests.count")
+	require.NoError(t, err)
+
+	assert.True(t, rules.Match("stats_counts.logins"))
+	assert.True(t, rules.Match("api.requests.count"))
+	// Звездочка соответствует ровно одному узлу пути
+	assert.False(t, rules.Match("stats_counts.api.logins"))
+	assert.False(t, rules.Match("servers.cpu.load"))
+
+	var empty *CounterRules
+	assert.False(t, empty.Match("stats_counts.logins"))
+
+	_, err = ParseCounterRules("stats.[")
+	assert.Error(t, err)
+}
+
+func TestParseLine(t *testing.T) {
+	rules, err := ParseCounterRules("stats_counts.*")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		line    string
+		want    storage.Metric
+		wantErr bool
+	}{
+		{
+			name: "gauge",
+			line: "servers.web1.cpu 42.5 1700000000\n",
+			want: storage.Metric{ID: "servers.web1.cpu", MType: storage.Gauge, Value: ptrFloat64(42.5)},
+		},
+		{
+			name: "counter",
+			line: "stats_counts.logins 3 1700000000",
+			want: storage.Metric{ID: "stats_counts.logins", MType: storage.Counter, Delta: ptrInt64(3)},
+		},
+		{
+			name: "tags",
+			line: "cpu.load;host=web1;dc=eu 0.7 -1",
+			want: storage.Metric{ID: "cpu.load", MType: storage.Gauge, Value: ptrFloat64(0.7),
+				Labels: map[string]string{"host": "web1", "dc": "eu"}},
+		},
+		{name: "fractional counter", line: "stats_counts.logins 1.5 1700000000", wantErr: true},
+		{name: "missing timestamp", line: "servers.web1.cpu 42.5", wantErr: true},
+		{name: "nan", line: "servers.web1.cpu nan 1700000000", wantErr: true},
+		{name: "bad value", line: "servers.web1.cpu abc 1700000000", wantErr: true},
+		{name: "bad tag", line: "cpu.load;host 1 1700000000", wantErr: true},
+		{name: "reserved tag", line: "cpu.load;__name__=x 1 1700000000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line, rules)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	store := ms.NewMemoryStorage()
+	rules, err := ParseCounterRules("stats_counts.*")
+	require.NoError(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewServer(store, rules, nil)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(lis) }()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(strings.Join([]string{
+		"servers.web1.cpu 10 1700000000",
+		"stats_counts.logins 2 1700000000",
+		"garbage",
+		"servers.web1.cpu 12 1700000060",
+		"stats_counts.logins 3 1700000060",
+		"cpu.load;host=web1 0.5 1700000060",
+		"",
+	}, "\n")))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// Последняя строка записана, значит записаны и предыдущие
+	labelled := storage.SeriesKey("cpu.load", map[string]string{"host": "web1"})
+	require.Eventually(t, func() bool {
+		_, _, err := store.GetMetric(ctx, labelled, storage.Gauge)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	srv.Stop()
+	assert.ErrorIs(t, <-done, ErrServerClosed)
+
+	_, value, err := store.GetMetric(ctx, "servers.web1.cpu", storage.Gauge)
+	require.NoError(t, err)
+	assert.Equal(t, 12.0, *value)
+
+	delta, _, err := store.GetMetric(ctx, "stats_counts.logins", storage.Counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *delta)
+
+	_, value, err = store.GetMetric(ctx, labelled, storage.Gauge)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, *value)
+}
+
+func TestServer_TrustedSubnets(t *testing.T) {
+	store := ms.NewMemoryStorage()
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewServer(store, nil, []*net.IPNet{subnet})
+	go srv.Serve(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("servers.web1.cpu 10 1700000000\n"))
+
+	// Соединение не из доверенной сети закрывается сервером
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	srv.Stop()
+
+	_, gauges, err := store.GetAllMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, gauges)
+}
+
+func ptrInt64(v int64) *int64       { return &v }
+func ptrFloat64(v float64) *float64 { return &v }
@@ -0,0 +1,243 @@
+// Package grpcserver implements the gRPC metrics service on top of storage.Storage.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/hll"
+	pb "github.com/antonminaichev/metricscollector/internal/proto"
+	"github.com/antonminaichev/metricscollector/internal/server/middleware"
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsServer serves metrics over gRPC.
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	storage storage.Storage
+}
+
+// NewMetricsServer creates a new gRPC metrics service backed by s.
+func NewMetricsServer(s storage.Storage) *MetricsServer {
+	return &MetricsServer{storage: s}
+}
+
+// NewServer creates a gRPC server with the metrics service registered.
+func NewServer(s storage.Storage, opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	pb.RegisterMetricsServer(srv, NewMetricsServer(s))
+	return srv
+}
+
+// IsWriteMethod reports whether the full gRPC method name modifies metrics.
+func IsWriteMethod(fullMethod string) bool {
+	return fullMethod == pb.Metrics_UpdateMetrics_FullMethodName
+}
+
+// UpdateMetrics applies a batch of metrics, invalid metrics are skipped as in the HTTP API.
+// Replayed batches are acknowledged without being applied again.
+// Histograms with other bounds than the stored ones are skipped, the rest of the batch is applied.
+func (s *MetricsServer) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	valid := make([]storage.Metric, 0, len(req.GetMetrics()))
+	for _, m := range req.GetMetrics() {
+		metric, ok := fromProto(m)
+		if !ok || metric.ID == "" || metric.Validate() != nil {
+			continue
+		}
+		valid = append(valid, metric)
+	}
+
+	if _, err := s.storage.UpdateMetrics(ctx, batchID(ctx, req.GetBatchId()), valid); err != nil {
+		return nil, status.Error(codes.Internal, "failed to update metrics")
+	}
+
+	resp := &pb.UpdateMetricsResponse{Metrics: make([]*pb.Metric, 0, len(valid))}
+	for _, m := range valid {
+		current, err := s.currentMetric(ctx, m.ID, m.MType, m.Labels)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to fetch updated metric")
+		}
+		resp.Metrics = append(resp.Metrics, toProto(current))
+	}
+	return resp, nil
+}
+
+// GetMetric returns a single metric value.
+// A metric without labels resolves as described in storage.ResolveSeries and is answered with the labels of the series.
+func (s *MetricsServer) GetMetric(ctx context.Context, req *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	mType, ok := metricType(req.GetType())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown metric type: %s", req.GetType())
+	}
+	id, labels := req.GetId(), req.GetLabels()
+	if len(labels) == 0 {
+		key, err := storage.ResolveSeries(ctx, s.storage, id, mType)
+		if errors.Is(err, storage.ErrAmbiguousSeries) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, "failed to find metrics")
+		}
+		if name, keyLabels, err := storage.ParseSeriesKey(key); err == nil {
+			id, labels = name, keyLabels
+		}
+	}
+	metric, err := s.currentMetric(ctx, id, mType, labels)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "metric not found")
+	}
+	return &pb.GetMetricResponse{Metric: toProto(metric)}, nil
+}
+
+// currentMetric reads the current value of a series from the storage.
+func (s *MetricsServer) currentMetric(ctx context.Context, id string, mType storage.MetricType, labels map[string]string) (storage.Metric, error) {
+	metric := storage.Metric{ID: id, MType: mType, Labels: labels}
+	key := storage.SeriesKey(id, labels)
+	var err error
+	switch mType {
+	case storage.Histogram:
+		hr, ok := s.storage.(storage.HistogramReader)
+		if !ok {
+			return metric, storage.ErrHistogramsUnsupported
+		}
+		metric.Histogram, err = hr.GetHistogram(ctx, key)
+	case storage.Summary:
+		sr, ok := s.storage.(storage.SummaryReader)
+		if !ok {
+			return metric, storage.ErrSummariesUnsupported
+		}
+		metric.Summary, err = sr.GetSummary(ctx, key)
+	case storage.Set:
+		sr, ok := s.storage.(storage.SetReader)
+		if !ok {
+			return metric, storage.ErrSetsUnsupported
+		}
+		metric.Set, err = sr.GetSet(ctx, key)
+	default:
+		metric.Delta, metric.Value, err = s.storage.GetMetric(ctx, key, mType)
+	}
+	return metric, err
+}
+
+// ListMetrics returns metrics selected by the match selector, all metrics if it is empty,
+// ordered by type and key.
+func (s *MetricsServer) ListMetrics(ctx context.Context, req *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	var matchers []*storage.Matcher
+	if req.GetMatch() != "" {
+		var err error
+		if matchers, err = storage.ParseSelector(req.GetMatch()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	var series []storage.Metric
+	var err error
+	if sr, ok := s.storage.(storage.SeriesReader); ok {
+		series, err = sr.FindSeries(ctx, matchers)
+	} else {
+		series, err = storage.SelectSeries(ctx, s.storage, matchers)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to fetch metrics")
+	}
+
+	resp := &pb.ListMetricsResponse{Metrics: make([]*pb.Metric, 0, len(series))}
+	for _, m := range series {
+		resp.Metrics = append(resp.Metrics, toProto(m))
+	}
+	return resp, nil
+}
+
+// batchID prefixes the batch ID with the verified client certificate CN, as ClientCertIdentity does for HTTP.
+func batchID(ctx context.Context, id string) string {
+	if id == "" {
+		return ""
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return id
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return id
+	}
+	if cn := crypto.ClientIdentity(&info.State); cn != "" {
+		return middleware.AgentIdentity(cn, id)
+	}
+	return id
+}
+
+func metricType(t pb.Metric_MType) (storage.MetricType, bool) {
+	switch t {
+	case pb.Metric_COUNTER:
+		return storage.Counter, true
+	case pb.Metric_GAUGE:
+		return storage.Gauge, true
+	case pb.Metric_HISTOGRAM:
+		return storage.Histogram, true
+	case pb.Metric_SUMMARY:
+		return storage.Summary, true
+	case pb.Metric_SET:
+		return storage.Set, true
+	default:
+		return "", false
+	}
+}
+
+func protoType(t storage.MetricType) pb.Metric_MType {
+	switch t {
+	case storage.Counter:
+		return pb.Metric_COUNTER
+	case storage.Gauge:
+		return pb.Metric_GAUGE
+	case storage.Histogram:
+		return pb.Metric_HISTOGRAM
+	case storage.Summary:
+		return pb.Metric_SUMMARY
+	case storage.Set:
+		return pb.Metric_SET
+	default:
+		return pb.Metric_MTYPE_UNSPECIFIED
+	}
+}
+
+func fromProto(m *pb.Metric) (storage.Metric, bool) {
+	mType, ok := metricType(m.GetType())
+	if !ok {
+		return storage.Metric{}, false
+	}
+	metric := storage.Metric{ID: m.GetId(), MType: mType, Delta: m.Delta, Value: m.Value, Labels: m.GetLabels(), Member: m.Member}
+	if h := m.GetHistogram(); h != nil {
+		metric.Histogram = &storage.HistogramValue{Bounds: h.GetBounds(), Counts: h.GetCounts(), Sum: h.GetSum(), Count: h.GetCount()}
+	}
+	if sk := m.GetSet().GetSketch(); sk != nil {
+		// Точность вне диапазона uint8 не должна пройти валидацию после приведения
+		precision := uint8(min(sk.GetPrecision(), math.MaxUint8))
+		metric.Set = &storage.SetValue{Sketch: &hll.Sketch{Precision: precision, Registers: sk.GetRegisters()}}
+	}
+	return metric, true
+}
+
+func toProto(m storage.Metric) *pb.Metric {
+	pm := &pb.Metric{Id: m.ID, Type: protoType(m.MType), Delta: m.Delta, Value: m.Value, Labels: m.Labels}
+	if h := m.Histogram; h != nil {
+		pm.Histogram = &pb.Histogram{Bounds: h.Bounds, Counts: h.Counts, Sum: h.Sum, Count: h.Count}
+	}
+	if sm := m.Summary; sm != nil {
+		pm.Summary = &pb.Summary{Count: sm.Count, Sum: sm.Sum, Min: sm.Min, Max: sm.Max}
+		for _, q := range sm.Quantiles {
+			pm.Summary.Quantiles = append(pm.Summary.Quantiles, &pb.Summary_Quantile{Quantile: q.Quantile, Value: q.Value})
+		}
+	}
+	if st := m.Set; st != nil {
+		pm.Set = &pb.Set{Cardinality: st.Cardinality}
+	}
+	return pm
+}
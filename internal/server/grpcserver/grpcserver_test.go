@@ -0,0 +1,269 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	"github.com/antonminaichev/metricscollector/internal/hll"
+	pb "github.com/antonminaichev/metricscollector/internal/proto"
+	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestClient(t *testing.T) pb.MetricsClient {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewServer(ms.NewMemoryStorage())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func TestUpdateMetrics(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	req := &pb.UpdateMetricsRequest{
+		BatchId: "agent/1",
+		Metrics: []*pb.Metric{
+			{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: proto.Int64(5)},
+			{Id: "Alloc", Type: pb.Metric_GAUGE, Value: proto.Float64(1.5)},
+			// Невалидные метрики пропускаются
+			{Id: "NoDelta", Type: pb.Metric_COUNTER},
+			{Id: "NoType", Value: proto.Float64(1)},
+		},
+	}
+
+	resp, err := client.UpdateMetrics(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, resp.GetMetrics(), 2)
+	assert.Equal(t, int64(5), resp.GetMetrics()[0].GetDelta())
+	assert.Equal(t, 1.5, resp.GetMetrics()[1].GetValue())
+
+	t.Run("replayed batch is not applied again", func(t *testing.T) {
+		resp, err := client.UpdateMetrics(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), resp.GetMetrics()[0].GetDelta())
+	})
+
+	t.Run("batch without ID is always applied", func(t *testing.T) {
+		resp, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{
+			Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.Metric_COUNTER, Delta: proto.Int64(1)}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(6), resp.GetMetrics()[0].GetDelta())
+	})
+}
+
+func TestGetMetric(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{
+		Metrics: []*pb.Metric{{Id: "Alloc", Type: pb.Metric_GAUGE, Value: proto.Float64(2)}},
+	})
+	require.NoError(t, err)
+
+	t.Run("existing metric", func(t *testing.T) {
+		resp, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", Type: pb.Metric_GAUGE})
+		require.NoError(t, err)
+		assert.Equal(t, "Alloc", resp.GetMetric().GetId())
+		assert.Equal(t, 2.0, resp.GetMetric().GetValue())
+	})
+
+	t.Run("unknown metric", func(t *testing.T) {
+		_, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Missing", Type: pb.Metric_GAUGE})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestListMetrics(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{
+		Metrics: []*pb.Metric{
+			{Id: "b", Type: pb.Metric_GAUGE, Value: proto.Float64(2)},
+			{Id: "a", Type: pb.Metric_GAUGE, Value: proto.Float64(1)},
+			{Id: "c", Type: pb.Metric_COUNTER, Delta: proto.Int64(3)},
+		},
+	})
+	require.NoError(t, err)
+
+	resp, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+
+	var ids []string
+	for _, m := range resp.GetMetrics() {
+		ids = append(ids, m.GetId())
+	}
+	assert.Equal(t, []string{"c", "a", "b"}, ids)
+}
+
+func TestMetricLabels(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{
+		Metrics: []*pb.Metric{
+			{Id: "cpu", Type: pb.Metric_GAUGE, Value: proto.Float64(10), Labels: map[string]string{"core": "0"}},
+			{Id: "cpu", Type: pb.Metric_GAUGE, Value: proto.Float64(20), Labels: map[string]string{"core": "1"}},
+			{Id: "mem", Type: pb.Metric_GAUGE, Value: proto.Float64(1)},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("get labelled series", func(t *testing.T) {
+		resp, err := client.GetMetric(ctx, &pb.GetMetricRequest{
+			Id: "cpu", Type: pb.Metric_GAUGE, Labels: map[string]string{"core": "1"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 20.0, resp.GetMetric().GetValue())
+		assert.Equal(t, map[string]string{"core": "1"}, resp.GetMetric().GetLabels())
+	})
+
+	t.Run("bare name of a labelled series", func(t *testing.T) {
+		_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+			{Id: "Alloc", Type: pb.Metric_GAUGE, Value: proto.Float64(5), Labels: map[string]string{"host": "h", "instance": "h"}},
+			{Id: "latency", Type: pb.Metric_HISTOGRAM, Labels: map[string]string{"host": "h"},
+				Histogram: &pb.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}},
+		}})
+		require.NoError(t, err)
+
+		resp, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", Type: pb.Metric_GAUGE})
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, resp.GetMetric().GetValue())
+		assert.Equal(t, map[string]string{"host": "h", "instance": "h"}, resp.GetMetric().GetLabels())
+
+		resp, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "latency", Type: pb.Metric_HISTOGRAM})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), resp.GetMetric().GetHistogram().GetCount())
+	})
+
+	t.Run("bare name of several series is ambiguous", func(t *testing.T) {
+		_, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "cpu", Type: pb.Metric_GAUGE})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("list by selector", func(t *testing.T) {
+		resp, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{Match: `cpu{core="0"}`})
+		require.NoError(t, err)
+		require.Len(t, resp.GetMetrics(), 1)
+		assert.Equal(t, 10.0, resp.GetMetrics()[0].GetValue())
+	})
+
+	t.Run("invalid selector", func(t *testing.T) {
+		_, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{Match: "cpu{"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestHistogram(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	report := &pb.Metric{Id: "latency", Type: pb.Metric_HISTOGRAM,
+		Histogram: &pb.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 2}, Sum: 4, Count: 3}}
+	for i := 0; i < 2; i++ {
+		_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{report}})
+		require.NoError(t, err)
+	}
+
+	resp, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "latency", Type: pb.Metric_HISTOGRAM})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 4}, resp.GetMetric().GetHistogram().GetCounts())
+	assert.Equal(t, uint64(6), resp.GetMetric().GetHistogram().GetCount())
+
+	rebucketed := &pb.Metric{Id: "latency", Type: pb.Metric_HISTOGRAM,
+		Histogram: &pb.Histogram{Bounds: []float64{5}, Counts: []uint64{1, 0}, Sum: 1, Count: 1}}
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{rebucketed}})
+	require.NoError(t, err)
+	// Гистограмма с другими границами пропускается, накопленная сохраняется
+	resp, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "latency", Type: pb.Metric_HISTOGRAM})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1}, resp.GetMetric().GetHistogram().GetBounds())
+	assert.Equal(t, uint64(6), resp.GetMetric().GetHistogram().GetCount())
+}
+
+func TestSummary(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	resp, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "rt", Type: pb.Metric_SUMMARY, Value: proto.Float64(1)},
+		{Id: "rt", Type: pb.Metric_SUMMARY, Value: proto.Float64(3)},
+	}})
+	require.NoError(t, err)
+	require.Len(t, resp.GetMetrics(), 2)
+
+	got, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "rt", Type: pb.Metric_SUMMARY})
+	require.NoError(t, err)
+	summary := got.GetMetric().GetSummary()
+	assert.Equal(t, uint64(2), summary.GetCount())
+	assert.Equal(t, 4.0, summary.GetSum())
+	assert.Equal(t, 3.0, summary.GetMax())
+	assert.Len(t, summary.GetQuantiles(), 3)
+}
+
+func TestSet(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	sketch := hll.New()
+	sketch.Add("bob")
+	sketch.Add("carol")
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "users", Type: pb.Metric_SET, Member: proto.String("alice")},
+		{Id: "users", Type: pb.Metric_SET, Set: &pb.Set{Sketch: &pb.HyperLogLog{Precision: uint32(sketch.Precision), Registers: sketch.Registers}}},
+		// Скетч с неподдерживаемой точностью пропускается
+		{Id: "users", Type: pb.Metric_SET, Set: &pb.Set{Sketch: &pb.HyperLogLog{Precision: 4, Registers: make([]byte, 16)}}},
+	}})
+	require.NoError(t, err)
+
+	got, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "users", Type: pb.Metric_SET})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), got.GetMetric().GetSet().GetCardinality())
+}
+
+func TestBatchID(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "agent/1", batchID(ctx, "agent/1"))
+
+	verified := peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "agent-1"}}}},
+	}}})
+	assert.Equal(t, "agent-1/agent/1", batchID(verified, "agent/1"))
+	assert.Empty(t, batchID(verified, ""))
+}
+
+func TestIsWriteMethod(t *testing.T) {
+	assert.True(t, IsWriteMethod(pb.Metrics_UpdateMetrics_FullMethodName))
+	assert.False(t, IsWriteMethod(pb.Metrics_GetMetric_FullMethodName))
+	assert.False(t, IsWriteMethod(pb.Metrics_ListMetrics_FullMethodName))
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+)
+
+// AggCount is the number of series in a group, supported by AggregateSeries only.
+const AggCount = "count"
+
+// DefaultAggregateWithout are the per agent labels dropped by AggregateSeries when no grouping is given.
+var DefaultAggregateWithout = []string{"instance", "host"}
+
+// AggregateGroup is an aggregated value of series sharing the same name, type and grouping labels.
+type AggregateGroup struct {
+	ID     string             `json:"id"`
+	MType  storage.MetricType `json:"type"`
+	Labels map[string]string  `json:"labels,omitempty"`
+	Value  float64            `json:"value"`
+	// Series is the number of series folded into the group.
+	Series int `json:"series"`
+}
+
+// AggregateSeries returns current values of metrics selected by the match query parameter folded across series.
+// Query parameters: match (selector, required), agg (sum, avg, min, max or count, sum by default)
+// and either by (comma separated labels to keep) or without (comma separated labels to drop).
+// Without grouping parameters the instance and host labels are dropped, which gives a cross-instance view.
+func AggregateSeries(rw http.ResponseWriter, r *http.Request, s storage.SeriesReader) {
+	q := r.URL.Query()
+
+	selector := q.Get("match")
+	if selector == "" {
+		http.Error(rw, "Match parameter is required", http.StatusBadRequest)
+		return
+	}
+	matchers, err := storage.ParseSelector(selector)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	agg := q.Get("agg")
+	if agg == "" {
+		agg = AggSum
+	}
+	switch agg {
+	case AggSum, AggAvg, AggMin, AggMax, AggCount:
+	default:
+		http.Error(rw, "Unknown aggregation "+agg, http.StatusBadRequest)
+		return
+	}
+
+	if q.Has("by") && q.Has("without") {
+		http.Error(rw, "Only one of by and without may be set", http.StatusBadRequest)
+		return
+	}
+	groupLabels := func(labels map[string]string) map[string]string {
+		return dropLabels(labels, DefaultAggregateWithout)
+	}
+	if q.Has("by") {
+		by := splitLabelNames(q.Get("by"))
+		groupLabels = func(labels map[string]string) map[string]string {
+			return keepLabels(labels, by)
+		}
+	} else if q.Has("without") {
+		without := splitLabelNames(q.Get("without"))
+		groupLabels = func(labels map[string]string) map[string]string {
+			return dropLabels(labels, without)
+		}
+	}
+
+	series, err := s.FindSeries(r.Context(), matchers)
+	if err != nil {
+		http.Error(rw, "Failed to find metrics", http.StatusInternalServerError)
+		return
+	}
+
+	groups := make(map[string]*AggregateGroup)
+	for _, m := range series {
+		labels := groupLabels(m.Labels)
+		key := string(m.MType) + ":" + storage.SeriesKey(m.ID, labels)
+		v := metricValue(m)
+
+		g, ok := groups[key]
+		if !ok {
+			g = &AggregateGroup{ID: m.ID, MType: m.MType, Labels: labels, Value: v}
+			groups[key] = g
+		} else {
+			switch agg {
+			case AggSum, AggAvg:
+				g.Value += v
+			case AggMin:
+				g.Value = math.Min(g.Value, v)
+			case AggMax:
+				g.Value = math.Max(g.Value, v)
+			}
+		}
+		g.Series++
+	}
+
+	response := make([]AggregateGroup, 0, len(groups))
+	for _, key := range sortedKeys(groups) {
+		g := groups[key]
+		switch agg {
+		case AggAvg:
+			g.Value /= float64(g.Series)
+		case AggCount:
+			g.Value = float64(g.Series)
+		}
+		response = append(response, *g)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		http.Error(rw, "Can't encode response", http.StatusInternalServerError)
+	}
+}
+
+// metricValue returns the current metric value as float, counters report their accumulated delta.
+func metricValue(m storage.Metric) float64 {
+	if m.Delta != nil {
+		return float64(*m.Delta)
+	}
+	if m.Value != nil {
+		return *m.Value
+	}
+	return 0
+}
+
+// splitLabelNames parses a comma separated list of label names.
+func splitLabelNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// keepLabels returns labels restricted to names.
+func keepLabels(labels map[string]string, names []string) map[string]string {
+	kept := make(map[string]string)
+	for _, name := range names {
+		if v, ok := labels[name]; ok {
+			kept[name] = v
+		}
+	}
+	return kept
+}
+
+// dropLabels returns labels without names.
+func dropLabels(labels map[string]string, names []string) map[string]string {
+	kept := make(map[string]string, len(labels))
+	for k, v := range labels {
+		kept[k] = v
+	}
+	for _, name := range names {
+		delete(kept, name)
+	}
+	return kept
+}
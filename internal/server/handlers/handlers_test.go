@@ -7,9 +7,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/antonminaichev/metricscollector/internal/headers"
+	"github.com/antonminaichev/metricscollector/internal/server/influx"
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
 	memstorage "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
 	"github.com/go-chi/chi"
@@ -254,6 +259,64 @@ func TestPostMetricsJSON(t *testing.T) {
 		assert.Len(t, response, 2)
 	})
 
+	t.Run("replayed batch is not applied twice", func(t *testing.T) {
+		metrics := []storage.Metric{
+			{ID: "replayed", MType: storage.Counter, Delta: ptrInt64(3)},
+		}
+		body, _ := json.Marshal(metrics)
+
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			req.Header.Set(headers.AgentID, "agent-1")
+			req.Header.Set(headers.BatchSeq, "7")
+			w := httptest.NewRecorder()
+			PostMetricsJSON(w, req, store)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			var response []storage.Metric
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			require.Len(t, response, 1)
+			assert.Equal(t, int64(3), *response[0].Delta)
+		}
+	})
+
+	t.Run("idempotency key header", func(t *testing.T) {
+		metrics := []storage.Metric{
+			{ID: "keyed", MType: storage.Counter, Delta: ptrInt64(5)},
+		}
+		body, _ := json.Marshal(metrics)
+
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			req.Header.Set(headers.IdempotencyKey, "batch-42")
+			w := httptest.NewRecorder()
+			PostMetricsJSON(w, req, store)
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+
+		delta, _, err := store.GetMetric(context.Background(), "keyed", storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), *delta)
+	})
+
+	t.Run("batches without identity are always applied", func(t *testing.T) {
+		metrics := []storage.Metric{
+			{ID: "anonymous", MType: storage.Counter, Delta: ptrInt64(2)},
+		}
+		body, _ := json.Marshal(metrics)
+
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			PostMetricsJSON(w, req, store)
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+
+		delta, _, err := store.GetMetric(context.Background(), "anonymous", storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), *delta)
+	})
+
 	t.Run("invalid JSON", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader("invalid"))
 		w := httptest.NewRecorder()
@@ -378,7 +441,7 @@ func TestGetMetric(t *testing.T) {
 		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
 
 		w := httptest.NewRecorder()
-		GetMetric(w, req, store)
+		GetMetric(w, req, store, store)
 
 		assert.Equal(t, http.StatusOK, w.Code)
 		assert.Equal(t, "100", w.Body.String())
@@ -392,7 +455,7 @@ func TestGetMetric(t *testing.T) {
 		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
 
 		w := httptest.NewRecorder()
-		GetMetric(w, req, store)
+		GetMetric(w, req, store, store)
 
 		assert.Equal(t, http.StatusOK, w.Code)
 		assert.Equal(t, "99.9", w.Body.String())
@@ -406,7 +469,7 @@ func TestGetMetric(t *testing.T) {
 		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
 
 		w := httptest.NewRecorder()
-		GetMetric(w, req, store)
+		GetMetric(w, req, store, store)
 
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
@@ -419,10 +482,89 @@ func TestGetMetric(t *testing.T) {
 		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
 
 		w := httptest.NewRecorder()
-		GetMetric(w, req, store)
+		GetMetric(w, req, store, store)
 
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
+
+	_ = store.UpdateMetric(ctx, `HeapAlloc{host="a",instance="i1"}`, storage.Gauge, nil, ptrFloat64(42))
+	get := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/value/gauge/"+name, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("type", "gauge")
+		rctx.URLParams.Add("metric", name)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		w := httptest.NewRecorder()
+		GetMetric(w, req, store, store)
+		return w
+	}
+
+	t.Run("bare name resolves to the only labelled series", func(t *testing.T) {
+		w := get("HeapAlloc")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "42", w.Body.String())
+	})
+
+	t.Run("series key", func(t *testing.T) {
+		w := get(`HeapAlloc{host="a",instance="i1"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "42", w.Body.String())
+	})
+
+	t.Run("bare name of several series is ambiguous", func(t *testing.T) {
+		_ = store.UpdateMetric(ctx, `HeapAlloc{host="b",instance="i2"}`, storage.Gauge, nil, ptrFloat64(7))
+		assert.Equal(t, http.StatusBadRequest, get("HeapAlloc").Code)
+	})
+}
+
+func TestGetMetricJSON_BareName(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	ctx := context.Background()
+	agent := map[string]string{"host": "h", "instance": "h"}
+	_ = store.UpdateMetric(ctx, storage.SeriesKey("Alloc", agent), storage.Gauge, nil, ptrFloat64(42))
+	_ = store.UpdateMetric(ctx, storage.SeriesKey("PollCount", agent), storage.Counter, ptrInt64(5), nil)
+	_, err := store.UpdateMetrics(ctx, "", []storage.Metric{{ID: "Latency", MType: storage.Histogram, Labels: agent,
+		Histogram: &storage.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}}})
+	require.NoError(t, err)
+
+	get := func(m storage.Metric) (*httptest.ResponseRecorder, storage.Metric) {
+		body, _ := json.Marshal(m)
+		w := httptest.NewRecorder()
+		GetMetricJSON(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader(body)), store)
+		var response storage.Metric
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		}
+		return w, response
+	}
+
+	t.Run("gauge", func(t *testing.T) {
+		w, response := get(storage.Metric{ID: "Alloc", MType: storage.Gauge})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 42.0, *response.Value)
+		assert.Equal(t, agent, response.Labels)
+	})
+
+	t.Run("counter", func(t *testing.T) {
+		w, response := get(storage.Metric{ID: "PollCount", MType: storage.Counter})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, int64(5), *response.Delta)
+	})
+
+	t.Run("histogram", func(t *testing.T) {
+		w, response := get(storage.Metric{ID: "Latency", MType: storage.Histogram})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NotNil(t, response.Histogram)
+		assert.Equal(t, uint64(1), response.Histogram.Count)
+	})
+
+	t.Run("bare name of several series is ambiguous", func(t *testing.T) {
+		_ = store.UpdateMetric(ctx, storage.SeriesKey("Alloc", map[string]string{"host": "b"}), storage.Gauge, nil, ptrFloat64(7))
+		w, _ := get(storage.Metric{ID: "Alloc", MType: storage.Gauge})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), storage.ErrAmbiguousSeries.Error())
+	})
 }
 
 // Test for HealthCheck
@@ -488,6 +630,477 @@ func TestPrintAllMetrics(t *testing.T) {
 	})
 }
 
+// Test for PrometheusMetrics
+func TestPrometheusMetrics(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	ctx := context.Background()
+	_ = store.UpdateMetric(ctx, "PollCount", storage.Counter, ptrInt64(7), nil)
+	_ = store.UpdateMetric(ctx, "requests_total", storage.Counter, ptrInt64(3), nil)
+	_ = store.UpdateMetric(ctx, "Alloc", storage.Gauge, nil, ptrFloat64(1.5))
+	_ = store.UpdateMetric(ctx, "cpu.0-load", storage.Gauge, nil, ptrFloat64(0.25))
+
+	t.Run("text format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		w := httptest.NewRecorder()
+		PrometheusMetrics(w, req, store)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, PrometheusTextContentType, w.Header().Get("Content-Type"))
+		assert.Equal(t, `# HELP PollCount_total Counter PollCount.
+# TYPE PollCount_total counter
+PollCount_total 7
+# HELP requests_total Counter requests_total.
+# TYPE requests_total counter
+requests_total 3
+# HELP Alloc Gauge Alloc.
+# TYPE Alloc gauge
+Alloc 1.5
+# HELP cpu_0_load Gauge cpu.0-load.
+# TYPE cpu_0_load gauge
+cpu_0_load 0.25
+`, w.Body.String())
+	})
+
+	t.Run("openmetrics format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+		w := httptest.NewRecorder()
+		PrometheusMetrics(w, req, store)
+
+		assert.Equal(t, OpenMetricsContentType, w.Header().Get("Content-Type"))
+		body := w.Body.String()
+		assert.Contains(t, body, "# TYPE PollCount counter\nPollCount_total 7\n")
+		assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+	})
+
+	t.Run("text preferred over openmetrics", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text;q=0.3,text/plain")
+		w := httptest.NewRecorder()
+		PrometheusMetrics(w, req, store)
+
+		assert.Equal(t, PrometheusTextContentType, w.Header().Get("Content-Type"))
+	})
+}
+
+func TestPrometheusMetrics_Labels(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	ctx := context.Background()
+	_ = store.UpdateMetric(ctx, storage.SeriesKey("CPU", map[string]string{"cpu": "1", "host": "a"}), storage.Gauge, nil, ptrFloat64(20))
+	_ = store.UpdateMetric(ctx, storage.SeriesKey("CPU", map[string]string{"cpu": "0", "host": "a"}), storage.Gauge, nil, ptrFloat64(10))
+	_ = store.UpdateMetric(ctx, storage.SeriesKey("PollCount", map[string]string{"host": "a"}), storage.Counter, ptrInt64(2), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	PrometheusMetrics(w, req, store)
+
+	// Серии с разными метками объединяются в одно семейство
+	assert.Equal(t, `# HELP PollCount_total Counter PollCount.
+# TYPE PollCount_total counter
+PollCount_total{host="a"} 2
+# HELP CPU Gauge CPU.
+# TYPE CPU gauge
+CPU{cpu="0",host="a"} 10
+CPU{cpu="1",host="a"} 20
+`, w.Body.String())
+}
+
+func TestPrometheusMetrics_Histogram(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	_, err := store.UpdateMetrics(context.Background(), "", []storage.Metric{{
+		ID: "Latency", MType: storage.Histogram, Labels: map[string]string{"host": "a"},
+		Histogram: &storage.HistogramValue{Bounds: []float64{0.1, 1}, Counts: []uint64{2, 1, 1}, Sum: 3.5, Count: 4},
+	}})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	PrometheusMetrics(w, req, store)
+
+	// Бакеты выводятся нарастающим итогом
+	assert.Equal(t, `# HELP Latency Histogram Latency.
+# TYPE Latency histogram
+Latency_bucket{host="a",le="0.1"} 2
+Latency_bucket{host="a",le="1"} 3
+Latency_bucket{host="a",le="+Inf"} 4
+Latency_sum{host="a"} 3.5
+Latency_count{host="a"} 4
+`, w.Body.String())
+}
+
+func TestPrometheusMetrics_ReservedLabels(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	v := 0.5
+	_, err := store.UpdateMetrics(context.Background(), "", []storage.Metric{
+		{ID: "Latency", MType: storage.Histogram, Labels: map[string]string{"le": "user"},
+			Histogram: &storage.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}},
+		{ID: "RT", MType: storage.Summary, Labels: map[string]string{"quantile": "user"}, Value: &v},
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	PrometheusMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), store)
+	body := w.Body.String()
+
+	// Пользовательские метки le и quantile не перезаписываются служебными
+	assert.Contains(t, body, `Latency_bucket{exported_le="user",le="1"} 1`+"\n")
+	assert.Contains(t, body, `Latency_bucket{exported_le="user",le="+Inf"} 1`+"\n")
+	assert.Contains(t, body, `Latency_count{exported_le="user"} 1`+"\n")
+	assert.Contains(t, body, `RT{exported_quantile="user",quantile="0.5"} `)
+	assert.Contains(t, body, `RT_count{exported_quantile="user"} 1`+"\n")
+}
+
+func TestSummary(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	for _, v := range []float64{0.1, 0.2, 0.3} {
+		body, _ := json.Marshal(storage.Metric{ID: "Latency", MType: storage.Summary, Value: &v})
+		w := httptest.NewRecorder()
+		PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	t.Run("json value", func(t *testing.T) {
+		body, _ := json.Marshal(storage.Metric{ID: "Latency", MType: storage.Summary})
+		w := httptest.NewRecorder()
+		GetMetricJSON(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader(body)), store)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response storage.Metric
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.NotNil(t, response.Summary)
+		assert.Equal(t, uint64(3), response.Summary.Count)
+		assert.Equal(t, 0.1, response.Summary.Min)
+		assert.Equal(t, 0.3, response.Summary.Max)
+		// Внутреннее состояние оценщика наружу не отдается
+		assert.Nil(t, response.Summary.Sketch)
+	})
+
+	t.Run("prometheus", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		PrometheusMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), store)
+		body := w.Body.String()
+		assert.Contains(t, body, "# TYPE Latency summary\n")
+		assert.Contains(t, body, `Latency{quantile="0.5"} `)
+		assert.Contains(t, body, `Latency{quantile="0.99"} `)
+		assert.Contains(t, body, "Latency_count 3\n")
+	})
+
+	t.Run("observation is required", func(t *testing.T) {
+		body, _ := json.Marshal(storage.Metric{ID: "Latency", MType: storage.Summary})
+		w := httptest.NewRecorder()
+		PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestSet(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	for _, member := range []string{"alice", "bob", "alice"} {
+		body, _ := json.Marshal(storage.Metric{ID: "Users", MType: storage.Set, Member: &member})
+		w := httptest.NewRecorder()
+		PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	t.Run("json value", func(t *testing.T) {
+		body, _ := json.Marshal(storage.Metric{ID: "Users", MType: storage.Set})
+		w := httptest.NewRecorder()
+		GetMetricJSON(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader(body)), store)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response storage.Metric
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.NotNil(t, response.Set)
+		assert.Equal(t, uint64(2), response.Set.Cardinality)
+		// Регистры скетча наружу не отдаются
+		assert.Nil(t, response.Set.Sketch)
+	})
+
+	t.Run("prometheus", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		PrometheusMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), store)
+		body := w.Body.String()
+		assert.Contains(t, body, "# TYPE Users gauge\n")
+		assert.Contains(t, body, "Users 2\n")
+	})
+
+	t.Run("member is required", func(t *testing.T) {
+		body, _ := json.Marshal(storage.Metric{ID: "Users", MType: storage.Set})
+		w := httptest.NewRecorder()
+		PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestInfluxWrite(t *testing.T) {
+	mapping, err := influx.ParseMapping("net_*_total", "cpu")
+	require.NoError(t, err)
+
+	t.Run("writes points", func(t *testing.T) {
+		store := memstorage.NewMemoryStorage()
+		body := strings.Join([]string{
+			"# комментарии и пустые строки пропускаются",
+			"",
+			"cpu,cpu=cpu0,host=web1 usage_idle=97.5,usage_user=1i 1700000000000000000",
+			"net,host=web1 bytes_total=42i,up=true",
+			"net,host=web1 bytes_total=50i,status=\"ok\"",
+		}, "\n")
+		w := httptest.NewRecorder()
+		InfluxWrite(w, httptest.NewRequest(http.MethodPost, "/api/v2/write?org=o&bucket=b&precision=ns", strings.NewReader(body)), store, mapping)
+		require.Equal(t, http.StatusNoContent, w.Code)
+
+		web1 := map[string]string{"host": "web1"}
+		_, value, err := store.GetMetric(context.Background(), storage.SeriesKey("cpu_cpu0_usage_idle", web1), storage.Gauge)
+		require.NoError(t, err)
+		assert.Equal(t, 97.5, *value)
+		_, value, err = store.GetMetric(context.Background(), storage.SeriesKey("net_up", web1), storage.Gauge)
+		require.NoError(t, err)
+		assert.Equal(t, 1.0, *value)
+		// Счетчики накопительные, записывается прирост с первой точки
+		delta, _, err := store.GetMetric(context.Background(), storage.SeriesKey("net_bytes_total", web1), storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(8), *delta)
+	})
+
+	t.Run("successive cumulative writes", func(t *testing.T) {
+		store := memstorage.NewMemoryStorage()
+		for _, total := range []string{"100", "250", "400"} {
+			w := httptest.NewRecorder()
+			InfluxWrite(w, httptest.NewRequest(http.MethodPost, "/api/v2/write", strings.NewReader("net,host=web2 bytes_total="+total+"i\n")), store, mapping)
+			require.Equal(t, http.StatusNoContent, w.Code)
+		}
+
+		delta, _, err := store.GetMetric(context.Background(), storage.SeriesKey("net_bytes_total", map[string]string{"host": "web2"}), storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(300), *delta)
+	})
+
+	t.Run("partial write", func(t *testing.T) {
+		store := memstorage.NewMemoryStorage()
+		body := "mem used=10\nmem used\n"
+		w := httptest.NewRecorder()
+		InfluxWrite(w, httptest.NewRequest(http.MethodPost, "/api/v2/write", strings.NewReader(body)), store, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "line 2")
+
+		// Корректные строки записываются
+		_, value, err := store.GetMetric(context.Background(), "mem_used", storage.Gauge)
+		require.NoError(t, err)
+		assert.Equal(t, 10.0, *value)
+	})
+
+	t.Run("invalid precision", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		InfluxWrite(w, httptest.NewRequest(http.MethodPost, "/api/v2/write?precision=h", strings.NewReader("mem used=1")), memstorage.NewMemoryStorage(), nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestHistogramJSON(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	report := storage.Metric{ID: "Latency", MType: storage.Histogram,
+		Histogram: &storage.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1, 1}, Sum: 2.5, Count: 2}}
+
+	t.Run("single update merges reports", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			body, _ := json.Marshal(report)
+			w := httptest.NewRecorder()
+			PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+
+		body, _ := json.Marshal(storage.Metric{ID: "Latency", MType: storage.Histogram})
+		w := httptest.NewRecorder()
+		GetMetricJSON(w, httptest.NewRequest(http.MethodPost, "/value/", bytes.NewReader(body)), store)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response storage.Metric
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.NotNil(t, response.Histogram)
+		assert.Equal(t, []uint64{2, 2}, response.Histogram.Counts)
+		assert.Equal(t, 5.0, response.Histogram.Sum)
+	})
+
+	t.Run("batch update", func(t *testing.T) {
+		body, _ := json.Marshal([]storage.Metric{report})
+		w := httptest.NewRecorder()
+		PostMetricsJSON(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body)), store)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response []storage.Metric
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Len(t, response, 1)
+		assert.Equal(t, uint64(6), response[0].Histogram.Count)
+	})
+
+	t.Run("invalid histogram", func(t *testing.T) {
+		invalid := report
+		invalid.Histogram = &storage.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1}, Count: 1}
+		body, _ := json.Marshal(invalid)
+		w := httptest.NewRecorder()
+		PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("other bounds", func(t *testing.T) {
+		rebucketed := report
+		rebucketed.Histogram = &storage.HistogramValue{Bounds: []float64{5}, Counts: []uint64{1, 0}, Sum: 1, Count: 1}
+		body, _ := json.Marshal(rebucketed)
+		w := httptest.NewRecorder()
+		PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		// В пакете пропускается только гистограмма с другими границами
+		body, _ = json.Marshal([]storage.Metric{rebucketed, {ID: "PollCount", MType: storage.Counter, Delta: ptrInt64(2)}})
+		w = httptest.NewRecorder()
+		PostMetricsJSON(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body)), store)
+		assert.Equal(t, http.StatusOK, w.Code)
+		delta, _, err := store.GetMetric(context.Background(), "PollCount", storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), *delta)
+
+		// Накопленная гистограмма не заменяется
+		h, err := store.GetHistogram(context.Background(), "Latency")
+		require.NoError(t, err)
+		assert.Equal(t, []float64{1}, h.Bounds)
+		assert.Equal(t, uint64(6), h.Count)
+	})
+}
+
+func TestPostMetricJSON_Labels(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	post := func(m storage.Metric) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(m)
+		w := httptest.NewRecorder()
+		PostMetricJSON(w, httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body)), store)
+		return w
+	}
+
+	w := post(storage.Metric{ID: "Alloc", MType: storage.Gauge, Value: ptrFloat64(1), Labels: map[string]string{"host": "a"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	var response storage.Metric
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"host": "a"}, response.Labels)
+
+	require.Equal(t, http.StatusOK, post(storage.Metric{ID: "Alloc", MType: storage.Gauge, Value: ptrFloat64(2), Labels: map[string]string{"host": "b"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, post(storage.Metric{ID: "Alloc", MType: storage.Gauge, Value: ptrFloat64(3), Labels: map[string]string{"bad-name": "x"}}).Code)
+
+	// Одинаковые имена с разными метками не перезаписывают друг друга
+	_, a, err := store.GetMetric(context.Background(), `Alloc{host="a"}`, storage.Gauge)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *a)
+	_, b, err := store.GetMetric(context.Background(), `Alloc{host="b"}`, storage.Gauge)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *b)
+}
+
+func TestFindSeries(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	ctx := context.Background()
+	_ = store.UpdateMetric(ctx, `Alloc{host="a"}`, storage.Gauge, nil, ptrFloat64(1))
+	_ = store.UpdateMetric(ctx, `Alloc{host="b"}`, storage.Gauge, nil, ptrFloat64(2))
+	_ = store.UpdateMetric(ctx, `PollCount{host="a"}`, storage.Counter, ptrInt64(3), nil)
+
+	find := func(query string) (*httptest.ResponseRecorder, []storage.Metric) {
+		w := httptest.NewRecorder()
+		FindSeries(w, httptest.NewRequest(http.MethodGet, "/api/v1/series?"+query, nil), store)
+		var series []storage.Metric
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&series))
+		}
+		return w, series
+	}
+
+	w, series := find(`match=` + url.QueryEscape(`Alloc{host=~"a|b"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, series, 2)
+	assert.Equal(t, map[string]string{"host": "b"}, series[1].Labels)
+
+	// Результаты нескольких селекторов объединяются без повторов
+	w, series = find(`match=` + url.QueryEscape(`{host="a"}`) + `&match=Alloc`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, series, 3)
+
+	w, _ = find("")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = find(`match=` + url.QueryEscape(`Alloc{host=`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAggregateSeries(t *testing.T) {
+	store := memstorage.NewMemoryStorage()
+	ctx := context.Background()
+	_ = store.UpdateMetric(ctx, `Alloc{host="a",instance="a"}`, storage.Gauge, nil, ptrFloat64(1))
+	_ = store.UpdateMetric(ctx, `Alloc{host="b",instance="b"}`, storage.Gauge, nil, ptrFloat64(3))
+	_ = store.UpdateMetric(ctx, `CPUutilization{cpu="0",instance="a"}`, storage.Gauge, nil, ptrFloat64(10))
+	_ = store.UpdateMetric(ctx, `CPUutilization{cpu="1",instance="a"}`, storage.Gauge, nil, ptrFloat64(30))
+	_ = store.UpdateMetric(ctx, `CPUutilization{cpu="0",instance="b"}`, storage.Gauge, nil, ptrFloat64(50))
+	_ = store.UpdateMetric(ctx, `PollCount{instance="a"}`, storage.Counter, ptrInt64(2), nil)
+	_ = store.UpdateMetric(ctx, `PollCount{instance="b"}`, storage.Counter, ptrInt64(5), nil)
+
+	aggregate := func(query string) (*httptest.ResponseRecorder, []AggregateGroup) {
+		w := httptest.NewRecorder()
+		AggregateSeries(w, httptest.NewRequest(http.MethodGet, "/api/v1/aggregate?"+query, nil), store)
+		var groups []AggregateGroup
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&groups))
+		}
+		return w, groups
+	}
+
+	t.Run("sum across instances by default", func(t *testing.T) {
+		w, groups := aggregate("match=Alloc")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, groups, 1)
+		assert.Equal(t, AggregateGroup{ID: "Alloc", MType: storage.Gauge, Value: 4, Series: 2}, groups[0])
+
+		w, groups = aggregate("match=PollCount")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, groups, 1)
+		assert.Equal(t, 7.0, groups[0].Value)
+	})
+
+	t.Run("other labels are kept", func(t *testing.T) {
+		w, groups := aggregate("match=CPUutilization&agg=avg")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, groups, 2)
+		assert.Equal(t, map[string]string{"cpu": "0"}, groups[0].Labels)
+		assert.Equal(t, 30.0, groups[0].Value)
+		assert.Equal(t, 30.0, groups[1].Value)
+	})
+
+	t.Run("by", func(t *testing.T) {
+		w, groups := aggregate("match=CPUutilization&agg=max&by=instance")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, groups, 2)
+		assert.Equal(t, map[string]string{"instance": "a"}, groups[0].Labels)
+		assert.Equal(t, 30.0, groups[0].Value)
+		assert.Equal(t, 50.0, groups[1].Value)
+	})
+
+	t.Run("without", func(t *testing.T) {
+		w, groups := aggregate("match=CPUutilization&agg=count&without=cpu,instance")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, groups, 1)
+		assert.Equal(t, 3.0, groups[0].Value)
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, query := range []string{
+			"",
+			"match=" + url.QueryEscape("Alloc{"),
+			"match=Alloc&agg=rate",
+			"match=Alloc&by=cpu&without=instance",
+		} {
+			w, _ := aggregate(query)
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+}
+
+func TestPrometheusName(t *testing.T) {
+	assert.Equal(t, "Alloc", PrometheusName("Alloc"))
+	assert.Equal(t, "cpu_0_load", PrometheusName("cpu.0-load"))
+	assert.Equal(t, "_9lives", PrometheusName("9lives"))
+	assert.Equal(t, "_", PrometheusName(""))
+}
+
 // Examples (keeping existing ones)
 
 func ExamplePostMetricJSON() {
@@ -652,3 +1265,164 @@ func ExampleHealthCheck() {
 
 	// Output: Status: 200, Body: {"status": "ok"}
 }
+
+type staticHistory []storage.Sample
+
+func (h staticHistory) GetHistory(_ context.Context, _ string, _ storage.MetricType, from, to time.Time) ([]storage.Sample, error) {
+	var samples []storage.Sample
+	for _, s := range h {
+		if !s.Time.Before(from) && !s.Time.After(to) {
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+func TestQueryRange(t *testing.T) {
+	base := time.Unix(1_700_000_040, 0).UTC() // кратно 60 секундам
+	gauges := staticHistory{
+		{Time: base.Add(5 * time.Second), Value: ptrFloat64(1)},
+		{Time: base.Add(35 * time.Second), Value: ptrFloat64(3)},
+		{Time: base.Add(65 * time.Second), Value: ptrFloat64(10)},
+	}
+	counters := staticHistory{
+		{Time: base.Add(-30 * time.Second), Delta: ptrInt64(100)},
+		{Time: base.Add(30 * time.Second), Delta: ptrInt64(160)},
+		{Time: base.Add(90 * time.Second), Delta: ptrInt64(40)}, // сброс счетчика
+	}
+
+	series := memstorage.NewMemoryStorage()
+	query := func(h storage.HistoryReader, params string) (*httptest.ResponseRecorder, QueryRangeResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+params, nil)
+		rec := httptest.NewRecorder()
+		QueryRange(rec, req, h, series)
+		var resp QueryRangeResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return rec, resp
+	}
+	from, to := strconv.FormatInt(base.Unix(), 10), strconv.FormatInt(base.Add(2*time.Minute).Unix(), 10)
+	rangeParams := "&from=" + from + "&to=" + to + "&step=60"
+
+	tests := []struct {
+		name    string
+		history staticHistory
+		params  string
+		want    []float64
+	}{
+		{"avg", gauges, "id=g&type=gauge&agg=avg", []float64{2, 10}},
+		{"min", gauges, "id=g&type=gauge&agg=min", []float64{1, 10}},
+		{"max", gauges, "id=g&type=gauge&agg=max", []float64{3, 10}},
+		{"sum", gauges, "id=g&type=gauge&agg=sum", []float64{4, 10}},
+		{"last by default", gauges, "id=g&type=gauge", []float64{3, 10}},
+		{"rate uses previous sample and handles reset", counters, "id=c&type=counter&agg=rate", []float64{1, 40.0 / 60}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resp := query(tt.history, tt.params+rangeParams)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			require.Len(t, resp.Points, len(tt.want))
+			for i, want := range tt.want {
+				assert.InDelta(t, want, resp.Points[i].Value, 1e-9)
+				assert.True(t, base.Add(time.Duration(i)*time.Minute).Equal(resp.Points[i].Time))
+			}
+			assert.Equal(t, 60.0, resp.Step)
+		})
+	}
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, params := range []string{
+			"type=gauge",
+			"id=g&match=g&type=gauge",
+			"match=g{&type=gauge",
+			"id=g&type=histogram",
+			"id=g&type=gauge&agg=rate",
+			"id=g&type=gauge&agg=median",
+			"id=g&type=gauge&step=0.1",
+			"id=g&type=gauge&from=2&to=1",
+			"id=g&type=gauge&from=yesterday",
+			"id=g&type=gauge&from=0&to=1000000&step=1",
+		} {
+			rec, _ := query(gauges, params)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, params)
+		}
+	})
+
+	t.Run("RFC 3339 bounds and duration step", func(t *testing.T) {
+		rec, resp := query(gauges, "id=g&type=gauge&step=1m&from="+base.Format(time.RFC3339)+"&to="+base.Add(time.Minute).Format(time.RFC3339))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, resp.Points, 1)
+	})
+
+	t.Run("series resolution", func(t *testing.T) {
+		ctx := context.Background()
+		require.NoError(t, series.UpdateMetric(ctx, `g{host="a"}`, storage.Gauge, nil, ptrFloat64(1)))
+
+		rec, resp := query(gauges, "id=g&type=gauge")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Equal(t, `g{host="a"}`, resp.ID)
+
+		rec, resp = query(gauges, "match="+url.QueryEscape(`g{host="a"}`)+"&type=gauge")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Equal(t, `g{host="a"}`, resp.ID)
+
+		rec, _ = query(gauges, "match="+url.QueryEscape(`g{host="c"}`)+"&type=gauge")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		require.NoError(t, series.UpdateMetric(ctx, `g{host="b"}`, storage.Gauge, nil, ptrFloat64(2)))
+		rec, _ = query(gauges, "id=g&type=gauge")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+type staticRollups map[storage.Resolution][]storage.Rollup
+
+func (r staticRollups) GetRollups(_ context.Context, _ string, _ storage.MetricType, res storage.Resolution, _, _ time.Time) ([]storage.Rollup, error) {
+	rollups, ok := r[res]
+	if !ok {
+		return nil, storage.ErrRollupsDisabled
+	}
+	return rollups, nil
+}
+
+func TestQueryRollups(t *testing.T) {
+	base := time.Unix(1_700_000_040, 0).UTC()
+	rollups := staticRollups{
+		storage.RollupMinute: {{Time: base, Min: 1, Max: 3, Avg: 2, Count: 2, Last: 3}},
+	}
+
+	query := func(params string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/rollups?"+params, nil)
+		rec := httptest.NewRecorder()
+		QueryRollups(rec, req, rollups, memstorage.NewMemoryStorage())
+		return rec
+	}
+
+	t.Run("returns minute rollups by default", func(t *testing.T) {
+		rec := query("id=g&type=gauge")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var resp RollupsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, storage.RollupMinute, resp.Resolution)
+		require.Len(t, resp.Rollups, 1)
+		assert.Equal(t, int64(2), resp.Rollups[0].Count)
+		assert.Equal(t, 2.0, resp.Rollups[0].Avg)
+	})
+
+	t.Run("disabled resolution", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotImplemented, query("id=g&type=gauge&resolution=1h").Code)
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, params := range []string{
+			"type=gauge",
+			"id=g&type=gauge&resolution=5m",
+			"id=g&type=gauge&from=2&to=1",
+			"id=g&type=gauge&from=0&to=1000000000",
+		} {
+			assert.Equal(t, http.StatusBadRequest, query(params).Code, params)
+		}
+	})
+}
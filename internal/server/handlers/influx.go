@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/antonminaichev/metricscollector/internal/server/influx"
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+)
+
+// maxInfluxLineLength is the longest accepted line protocol line.
+const maxInfluxLineLength = 1024 * 1024
+
+// influxError is the error body of the InfluxDB v2 API.
+type influxError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// InfluxWrite stores points of an InfluxDB v2 /api/v2/write request body in line protocol.
+// The org and bucket parameters are accepted and ignored, timestamps are validated but not stored.
+// Valid lines are written even if some lines fail to parse, the failures are then reported with 400
+// as InfluxDB does for partial writes. Nil mapping writes all fields as gauges with tags as labels.
+// Clients authenticate with the server key as an InfluxDB token, see middleware.HashHandler.
+func InfluxWrite(rw http.ResponseWriter, r *http.Request, s storage.BatchWriter, mapping *influx.Mapping) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if precision := r.URL.Query().Get("precision"); !influx.ValidPrecision(precision) {
+		writeInfluxError(rw, http.StatusBadRequest, "invalid", "invalid precision "+precision)
+		return
+	}
+
+	var metrics []storage.Metric
+	var failures []string
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxInfluxLineLength)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := influx.ParseLine(line)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("line %d: %v", n, err))
+			continue
+		}
+		pointMetrics, err := mapping.Metrics(point)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("line %d: %v", n, err))
+			continue
+		}
+		metrics = append(metrics, pointMetrics...)
+	}
+	if err := scanner.Err(); err != nil {
+		writeInfluxError(rw, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	if len(metrics) > 0 {
+		if _, err := s.UpdateMetrics(r.Context(), "", metrics); err != nil {
+			writeInfluxError(rw, http.StatusInternalServerError, "internal error", "failed to write metrics")
+			return
+		}
+	}
+	if len(failures) > 0 {
+		writeInfluxError(rw, http.StatusBadRequest, "invalid", fmt.Sprintf("partial write: %s", strings.Join(failures, "; ")))
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func writeInfluxError(rw http.ResponseWriter, status int, code, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(influxError{Code: code, Message: message})
+}
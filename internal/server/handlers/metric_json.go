@@ -2,9 +2,12 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"slices"
 
+	"github.com/antonminaichev/metricscollector/internal/headers"
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
 )
 
@@ -26,10 +29,16 @@ func PostMetricJSON(rw http.ResponseWriter, r *http.Request, s storage.Storage)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if err := storage.ValidateSeries(metric.ID, metric.Labels); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var response storage.Metric
 	response.ID = metric.ID
 	response.MType = metric.MType
+	response.Labels = metric.Labels
+	key := metric.Key()
 
 	switch metric.MType {
 	case storage.Counter:
@@ -37,11 +46,11 @@ func PostMetricJSON(rw http.ResponseWriter, r *http.Request, s storage.Storage)
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if err := s.UpdateMetric(r.Context(), metric.ID, storage.Counter, metric.Delta, nil); err != nil {
+		if err := s.UpdateMetric(r.Context(), key, storage.Counter, metric.Delta, nil); err != nil {
 			http.Error(rw, "Failed to update counter", http.StatusInternalServerError)
 			return
 		}
-		delta, _, err := s.GetMetric(r.Context(), metric.ID, storage.Counter)
+		delta, _, err := s.GetMetric(r.Context(), key, storage.Counter)
 		if err != nil {
 			http.Error(rw, "Failed to fetch updated metric", http.StatusInternalServerError)
 			return
@@ -53,17 +62,38 @@ func PostMetricJSON(rw http.ResponseWriter, r *http.Request, s storage.Storage)
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if err := s.UpdateMetric(r.Context(), metric.ID, storage.Gauge, nil, metric.Value); err != nil {
+		if err := s.UpdateMetric(r.Context(), key, storage.Gauge, nil, metric.Value); err != nil {
 			http.Error(rw, "Failed to update gauge", http.StatusInternalServerError)
 			return
 		}
-		_, value, err := s.GetMetric(r.Context(), metric.ID, storage.Gauge)
+		_, value, err := s.GetMetric(r.Context(), key, storage.Gauge)
 		if err != nil {
 			http.Error(rw, "Failed to fetch updated metric", http.StatusInternalServerError)
 			return
 		}
 		response.Value = value
 
+	case storage.Histogram, storage.Summary, storage.Set:
+		if err := metric.Validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := s.UpdateMetrics(r.Context(), "", []storage.Metric{metric}); err != nil {
+			http.Error(rw, "Failed to update "+string(metric.MType), http.StatusInternalServerError)
+			return
+		}
+		current, err := currentMetric(r.Context(), s, metric)
+		if err != nil {
+			http.Error(rw, "Failed to fetch updated metric", http.StatusInternalServerError)
+			return
+		}
+		// Хранилище пропускает отчет с другими границами, единственную метрику отклоняем явно
+		if metric.Histogram != nil && !slices.Equal(current.Histogram.Bounds, metric.Histogram.Bounds) {
+			http.Error(rw, storage.ErrHistogramBounds.Error(), http.StatusBadRequest)
+			return
+		}
+		response = current
+
 	default:
 		rw.WriteHeader(http.StatusBadRequest)
 		return
@@ -76,6 +106,7 @@ func PostMetricJSON(rw http.ResponseWriter, r *http.Request, s storage.Storage)
 }
 
 // GetMetricJSON returns a metric value via JSON request.
+// A metric without labels resolves as described in storage.ResolveSeries and is answered with the labels of the series.
 func GetMetricJSON(rw http.ResponseWriter, r *http.Request, s storage.MetricReader) {
 	if r.Method != http.MethodPost {
 		rw.WriteHeader(http.StatusMethodNotAllowed)
@@ -87,22 +118,42 @@ func GetMetricJSON(rw http.ResponseWriter, r *http.Request, s storage.MetricRead
 		return
 	}
 
+	switch metric.MType {
+	case storage.Counter, storage.Gauge, storage.Histogram, storage.Summary, storage.Set:
+	default:
+		http.Error(rw, "No such metric type "+metric.ID, http.StatusNotFound)
+		return
+	}
+	if len(metric.Labels) == 0 {
+		key, err := storage.ResolveSeries(r.Context(), s, metric.ID, metric.MType)
+		if err != nil {
+			writeSeriesError(rw, err)
+			return
+		}
+		if id, labels, err := storage.ParseSeriesKey(key); err == nil {
+			metric.ID, metric.Labels = id, labels
+		}
+	}
+
 	var response storage.Metric
 	response.ID = metric.ID
 	response.MType = metric.MType
+	response.Labels = metric.Labels
 
-	var mType storage.MetricType
-	switch metric.MType {
-	case storage.Counter:
-		mType = storage.Counter
-	case storage.Gauge:
-		mType = storage.Gauge
-	default:
-		http.Error(rw, "No such metric type "+metric.ID, http.StatusNotFound)
+	if metric.MType != storage.Counter && metric.MType != storage.Gauge {
+		current, err := currentMetric(r.Context(), s, metric)
+		if err != nil {
+			http.Error(rw, "Metric not found", http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(current); err != nil {
+			http.Error(rw, "Can't encode response", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	delta, value, err := s.GetMetric(r.Context(), metric.ID, mType)
+	delta, value, err := s.GetMetric(r.Context(), metric.Key(), metric.MType)
 	if err != nil {
 		http.Error(rw, "Metric not found", http.StatusNotFound)
 		return
@@ -118,6 +169,8 @@ func GetMetricJSON(rw http.ResponseWriter, r *http.Request, s storage.MetricRead
 }
 
 // PostMetricsJSON updates a banch of metric values via JSON request.
+// Replayed batches are acknowledged without being applied again.
+// Histograms with other bounds than the stored ones are skipped, the rest of the batch is applied.
 func PostMetricsJSON(rw http.ResponseWriter, r *http.Request, s storage.Storage) {
 	if r.Method != http.MethodPost {
 		rw.WriteHeader(http.StatusMethodNotAllowed)
@@ -130,46 +183,27 @@ func PostMetricsJSON(rw http.ResponseWriter, r *http.Request, s storage.Storage)
 		return
 	}
 
-	response := make([]storage.Metric, 0, len(metrics))
-
+	valid := make([]storage.Metric, 0, len(metrics))
 	for _, metric := range metrics {
-		if metric.ID == "" || metric.MType == "" {
-			continue
-		}
-
-		var mType storage.MetricType
-		switch metric.MType {
-		case storage.Counter:
-			mType = storage.Counter
-			if metric.Delta == nil {
-				continue
-			}
-		case storage.Gauge:
-			mType = storage.Gauge
-			if metric.Value == nil {
-				continue
-			}
-		default:
+		if metric.ID == "" || metric.Validate() != nil {
 			continue
 		}
+		valid = append(valid, metric)
+	}
 
-		if err := s.UpdateMetric(r.Context(), metric.ID, mType, metric.Delta, metric.Value); err != nil {
-			http.Error(rw, "Failed to update metrics", http.StatusInternalServerError)
-			return
-		}
+	if _, err := s.UpdateMetrics(r.Context(), batchID(r), valid); err != nil {
+		http.Error(rw, "Failed to update metrics", http.StatusInternalServerError)
+		return
+	}
 
-		delta, value, err := s.GetMetric(r.Context(), metric.ID, mType)
+	response := make([]storage.Metric, 0, len(valid))
+	for _, metric := range valid {
+		current, err := currentMetric(r.Context(), s, metric)
 		if err != nil {
 			http.Error(rw, "Failed to fetch updated metric", http.StatusInternalServerError)
 			return
 		}
-
-		response = append(response, storage.Metric{
-			ID:    metric.ID,
-			MType: metric.MType,
-			Delta: delta,
-			Value: value,
-		})
+		response = append(response, current)
 	}
 
 	rw.Header().Set("Content-Type", "application/json")
@@ -177,3 +211,47 @@ func PostMetricsJSON(rw http.ResponseWriter, r *http.Request, s storage.Storage)
 		http.Error(rw, "Can't encode response", http.StatusInternalServerError)
 	}
 }
+
+// currentMetric reads the current state of the series of m from the storage.
+func currentMetric(ctx context.Context, s storage.MetricReader, m storage.Metric) (storage.Metric, error) {
+	current := storage.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels}
+	var err error
+	switch m.MType {
+	case storage.Histogram:
+		hr, ok := s.(storage.HistogramReader)
+		if !ok {
+			return current, storage.ErrHistogramsUnsupported
+		}
+		current.Histogram, err = hr.GetHistogram(ctx, m.Key())
+	case storage.Summary:
+		sr, ok := s.(storage.SummaryReader)
+		if !ok {
+			return current, storage.ErrSummariesUnsupported
+		}
+		current.Summary, err = sr.GetSummary(ctx, m.Key())
+	case storage.Set:
+		sr, ok := s.(storage.SetReader)
+		if !ok {
+			return current, storage.ErrSetsUnsupported
+		}
+		current.Set, err = sr.GetSet(ctx, m.Key())
+	default:
+		current.Delta, current.Value, err = s.GetMetric(ctx, m.Key(), m.MType)
+	}
+	return current, err
+}
+
+// batchID builds an idempotency key for a batch request.
+// Idempotency-Key header is used as is, otherwise agent ID and batch sequence number are combined.
+// Empty result means the batch is not deduplicated.
+func batchID(r *http.Request) string {
+	if key := r.Header.Get(headers.IdempotencyKey); key != "" {
+		return key
+	}
+	agentID := r.Header.Get(headers.AgentID)
+	seq := r.Header.Get(headers.BatchSeq)
+	if agentID == "" || seq == "" {
+		return ""
+	}
+	return agentID + "/" + seq
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"io"
+	"math"
 	"net/http"
 	"strconv"
 
@@ -10,6 +11,7 @@ import (
 )
 
 // PostMetric updates single metric value via plaintext request.
+// For summaries the value is a single observation, for sets it is a member.
 func PostMetric(rw http.ResponseWriter, r *http.Request, s storage.MetricWriter) {
 	if r.Method != http.MethodPost {
 		rw.WriteHeader(http.StatusMethodNotAllowed)
@@ -24,6 +26,11 @@ func PostMetric(rw http.ResponseWriter, r *http.Request, s storage.MetricWriter)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	// Метки передаются только в JSON, имя из пути не должно подменять ключ серии с метками
+	if err := storage.ValidateName(metricName); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	switch metricType {
 	case string(storage.Counter):
@@ -36,13 +43,29 @@ func PostMetric(rw http.ResponseWriter, r *http.Request, s storage.MetricWriter)
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-	case string(storage.Gauge):
+	case string(storage.Gauge), string(storage.Summary):
 		v, err := strconv.ParseFloat(metricValue, 64)
 		if err != nil {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if err := s.UpdateMetric(r.Context(), metricName, storage.Gauge, nil, &v); err != nil {
+		if metricType == string(storage.Summary) && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := s.UpdateMetric(r.Context(), metricName, storage.MetricType(metricType), nil, &v); err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	case string(storage.Set):
+		// Элементы множеств записываются только пакетами
+		bw, ok := s.(storage.BatchWriter)
+		if !ok {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		m := storage.Metric{ID: metricName, MType: storage.Set, Member: &metricValue}
+		if _, err := bw.UpdateMetrics(r.Context(), "", []storage.Metric{m}); err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -55,7 +78,8 @@ func PostMetric(rw http.ResponseWriter, r *http.Request, s storage.MetricWriter)
 }
 
 // GetMetric returns a metric values via plaintext request.
-func GetMetric(rw http.ResponseWriter, r *http.Request, s storage.MetricReader) {
+// The metric is a name or series key, a bare name resolves as described in resolveSeries.
+func GetMetric(rw http.ResponseWriter, r *http.Request, s storage.MetricReader, sr storage.SeriesReader) {
 	metricType := chi.URLParam(r, "type")
 	metricName := chi.URLParam(r, "metric")
 
@@ -70,7 +94,12 @@ func GetMetric(rw http.ResponseWriter, r *http.Request, s storage.MetricReader)
 		return
 	}
 
-	delta, value, err := s.GetMetric(r.Context(), metricName, mType)
+	key, err := resolveSeries(r.Context(), sr, metricName, nil, mType)
+	if err != nil {
+		writeSeriesError(rw, err)
+		return
+	}
+	delta, value, err := s.GetMetric(r.Context(), key, mType)
 	if err != nil {
 		http.Error(rw, "Metric not found", http.StatusNotFound)
 		return
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+)
+
+// Exposition format content types.
+const (
+	PrometheusTextContentType = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType    = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// PrometheusMetrics renders all metrics in the Prometheus text exposition format.
+// Counters get the _total suffix, gauges are exported as is, histograms get cumulative
+// _bucket series with the le label and _sum and _count series, sets are exported as gauges
+// of their estimated cardinality. User labels le of histograms and quantile of summaries are
+// renamed to exported_le and exported_quantile, as Prometheus does. Clients that prefer
+// application/openmetrics-text in the Accept header get the OpenMetrics format.
+// Types the storage does not keep, by interface or by an unsupported error, are left out.
+func PrometheusMetrics(rw http.ResponseWriter, r *http.Request, s storage.MetricReader) {
+	counters, gauges, err := s.GetAllMetrics(r.Context())
+	if err != nil {
+		http.Error(rw, "Failed to get metrics", http.StatusInternalServerError)
+		return
+	}
+	var histograms map[string]*storage.HistogramValue
+	if hr, ok := s.(storage.HistogramReader); ok {
+		if histograms, err = hr.GetAllHistograms(r.Context()); err != nil && !errors.Is(err, storage.ErrHistogramsUnsupported) {
+			http.Error(rw, "Failed to get metrics", http.StatusInternalServerError)
+			return
+		}
+	}
+	var sets map[string]*storage.SetValue
+	if sr, ok := s.(storage.SetReader); ok {
+		if sets, err = sr.GetAllSets(r.Context()); err != nil && !errors.Is(err, storage.ErrSetsUnsupported) {
+			http.Error(rw, "Failed to get metrics", http.StatusInternalServerError)
+			return
+		}
+	}
+	var summaries map[string]*storage.SummaryValue
+	if sr, ok := s.(storage.SummaryReader); ok {
+		if summaries, err = sr.GetAllSummaries(r.Context()); err != nil && !errors.Is(err, storage.ErrSummariesUnsupported) {
+			http.Error(rw, "Failed to get metrics", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	openMetrics := acceptsOpenMetrics(r.Header.Get("Accept"))
+	if openMetrics {
+		rw.Header().Set("Content-Type", OpenMetricsContentType)
+	} else {
+		rw.Header().Set("Content-Type", PrometheusTextContentType)
+	}
+	rw.WriteHeader(http.StatusOK)
+
+	// Метрики с одинаковым именем и разными метками образуют одно семейство
+	var families []*promFamily
+	byName := make(map[string]*promFamily)
+	// Разные ID могут совпасть после приведения к имени Prometheus, дубликаты пропускаем
+	seen := make(map[string]bool)
+	add := func(key, typ string, sample promSample) {
+		id, labels, err := storage.ParseSeriesKey(key)
+		if err != nil {
+			return
+		}
+		name := PrometheusName(id)
+		if typ == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		f, ok := byName[name]
+		if !ok {
+			f = &promFamily{name: name, typ: typ, id: id}
+			byName[name] = f
+			families = append(families, f)
+		}
+		series := storage.SeriesKey(name, labels)
+		if f.typ != typ || seen[series] {
+			return
+		}
+		seen[series] = true
+		sample.labels = labels
+		f.samples = append(f.samples, sample)
+	}
+	for _, key := range sortedKeys(counters) {
+		add(key, "counter", promSample{value: strconv.FormatInt(counters[key], 10)})
+	}
+	for _, key := range sortedKeys(gauges) {
+		add(key, "gauge", promSample{value: formatPrometheusFloat(gauges[key])})
+	}
+	for _, key := range sortedKeys(histograms) {
+		add(key, "histogram", promSample{histogram: histograms[key]})
+	}
+	for _, key := range sortedKeys(summaries) {
+		add(key, "summary", promSample{summary: summaries[key]})
+	}
+	for _, key := range sortedKeys(sets) {
+		add(key, "set", promSample{value: strconv.FormatUint(sets[key].Cardinality, 10)})
+	}
+	sort.SliceStable(families, func(i, j int) bool {
+		if families[i].typ != families[j].typ {
+			return promTypeOrder[families[i].typ] < promTypeOrder[families[j].typ]
+		}
+		return families[i].name < families[j].name
+	})
+
+	w := bufio.NewWriter(rw)
+	for _, f := range families {
+		switch f.typ {
+		case "counter":
+			family := f.name
+			if !openMetrics {
+				family = f.name + "_total"
+			}
+			writeFamily(w, family, "counter", "Counter "+f.id+".")
+			for _, s := range f.samples {
+				w.WriteString(f.name + "_total" + formatPrometheusLabels(s.labels) + " " + s.value + "\n")
+			}
+		case "histogram":
+			writeFamily(w, f.name, "histogram", "Histogram "+f.id+".")
+			for _, s := range f.samples {
+				writeHistogram(w, f.name, s.labels, s.histogram)
+			}
+		case "summary":
+			writeFamily(w, f.name, "summary", "Summary "+f.id+".")
+			for _, s := range f.samples {
+				writeSummary(w, f.name, s.labels, s.summary)
+			}
+		case "set":
+			writeFamily(w, f.name, "gauge", "Cardinality of set "+f.id+".")
+			for _, s := range f.samples {
+				w.WriteString(f.name + formatPrometheusLabels(s.labels) + " " + s.value + "\n")
+			}
+		default:
+			writeFamily(w, f.name, f.typ, "Gauge "+f.id+".")
+			for _, s := range f.samples {
+				w.WriteString(f.name + formatPrometheusLabels(s.labels) + " " + s.value + "\n")
+			}
+		}
+	}
+	if openMetrics {
+		w.WriteString("# EOF\n")
+	}
+	w.Flush()
+}
+
+// promFamily groups samples sharing a metric name.
+type promFamily struct {
+	name    string
+	typ     string
+	id      string
+	samples []promSample
+}
+
+type promSample struct {
+	labels    map[string]string
+	value     string
+	histogram *storage.HistogramValue
+	summary   *storage.SummaryValue
+}
+
+// promTypeOrder orders families by type: counters, gauges, histograms, then summaries.
+var promTypeOrder = map[string]int{"counter": 0, "gauge": 1, "histogram": 2, "summary": 3, "set": 4}
+
+// writeHistogram writes cumulative buckets, sum and count of a histogram series.
+func writeHistogram(w *bufio.Writer, name string, labels map[string]string, h *storage.HistogramValue) {
+	labels = exportLabel(labels, "le")
+	bucketLabels := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		bucketLabels[k] = v
+	}
+	var cumulative uint64
+	for i, c := range h.Counts {
+		cumulative += c
+		le := math.Inf(1)
+		if i < len(h.Bounds) {
+			le = h.Bounds[i]
+		}
+		bucketLabels["le"] = formatPrometheusFloat(le)
+		w.WriteString(name + "_bucket" + formatPrometheusLabels(bucketLabels) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+	}
+	w.WriteString(name + "_sum" + formatPrometheusLabels(labels) + " " + formatPrometheusFloat(h.Sum) + "\n")
+	w.WriteString(name + "_count" + formatPrometheusLabels(labels) + " " + strconv.FormatUint(h.Count, 10) + "\n")
+}
+
+// writeSummary writes quantile estimates, sum and count of a summary series.
+func writeSummary(w *bufio.Writer, name string, labels map[string]string, s *storage.SummaryValue) {
+	labels = exportLabel(labels, "quantile")
+	quantileLabels := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		quantileLabels[k] = v
+	}
+	for _, q := range s.Quantiles {
+		quantileLabels["quantile"] = formatPrometheusFloat(q.Quantile)
+		w.WriteString(name + formatPrometheusLabels(quantileLabels) + " " + formatPrometheusFloat(q.Value) + "\n")
+	}
+	w.WriteString(name + "_sum" + formatPrometheusLabels(labels) + " " + formatPrometheusFloat(s.Sum) + "\n")
+	w.WriteString(name + "_count" + formatPrometheusLabels(labels) + " " + strconv.FormatUint(s.Count, 10) + "\n")
+}
+
+// exportLabel renames the user label reserved by the exposition format to exported_<name>,
+// so it is not overwritten by the bucket or quantile label.
+func exportLabel(labels map[string]string, name string) map[string]string {
+	value, ok := labels[name]
+	if !ok {
+		return labels
+	}
+	exported := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != name {
+			exported[k] = v
+		}
+	}
+	exported["exported_"+name] = value
+	return exported
+}
+
+// formatPrometheusLabels renders labels as {k="v",...} sorted by name, empty labels yield an empty string.
+// Series keys use the same escaping as the exposition format.
+func formatPrometheusLabels(labels map[string]string) string {
+	return storage.SeriesKey("", labels)
+}
+
+// PrometheusName converts a metric ID to a valid Prometheus metric name.
+// Invalid characters are replaced with underscores and a leading digit is prefixed with one.
+func PrometheusName(id string) string {
+	var b strings.Builder
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+func writeFamily(w *bufio.Writer, name, typ, help string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func formatPrometheusFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// acceptsOpenMetrics reports whether the Accept header prefers OpenMetrics over the text format.
+func acceptsOpenMetrics(accept string) bool {
+	var openMetricsQ, textQ float64 = -1, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.EqualFold(k, "q") {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch mediaType {
+		case "application/openmetrics-text":
+			openMetricsQ = math.Max(openMetricsQ, q)
+		case "text/plain":
+			textQ = math.Max(textQ, q)
+		}
+	}
+	return openMetricsQ > 0 && openMetricsQ >= textQ
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
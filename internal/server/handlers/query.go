@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+)
+
+// Aggregation functions supported by QueryRange.
+const (
+	AggAvg  = "avg"
+	AggMin  = "min"
+	AggMax  = "max"
+	AggSum  = "sum"
+	AggLast = "last"
+	// AggRate is the per-second increase of a counter, counter resets are taken into account.
+	AggRate = "rate"
+)
+
+// Range query defaults and limits.
+const (
+	DefaultQueryRange = time.Hour
+	DefaultQueryStep  = time.Minute
+	// MaxQueryPoints limits the number of steps a single query may span.
+	MaxQueryPoints = 11000
+)
+
+// Point is an aggregated metric value, Time is the start of the step.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// QueryRangeResponse is the QueryRange answer.
+type QueryRangeResponse struct {
+	ID          string             `json:"id"`
+	MType       storage.MetricType `json:"type"`
+	Aggregation string             `json:"aggregation"`
+	// Step is the step length in seconds.
+	Step   float64 `json:"step"`
+	Points []Point `json:"points"`
+}
+
+// QueryRange returns metric history aggregated into steps aligned to multiples of step.
+// Query parameters: id (metric name or series key) or match (selector of a single series), type,
+// from and to (unix seconds or RFC 3339), step (seconds or Go duration) and agg (avg, min, max, sum, last or rate).
+// A bare name resolves as described in resolveSeries, ID of the response is the resolved series key.
+// Steps without samples are omitted.
+func QueryRange(rw http.ResponseWriter, r *http.Request, s storage.HistoryReader, sr storage.SeriesReader) {
+	q := r.URL.Query()
+
+	mType := storage.MetricType(q.Get("type"))
+	if mType != storage.Counter && mType != storage.Gauge {
+		http.Error(rw, "No such metric type "+string(mType), http.StatusBadRequest)
+		return
+	}
+	id, ok := seriesParams(rw, r, sr, mType)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	to, err := parseQueryTime(q.Get("to"), now)
+	if err != nil {
+		http.Error(rw, "Invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseQueryTime(q.Get("from"), to.Add(-DefaultQueryRange))
+	if err != nil {
+		http.Error(rw, "Invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := parseQueryStep(q.Get("step"))
+	if err != nil {
+		http.Error(rw, "Invalid step: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		http.Error(rw, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from)/step > MaxQueryPoints {
+		http.Error(rw, "Too many points, increase step", http.StatusBadRequest)
+		return
+	}
+
+	agg := q.Get("agg")
+	if agg == "" {
+		agg = AggLast
+	}
+	switch agg {
+	case AggAvg, AggMin, AggMax, AggSum, AggLast:
+	case AggRate:
+		if mType != storage.Counter {
+			http.Error(rw, "rate is supported for counters only", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, "Unknown aggregation "+agg, http.StatusBadRequest)
+		return
+	}
+
+	start := alignTime(from, step)
+	// Предыдущий шаг нужен как точка отсчета для rate
+	samples, err := s.GetHistory(r.Context(), id, mType, start.Add(-step), to)
+	if err != nil {
+		if errors.Is(err, storage.ErrHistoryDisabled) {
+			http.Error(rw, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		http.Error(rw, "Failed to read metric history", http.StatusInternalServerError)
+		return
+	}
+
+	response := QueryRangeResponse{
+		ID:          id,
+		MType:       mType,
+		Aggregation: agg,
+		Step:        step.Seconds(),
+		Points:      aggregate(samples, start, step, agg),
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		http.Error(rw, "Can't encode response", http.StatusInternalServerError)
+	}
+}
+
+// RollupsResponse is the QueryRollups answer.
+type RollupsResponse struct {
+	ID         string             `json:"id"`
+	MType      storage.MetricType `json:"type"`
+	Resolution storage.Resolution `json:"resolution"`
+	Rollups    []storage.Rollup   `json:"rollups"`
+}
+
+// QueryRollups returns precomputed rollups of a metric.
+// Query parameters: id or match selecting the series as in QueryRange, type,
+// resolution (1m or 1h, 1m by default), from and to (unix seconds or RFC 3339).
+func QueryRollups(rw http.ResponseWriter, r *http.Request, s storage.RollupReader, sr storage.SeriesReader) {
+	q := r.URL.Query()
+
+	mType := storage.MetricType(q.Get("type"))
+	if mType != storage.Counter && mType != storage.Gauge {
+		http.Error(rw, "No such metric type "+string(mType), http.StatusBadRequest)
+		return
+	}
+	id, ok := seriesParams(rw, r, sr, mType)
+	if !ok {
+		return
+	}
+
+	res := storage.RollupMinute
+	if v := q.Get("resolution"); v != "" {
+		var err error
+		if res, err = storage.ParseResolution(v); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	to, err := parseQueryTime(q.Get("to"), time.Now())
+	if err != nil {
+		http.Error(rw, "Invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseQueryTime(q.Get("from"), to.Add(-DefaultQueryRange))
+	if err != nil {
+		http.Error(rw, "Invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		http.Error(rw, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from)/res.Duration() > MaxQueryPoints {
+		http.Error(rw, "Too many points, use coarser resolution", http.StatusBadRequest)
+		return
+	}
+
+	rollups, err := s.GetRollups(r.Context(), id, mType, res, from, to)
+	if err != nil {
+		if errors.Is(err, storage.ErrRollupsDisabled) {
+			http.Error(rw, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		http.Error(rw, "Failed to read metric rollups", http.StatusInternalServerError)
+		return
+	}
+	if rollups == nil {
+		rollups = []storage.Rollup{}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(RollupsResponse{ID: id, MType: mType, Resolution: res, Rollups: rollups}); err != nil {
+		http.Error(rw, "Can't encode response", http.StatusInternalServerError)
+	}
+}
+
+// aggregate folds time ordered samples into steps starting at start.
+// Samples before start only serve as the rate baseline.
+func aggregate(samples []storage.Sample, start time.Time, step time.Duration, agg string) []Point {
+	points := []Point{}
+	var (
+		prev    float64
+		hasPrev bool
+		bucket  time.Time
+		values  []float64
+	)
+	flush := func() {
+		if len(values) == 0 {
+			return
+		}
+		points = append(points, Point{Time: bucket, Value: fold(values, prev, hasPrev, step, agg)})
+		prev, hasPrev = values[len(values)-1], true
+		values = values[:0]
+	}
+
+	for _, s := range samples {
+		v := sampleValue(s)
+		if s.Time.Before(start) {
+			prev, hasPrev = v, true
+			continue
+		}
+		b := alignTime(s.Time, step)
+		if !b.Equal(bucket) {
+			flush()
+			bucket = b
+		}
+		values = append(values, v)
+	}
+	flush()
+	return points
+}
+
+// fold computes the aggregation over values of a single step.
+func fold(values []float64, prev float64, hasPrev bool, step time.Duration, agg string) float64 {
+	switch agg {
+	case AggAvg, AggSum:
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		if agg == AggAvg {
+			return sum / float64(len(values))
+		}
+		return sum
+	case AggMin:
+		m := math.Inf(1)
+		for _, v := range values {
+			m = math.Min(m, v)
+		}
+		return m
+	case AggMax:
+		m := math.Inf(-1)
+		for _, v := range values {
+			m = math.Max(m, v)
+		}
+		return m
+	case AggRate:
+		if !hasPrev {
+			prev, values = values[0], values[1:]
+		}
+		var increase float64
+		for _, v := range values {
+			if v < prev {
+				// Счетчик сбросился, отсчитываем от нуля
+				increase += v
+			} else {
+				increase += v - prev
+			}
+			prev = v
+		}
+		return increase / step.Seconds()
+	default:
+		return values[len(values)-1]
+	}
+}
+
+func sampleValue(s storage.Sample) float64 {
+	if s.Delta != nil {
+		return float64(*s.Delta)
+	}
+	if s.Value != nil {
+		return *s.Value
+	}
+	return 0
+}
+
+// alignTime rounds t down to a multiple of step since the Unix epoch.
+func alignTime(t time.Time, step time.Duration) time.Time {
+	ns := t.UnixNano()
+	rem := ns % int64(step)
+	if rem < 0 {
+		rem += int64(step)
+	}
+	return time.Unix(0, ns-rem).UTC()
+}
+
+// parseQueryTime parses unix seconds or RFC 3339, empty value yields def.
+func parseQueryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseQueryStep parses seconds or Go duration, empty value yields DefaultQueryStep.
+func parseQueryStep(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultQueryStep, nil
+	}
+	var step time.Duration
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		step = time.Duration(sec * float64(time.Second))
+	} else if step, err = time.ParseDuration(s); err != nil {
+		return 0, err
+	}
+	if step < time.Second {
+		return 0, fmt.Errorf("step must be at least 1s")
+	}
+	return step, nil
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+)
+
+// FindSeries returns current values of metrics selected by one or more match query parameters.
+// Each parameter is a Prometheus style selector such as CPUutilization{host="a"}, results of
+// several selectors are merged.
+func FindSeries(rw http.ResponseWriter, r *http.Request, s storage.SeriesReader) {
+	selectors := r.URL.Query()["match"]
+	if len(selectors) == 0 {
+		http.Error(rw, "At least one match parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	response := []storage.Metric{}
+	seen := make(map[string]bool)
+	for _, selector := range selectors {
+		matchers, err := storage.ParseSelector(selector)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series, err := s.FindSeries(r.Context(), matchers)
+		if err != nil {
+			http.Error(rw, "Failed to find metrics", http.StatusInternalServerError)
+			return
+		}
+		for _, m := range series {
+			key := string(m.MType) + ":" + m.Key()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			response = append(response, m)
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		http.Error(rw, "Can't encode response", http.StatusInternalServerError)
+	}
+}
+
+// errSeriesNotFound is returned when no series matches the selector of a single series read.
+var errSeriesNotFound = errors.New("no series matches the selector")
+
+// resolveSeries returns the storage key of a single series of mType named by id or selected by matchers.
+// A name resolves as described in storage.ResolveSeries, a selector has to match exactly one series.
+func resolveSeries(ctx context.Context, s storage.SeriesReader, id string, matchers []*storage.Matcher, mType storage.MetricType) (string, error) {
+	if matchers == nil {
+		if _, labels, err := storage.ParseSeriesKey(id); err != nil || labels != nil {
+			return id, nil
+		}
+		name, err := storage.NewMatcher(storage.MatchEqual, storage.NameLabel, id)
+		if err != nil {
+			return "", err
+		}
+		matchers = []*storage.Matcher{name}
+	}
+	series, err := s.FindSeries(ctx, matchers)
+	if err != nil {
+		return "", err
+	}
+	var keys []string
+	for _, m := range series {
+		if m.MType == mType {
+			keys = append(keys, m.Key())
+		}
+	}
+	key, err := storage.PickSeries(id, keys)
+	if err == nil && key == "" {
+		return "", errSeriesNotFound
+	}
+	return key, err
+}
+
+// seriesParams reads the series of a range read from either the id or the match query parameter.
+// It writes the error response and returns false when the series cannot be resolved.
+func seriesParams(rw http.ResponseWriter, r *http.Request, s storage.SeriesReader, mType storage.MetricType) (string, bool) {
+	q := r.URL.Query()
+	id, selector := q.Get("id"), q.Get("match")
+	if (id == "") == (selector == "") {
+		http.Error(rw, "Exactly one of id and match is required", http.StatusBadRequest)
+		return "", false
+	}
+	var matchers []*storage.Matcher
+	if selector != "" {
+		var err error
+		if matchers, err = storage.ParseSelector(selector); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+	}
+	key, err := resolveSeries(r.Context(), s, id, matchers, mType)
+	if err != nil {
+		writeSeriesError(rw, err)
+		return "", false
+	}
+	return key, true
+}
+
+// writeSeriesError answers a failed series resolution.
+func writeSeriesError(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errSeriesNotFound):
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrAmbiguousSeries):
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(rw, "Failed to find metrics", http.StatusInternalServerError)
+	}
+}
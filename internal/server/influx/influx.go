@@ -0,0 +1,360 @@
+// Package influx parses InfluxDB line protocol and maps points to metrics.
+// A point "measurement,tag=value field=1.5 1700000000000000000" becomes the gauge measurement_field
+// labelled with the point tags. The field named value keeps the measurement name.
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+)
+
+// Timestamp precisions of the write API.
+var precisions = map[string]bool{"": true, "ns": true, "us": true, "ms": true, "s": true}
+
+// ValidPrecision reports whether p is a timestamp precision of the write API, empty means nanoseconds.
+func ValidPrecision(p string) bool {
+	return precisions[p]
+}
+
+// Field is a point field, Value is float64, int64, uint64, bool or string.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// Point is a parsed line protocol line.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	// Timestamp is in the write precision, zero if the line has none.
+	Timestamp int64
+}
+
+// ParseLine parses a single line protocol line.
+func ParseLine(line string) (Point, error) {
+	var p Point
+	var i int
+	p.Measurement, i = readToken(line, 0, ", ")
+	if p.Measurement == "" {
+		return p, errors.New("missing measurement")
+	}
+
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = readToken(line, i+1, "=, ")
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return p, fmt.Errorf("invalid tag %q", key)
+		}
+		value, i = readToken(line, i+1, ", ")
+		if value == "" {
+			return p, fmt.Errorf("tag %q has no value", key)
+		}
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		p.Tags[key] = value
+	}
+
+	if i >= len(line) || line[i] != ' ' {
+		return p, errors.New("missing fields")
+	}
+	for {
+		var key string
+		key, i = readToken(line, i+1, "=, ")
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return p, fmt.Errorf("invalid field %q", key)
+		}
+		var value any
+		var err error
+		value, i, err = readFieldValue(line, i+1)
+		if err != nil {
+			return p, fmt.Errorf("field %q: %w", key, err)
+		}
+		p.Fields = append(p.Fields, Field{Key: key, Value: value})
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+	}
+
+	if i < len(line) {
+		ts := strings.TrimSpace(line[i:])
+		if line[i] != ' ' || ts == "" {
+			return p, fmt.Errorf("unexpected %q after fields", line[i:])
+		}
+		t, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		p.Timestamp = t
+	}
+	return p, nil
+}
+
+// readToken reads an unquoted token from i until one of stops, a backslash escapes the next stop or '='.
+func readToken(line string, i int, stops string) (string, int) {
+	var b strings.Builder
+	for i < len(line) {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte(",= ", line[i+1]) >= 0 {
+			b.WriteByte(line[i+1])
+			i += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String(), i
+}
+
+// readFieldValue reads a field value starting at i.
+func readFieldValue(line string, i int) (any, int, error) {
+	if i < len(line) && line[i] == '"' {
+		var b strings.Builder
+		for i++; i < len(line); i++ {
+			switch c := line[i]; {
+			case c == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\'):
+				b.WriteByte(line[i+1])
+				i++
+			case c == '"':
+				return b.String(), i + 1, nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return nil, i, errors.New("unterminated string")
+	}
+
+	end := i
+	for end < len(line) && line[end] != ',' && line[end] != ' ' {
+		end++
+	}
+	raw := line[i:end]
+	switch {
+	case raw == "":
+		return nil, end, errors.New("missing value")
+	case strings.HasSuffix(raw, "i"):
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, end, fmt.Errorf("invalid integer %q", raw)
+		}
+		return v, end, nil
+	case strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, end, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return v, end, nil
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return true, end, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, end, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, end, fmt.Errorf("invalid float %q", raw)
+	}
+	return v, end, nil
+}
+
+// counterIdleTimeout is how long the last value of a counter series is kept without points.
+const counterIdleTimeout = time.Hour
+
+// counterPruneInterval is how often idle counter series are forgotten.
+const counterPruneInterval = time.Minute
+
+// Mapping configures how points are mapped to metrics.
+// It remembers the last values of counters and is safe for concurrent use.
+type Mapping struct {
+	counters []string
+	nameTags []string
+
+	mu sync.Mutex
+	// last are the last cumulative values of counters by series key.
+	last   map[string]lastCounter
+	pruned time.Time
+}
+
+// lastCounter is the last cumulative value of a counter series.
+type lastCounter struct {
+	value int64
+	seen  time.Time
+}
+
+// ParseMapping parses comma separated counter name patterns and name tags.
+// Metrics with names matching a counter pattern are counters, other metrics are gauges.
+// Counter fields are cumulative totals, as Telegraf reports them, and are written as the increase
+// since the previous point of the series.
+// Values of name tags are put into metric names between the measurement and the field
+// instead of being labels.
+func ParseMapping(counters, nameTags string) (*Mapping, error) {
+	m := &Mapping{last: make(map[string]lastCounter)}
+	for _, pattern := range splitList(counters) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid influx counter pattern %q: %w", pattern, err)
+		}
+		m.counters = append(m.counters, pattern)
+	}
+	m.nameTags = splitList(nameTags)
+	return m, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			items = append(items, part)
+		}
+	}
+	return items
+}
+
+func (m *Mapping) isCounter(name string) bool {
+	if m == nil {
+		return false
+	}
+	for _, pattern := range m.counters {
+		// Шаблоны проверены при разборе
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics maps fields of p to metrics, m may be nil for the default mapping.
+// String fields are skipped and booleans are gauges of 0 or 1.
+// Counters are converted to increments, see increment.
+func (m *Mapping) Metrics(p Point) ([]storage.Metric, error) {
+	nameParts := []string{p.Measurement}
+	var labels map[string]string
+	var nameTags []string
+	if m != nil {
+		nameTags = m.nameTags
+	}
+	for _, tag := range nameTags {
+		if v, ok := p.Tags[tag]; ok {
+			nameParts = append(nameParts, v)
+		}
+	}
+	for k, v := range p.Tags {
+		if slices.Contains(nameTags, k) {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(p.Tags))
+		}
+		labels[k] = v
+	}
+
+	metrics := make([]storage.Metric, 0, len(p.Fields))
+	for _, f := range p.Fields {
+		name := strings.Join(nameParts, "_")
+		if f.Key != "value" {
+			name += "_" + f.Key
+		}
+		metric := storage.Metric{ID: name, MType: storage.Gauge, Labels: labels}
+		if m.isCounter(name) {
+			delta, ok := integer(f.Value)
+			if !ok {
+				return nil, fmt.Errorf("counter field %q is not an integer", f.Key)
+			}
+			metric.MType = storage.Counter
+			metric.Delta = &delta
+		} else {
+			v, ok := float(f.Value)
+			if !ok {
+				continue
+			}
+			metric.Value = &v
+		}
+		if err := storage.ValidateSeries(metric.ID, metric.Labels); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+
+	// Последние значения обновляются только для точек без ошибок, иначе прирост был бы потерян
+	now := time.Now()
+	for _, metric := range metrics {
+		if metric.MType == storage.Counter {
+			*metric.Delta = m.increment(metric.Key(), *metric.Delta, now)
+		}
+	}
+	return metrics, nil
+}
+
+// increment returns the increase of a cumulative counter since the previous point of the series.
+// The first point of a series is the baseline and yields zero. A value below the previous one means
+// the counter was reset, so the whole value is the increase.
+func (m *Mapping) increment(key string, value int64, now time.Time) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.pruned) >= counterPruneInterval {
+		m.pruned = now
+		for k, c := range m.last {
+			if now.Sub(c.seen) > counterIdleTimeout {
+				delete(m.last, k)
+			}
+		}
+	}
+
+	prev, ok := m.last[key]
+	m.last[key] = lastCounter{value: value, seen: now}
+	switch {
+	case !ok:
+		return 0
+	case value < prev.value:
+		return value
+	default:
+		return value - prev.value
+	}
+}
+
+// float converts a numeric or boolean field value to a gauge value.
+func float(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// integer converts an integral field value to a cumulative counter value.
+func integer(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float64:
+		return int64(v), v == math.Trunc(v) && math.Abs(v) < math.MaxInt64
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,124 @@
+package influx
+
+import (
+	"testing"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Point
+		wantErr bool
+	}{
+		{
+			name: "full line",
+			line: `cpu,host=web1,cpu=cpu0 usage_idle=97.5,procs=12i,open=3u,up=t 1700000000000000000`,
+			want: Point{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "web1", "cpu": "cpu0"},
+				Fields: []Field{
+					{"usage_idle", 97.5}, {"procs", int64(12)}, {"open", uint64(3)}, {"up", true},
+				},
+				Timestamp: 1700000000000000000,
+			},
+		},
+		{
+			name: "escapes and strings",
+			line: `disk\ io,path=/var\,log value=1,msg="say \"hi\", ok"`,
+			want: Point{
+				Measurement: "disk io",
+				Tags:        map[string]string{"path": "/var,log"},
+				Fields:      []Field{{"value", 1.0}, {"msg", `say "hi", ok`}},
+			},
+		},
+		{name: "no fields", line: "cpu,host=web1", wantErr: true},
+		{name: "empty tag value", line: "cpu,host= value=1", wantErr: true},
+		{name: "bad integer", line: "cpu value=1.5i", wantErr: true},
+		{name: "unterminated string", line: `cpu msg="oops`, wantErr: true},
+		{name: "bad timestamp", line: "cpu value=1 soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMapping_Metrics(t *testing.T) {
+	p := Point{
+		Measurement: "net",
+		Tags:        map[string]string{"host": "web1", "interface": "eth0"},
+		Fields:      []Field{{"bytes_recv", int64(100)}, {"speed", 1.5}, {"name", "eth0"}},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		var m *Mapping
+		metrics, err := m.Metrics(p)
+		require.NoError(t, err)
+		// Строковые поля пропускаются
+		require.Len(t, metrics, 2)
+		assert.Equal(t, "net_bytes_recv", metrics[0].ID)
+		assert.Equal(t, storage.Gauge, metrics[0].MType)
+		assert.Equal(t, 100.0, *metrics[0].Value)
+		assert.Equal(t, p.Tags, metrics[0].Labels)
+	})
+
+	t.Run("counters and name tags", func(t *testing.T) {
+		m, err := ParseMapping("*_bytes_recv", "interface")
+		require.NoError(t, err)
+		metrics, err := m.Metrics(p)
+		require.NoError(t, err)
+		require.Len(t, metrics, 2)
+		assert.Equal(t, "net_eth0_bytes_recv", metrics[0].ID)
+		assert.Equal(t, storage.Counter, metrics[0].MType)
+		// Первое значение счетчика служит точкой отсчета
+		assert.Equal(t, int64(0), *metrics[0].Delta)
+		assert.Equal(t, map[string]string{"host": "web1"}, metrics[0].Labels)
+		assert.Equal(t, "net_eth0_speed", metrics[1].ID)
+	})
+
+	t.Run("cumulative counters", func(t *testing.T) {
+		m, err := ParseMapping("net_bytes_recv", "")
+		require.NoError(t, err)
+		write := func(total int64, tags map[string]string) int64 {
+			metrics, err := m.Metrics(Point{Measurement: "net", Tags: tags, Fields: []Field{{"bytes_recv", total}}})
+			require.NoError(t, err)
+			require.Len(t, metrics, 1)
+			return *metrics[0].Delta
+		}
+		eth0 := map[string]string{"interface": "eth0"}
+		eth1 := map[string]string{"interface": "eth1"}
+
+		assert.Equal(t, int64(0), write(100, eth0))
+		assert.Equal(t, int64(150), write(250, eth0))
+		assert.Equal(t, int64(0), write(5000, eth1), "series are tracked separately")
+		assert.Equal(t, int64(50), write(300, eth0))
+		assert.Equal(t, int64(20), write(20, eth0), "reset counts from zero")
+	})
+
+	t.Run("fractional counter", func(t *testing.T) {
+		m, err := ParseMapping("net_speed", "")
+		require.NoError(t, err)
+		_, err = m.Metrics(p)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid tag name", func(t *testing.T) {
+		_, err := (*Mapping)(nil).Metrics(Point{Measurement: "cpu", Tags: map[string]string{"cpu-id": "0"}, Fields: []Field{{"value", 1.0}}})
+		assert.Error(t, err)
+	})
+
+	_, err := ParseMapping("net_[", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/server/telemetry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// HashInterceptor is the gRPC counterpart of HashHandler.
+// Signature, timestamp and nonce are read from metadata, the signed body is the deterministically
+// marshaled request, see crypto.GRPCMethod. Responses are signed into the HashHeader metadata.
+// isWrite classifies full method names for SignWrites policy.
+func HashInterceptor(cfg HashConfig, isWrite func(fullMethod string) bool) grpc.UnaryServerInterceptor {
+	if cfg.Key == "" {
+		return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			return handler(ctx, req)
+		}
+	}
+	if cfg.MaxSkew <= 0 {
+		cfg.MaxSkew = DefaultMaxSkew
+	}
+	verifier := newSignatureVerifier(cfg)
+	marshal := proto.MarshalOptions{Deterministic: true}
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		recvSig := first(md, crypto.HashHeader)
+		if recvSig == "" {
+			if cfg.Policy == SignAll || (cfg.Policy == SignWrites && isWrite(info.FullMethod)) {
+				telemetry.SignatureFailures.Inc("grpc", "missing")
+				return nil, status.Error(codes.Unauthenticated, "signature required")
+			}
+		} else {
+			msg, ok := req.(proto.Message)
+			if !ok {
+				return nil, status.Error(codes.Internal, "unsupported request type")
+			}
+			body, err := marshal.Marshal(msg)
+			if err != nil {
+				return nil, status.Error(codes.Internal, "failed to marshal request")
+			}
+			err = verifier.verify(crypto.GRPCMethod, info.FullMethod, recvSig,
+				first(md, crypto.TimestampHeader), first(md, crypto.NonceHeader), body)
+			if err != nil {
+				telemetry.SignatureFailures.Inc("grpc", signatureFailureReason(err))
+				if errors.Is(err, errNonceCacheFull) {
+					return nil, status.Error(codes.ResourceExhausted, err.Error())
+				}
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		if msg, ok := resp.(proto.Message); ok {
+			body, err := marshal.Marshal(msg)
+			if err != nil {
+				return nil, status.Error(codes.Internal, "failed to marshal response")
+			}
+			mac := hmac.New(sha256.New, []byte(cfg.Key))
+			mac.Write(body)
+			if err := grpc.SetHeader(ctx, metadata.Pairs(crypto.HashHeader, hex.EncodeToString(mac.Sum(nil)))); err != nil {
+				return nil, status.Error(codes.Internal, "failed to sign response")
+			}
+		}
+		return resp, nil
+	}
+}
+
+// TrustedSubnetInterceptor is the gRPC counterpart of TrustedSubnetMiddleware.
+// The agent address is read from RealIPHeader metadata, isWrite classifies full method names.
+func TrustedSubnetInterceptor(subnets []*net.IPNet, isWrite func(fullMethod string) bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if len(subnets) == 0 || !isWrite(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		ip := net.ParseIP(first(md, RealIPHeader))
+		if ip == nil || !containsIP(subnets, ip) {
+			return nil, status.Error(codes.PermissionDenied, "forbidden")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// first returns the first metadata value for key or empty string.
+func first(md metadata.MD, key string) string {
+	if vals := md.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	testWriteMethod = "/metrics.Metrics/UpdateMetrics"
+	testReadMethod  = "/metrics.Metrics/ListMetrics"
+)
+
+// fakeStream captures headers set by interceptors.
+type fakeStream struct {
+	grpc.ServerTransportStream
+	header metadata.MD
+}
+
+func (s *fakeStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func isTestWrite(fullMethod string) bool {
+	return fullMethod == testWriteMethod
+}
+
+func callInterceptor(interceptor grpc.UnaryServerInterceptor, md metadata.MD, method string, req proto.Message) (*fakeStream, error) {
+	stream := &fakeStream{}
+	ctx := grpc.NewContextWithServerTransportStream(metadata.NewIncomingContext(context.Background(), md), stream)
+	_, err := interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req any) (any, error) {
+		return wrapperspb.String("ok"), nil
+	})
+	return stream, err
+}
+
+func signedMD(t *testing.T, key, method string, req proto.Message, ts time.Time, nonce string) metadata.MD {
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	require.NoError(t, err)
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	return metadata.Pairs(
+		crypto.TimestampHeader, timestamp,
+		crypto.NonceHeader, nonce,
+		crypto.HashHeader, hex.EncodeToString(crypto.SignRequest(key, crypto.GRPCMethod, method, timestamp, nonce, body)),
+	)
+}
+
+func TestHashInterceptor(t *testing.T) {
+	key := "secret_key"
+	req := wrapperspb.String("payload")
+
+	t.Run("valid signature signs response", func(t *testing.T) {
+		interceptor := HashInterceptor(HashConfig{Key: key}, isTestWrite)
+		stream, err := callInterceptor(interceptor, signedMD(t, key, testWriteMethod, req, time.Now(), "n1"), testWriteMethod, req)
+		require.NoError(t, err)
+		assert.NotEmpty(t, stream.header.Get(crypto.HashHeader))
+	})
+
+	t.Run("replay is rejected", func(t *testing.T) {
+		interceptor := HashInterceptor(HashConfig{Key: key}, isTestWrite)
+		md := signedMD(t, key, testWriteMethod, req, time.Now(), "n1")
+		_, err := callInterceptor(interceptor, md, testWriteMethod, req)
+		require.NoError(t, err)
+		_, err = callInterceptor(interceptor, md, testWriteMethod, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("tampered request is rejected", func(t *testing.T) {
+		interceptor := HashInterceptor(HashConfig{Key: key}, isTestWrite)
+		md := signedMD(t, key, testWriteMethod, req, time.Now(), "n1")
+		_, err := callInterceptor(interceptor, md, testWriteMethod, wrapperspb.String("other"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("stale timestamp is rejected", func(t *testing.T) {
+		interceptor := HashInterceptor(HashConfig{Key: key, MaxSkew: time.Minute}, isTestWrite)
+		md := signedMD(t, key, testWriteMethod, req, time.Now().Add(-time.Hour), "n1")
+		_, err := callInterceptor(interceptor, md, testWriteMethod, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		writes := HashInterceptor(HashConfig{Key: key, Policy: SignWrites}, isTestWrite)
+		_, err := callInterceptor(writes, nil, testWriteMethod, req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		_, err = callInterceptor(writes, nil, testReadMethod, req)
+		assert.NoError(t, err)
+
+		all := HashInterceptor(HashConfig{Key: key, Policy: SignAll}, isTestWrite)
+		_, err = callInterceptor(all, nil, testReadMethod, req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("empty key disables checks", func(t *testing.T) {
+		interceptor := HashInterceptor(HashConfig{}, isTestWrite)
+		stream, err := callInterceptor(interceptor, metadata.Pairs(crypto.HashHeader, "bad"), testWriteMethod, req)
+		require.NoError(t, err)
+		assert.Empty(t, stream.header.Get(crypto.HashHeader))
+	})
+}
+
+func TestTrustedSubnetInterceptor(t *testing.T) {
+	subnets, err := ParseTrustedSubnets("10.0.0.0/8")
+	require.NoError(t, err)
+	interceptor := TrustedSubnetInterceptor(subnets, isTestWrite)
+	req := wrapperspb.String("payload")
+
+	_, err = callInterceptor(interceptor, metadata.Pairs(RealIPHeader, "10.0.0.1"), testWriteMethod, req)
+	assert.NoError(t, err)
+
+	_, err = callInterceptor(interceptor, metadata.Pairs(RealIPHeader, "192.168.0.1"), testWriteMethod, req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = callInterceptor(interceptor, nil, testWriteMethod, req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = callInterceptor(interceptor, nil, testReadMethod, req)
+	assert.NoError(t, err)
+}
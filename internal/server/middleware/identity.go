@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/headers"
+)
+
+// ClientCertIdentity binds the agent ID of a request to its verified client certificate.
+// The certificate common name prefixes the agent ID sent by the client, so batches of
+// different agents never collide and an agent can not pose as another one.
+// Requests without a verified certificate are passed unchanged.
+func ClientCertIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := crypto.ClientIdentity(r.TLS); id != "" {
+			r.Header.Set(headers.AgentID, AgentIdentity(id, r.Header.Get(headers.AgentID)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AgentIdentity combines a certificate common name with the agent ID sent by the client.
+func AgentIdentity(commonName, agentID string) string {
+	if agentID == "" {
+		return commonName
+	}
+	return commonName + "/" + agentID
+}
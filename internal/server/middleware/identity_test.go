@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/antonminaichev/metricscollector/internal/headers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCertIdentity(t *testing.T) {
+	var got string
+	handler := ClientCertIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(headers.AgentID)
+	}))
+	verified := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "agent-1"}}}},
+	}
+
+	t.Run("prefixes agent ID with certificate CN", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.TLS = verified
+		req.Header.Set(headers.AgentID, "abc")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "agent-1/abc", got)
+	})
+
+	t.Run("uses CN when agent ID is missing", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.TLS = verified
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "agent-1", got)
+	})
+
+	t.Run("keeps header without client certificate", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.Header.Set(headers.AgentID, "abc")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "abc", got)
+	})
+}
@@ -7,13 +7,19 @@ import (
 	"crypto/hmac"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/server/telemetry"
 )
 
 type gzipResponseWriter struct {
@@ -59,29 +65,227 @@ func GzipHandler(next http.Handler) http.Handler {
 	})
 }
 
+// DefaultMaxSkew is the default allowed difference between a signed request timestamp and server time.
+const DefaultMaxSkew = 5 * time.Minute
+
+// SignaturePolicy defines which requests must be signed.
+type SignaturePolicy string
+
+// Signature policies.
+const (
+	// SignOptional verifies signatures when present and lets unsigned requests through.
+	SignOptional SignaturePolicy = "optional"
+	// SignWrites requires signatures on write requests only, reads may stay unsigned.
+	SignWrites SignaturePolicy = "writes"
+	// SignAll requires signatures on every request.
+	SignAll SignaturePolicy = "all"
+)
+
+// ParseSignaturePolicy converts a config value to SignaturePolicy, empty value means SignOptional.
+func ParseSignaturePolicy(s string) (SignaturePolicy, error) {
+	switch p := SignaturePolicy(strings.ToLower(s)); p {
+	case "":
+		return SignOptional, nil
+	case SignOptional, SignWrites, SignAll:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown signature policy: %s", s)
+	}
+}
+
+// writePrefixes lists path prefixes of endpoints that modify metrics.
+var writePrefixes = []string{"/update", "/api/v2/write"}
+
+// tokenPrefixes lists path prefixes of write endpoints of third-party protocols.
+// Their clients neither encrypt bodies nor sign requests, they authenticate with
+// an "Authorization: Token <token>" header instead, as InfluxDB clients do.
+var tokenPrefixes = []string{"/api/v2/write"}
+
+// isTokenRequest reports whether the request is sent to an endpoint authenticated with a token.
+func isTokenRequest(r *http.Request) bool {
+	for _, prefix := range tokenPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestToken returns the token of an "Authorization: Token <token>" header.
+func requestToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Token") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// IsWriteRequest reports whether the request modifies metrics.
+func IsWriteRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	for _, prefix := range writePrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashConfig configures request signature verification.
+type HashConfig struct {
+	// Key is the HMAC key, empty key disables signature checks.
+	Key string
+	// MaxSkew is the allowed difference between the request timestamp and server time.
+	MaxSkew time.Duration
+	// Policy defines which requests must be signed.
+	Policy SignaturePolicy
+	// IsWrite classifies requests for SignWrites policy, IsWriteRequest is used if nil.
+	IsWrite func(*http.Request) bool
+	// InfluxToken authenticates unsigned requests to the InfluxDB write endpoint, empty token disables it.
+	// It is a separate secret, so the HMAC key never travels as a bearer credential.
+	InfluxToken string
+}
+
+// requiresSignature reports whether the request must carry a signature under the configured policy.
+func (c HashConfig) requiresSignature(r *http.Request) bool {
+	switch c.Policy {
+	case SignAll:
+		return true
+	case SignWrites:
+		return c.IsWrite(r)
+	default:
+		return false
+	}
+}
+
+// Signature verification errors.
+var (
+	errSignatureParams    = errors.New("missing signature timestamp or nonce")
+	errSignatureTimestamp = errors.New("invalid signature timestamp")
+	errSignatureSkew      = errors.New("signature timestamp is outside of allowed window")
+	errSignatureMismatch  = errors.New("signature mismatch")
+	errSignatureReplay    = errors.New("replayed request")
+	// errNonceCacheFull rejects valid requests while the nonce cache is full of unexpired nonces.
+	errNonceCacheFull = errors.New("too many signed requests, retry later")
+)
+
+// signatureFailureReason returns the telemetry label for a signature verification error.
+func signatureFailureReason(err error) string {
+	switch err {
+	case errSignatureParams:
+		return "params"
+	case errSignatureTimestamp:
+		return "timestamp"
+	case errSignatureSkew:
+		return "skew"
+	case errSignatureMismatch:
+		return "mismatch"
+	case errSignatureReplay:
+		return "replay"
+	case errNonceCacheFull:
+		return "nonce_cache_full"
+	default:
+		return "unknown"
+	}
+}
+
+// signatureVerifier checks request signatures and remembers nonces of accepted requests.
+type signatureVerifier struct {
+	key     string
+	maxSkew time.Duration
+	nonces  *nonceCache
+}
+
+func newSignatureVerifier(cfg HashConfig) *signatureVerifier {
+	return &signatureVerifier{
+		key:     cfg.Key,
+		maxSkew: cfg.MaxSkew,
+		nonces:  newNonceCache(nonceCacheSize, 2*cfg.MaxSkew),
+	}
+}
+
+// verify checks the timestamp window and the signature, the nonce is recorded only for valid requests.
+func (v *signatureVerifier) verify(method, path, signature, timestamp, nonce string, body []byte) error {
+	if timestamp == "" || nonce == "" {
+		return errSignatureParams
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errSignatureTimestamp
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(sec, 0)); skew > v.maxSkew || skew < -v.maxSkew {
+		return errSignatureSkew
+	}
+
+	expected := crypto.SignRequest(v.key, method, path, timestamp, nonce, body)
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, expected) {
+		return errSignatureMismatch
+	}
+	return v.nonces.add(nonce, now)
+}
+
 // HashHandler checks HMAC-SHA256 of incoming requests and signs answers.
-// If keys is empty, checking is skipped.
-func HashHandler(next http.Handler, key string) http.Handler {
-	if key == "" {
+// The signature covers method, path, timestamp, nonce and body, see crypto.SignRequest.
+// Requests with a timestamp outside of the skew window or a reused nonce are rejected.
+// While too many nonces are remembered signed requests are rejected with 429.
+// Unsigned requests are rejected with 401 when the policy requires a signature.
+// When an Influx token is configured unsigned requests to the InfluxDB write endpoint must pass it
+// as an "Authorization: Token <token>" header, requests without it or with another token are rejected with 401.
+// If neither key nor token is set, checking is skipped.
+func HashHandler(next http.Handler, cfg HashConfig) http.Handler {
+	if cfg.Key == "" && cfg.InfluxToken == "" {
 		return next
 	}
+	if cfg.MaxSkew <= 0 {
+		cfg.MaxSkew = DefaultMaxSkew
+	}
+	if cfg.IsWrite == nil {
+		cfg.IsWrite = IsWriteRequest
+	}
+	key := cfg.Key
+	verifier := newSignatureVerifier(cfg)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		recvSig := r.Header.Get("HashSHA256")
-		if recvSig != "" {
+		recvSig := r.Header.Get(crypto.HashHeader)
+		if recvSig == "" && cfg.InfluxToken != "" && isTokenRequest(r) {
+			token, _ := requestToken(r)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.InfluxToken)) != 1 {
+				telemetry.SignatureFailures.Inc("http", "token")
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case recvSig == "" && cfg.requiresSignature(r):
+			telemetry.SignatureFailures.Inc("http", "missing")
+			http.Error(w, "Signature required", http.StatusUnauthorized)
+			return
+		case recvSig != "":
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
 				http.Error(w, "Failed to read request body", http.StatusBadRequest)
 				return
 			}
-
-			mac := hmac.New(sha256.New, []byte(key))
-			mac.Write(body)
-			expected := mac.Sum(nil)
-			recvBytes, err := hex.DecodeString(recvSig)
-			log.Printf("Hash expected: %s", hex.EncodeToString(expected))
-			log.Printf("Hash recieved: %s", recvSig)
-			if err != nil || !hmac.Equal(recvBytes, expected) {
-				http.Error(w, "Bad Request", http.StatusBadRequest)
+			err = verifier.verify(r.Method, r.URL.Path, recvSig,
+				r.Header.Get(crypto.TimestampHeader), r.Header.Get(crypto.NonceHeader), body)
+			if err != nil {
+				telemetry.SignatureFailures.Inc("http", signatureFailureReason(err))
+				code := http.StatusBadRequest
+				if errors.Is(err, errNonceCacheFull) {
+					code = http.StatusTooManyRequests
+				}
+				http.Error(w, err.Error(), code)
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewReader(body))
@@ -109,7 +313,7 @@ func HashHandler(next http.Handler, key string) http.Handler {
 				w.Header().Add(k, v)
 			}
 		}
-		w.Header().Set("HashSHA256", hex.EncodeToString(mac.Sum(nil)))
+		w.Header().Set(crypto.HashHeader, hex.EncodeToString(mac.Sum(nil)))
 		w.WriteHeader(hw.statusCode)
 		if _, err := w.Write(buf.Bytes()); err != nil {
 			log.Printf("failed to write response body: %v", err)
@@ -117,8 +321,12 @@ func HashHandler(next http.Handler, key string) http.Handler {
 	})
 }
 
-func RSADecryptMiddleware(privateKey *rsa.PrivateKey) func(http.Handler) http.Handler {
-	if privateKey == nil {
+// RSADecryptMiddleware decrypts POST request bodies with keys from the key ring.
+// The key is selected by crypto.KeyIDHeader, requests without it are tried with every key.
+// The scheme is selected by crypto.EncryptionHeader, requests without it use the legacy raw RSA scheme.
+// Bodies of the InfluxDB write endpoint are not encrypted and passed as is.
+func RSADecryptMiddleware(keys *crypto.KeyRing) func(http.Handler) http.Handler {
+	if keys == nil {
 		return func(next http.Handler) http.Handler {
 			return next
 		}
@@ -126,20 +334,51 @@ func RSADecryptMiddleware(privateKey *rsa.PrivateKey) func(http.Handler) http.Ha
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Только для POST-запросов
-			if r.Method != http.MethodPost {
+			// Только для POST-запросов, клиенты InfluxDB тело не шифруют
+			if r.Method != http.MethodPost || isTokenRequest(r) {
 				next.ServeHTTP(w, r)
 				return
 			}
 
+			var candidates []*rsa.PrivateKey
+			if id := r.Header.Get(crypto.KeyIDHeader); id != "" {
+				key, ok := keys.Get(id)
+				if !ok {
+					telemetry.DecryptFailures.Inc("unknown_key")
+					http.Error(w, "Unknown key ID", http.StatusBadRequest)
+					return
+				}
+				candidates = []*rsa.PrivateKey{key}
+			} else {
+				candidates = keys.Keys()
+			}
+
+			var decrypt func(*rsa.PrivateKey, []byte) ([]byte, error)
+			switch r.Header.Get(crypto.EncryptionHeader) {
+			case "", crypto.EncryptionV1:
+				decrypt = crypto.DecryptRSA
+			case crypto.EncryptionV2:
+				decrypt = crypto.DecryptEnvelope
+			default:
+				telemetry.DecryptFailures.Inc("unsupported_version")
+				http.Error(w, "Unsupported encryption version", http.StatusBadRequest)
+				return
+			}
+
 			ciphertext, err := io.ReadAll(r.Body)
 			if err != nil {
 				http.Error(w, "Failed to read body", http.StatusBadRequest)
 				return
 			}
 
-			plaintext, err := crypto.DecryptRSA(privateKey, ciphertext)
+			var plaintext []byte
+			for _, key := range candidates {
+				if plaintext, err = decrypt(key, ciphertext); err == nil {
+					break
+				}
+			}
 			if err != nil {
+				telemetry.DecryptFailures.Inc("decrypt")
 				http.Error(w, "Failed to decrypt body", http.StatusBadRequest)
 				return
 			}
@@ -11,10 +11,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/antonminaichev/metricscollector/internal/crypto"
+	"github.com/antonminaichev/metricscollector/internal/server/telemetry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -126,7 +129,7 @@ func TestHashHandler(t *testing.T) {
 		req.Header.Set("HashSHA256", "invalid_hash")
 
 		recorder := httptest.NewRecorder()
-		handler := HashHandler(testHandler, "")
+		handler := HashHandler(testHandler, HashConfig{})
 		handler.ServeHTTP(recorder, req)
 
 		assert.Equal(t, http.StatusOK, recorder.Code)
@@ -137,21 +140,98 @@ func TestHashHandler(t *testing.T) {
 		key := "secret_key"
 		body := "test body"
 
-		// Создаем правильный хеш
+		req := newSignedRequest(key, "/test", body, time.Now(), "nonce-1")
+
+		recorder := httptest.NewRecorder()
+		handler := HashHandler(testHandler, HashConfig{Key: key})
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "test response", recorder.Body.String())
+		assert.NotEmpty(t, recorder.Header().Get("HashSHA256"))
+	})
+
+	t.Run("rejects legacy body-only signature", func(t *testing.T) {
+		key := "secret_key"
+		body := "test body"
+
+		// Подпись старого формата только по телу запроса
 		mac := hmac.New(sha256.New, []byte(key))
 		mac.Write([]byte(body))
-		expectedHash := hex.EncodeToString(mac.Sum(nil))
 
 		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(body))
-		req.Header.Set("HashSHA256", expectedHash)
+		req.Header.Set("HashSHA256", hex.EncodeToString(mac.Sum(nil)))
 
 		recorder := httptest.NewRecorder()
-		handler := HashHandler(testHandler, key)
+		handler := HashHandler(testHandler, HashConfig{Key: key})
 		handler.ServeHTTP(recorder, req)
 
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("rejects replayed request", func(t *testing.T) {
+		key := "secret_key"
+		handler := HashHandler(testHandler, HashConfig{Key: key})
+		now := time.Now()
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newSignedRequest(key, "/test", "test body", now, "nonce-1"))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newSignedRequest(key, "/test", "test body", now, "nonce-1"))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newSignedRequest(key, "/test", "test body", now, "nonce-2"))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("rejects timestamp outside of skew window", func(t *testing.T) {
+		key := "secret_key"
+		handler := HashHandler(testHandler, HashConfig{Key: key, MaxSkew: time.Minute})
+
+		for name, ts := range map[string]time.Time{
+			"past":   time.Now().Add(-2 * time.Minute),
+			"future": time.Now().Add(2 * time.Minute),
+		} {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newSignedRequest(key, "/test", "test body", ts, "nonce-"+name))
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, name)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newSignedRequest(key, "/test", "test body", time.Now().Add(-30*time.Second), "nonce-ok"))
 		assert.Equal(t, http.StatusOK, recorder.Code)
-		assert.Equal(t, "test response", recorder.Body.String())
-		assert.NotEmpty(t, recorder.Header().Get("HashSHA256"))
+	})
+
+	t.Run("rejects signature for another path", func(t *testing.T) {
+		key := "secret_key"
+		req := newSignedRequest(key, "/test", "test body", time.Now(), "nonce-1")
+		req.URL.Path = "/other"
+
+		recorder := httptest.NewRecorder()
+		handler := HashHandler(testHandler, HashConfig{Key: key})
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("rejects missing or malformed timestamp", func(t *testing.T) {
+		key := "secret_key"
+		handler := HashHandler(testHandler, HashConfig{Key: key})
+
+		req := newSignedRequest(key, "/test", "test body", time.Now(), "nonce-1")
+		req.Header.Del(crypto.TimestampHeader)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		req = newSignedRequest(key, "/test", "test body", time.Now(), "nonce-2")
+		req.Header.Set(crypto.TimestampHeader, "yesterday")
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
 	})
 
 	t.Run("rejects invalid hash", func(t *testing.T) {
@@ -162,7 +242,7 @@ func TestHashHandler(t *testing.T) {
 		req.Header.Set("HashSHA256", "invalid_hash")
 
 		recorder := httptest.NewRecorder()
-		handler := HashHandler(testHandler, key)
+		handler := HashHandler(testHandler, HashConfig{Key: key})
 		handler.ServeHTTP(recorder, req)
 
 		assert.Equal(t, http.StatusBadRequest, recorder.Code)
@@ -176,7 +256,7 @@ func TestHashHandler(t *testing.T) {
 		req.Header.Set("HashSHA256", "not_hex")
 
 		recorder := httptest.NewRecorder()
-		handler := HashHandler(testHandler, key)
+		handler := HashHandler(testHandler, HashConfig{Key: key})
 		handler.ServeHTTP(recorder, req)
 
 		assert.Equal(t, http.StatusBadRequest, recorder.Code)
@@ -188,7 +268,7 @@ func TestHashHandler(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/test", nil)
 
 		recorder := httptest.NewRecorder()
-		handler := HashHandler(testHandler, key)
+		handler := HashHandler(testHandler, HashConfig{Key: key})
 		handler.ServeHTTP(recorder, req)
 
 		assert.Equal(t, http.StatusOK, recorder.Code)
@@ -210,7 +290,7 @@ func TestHashHandler(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("test body"))
 
 		recorder := httptest.NewRecorder()
-		handler := HashHandler(testHandler, key)
+		handler := HashHandler(testHandler, HashConfig{Key: key})
 		handler.ServeHTTP(recorder, req)
 
 		assert.Equal(t, http.StatusOK, recorder.Code)
@@ -228,7 +308,7 @@ func TestHashHandler(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/test", nil)
 
 		recorder := httptest.NewRecorder()
-		handler := HashHandler(testHandler, key)
+		handler := HashHandler(testHandler, HashConfig{Key: key})
 		handler.ServeHTTP(recorder, req)
 
 		assert.Equal(t, http.StatusOK, recorder.Code)
@@ -237,6 +317,163 @@ func TestHashHandler(t *testing.T) {
 	})
 }
 
+func TestHashHandler_Policy(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	key := "secret_key"
+
+	tests := []struct {
+		name   string
+		policy SignaturePolicy
+		method string
+		path   string
+		want   int
+	}{
+		{"optional allows unsigned write", SignOptional, http.MethodPost, "/updates/", http.StatusOK},
+		{"writes rejects unsigned batch update", SignWrites, http.MethodPost, "/updates/", http.StatusUnauthorized},
+		{"writes rejects unsigned url update", SignWrites, http.MethodPost, "/update/counter/c/1", http.StatusUnauthorized},
+		{"writes rejects unsigned influx write", SignWrites, http.MethodPost, "/api/v2/write", http.StatusUnauthorized},
+		{"writes allows unsigned value read", SignWrites, http.MethodPost, "/value/", http.StatusOK},
+		{"writes allows unsigned dashboard", SignWrites, http.MethodGet, "/", http.StatusOK},
+		{"all rejects unsigned read", SignAll, http.MethodGet, "/", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+
+			recorder := httptest.NewRecorder()
+			handler := HashHandler(testHandler, HashConfig{Key: key, Policy: tt.policy})
+			handler.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tt.want, recorder.Code)
+		})
+	}
+
+	t.Run("signed write passes strict policy", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		handler := HashHandler(testHandler, HashConfig{Key: key, Policy: SignAll})
+		handler.ServeHTTP(recorder, newSignedRequest(key, "/updates/", "{}", time.Now(), "nonce-1"))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("custom write classifier", func(t *testing.T) {
+		handler := HashHandler(testHandler, HashConfig{
+			Key:     key,
+			Policy:  SignWrites,
+			IsWrite: func(r *http.Request) bool { return r.URL.Path == "/custom" },
+		})
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/custom", nil))
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+}
+
+func TestInfluxWriteAuth(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key := "secret_key"
+	token := "influx_token"
+	body := "cpu,host=a usage=1.5"
+
+	var received string
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	// Порядок обработчиков совпадает с сервером: подпись проверяется до расшифровки
+	handler := HashHandler(RSADecryptMiddleware(newKeyRing(t, privateKey))(testHandler), HashConfig{Key: key, Policy: SignWrites, InfluxToken: token})
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"valid token", "Token " + token, http.StatusNoContent},
+		{"scheme is case insensitive", "token " + token, http.StatusNoContent},
+		{"invalid token", "Token other_token", http.StatusUnauthorized},
+		{"hash key is not a token", "Token " + key, http.StatusUnauthorized},
+		{"missing token", "", http.StatusUnauthorized},
+		{"other scheme", "Bearer " + token, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			req := httptest.NewRequest(http.MethodPost, "/api/v2/write?bucket=b", strings.NewReader(body))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tt.want, recorder.Code)
+			if tt.want == http.StatusNoContent {
+				// Тело line protocol передается без расшифровки
+				assert.Equal(t, body, received)
+			}
+		})
+	}
+
+	t.Run("token does not authorize agent writes", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader("[]"))
+		req.Header.Set("Authorization", "Token "+token)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("without a token unsigned writes need a signature", func(t *testing.T) {
+		handler := HashHandler(testHandler, HashConfig{Key: key, Policy: SignWrites})
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/write?bucket=b", strings.NewReader(body))
+		req.Header.Set("Authorization", "Token "+key)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("token without a hash key", func(t *testing.T) {
+		handler := HashHandler(testHandler, HashConfig{InfluxToken: token})
+		for authorization, want := range map[string]int{"Token " + token: http.StatusNoContent, "": http.StatusUnauthorized} {
+			req := httptest.NewRequest(http.MethodPost, "/api/v2/write?bucket=b", strings.NewReader(body))
+			if authorization != "" {
+				req.Header.Set("Authorization", authorization)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			assert.Equal(t, want, recorder.Code)
+		}
+	})
+}
+
+func TestParseSignaturePolicy(t *testing.T) {
+	p, err := ParseSignaturePolicy("")
+	require.NoError(t, err)
+	assert.Equal(t, SignOptional, p)
+
+	p, err = ParseSignaturePolicy("WRITES")
+	require.NoError(t, err)
+	assert.Equal(t, SignWrites, p)
+
+	_, err = ParseSignaturePolicy("sometimes")
+	assert.Error(t, err)
+}
+
 func TestRSADecryptMiddleware(t *testing.T) {
 	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		body, _ := io.ReadAll(r.Body)
@@ -263,7 +500,7 @@ func TestRSADecryptMiddleware(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/test", strings.NewReader("some data"))
 
 		recorder := httptest.NewRecorder()
-		middleware := RSADecryptMiddleware(privateKey)
+		middleware := RSADecryptMiddleware(newKeyRing(t, privateKey))
 		handler := middleware(testHandler)
 		handler.ServeHTTP(recorder, req)
 
@@ -282,7 +519,7 @@ func TestRSADecryptMiddleware(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewReader(ciphertext))
 
 		recorder := httptest.NewRecorder()
-		middleware := RSADecryptMiddleware(privateKey)
+		middleware := RSADecryptMiddleware(newKeyRing(t, privateKey))
 		handler := middleware(testHandler)
 		handler.ServeHTTP(recorder, req)
 
@@ -290,6 +527,94 @@ func TestRSADecryptMiddleware(t *testing.T) {
 		assert.Equal(t, plaintext, recorder.Body.String())
 	})
 
+	t.Run("decrypts envelope encrypted request", func(t *testing.T) {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		plaintext := strings.Repeat("large payload ", 1000)
+		ciphertext, err := crypto.EncryptEnvelope(&privateKey.PublicKey, []byte(plaintext))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewReader(ciphertext))
+		req.Header.Set(crypto.EncryptionHeader, crypto.EncryptionV2)
+
+		recorder := httptest.NewRecorder()
+		handler := RSADecryptMiddleware(newKeyRing(t, privateKey))(testHandler)
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, plaintext, recorder.Body.String())
+	})
+
+	t.Run("rejects unknown encryption version", func(t *testing.T) {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("data"))
+		req.Header.Set(crypto.EncryptionHeader, "42")
+
+		recorder := httptest.NewRecorder()
+		handler := RSADecryptMiddleware(newKeyRing(t, privateKey))(testHandler)
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("selects key by key ID", func(t *testing.T) {
+		oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		handler := RSADecryptMiddleware(newKeyRing(t, oldKey, newKey))(testHandler)
+
+		for _, key := range []*rsa.PrivateKey{oldKey, newKey} {
+			ciphertext, err := crypto.EncryptEnvelope(&key.PublicKey, []byte("rotated"))
+			require.NoError(t, err)
+			keyID, err := crypto.KeyID(&key.PublicKey)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewReader(ciphertext))
+			req.Header.Set(crypto.EncryptionHeader, crypto.EncryptionV2)
+			req.Header.Set(crypto.KeyIDHeader, keyID)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "rotated", recorder.Body.String())
+		}
+	})
+
+	t.Run("tries every key without key ID", func(t *testing.T) {
+		oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		ciphertext, err := crypto.EncryptRSA(&oldKey.PublicKey, []byte("legacy agent"))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewReader(ciphertext))
+		recorder := httptest.NewRecorder()
+		RSADecryptMiddleware(newKeyRing(t, oldKey, newKey))(testHandler).ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "legacy agent", recorder.Body.String())
+	})
+
+	t.Run("rejects unknown key ID", func(t *testing.T) {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("data"))
+		req.Header.Set(crypto.KeyIDHeader, "retired")
+
+		recorder := httptest.NewRecorder()
+		RSADecryptMiddleware(newKeyRing(t, privateKey))(testHandler).ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
 	t.Run("handles decryption failure", func(t *testing.T) {
 		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 		require.NoError(t, err)
@@ -297,7 +622,7 @@ func TestRSADecryptMiddleware(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("invalid ciphertext"))
 
 		recorder := httptest.NewRecorder()
-		middleware := RSADecryptMiddleware(privateKey)
+		middleware := RSADecryptMiddleware(newKeyRing(t, privateKey))
 		handler := middleware(testHandler)
 		handler.ServeHTTP(recorder, req)
 
@@ -313,7 +638,7 @@ func TestRSADecryptMiddleware(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/test", errorReader)
 
 		recorder := httptest.NewRecorder()
-		middleware := RSADecryptMiddleware(privateKey)
+		middleware := RSADecryptMiddleware(newKeyRing(t, privateKey))
 		handler := middleware(testHandler)
 		handler.ServeHTTP(recorder, req)
 
@@ -393,6 +718,36 @@ func TestHashResponseWriter(t *testing.T) {
 	})
 }
 
+func TestHashHandler_CountsFailures(t *testing.T) {
+	key := "secret_key"
+	handler := HashHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		HashConfig{Key: key, Policy: SignAll})
+
+	missing := telemetry.SignatureFailures.Value("http", "missing")
+	mismatch := telemetry.SignatureFailures.Value("http", "mismatch")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), newSignedRequest("other_key", "/test", "body", time.Now(), "nonce-1"))
+
+	assert.Equal(t, missing+1, telemetry.SignatureFailures.Value("http", "missing"))
+	assert.Equal(t, mismatch+1, telemetry.SignatureFailures.Value("http", "mismatch"))
+}
+
+func newSignedRequest(key, path, body string, ts time.Time, nonce string) *http.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(crypto.TimestampHeader, timestamp)
+	req.Header.Set(crypto.NonceHeader, nonce)
+	req.Header.Set(crypto.HashHeader, hex.EncodeToString(crypto.SignRequest(key, http.MethodPost, path, timestamp, nonce, []byte(body))))
+	return req
+}
+
+func newKeyRing(t *testing.T, keys ...*rsa.PrivateKey) *crypto.KeyRing {
+	kr, err := crypto.NewKeyRing(keys...)
+	require.NoError(t, err)
+	return kr
+}
+
 // Helper type for testing read errors
 type errorReader struct{}
 
@@ -422,7 +777,7 @@ func BenchmarkHashHandler(b *testing.B) {
 		w.Write([]byte("benchmark response"))
 	})
 
-	handler := HashHandler(testHandler, "secret_key")
+	handler := HashHandler(testHandler, HashConfig{Key: "secret_key"})
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceCacheSize bounds the number of remembered request nonces.
+const nonceCacheSize = 100000
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// nonceCache remembers nonces of accepted requests until they expire.
+// Unexpired nonces are never evicted, so a request can not be replayed within the skew window.
+// When the cache is full of them new requests are rejected until the oldest nonces expire.
+type nonceCache struct {
+	mu      sync.Mutex
+	limit   int
+	ttl     time.Duration
+	entries map[string]time.Time
+	order   []nonceEntry
+}
+
+func newNonceCache(limit int, ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		limit:   limit,
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// add records the nonce. It returns errSignatureReplay if the nonce was already seen and has not expired
+// and errNonceCacheFull if limit unexpired nonces are remembered.
+func (c *nonceCache) add(nonce string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.order) > 0 && !c.order[0].expires.After(now) {
+		c.evictOldest()
+	}
+
+	if _, ok := c.entries[nonce]; ok {
+		return errSignatureReplay
+	}
+	if len(c.order) >= c.limit {
+		return errNonceCacheFull
+	}
+
+	expires := now.Add(c.ttl)
+	c.entries[nonce] = expires
+	c.order = append(c.order, nonceEntry{nonce: nonce, expires: expires})
+	return nil
+}
+
+func (c *nonceCache) evictOldest() {
+	oldest := c.order[0]
+	if c.entries[oldest.nonce].Equal(oldest.expires) {
+		delete(c.entries, oldest.nonce)
+	}
+	c.order = c.order[1:]
+}
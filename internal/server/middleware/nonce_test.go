@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceCache(t *testing.T) {
+	now := time.Now()
+
+	t.Run("rejects duplicate until expiry", func(t *testing.T) {
+		c := newNonceCache(10, time.Minute)
+		assert.NoError(t, c.add("a", now))
+		assert.ErrorIs(t, c.add("a", now.Add(30*time.Second)), errSignatureReplay)
+		assert.NoError(t, c.add("a", now.Add(2*time.Minute)))
+	})
+
+	t.Run("rejects new nonces when full of unexpired ones", func(t *testing.T) {
+		c := newNonceCache(2, time.Hour)
+		assert.NoError(t, c.add("a", now))
+		assert.NoError(t, c.add("b", now.Add(time.Minute)))
+		assert.ErrorIs(t, c.add("c", now), errNonceCacheFull)
+		assert.Len(t, c.entries, 2)
+		// Непросроченные nonce не вытесняются, повтор по-прежнему отклоняется
+		assert.ErrorIs(t, c.add("a", now), errSignatureReplay)
+
+		// После истечения старейшего nonce место освобождается
+		assert.NoError(t, c.add("c", now.Add(time.Hour)))
+		assert.ErrorIs(t, c.add("b", now.Add(time.Hour)), errSignatureReplay)
+	})
+
+	t.Run("drops expired entries", func(t *testing.T) {
+		c := newNonceCache(10, time.Minute)
+		c.add("a", now)
+		c.add("b", now)
+		c.add("c", now.Add(2*time.Minute))
+		assert.Len(t, c.entries, 1)
+	})
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIPHeader carries the address of the agent that sent the request.
+const RealIPHeader = "X-Real-IP"
+
+// ParseTrustedSubnets parses a comma-separated list of CIDRs, empty string gives no subnets.
+func ParseTrustedSubnets(s string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted subnet %q: %w", part, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// TrustedSubnetMiddleware rejects write requests with 403 unless RealIPHeader belongs to one of subnets.
+// Third-party clients of token authenticated endpoints, such as Telegraf writing to /api/v2/write,
+// do not send RealIPHeader, so the remote address of the connection is checked for them instead,
+// as the Graphite listener does. Empty subnets disable the check.
+func TrustedSubnetMiddleware(subnets []*net.IPNet) func(http.Handler) http.Handler {
+	if len(subnets) == 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !IsWriteRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ip := requestIP(r)
+			if ip == nil || !containsIP(subnets, ip) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestIP returns the agent address of the request, nil if it is missing or malformed.
+func requestIP(r *http.Request) net.IP {
+	if !isTokenRequest(r) {
+		return net.ParseIP(strings.TrimSpace(r.Header.Get(RealIPHeader)))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedSubnets(t *testing.T) {
+	t.Run("empty string", func(t *testing.T) {
+		subnets, err := ParseTrustedSubnets("")
+		require.NoError(t, err)
+		assert.Empty(t, subnets)
+	})
+
+	t.Run("list of subnets", func(t *testing.T) {
+		subnets, err := ParseTrustedSubnets("10.0.0.0/8, 192.168.1.0/24,,fd00::/8")
+		require.NoError(t, err)
+		require.Len(t, subnets, 3)
+		assert.Equal(t, "192.168.1.0/24", subnets[1].String())
+	})
+
+	t.Run("invalid CIDR", func(t *testing.T) {
+		_, err := ParseTrustedSubnets("10.0.0.1")
+		assert.Error(t, err)
+	})
+}
+
+func TestTrustedSubnetMiddleware(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	subnets, err := ParseTrustedSubnets("10.0.0.0/8,192.168.1.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		realIP     string
+		remoteAddr string
+		want       int
+	}{
+		{"trusted write", http.MethodPost, "/updates/", "10.1.2.3", "", http.StatusOK},
+		{"second subnet", http.MethodPost, "/update/gauge/g/1", "192.168.1.5", "", http.StatusOK},
+		{"untrusted write", http.MethodPost, "/updates/", "192.168.2.5", "", http.StatusForbidden},
+		{"missing header", http.MethodPost, "/updates/", "", "10.1.2.3:1234", http.StatusForbidden},
+		{"malformed header", http.MethodPost, "/updates/", "not-an-ip", "", http.StatusForbidden},
+		{"read from anywhere", http.MethodGet, "/", "8.8.8.8", "", http.StatusOK},
+		{"influx write from trusted address", http.MethodPost, "/api/v2/write", "", "10.1.2.3:1234", http.StatusOK},
+		{"influx write from untrusted address", http.MethodPost, "/api/v2/write", "10.1.2.3", "8.8.8.8:1234", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.realIP != "" {
+				req.Header.Set(RealIPHeader, tt.realIP)
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+
+			recorder := httptest.NewRecorder()
+			TrustedSubnetMiddleware(subnets)(testHandler).ServeHTTP(recorder, req)
+
+			assert.Equal(t, tt.want, recorder.Code)
+		})
+	}
+
+	t.Run("no subnets disables check", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+
+		recorder := httptest.NewRecorder()
+		TrustedSubnetMiddleware(nil)(testHandler).ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+}
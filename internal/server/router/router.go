@@ -2,16 +2,88 @@
 package router
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/antonminaichev/metricscollector/internal/server/handlers"
+	"github.com/antonminaichev/metricscollector/internal/server/influx"
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	"github.com/antonminaichev/metricscollector/internal/server/telemetry"
 	"github.com/go-chi/chi"
 )
 
+// seriesReader selects series of storages that do not implement storage.SeriesReader.
+type seriesReader struct {
+	storage.MetricReader
+}
+
+func (r seriesReader) FindSeries(ctx context.Context, matchers []*storage.Matcher) ([]storage.Metric, error) {
+	return storage.SelectSeries(ctx, r.MetricReader, matchers)
+}
+
+// newSeriesReader returns s as a storage.SeriesReader, falling back to a full scan.
+func newSeriesReader(s storage.Storage) storage.SeriesReader {
+	if sr, ok := s.(storage.SeriesReader); ok {
+		return sr
+	}
+	return seriesReader{s}
+}
+
+// noHistory is the history of storages that do not implement storage.HistoryReader.
+type noHistory struct{}
+
+func (noHistory) GetHistory(context.Context, string, storage.MetricType, time.Time, time.Time) ([]storage.Sample, error) {
+	return nil, storage.ErrHistoryDisabled
+}
+
+// noRollups are the rollups of storages that do not implement storage.RollupReader.
+type noRollups struct{}
+
+func (noRollups) GetRollups(context.Context, string, storage.MetricType, storage.Resolution, time.Time, time.Time) ([]storage.Rollup, error) {
+	return nil, storage.ErrRollupsDisabled
+}
+
+// newHistoryReader returns s as a storage.HistoryReader, a storage without history answers storage.ErrHistoryDisabled
+// the same way as telemetry.InstrumentedStorage does.
+func newHistoryReader(s storage.Storage) storage.HistoryReader {
+	if hr, ok := s.(storage.HistoryReader); ok {
+		return hr
+	}
+	return noHistory{}
+}
+
+// newRollupReader returns s as a storage.RollupReader, a storage without rollups answers storage.ErrRollupsDisabled.
+func newRollupReader(s storage.Storage) storage.RollupReader {
+	if rr, ok := s.(storage.RollupReader); ok {
+		return rr
+	}
+	return noRollups{}
+}
+
+// Option configures the router.
+type Option func(*options)
+
+type options struct {
+	influxMapping *influx.Mapping
+}
+
+// WithInfluxMapping sets how InfluxDB line protocol points are mapped to metrics.
+func WithInfluxMapping(m *influx.Mapping) Option {
+	return func(o *options) {
+		o.influxMapping = m
+	}
+}
+
 // NewRouter creates a router with a handlers layout.
-func NewRouter(s storage.Storage) chi.Router {
+func NewRouter(s storage.Storage, opts ...Option) chi.Router {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	r := chi.NewRouter()
+	r.Use(telemetry.HTTPMiddleware)
 	r.Route("/", func(r chi.Router) {
 		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			handlers.PrintAllMetrics(w, r, s)
@@ -35,8 +107,27 @@ func NewRouter(s storage.Storage) chi.Router {
 			handlers.GetMetricJSON(w, r, s)
 		})
 		r.Get("/health", handlers.HealthCheck)
+		r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			handlers.PrometheusMetrics(w, r, s)
+		})
+		r.Get("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+			handlers.FindSeries(w, r, newSeriesReader(s))
+		})
+		r.Get("/api/v1/aggregate", func(w http.ResponseWriter, r *http.Request) {
+			handlers.AggregateSeries(w, r, newSeriesReader(s))
+		})
+		r.Get("/api/v1/query_range", func(w http.ResponseWriter, r *http.Request) {
+			handlers.QueryRange(w, r, newHistoryReader(s), newSeriesReader(s))
+		})
+		r.Get("/api/v1/rollups", func(w http.ResponseWriter, r *http.Request) {
+			handlers.QueryRollups(w, r, newRollupReader(s), newSeriesReader(s))
+		})
+		r.Post("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+			handlers.InfluxWrite(w, r, s, o.influxMapping)
+		})
+		r.Get("/internal/metrics", telemetry.Default.Handler().ServeHTTP)
 		r.Get("/value/{type}/{metric}", func(w http.ResponseWriter, r *http.Request) {
-			handlers.GetMetric(w, r, s)
+			handlers.GetMetric(w, r, s, newSeriesReader(s))
 		})
 		r.Post("/update/{type}/{metric}/{value}", func(w http.ResponseWriter, r *http.Request) {
 			handlers.PostMetric(w, r, s)
@@ -11,13 +11,16 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/antonminaichev/metricscollector/internal/logger"
+	"github.com/antonminaichev/metricscollector/internal/server/influx"
 	"github.com/antonminaichev/metricscollector/internal/server/middleware"
 	st "github.com/antonminaichev/metricscollector/internal/server/storage"
 	fs "github.com/antonminaichev/metricscollector/internal/server/storage/file"
 	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
+	"github.com/antonminaichev/metricscollector/internal/server/telemetry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -98,6 +101,31 @@ func TestPostMetric(t *testing.T) {
 			url:  "/update/gauge/testGauge/abc",
 			want: http.StatusBadRequest,
 		},
+		{
+			name: "Positive summary",
+			url:  "/update/summary/testSummary/0.25",
+			want: http.StatusOK,
+		},
+		{
+			name: "Infinite summary observation",
+			url:  "/update/summary/testSummary/Inf",
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "Positive set member",
+			url:  "/update/set/testSet/alice",
+			want: http.StatusOK,
+		},
+		{
+			name: "Name with labels",
+			url:  "/update/counter/testCounter%7Bhost=%22a%22%7D/1",
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "Name with label separators",
+			url:  "/update/gauge/testGauge,host=a/1",
+			want: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range testTable {
@@ -206,6 +234,104 @@ func TestPrintAllMetrics(t *testing.T) {
 	assert.Contains(t, body, "5432.21234")
 }
 
+func TestPrometheusMetrics(t *testing.T) {
+	storage := ms.NewMemoryStorage()
+	ts := httptest.NewServer(NewRouter(storage))
+	defer ts.Close()
+
+	delta := int64(52)
+	storage.UpdateMetric(context.Background(), "testCounter", st.Counter, &delta, nil)
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/metrics")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	assert.Contains(t, body, "testCounter_total 52")
+}
+
+func TestQueryRange(t *testing.T) {
+	storage := ms.NewMemoryStorage()
+	ts := httptest.NewServer(NewRouter(storage))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodPost, "/update/gauge/HeapAlloc/42.5")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/api/v1/query_range?id=HeapAlloc&type=gauge&step=1m")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"value":42.5`)
+
+	// Метрики агента хранятся с метками, имя без меток указывает на единственную серию
+	require.NoError(t, storage.UpdateMetric(context.Background(), `Alloc{host="h",instance="i"}`, st.Gauge, nil, newFloat64(7)))
+	resp, body = testRequest(t, ts, http.MethodGet, "/api/v1/query_range?id=Alloc&type=gauge&step=1m")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"value":7`)
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/value/gauge/Alloc")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "7", body)
+}
+
+func TestAggregate(t *testing.T) {
+	storage := ms.NewMemoryStorage()
+	ts := httptest.NewServer(NewRouter(storage))
+	defer ts.Close()
+
+	ctx := context.Background()
+	require.NoError(t, storage.UpdateMetric(ctx, `Alloc{instance="a"}`, st.Gauge, nil, newFloat64(1)))
+	require.NoError(t, storage.UpdateMetric(ctx, `Alloc{instance="b"}`, st.Gauge, nil, newFloat64(2)))
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/api/v1/aggregate?match=Alloc")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"value":3,"series":2`)
+}
+
+func TestRollups_NotSupported(t *testing.T) {
+	for name, s := range map[string]st.Storage{
+		"plain":        ms.NewMemoryStorage(),
+		"instrumented": telemetry.NewInstrumentedStorage(ms.NewMemoryStorage(), "memory"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(NewRouter(s))
+			defer ts.Close()
+
+			resp, _ := testRequest(t, ts, http.MethodGet, "/api/v1/rollups?id=HeapAlloc&type=gauge")
+			assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+		})
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	store := ms.NewMemoryStorage()
+	mapping, err := influx.ParseMapping("", "cpu")
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewRouter(store, WithInfluxMapping(mapping)))
+	defer ts.Close()
+
+	resp, err := ts.Client().Post(ts.URL+"/api/v2/write?org=o&bucket=b", "text/plain", strings.NewReader("cpu,cpu=cpu0 usage_idle=97.5\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	_, value, err := store.GetMetric(context.Background(), "cpu_cpu0_usage_idle", st.Gauge)
+	require.NoError(t, err)
+	assert.Equal(t, 97.5, *value)
+}
+
+func TestInternalMetrics(t *testing.T) {
+	storage := ms.NewMemoryStorage()
+	ts := httptest.NewServer(NewRouter(storage))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodPost, "/update/counter/c/1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/internal/metrics")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// Маршрут записывается шаблоном, а не конкретным путем
+	assert.Contains(t, body, `metricscollector_http_requests_total{method="POST",route="/update/{type}/{metric}/{value}",status="200"}`)
+	assert.NotContains(t, body, "/update/counter/c/1")
+}
+
 func BenchmarkServer_FileStorageUpdate(b *testing.B) {
 	// создаем временный файл для хранения метрик
 	tmpFile := filepath.Join(os.TempDir(), "metrics_benchmark.json")
@@ -2,7 +2,10 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os/signal"
 	"syscall"
@@ -10,61 +13,178 @@ import (
 
 	"github.com/antonminaichev/metricscollector/internal/crypto"
 	"github.com/antonminaichev/metricscollector/internal/logger"
+	"github.com/antonminaichev/metricscollector/internal/server/graphite"
+	"github.com/antonminaichev/metricscollector/internal/server/grpcserver"
+	"github.com/antonminaichev/metricscollector/internal/server/influx"
 	"github.com/antonminaichev/metricscollector/internal/server/middleware"
 	"github.com/antonminaichev/metricscollector/internal/server/router"
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
 	db "github.com/antonminaichev/metricscollector/internal/server/storage/database"
 	fs "github.com/antonminaichev/metricscollector/internal/server/storage/file"
 	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
+	"github.com/antonminaichev/metricscollector/internal/server/telemetry"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // Config stores server setting.
 type Config struct {
-	Address            string `env:"ADDRESS"`
-	LogLevel           string `env:"LOG_LEVEL"`
-	StoreInterval      int    `env:"STORE_INTERVAL"`
-	FileStoragePath    string `env:"FILE_STORAGE_PATH"`
-	Restore            bool   `env:"RESTORE"`
-	DatabaseConnection string `env:"DATABASE_DSN"`
-	HashKey            string `env:"KEY"`
-	CryptoKey          string `env:"CRYPTO_KEY"`
+	Address               string `env:"ADDRESS"`
+	LogLevel              string `env:"LOG_LEVEL"`
+	StoreInterval         int    `env:"STORE_INTERVAL"`
+	FileStoragePath       string `env:"FILE_STORAGE_PATH"`
+	Restore               bool   `env:"RESTORE"`
+	DatabaseConnection    string `env:"DATABASE_DSN"`
+	HashKey               string `env:"KEY"`
+	CryptoKey             string `env:"CRYPTO_KEY"`
+	HashMaxSkew           int    `env:"HASH_MAX_SKEW"`
+	HashPolicy            string `env:"HASH_POLICY"`
+	TrustedSubnet         string `env:"TRUSTED_SUBNET"`
+	GRPCAddress           string `env:"GRPC_ADDRESS"`
+	TLSCert               string `env:"TLS_CERT"`
+	TLSKey                string `env:"TLS_KEY"`
+	TLSClientCA           string `env:"TLS_CLIENT_CA"`
+	HistoryRetention      int    `env:"HISTORY_RETENTION"`
+	RollupRetentionMinute int    `env:"ROLLUP_RETENTION_1M"`
+	RollupRetentionHour   int    `env:"ROLLUP_RETENTION_1H"`
+	GraphiteAddress       string `env:"GRAPHITE_ADDRESS"`
+	GraphiteCounters      string `env:"GRAPHITE_COUNTERS"`
+	InfluxCounters        string `env:"INFLUX_COUNTERS"`
+	InfluxNameTags        string `env:"INFLUX_NAME_TAGS"`
+	InfluxToken           string `env:"INFLUX_TOKEN"`
 }
 
-func StartServer(addr string, storage storage.Storage, hashKey string, privKeyPath string) error {
-	privKey, err := crypto.LoadPrivateKey(privKeyPath)
+// keyReloadInterval is how often private keys are re-read, so rotated keys are picked up without restart.
+const keyReloadInterval = time.Minute
+
+func StartServer(cfg *Config, storage storage.Storage) error {
+	policy, err := middleware.ParseSignaturePolicy(cfg.HashPolicy)
+	if err != nil {
+		return err
+	}
+
+	subnets, err := middleware.ParseTrustedSubnets(cfg.TrustedSubnet)
+	if err != nil {
+		return err
+	}
+
+	graphiteRules, err := graphite.ParseCounterRules(cfg.GraphiteCounters)
 	if err != nil {
-		log.Fatalf("Failed to load private key: %v", err)
+		return err
+	}
+
+	influxMapping, err := influx.ParseMapping(cfg.InfluxCounters, cfg.InfluxNameTags)
+	if err != nil {
+		return err
+	}
+
+	keys, err := crypto.LoadKeyRing(cfg.CryptoKey)
+	if err != nil {
+		log.Fatalf("Failed to load private keys: %v", err)
+	}
+
+	var tlsCfg *tls.Config
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		tlsCfg, err = crypto.ServerTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			return err
+		}
+	} else if cfg.TLSClientCA != "" {
+		return errors.New("client CA requires server TLS certificate and key")
+	}
+
+	if cfg.InfluxToken != "" && cfg.InfluxToken == cfg.HashKey {
+		return errors.New("influx token must differ from the hash key")
+	}
+	hashCfg := middleware.HashConfig{
+		Key:         cfg.HashKey,
+		MaxSkew:     time.Duration(cfg.HashMaxSkew) * time.Second,
+		Policy:      policy,
+		InfluxToken: cfg.InfluxToken,
 	}
 
 	server := &http.Server{
-		Addr: addr,
+		Addr:      cfg.Address,
+		TLSConfig: tlsCfg,
 		Handler: logger.WithLogging(
-			middleware.HashHandler(
-				middleware.RSADecryptMiddleware(privKey)(
-					middleware.GzipHandler(
-						router.NewRouter(storage),
+			middleware.TrustedSubnetMiddleware(subnets)(
+				middleware.ClientCertIdentity(
+					middleware.HashHandler(
+						middleware.RSADecryptMiddleware(keys)(
+							middleware.GzipHandler(
+								router.NewRouter(storage, router.WithInfluxMapping(influxMapping)),
+							),
+						),
+						hashCfg,
 					),
 				),
-				hashKey,
 			),
 		),
 	}
 
+	grpcOpts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(
+		logger.UnaryLoggingInterceptor,
+		middleware.TrustedSubnetInterceptor(subnets, grpcserver.IsWriteMethod),
+		middleware.HashInterceptor(hashCfg, grpcserver.IsWriteMethod),
+	)}
+	if tlsCfg != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	grpcServer := grpcserver.NewServer(storage, grpcOpts...)
+
 	ctx, stop := signal.NotifyContext(context.Background(),
 		syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	defer stop()
 
-	errCh := make(chan error, 1)
+	if keys != nil {
+		logger.Log.Info("Loaded private keys", zap.Strings("key_ids", keys.IDs()))
+		go reloadKeys(ctx, keys, keyReloadInterval)
+	}
+
+	errCh := make(chan error, 3)
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
+		var err error
+		if tlsCfg != nil {
+			// Сертификат уже загружен в TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
 			errCh <- err
-			return
 		}
-		close(errCh)
 	}()
 
+	if cfg.GRPCAddress != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			return err
+		}
+		logger.Log.Info("Starting gRPC server", zap.String("address", cfg.GRPCAddress))
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+
+	var graphiteServer *graphite.Server
+	if cfg.GraphiteAddress != "" {
+		lis, err := net.Listen("tcp", cfg.GraphiteAddress)
+		if err != nil {
+			return err
+		}
+		graphiteServer = graphite.NewServer(storage, graphiteRules, subnets)
+		logger.Log.Info("Starting Graphite listener", zap.String("address", cfg.GraphiteAddress))
+		go func() {
+			if err := graphiteServer.Serve(lis); err != nil && !errors.Is(err, graphite.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+
 	select {
 	case <-ctx.Done():
 		logger.Log.Info("Shutdown signal received, stopping HTTP…")
@@ -75,6 +195,10 @@ func StartServer(addr string, storage storage.Storage, hashKey string, privKeyPa
 		if err := server.Shutdown(shCtx); err != nil {
 			logger.Log.Warn("Shutdown error", zap.Error(err))
 		}
+		grpcServer.GracefulStop()
+		if graphiteServer != nil {
+			graphiteServer.Stop()
+		}
 
 		logger.Log.Info("Server shutdown complete")
 		return nil
@@ -84,10 +208,48 @@ func StartServer(addr string, storage storage.Storage, hashKey string, privKeyPa
 	}
 }
 
-func SetupStorage(DSN string, fspath string, restore bool, storeInterval int) (storage.Storage, error) {
+func reloadKeys(ctx context.Context, keys *crypto.KeyRing, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := keys.Reload(); err != nil {
+				logger.Log.Error("Failed to reload private keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+// RollupRetention is how long database rollups are kept per resolution.
+type RollupRetention struct {
+	Minute time.Duration
+	Hour   time.Duration
+}
+
+// SetupStorage creates the storage backend.
+// Positive historyRetention enables metric history in file and database storages
+// and limits the age of recent samples always kept by memory storage.
+// Database rollups are maintained for resolutions with positive rollupRetention.
+// File storage saves values on every write and, together with history, every storeInterval seconds.
+func SetupStorage(DSN string, fspath string, restore bool, storeInterval int, historyRetention time.Duration, rollupRetention RollupRetention) (storage.Storage, error) {
 	if DSN != "" {
 		logger.Log.Info("Connecting to database", zap.String("dsn", DSN))
-		return db.NewPostgresStorage(DSN)
+		pg, err := db.NewPostgresStorage(DSN)
+		if err != nil {
+			return nil, err
+		}
+		if historyRetention > 0 {
+			pg.EnableHistory(historyRetention)
+		}
+		if rollupRetention.Minute > 0 || rollupRetention.Hour > 0 {
+			pg.EnableRollups(rollupRetention.Minute, rollupRetention.Hour)
+		}
+		go startPeriodicCleanup(pg, cleanupInterval)
+		return telemetry.NewInstrumentedStorage(pg, "postgres"), nil
 	}
 
 	if fspath != "" {
@@ -96,6 +258,9 @@ func SetupStorage(DSN string, fspath string, restore bool, storeInterval int) (s
 			return nil, err
 		}
 		logger.Log.Info("Using file storage", zap.String("path", fspath))
+		if historyRetention > 0 {
+			fs.EnableHistory(historyRetention)
+		}
 
 		if restore {
 			if err := fs.LoadMetrics(); err != nil {
@@ -103,16 +268,27 @@ func SetupStorage(DSN string, fspath string, restore bool, storeInterval int) (s
 			}
 		}
 
-		go startPeriodicSave(fs, storeInterval)
-		return fs, nil
+		saveInterval := time.Duration(storeInterval) * time.Second
+		if saveInterval <= 0 {
+			saveInterval = syncStoreSaveInterval
+		}
+		go startPeriodicSave(fs, saveInterval)
+		return telemetry.NewInstrumentedStorage(fs, "file"), nil
 	}
 
 	logger.Log.Info("Using in-memory storage")
-	return ms.NewMemoryStorage(), nil
+	mem := ms.NewMemoryStorage()
+	if historyRetention > 0 {
+		mem.EnableHistory(historyRetention)
+	}
+	return telemetry.NewInstrumentedStorage(mem, "memory"), nil
 }
 
-func startPeriodicSave(fs *fs.FileStorage, interval int) {
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+// syncStoreSaveInterval is how often history is saved with zero storeInterval.
+const syncStoreSaveInterval = time.Minute
+
+func startPeriodicSave(fs *fs.FileStorage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
@@ -121,3 +297,17 @@ func startPeriodicSave(fs *fs.FileStorage, interval int) {
 		}
 	}
 }
+
+// cleanupInterval is how often expired rows are deleted from the database.
+const cleanupInterval = time.Minute
+
+func startPeriodicCleanup(pg *db.PostgresStorage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := pg.DeleteExpired(context.Background(), time.Now()); err != nil {
+			logger.Log.Error("Failed to delete expired database rows", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBatchHistory is the number of applied batch IDs remembered per agent by in-process storages.
+const DefaultBatchHistory = 1000
+
+// BatchRetention is how long applied batch IDs are remembered, agents idle for longer are forgotten.
+const BatchRetention = 24 * time.Hour
+
+// batchPruneInterval is how often Add forgets idle agents.
+const batchPruneInterval = time.Minute
+
+// AppliedBatches remembers a bounded number of recently applied batch IDs per agent.
+// The agent is the part of the ID before the last slash, as in "agent/seq", so a busy fleet does not
+// evict IDs of other agents. The oldest IDs of an agent are evicted first.
+// It is not safe for concurrent use.
+type AppliedBatches struct {
+	limit  int
+	agents map[string]*agentBatches
+	// pruned is the time of the last pruning of idle agents.
+	pruned time.Time
+}
+
+// agentBatches are applied batch IDs of a single agent.
+type agentBatches struct {
+	ids   map[string]struct{}
+	order []string
+	// last is the time of the last applied batch.
+	last time.Time
+}
+
+// NewAppliedBatches creates a batch log that remembers up to limit IDs per agent.
+func NewAppliedBatches(limit int) *AppliedBatches {
+	return &AppliedBatches{
+		limit:  limit,
+		agents: make(map[string]*agentBatches),
+	}
+}
+
+// batchAgent returns the agent part of a batch ID, IDs without a slash share the empty agent.
+func batchAgent(id string) string {
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+// Seen reports whether the batch ID was already applied.
+func (a *AppliedBatches) Seen(id string) bool {
+	agent, ok := a.agents[batchAgent(id)]
+	if !ok {
+		return false
+	}
+	_, ok = agent.ids[id]
+	return ok
+}
+
+// Add records the batch ID as applied.
+func (a *AppliedBatches) Add(id string) {
+	a.add(id, time.Now())
+}
+
+func (a *AppliedBatches) add(id string, now time.Time) {
+	if now.Sub(a.pruned) >= batchPruneInterval {
+		a.prune(now)
+	}
+	name := batchAgent(id)
+	agent, ok := a.agents[name]
+	if !ok {
+		agent = &agentBatches{ids: make(map[string]struct{})}
+		a.agents[name] = agent
+	}
+	agent.last = now
+	if _, ok := agent.ids[id]; ok {
+		return
+	}
+	agent.ids[id] = struct{}{}
+	agent.order = append(agent.order, id)
+	if len(agent.order) > a.limit {
+		delete(agent.ids, agent.order[0])
+		agent.order = agent.order[1:]
+	}
+}
+
+// prune forgets agents without applied batches for BatchRetention.
+func (a *AppliedBatches) prune(now time.Time) {
+	a.pruned = now
+	for name, agent := range a.agents {
+		if now.Sub(agent.last) > BatchRetention {
+			delete(a.agents, name)
+		}
+	}
+}
+
+// MarshalJSON encodes remembered IDs of every agent from the oldest to the newest.
+func (a *AppliedBatches) MarshalJSON() ([]byte, error) {
+	names := make([]string, 0, len(a.agents))
+	for name := range a.agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ids := []string{}
+	for _, name := range names {
+		ids = append(ids, a.agents[name].order...)
+	}
+	return json.Marshal(ids)
+}
+
+// UnmarshalJSON restores remembered IDs keeping the configured limit.
+// Restored agents are kept for BatchRetention from now.
+func (a *AppliedBatches) UnmarshalJSON(data []byte) error {
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+	if a.limit == 0 {
+		a.limit = DefaultBatchHistory
+	}
+	a.agents = make(map[string]*agentBatches)
+	now := time.Now()
+	for _, id := range ids {
+		a.add(id, now)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppliedBatches(t *testing.T) {
+	t.Run("evicts oldest IDs", func(t *testing.T) {
+		b := NewAppliedBatches(2)
+		b.Add("a")
+		b.Add("b")
+		b.Add("c")
+
+		assert.False(t, b.Seen("a"))
+		assert.True(t, b.Seen("b"))
+		assert.True(t, b.Seen("c"))
+	})
+
+	t.Run("duplicate add does not evict", func(t *testing.T) {
+		b := NewAppliedBatches(2)
+		b.Add("a")
+		b.Add("b")
+		b.Add("b")
+
+		assert.True(t, b.Seen("a"))
+		assert.True(t, b.Seen("b"))
+	})
+
+	t.Run("limit is per agent", func(t *testing.T) {
+		b := NewAppliedBatches(2)
+		b.Add("agent1/1")
+		for i := 0; i < 10; i++ {
+			b.Add(fmt.Sprintf("agent2/%d", i))
+		}
+
+		// Пакеты других агентов не вытесняют последние пакеты агента
+		assert.True(t, b.Seen("agent1/1"))
+		assert.False(t, b.Seen("agent2/7"))
+		assert.True(t, b.Seen("agent2/9"))
+	})
+
+	t.Run("idle agents are forgotten after retention", func(t *testing.T) {
+		b := NewAppliedBatches(2)
+		now := time.Now()
+		b.add("agent1/1", now)
+		b.add("agent2/1", now.Add(BatchRetention))
+		assert.True(t, b.Seen("agent1/1"))
+
+		b.add("agent2/2", now.Add(BatchRetention+time.Hour))
+		assert.False(t, b.Seen("agent1/1"))
+		assert.True(t, b.Seen("agent2/1"))
+	})
+
+	t.Run("json round trip", func(t *testing.T) {
+		b := NewAppliedBatches(10)
+		b.Add("a")
+		b.Add("b")
+
+		data, err := json.Marshal(b)
+		require.NoError(t, err)
+		assert.JSONEq(t, `["a","b"]`, string(data))
+
+		restored := NewAppliedBatches(10)
+		require.NoError(t, json.Unmarshal(data, restored))
+		assert.True(t, restored.Seen("a"))
+		assert.True(t, restored.Seen("b"))
+		assert.False(t, restored.Seen("c"))
+	})
+}
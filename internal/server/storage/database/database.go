@@ -3,16 +3,70 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/antonminaichev/metricscollector/internal/hll"
 	"github.com/antonminaichev/metricscollector/internal/retry"
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+// batchRetention is how long applied batch IDs are remembered.
+const batchRetention = storage.BatchRetention
+
+const upsertMetricQuery = `
+		INSERT INTO metrics (id, type, delta, value)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id, type) DO UPDATE
+		SET delta = $3 + metrics.delta, value = $4`
+
+// recordHistoryQuery copies the current metric value to history.
+const recordHistoryQuery = `
+		INSERT INTO metric_history (id, type, ts, delta, value)
+		SELECT id, type, $3, delta, value FROM metrics WHERE id = $1 AND type = $2`
+
+// Tables keeping aggregated metric state as JSON.
+const (
+	histogramsTable = "metric_histograms"
+	summariesTable  = "metric_summaries"
+	setsTable       = "metric_sets"
+)
+
+// rollupTable describes a rollup table of a single resolution.
+type rollupTable struct {
+	res   storage.Resolution
+	table string
+	// unit is the date_trunc unit matching the resolution.
+	unit string
+}
+
+var rollupTables = []rollupTable{
+	{storage.RollupMinute, "metric_rollup_1m", "minute"},
+	{storage.RollupHour, "metric_rollup_1h", "hour"},
+}
+
+// upsertRollupQuery folds the current metric value and the written counter increment $4
+// into the rollup bucket, %[1]s is the table and %[2]s the unit.
+const upsertRollupQuery = `
+		INSERT INTO %[1]s AS r (id, type, bucket, min, max, sum, count, last, increase)
+		SELECT id, type, date_trunc('%[2]s', $3::timestamptz), v, v, v, 1, v, $4
+		FROM (SELECT id, type, COALESCE(delta::double precision, value) AS v FROM metrics WHERE id = $1 AND type = $2) m
+		ON CONFLICT (id, type, bucket) DO UPDATE
+		SET min = LEAST(r.min, EXCLUDED.min), max = GREATEST(r.max, EXCLUDED.max),
+			sum = r.sum + EXCLUDED.sum, count = r.count + 1, last = EXCLUDED.last,
+			increase = r.increase + EXCLUDED.increase`
+
 // PostgresStorage realieses storage interface for postgresDB.
 type PostgresStorage struct {
 	db *sql.DB
+	// historyRetention is how long samples are kept in metric_history, zero disables history.
+	historyRetention time.Duration
+	// rollupRetention is how long buckets are kept per resolution, missing resolutions are not maintained.
+	rollupRetention map[storage.Resolution]time.Duration
 }
 
 // NewPostgresStorage creates new PostgreSQL storage.
@@ -36,35 +90,289 @@ func NewPostgresStorage(connStr string) (*PostgresStorage, error) {
 }
 
 func (s *PostgresStorage) initTable() error {
-	query := `
+	queries := []string{`
 		CREATE TABLE IF NOT EXISTS metrics (
 			id VARCHAR NOT NULL,
 			type VARCHAR NOT NULL,
 			delta BIGINT,
 			value DOUBLE PRECISION,
 			PRIMARY KEY (id, type)
-		)`
+		)`, `
+		CREATE TABLE IF NOT EXISTS applied_batches (
+			batch_id VARCHAR PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`CREATE INDEX IF NOT EXISTS applied_batches_applied_at_idx ON applied_batches (applied_at)`, `
+		CREATE TABLE IF NOT EXISTS metric_history (
+			id VARCHAR NOT NULL,
+			type VARCHAR NOT NULL,
+			ts TIMESTAMPTZ NOT NULL,
+			delta BIGINT,
+			value DOUBLE PRECISION
+		)`,
+		`CREATE INDEX IF NOT EXISTS metric_history_id_type_ts_idx ON metric_history (id, type, ts)`,
+		`CREATE INDEX IF NOT EXISTS metric_history_ts_idx ON metric_history (ts)`, `
+		CREATE TABLE IF NOT EXISTS ` + histogramsTable + ` (
+			id VARCHAR PRIMARY KEY,
+			data JSONB NOT NULL
+		)`, `
+		CREATE TABLE IF NOT EXISTS ` + summariesTable + ` (
+			id VARCHAR PRIMARY KEY,
+			data JSONB NOT NULL
+		)`, `
+		CREATE TABLE IF NOT EXISTS ` + setsTable + ` (
+			id VARCHAR PRIMARY KEY,
+			data JSONB NOT NULL
+		)`,
+	}
+	for _, t := range rollupTables {
+		queries = append(queries, `
+		CREATE TABLE IF NOT EXISTS `+t.table+` (
+			id VARCHAR NOT NULL,
+			type VARCHAR NOT NULL,
+			bucket TIMESTAMPTZ NOT NULL,
+			min DOUBLE PRECISION NOT NULL,
+			max DOUBLE PRECISION NOT NULL,
+			sum DOUBLE PRECISION NOT NULL,
+			count BIGINT NOT NULL,
+			last DOUBLE PRECISION NOT NULL,
+			increase DOUBLE PRECISION NOT NULL,
+			PRIMARY KEY (id, type, bucket)
+		)`,
+			`CREATE INDEX IF NOT EXISTS `+t.table+`_bucket_idx ON `+t.table+` (bucket)`)
+	}
 
 	return retry.Do(retry.DefaultRetryConfig(), func() error {
-		_, err := s.db.Exec(query)
-		return err
+		for _, query := range queries {
+			if _, err := s.db.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
+// EnableHistory turns on recording of timestamped samples kept for retention.
+func (s *PostgresStorage) EnableHistory(retention time.Duration) {
+	s.historyRetention = retention
+}
+
+// EnableRollups turns on 1-minute and 1-hour rollups updated on each write.
+// Buckets are kept for the retention of their resolution, zero retention disables the resolution.
+func (s *PostgresStorage) EnableRollups(minuteRetention, hourRetention time.Duration) {
+	s.rollupRetention = make(map[storage.Resolution]time.Duration)
+	if minuteRetention > 0 {
+		s.rollupRetention[storage.RollupMinute] = minuteRetention
+	}
+	if hourRetention > 0 {
+		s.rollupRetention[storage.RollupHour] = hourRetention
+	}
+}
+
+// tracksWrites reports whether writes must also update history or rollups.
+func (s *PostgresStorage) tracksWrites() bool {
+	return s.historyRetention > 0 || len(s.rollupRetention) > 0
+}
+
+// recordWrites copies current values of written metrics to history and rollups,
+// expired rows are deleted by DeleteExpired.
+func (s *PostgresStorage) recordWrites(ctx context.Context, tx *sql.Tx, metrics []storage.Metric, now time.Time) error {
+	if s.historyRetention > 0 {
+		for _, m := range metrics {
+			if _, err := tx.ExecContext(ctx, recordHistoryQuery, m.Key(), string(m.MType), now); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, t := range rollupTables {
+		if _, ok := s.rollupRetention[t.res]; !ok {
+			continue
+		}
+		query := fmt.Sprintf(upsertRollupQuery, t.table, t.unit)
+		for _, m := range metrics {
+			// Сумма записанных приращений не зависит от значения счетчика до начала интервала
+			var increase float64
+			if m.MType == storage.Counter && m.Delta != nil {
+				increase = float64(*m.Delta)
+			}
+			if _, err := tx.ExecContext(ctx, query, m.Key(), string(m.MType), now, increase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteExpired deletes applied batch IDs, history samples and rollup buckets older than their retention.
+// It is run periodically, so writes do not delete expired rows.
+func (s *PostgresStorage) DeleteExpired(ctx context.Context, now time.Time) error {
+	type expiry struct {
+		query  string
+		cutoff time.Time
+	}
+	expired := []expiry{{`DELETE FROM applied_batches WHERE applied_at < $1`, now.Add(-batchRetention)}}
+	if s.historyRetention > 0 {
+		expired = append(expired, expiry{`DELETE FROM metric_history WHERE ts < $1`, now.Add(-s.historyRetention)})
+	}
+	for _, t := range rollupTables {
+		if retention, ok := s.rollupRetention[t.res]; ok {
+			expired = append(expired, expiry{`DELETE FROM ` + t.table + ` WHERE bucket < $1`, now.Add(-retention)})
+		}
+	}
+
+	for _, e := range expired {
+		err := retry.Do(retry.DefaultRetryConfig(), func() error {
+			_, err := s.db.ExecContext(ctx, e.query, e.cutoff)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // UpdateMetric creates or updates metric in a DB storage.
 func (s *PostgresStorage) UpdateMetric(ctx context.Context, id string, mType storage.MetricType, delta *int64, value *float64) error {
-	query := `
-		INSERT INTO metrics (id, type, delta, value)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (id, type) DO UPDATE
-		SET delta = $3 + metrics.delta, value = $4`
+	switch mType {
+	case storage.Histogram, storage.Set:
+		return fmt.Errorf("%s metrics can only be written in batches", mType)
+	case storage.Summary:
+		if value == nil {
+			return fmt.Errorf("value is required for summary metric")
+		}
+		return retry.Do(retry.DefaultRetryConfig(), func() error {
+			tx, err := s.db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = tx.Rollback()
+			}()
+
+			if err := observeSummary(ctx, tx, id, *value); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+	}
+	if !s.tracksWrites() {
+		return retry.Do(retry.DefaultRetryConfig(), func() error {
+			_, err := s.db.ExecContext(ctx, upsertMetricQuery, id, string(mType), delta, value)
+			return err
+		})
+	}
 
 	return retry.Do(retry.DefaultRetryConfig(), func() error {
-		_, err := s.db.ExecContext(ctx, query, id, string(mType), delta, value)
-		return err
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		if _, err := tx.ExecContext(ctx, upsertMetricQuery, id, string(mType), delta, value); err != nil {
+			return err
+		}
+		if err := s.recordWrites(ctx, tx, []storage.Metric{{ID: id, MType: mType, Delta: delta, Value: value}}, time.Now()); err != nil {
+			return err
+		}
+		return tx.Commit()
 	})
 }
 
+// UpdateMetrics applies a batch of metrics in a single transaction at most once per batch ID.
+// Applied batch IDs are kept for batchRetention, see DeleteExpired.
+// Rows are written in the order of type and key, so concurrent batches lock them in the same order.
+func (s *PostgresStorage) UpdateMetrics(ctx context.Context, batchID string, metrics []storage.Metric) (bool, error) {
+	for _, m := range metrics {
+		if err := m.Validate(); err != nil {
+			return false, err
+		}
+	}
+	metrics = append([]storage.Metric(nil), metrics...)
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].Key() < metrics[j].Key()
+	})
+
+	var applied bool
+	err := retry.Do(retry.DefaultRetryConfig(), func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		if batchID != "" {
+			res, err := tx.ExecContext(ctx, `INSERT INTO applied_batches (batch_id) VALUES ($1) ON CONFLICT DO NOTHING`, batchID)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				applied = false
+				return nil
+			}
+		}
+
+		scalars := make([]storage.Metric, 0, len(metrics))
+		for _, m := range metrics {
+			switch m.MType {
+			case storage.Histogram:
+				merge := func(h *storage.HistogramValue) (*storage.HistogramValue, error) {
+					merged, err := h.Merge(m.Histogram)
+					if errors.Is(err, storage.ErrHistogramBounds) {
+						// Отчет с другими границами пропускается, остальной пакет применяется
+						return h, nil
+					}
+					return merged, err
+				}
+				if err := mergeStored(ctx, tx, histogramsTable, m.Key(), merge); err != nil {
+					return err
+				}
+				continue
+			case storage.Summary:
+				if err := observeSummary(ctx, tx, m.Key(), *m.Value); err != nil {
+					return err
+				}
+				continue
+			case storage.Set:
+				add := func(s *hll.Sketch) (*hll.Sketch, error) { return storage.AddSet(s, m), nil }
+				if err := mergeStored(ctx, tx, setsTable, m.Key(), add); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, upsertMetricQuery, m.Key(), string(m.MType), m.Delta, m.Value); err != nil {
+				return err
+			}
+			scalars = append(scalars, m)
+		}
+		if s.tracksWrites() {
+			if err := s.recordWrites(ctx, tx, scalars, time.Now()); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	})
+
+	return applied, err
+}
+
 // GetMetric returns a metric from a DB storage.
 func (s *PostgresStorage) GetMetric(ctx context.Context, id string, mType storage.MetricType) (*int64, *float64, error) {
 	var delta sql.NullInt64
@@ -96,14 +404,250 @@ func (s *PostgresStorage) GetMetric(ctx context.Context, id string, mType storag
 	return deltaPtr, valuePtr, nil
 }
 
+// mergeStored replaces the JSON state kept in table for id with the result of merge.
+// merge gets nil if there is no state yet, the row is locked until the transaction ends.
+// An error of merge is returned and nothing is written.
+func mergeStored[T any](ctx context.Context, tx *sql.Tx, table, id string, merge func(*T) (*T, error)) error {
+	var stored *T
+	var data []byte
+	err := tx.QueryRowContext(ctx, `SELECT data FROM `+table+` WHERE id = $1 FOR UPDATE`, id).Scan(&data)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+	}
+
+	merged, err := merge(stored)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO `+table+` (id, data) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data`, id, data)
+	return err
+}
+
+// observeSummary adds an observation to the stored summary.
+func observeSummary(ctx context.Context, tx *sql.Tx, id string, v float64) error {
+	return mergeStored(ctx, tx, summariesTable, id, func(s *storage.SummaryValue) (*storage.SummaryValue, error) {
+		return s.Observe(v), nil
+	})
+}
+
+// getStored returns the JSON state kept in table for id, notFound is returned if there is none.
+func getStored[T any](ctx context.Context, db *sql.DB, table, id string, notFound error) (*T, error) {
+	var data []byte
+	err := retry.Do(retry.DefaultRetryConfig(), func() error {
+		return db.QueryRowContext(ctx, `SELECT data FROM `+table+` WHERE id = $1`, id).Scan(&data)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, notFound
+		}
+		return nil, err
+	}
+
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// getAllStored returns all JSON states kept in table by id.
+func getAllStored[T any](ctx context.Context, db *sql.DB, table string) (map[string]*T, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, data FROM `+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]*T)
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var v T
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		states[id] = &v
+	}
+	return states, rows.Err()
+}
+
+// GetHistogram returns a histogram from a DB storage.
+func (s *PostgresStorage) GetHistogram(ctx context.Context, id string) (*storage.HistogramValue, error) {
+	return getStored[storage.HistogramValue](ctx, s.db, histogramsTable, id, storage.ErrHistogramNotFound)
+}
+
+// GetAllHistograms returns all histograms from a DB storage.
+func (s *PostgresStorage) GetAllHistograms(ctx context.Context) (map[string]*storage.HistogramValue, error) {
+	return getAllStored[storage.HistogramValue](ctx, s.db, histogramsTable)
+}
+
+// GetSummary returns a summary snapshot from a DB storage.
+func (s *PostgresStorage) GetSummary(ctx context.Context, id string) (*storage.SummaryValue, error) {
+	summary, err := getStored[storage.SummaryValue](ctx, s.db, summariesTable, id, storage.ErrSummaryNotFound)
+	if err != nil {
+		return nil, err
+	}
+	return summary.Snapshot(), nil
+}
+
+// GetAllSummaries returns snapshots of all summaries from a DB storage.
+func (s *PostgresStorage) GetAllSummaries(ctx context.Context) (map[string]*storage.SummaryValue, error) {
+	summaries, err := getAllStored[storage.SummaryValue](ctx, s.db, summariesTable)
+	if err != nil {
+		return nil, err
+	}
+	for id, summary := range summaries {
+		summaries[id] = summary.Snapshot()
+	}
+	return summaries, nil
+}
+
+// GetSet returns a set snapshot from a DB storage.
+func (s *PostgresStorage) GetSet(ctx context.Context, id string) (*storage.SetValue, error) {
+	set, err := getStored[hll.Sketch](ctx, s.db, setsTable, id, storage.ErrSetNotFound)
+	if err != nil {
+		return nil, err
+	}
+	return storage.SetSnapshot(set), nil
+}
+
+// GetAllSets returns snapshots of all sets from a DB storage.
+func (s *PostgresStorage) GetAllSets(ctx context.Context) (map[string]*storage.SetValue, error) {
+	sets, err := getAllStored[hll.Sketch](ctx, s.db, setsTable)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make(map[string]*storage.SetValue, len(sets))
+	for id, set := range sets {
+		snapshots[id] = storage.SetSnapshot(set)
+	}
+	return snapshots, nil
+}
+
+// GetHistory returns samples of the metric recorded within [from, to].
+func (s *PostgresStorage) GetHistory(ctx context.Context, id string, mType storage.MetricType, from, to time.Time) ([]storage.Sample, error) {
+	if s.historyRetention == 0 {
+		return nil, storage.ErrHistoryDisabled
+	}
+	if cutoff := time.Now().Add(-s.historyRetention); from.Before(cutoff) {
+		from = cutoff
+	}
+
+	query := `SELECT ts, delta, value FROM metric_history WHERE id = $1 AND type = $2 AND ts >= $3 AND ts <= $4 ORDER BY ts`
+
+	var samples []storage.Sample
+	err := retry.Do(retry.DefaultRetryConfig(), func() error {
+		samples = nil
+		rows, err := s.db.QueryContext(ctx, query, id, string(mType), from, to)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sample storage.Sample
+			var delta sql.NullInt64
+			var value sql.NullFloat64
+			if err := rows.Scan(&sample.Time, &delta, &value); err != nil {
+				return err
+			}
+			if delta.Valid {
+				sample.Delta = &delta.Int64
+			}
+			if value.Valid {
+				sample.Value = &value.Float64
+			}
+			samples = append(samples, sample)
+		}
+		return rows.Err()
+	})
+
+	return samples, err
+}
+
+// GetRollups returns rollups of the metric with buckets starting within [from, to].
+func (s *PostgresStorage) GetRollups(ctx context.Context, id string, mType storage.MetricType, res storage.Resolution, from, to time.Time) ([]storage.Rollup, error) {
+	var table string
+	for _, t := range rollupTables {
+		if t.res == res {
+			table = t.table
+		}
+	}
+	if _, ok := s.rollupRetention[res]; !ok || table == "" {
+		return nil, storage.ErrRollupsDisabled
+	}
+
+	query := `SELECT bucket, min, max, sum / count, count, last, increase FROM ` + table + `
+		WHERE id = $1 AND type = $2 AND bucket >= $3 AND bucket <= $4 ORDER BY bucket`
+
+	var rollups []storage.Rollup
+	err := retry.Do(retry.DefaultRetryConfig(), func() error {
+		rollups = nil
+		rows, err := s.db.QueryContext(ctx, query, id, string(mType), from, to)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var r storage.Rollup
+			if err := rows.Scan(&r.Time, &r.Min, &r.Max, &r.Avg, &r.Count, &r.Last, &r.Increase); err != nil {
+				return err
+			}
+			rollups = append(rollups, r)
+		}
+		return rows.Err()
+	})
+
+	return rollups, err
+}
+
+// FindSeries returns current values of metrics matching all matchers.
+// A metric name equality matcher is applied in the query, the remaining matchers are applied to the result.
+func (s *PostgresStorage) FindSeries(ctx context.Context, matchers []*storage.Matcher) ([]storage.Metric, error) {
+	query := `SELECT id, type, delta, value FROM metrics`
+	var args []any
+	for _, m := range matchers {
+		if m.Name == storage.NameLabel && m.Type == storage.MatchEqual {
+			// Ключ помеченной метрики начинается с имени и фигурной скобки
+			query += ` WHERE id = $1 OR starts_with(id, $2)`
+			args = []any{m.Value, m.Value + "{"}
+			break
+		}
+	}
+
+	counters, gauges, err := s.queryMetrics(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return storage.FilterSeries(counters, gauges, matchers), nil
+}
+
 // GetAllMetrics returns all existing metrics from a DB storage.
 func (s *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]int64, map[string]float64, error) {
+	return s.queryMetrics(ctx, `SELECT id, type, delta, value FROM metrics`)
+}
+
+// queryMetrics runs a query returning id, type, delta and value columns.
+func (s *PostgresStorage) queryMetrics(ctx context.Context, query string, args ...any) (map[string]int64, map[string]float64, error) {
 	counters := make(map[string]int64)
 	gauges := make(map[string]float64)
 
-	query := `SELECT id, type, delta, value FROM metrics`
-
-	rows, err := s.db.QueryContext(ctx, query)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statement is a query executed through recordingConn.
+type statement struct {
+	query string
+	args  []driver.Value
+}
+
+// recordingConn is a database/sql connection that records statements and answers queries with rows.
+type recordingConn struct {
+	mu         sync.Mutex
+	statements []statement
+	rows       [][]driver.Value
+}
+
+func (c *recordingConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *recordingConn) Driver() driver.Driver                        { return nil }
+func (c *recordingConn) Close() error                                 { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error)                    { return c, nil }
+func (c *recordingConn) Commit() error                                { return nil }
+func (c *recordingConn) Rollback() error                              { return nil }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("unexpected prepare: %s", query)
+}
+
+func (c *recordingConn) record(query string, args []driver.NamedValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	c.statements = append(c.statements, statement{query: query, args: values})
+}
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.record(query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.record(query, args)
+	return &recordedRows{rows: c.rows}, nil
+}
+
+// recordedRows returns rows given to recordingConn.
+type recordedRows struct {
+	rows [][]driver.Value
+}
+
+func (r *recordedRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	columns := make([]string, len(r.rows[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+	}
+	return columns
+}
+
+func (r *recordedRows) Close() error { return nil }
+
+func (r *recordedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newRecordingStorage returns a storage with rollups of both resolutions writing to conn.
+func newRecordingStorage(t *testing.T, conn *recordingConn) *PostgresStorage {
+	db := sql.OpenDB(conn)
+	t.Cleanup(func() { db.Close() })
+	s := &PostgresStorage{db: db}
+	s.EnableRollups(time.Hour, 24*time.Hour)
+	return s
+}
+
+func TestPostgresStorage_RecordsRollups(t *testing.T) {
+	conn := &recordingConn{}
+	s := newRecordingStorage(t, conn)
+
+	value, delta := 1.5, int64(4)
+	start := time.Now()
+	applied, err := s.UpdateMetrics(context.Background(), "", []storage.Metric{
+		{ID: "load", MType: storage.Gauge, Value: &value, Labels: map[string]string{"host": "a"}},
+		{ID: "requests", MType: storage.Counter, Delta: &delta},
+	})
+	require.NoError(t, err)
+	assert.True(t, applied)
+
+	require.Len(t, conn.statements, 6)
+	assert.Equal(t, upsertMetricQuery, conn.statements[0].query)
+	assert.Equal(t, []driver.Value{"requests", "counter", int64(4), nil}, conn.statements[0].args)
+	assert.Equal(t, []driver.Value{`load{host="a"}`, "gauge", nil, 1.5}, conn.statements[1].args)
+
+	for i, want := range []struct{ table, unit string }{{"metric_rollup_1m", "minute"}, {"metric_rollup_1h", "hour"}} {
+		for j, m := range []struct {
+			id, mType string
+			increase  float64
+		}{{"requests", "counter", 4}, {`load{host="a"}`, "gauge", 0}} {
+			st := conn.statements[2+2*i+j]
+			assert.Contains(t, st.query, "INSERT INTO "+want.table+" AS r")
+			assert.Contains(t, st.query, "date_trunc('"+want.unit+"', $3::timestamptz)")
+			require.Len(t, st.args, 4)
+			assert.Equal(t, m.id, st.args[0])
+			assert.Equal(t, m.mType, st.args[1])
+			assert.WithinRange(t, st.args[2].(time.Time), start, time.Now())
+			// Для счетчика в интервал добавляется записанное приращение, а не накопленное значение
+			assert.Equal(t, m.increase, st.args[3])
+		}
+	}
+
+	// Устаревшие строки удаляются фоновой задачей, а не при записи
+	for _, st := range conn.statements {
+		assert.NotContains(t, st.query, "DELETE")
+	}
+}
+
+func TestPostgresStorage_UpdateMetricsLockOrder(t *testing.T) {
+	conn := &recordingConn{}
+	s := &PostgresStorage{db: sql.OpenDB(conn)}
+	t.Cleanup(func() { s.db.Close() })
+
+	one, two := int64(1), 2.0
+	batch := []storage.Metric{
+		{ID: "b", MType: storage.Gauge, Value: &two},
+		{ID: "b", MType: storage.Counter, Delta: &one},
+		{ID: "a", MType: storage.Gauge, Value: &two, Labels: map[string]string{"host": "z"}},
+		{ID: "a", MType: storage.Counter, Delta: &one},
+	}
+	_, err := s.UpdateMetrics(context.Background(), "", batch)
+	require.NoError(t, err)
+
+	// Пакеты с одинаковыми ключами блокируют строки в одном порядке и не взаимоблокируются
+	var written []driver.Value
+	for _, st := range conn.statements {
+		written = append(written, st.args[1].(string)+" "+st.args[0].(string))
+	}
+	assert.Equal(t, []driver.Value{"counter a", "counter b", `gauge a{host="z"}`, "gauge b"}, written)
+	assert.Equal(t, "b", batch[0].ID, "the caller's batch is not reordered")
+}
+
+func TestPostgresStorage_GetRollups(t *testing.T) {
+	bucket := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	conn := &recordingConn{rows: [][]driver.Value{{bucket, 10.0, 14.0, 12.0, int64(3), 14.0, 6.0}}}
+	s := newRecordingStorage(t, conn)
+
+	from, to := bucket.Add(-time.Hour), bucket.Add(time.Hour)
+	rollups, err := s.GetRollups(context.Background(), "requests", storage.Counter, storage.RollupMinute, from, to)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Rollup{{Time: bucket, Min: 10, Max: 14, Avg: 12, Count: 3, Last: 14, Increase: 6}}, rollups)
+
+	require.Len(t, conn.statements, 1)
+	st := conn.statements[0]
+	assert.Contains(t, st.query, "SELECT bucket, min, max, sum / count, count, last, increase FROM metric_rollup_1m")
+	assert.Contains(t, st.query, "WHERE id = $1 AND type = $2 AND bucket >= $3 AND bucket <= $4 ORDER BY bucket")
+	assert.Equal(t, []driver.Value{"requests", "counter", from, to}, st.args)
+
+	t.Run("disabled resolution", func(t *testing.T) {
+		s := newRecordingStorage(t, &recordingConn{})
+		s.EnableRollups(time.Hour, 0)
+		_, err := s.GetRollups(context.Background(), "load", storage.Gauge, storage.RollupHour, from, to)
+		assert.ErrorIs(t, err, storage.ErrRollupsDisabled)
+	})
+}
+
+func TestPostgresStorage_DeleteExpired(t *testing.T) {
+	conn := &recordingConn{}
+	s := newRecordingStorage(t, conn)
+	s.EnableHistory(10 * time.Minute)
+
+	now := time.Now()
+	require.NoError(t, s.DeleteExpired(context.Background(), now))
+
+	cutoffs := make(map[string]driver.Value)
+	for _, st := range conn.statements {
+		require.Len(t, st.args, 1)
+		table := strings.Fields(st.query)[2]
+		cutoffs[table] = st.args[0]
+	}
+	assert.Equal(t, map[string]driver.Value{
+		"applied_batches":  now.Add(-batchRetention),
+		"metric_history":   now.Add(-10 * time.Minute),
+		"metric_rollup_1m": now.Add(-time.Hour),
+		"metric_rollup_1h": now.Add(-24 * time.Hour),
+	}, cutoffs)
+}
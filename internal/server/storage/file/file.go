@@ -6,20 +6,32 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
+	"github.com/antonminaichev/metricscollector/internal/hll"
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	"github.com/antonminaichev/metricscollector/internal/server/telemetry"
 	"go.uber.org/zap"
 )
 
+// snapshot is the on-disk representation of the file storage.
+// History is kept in a separate file, so synchronous saves do not grow with it.
+type snapshot struct {
+	Counters   map[string]int64                   `json:"counters"`
+	Gauges     map[string]float64                 `json:"gauges"`
+	Histograms map[string]*storage.HistogramValue `json:"histograms,omitempty"`
+	Summaries  map[string]*storage.SummaryValue   `json:"summaries,omitempty"`
+	Sets       map[string]*hll.Sketch             `json:"sets,omitempty"`
+	Batches    *storage.AppliedBatches            `json:"batches,omitempty"`
+}
+
 // FileStorage realises intreface for metric storage in a file.
 type FileStorage struct {
 	filePath string
-	metrics  struct {
-		Counters map[string]int64   `json:"counters"`
-		Gauges   map[string]float64 `json:"gauges"`
-	}
-	mu     sync.RWMutex
-	logger *zap.Logger
+	metrics  snapshot
+	mu       sync.RWMutex
+	logger   *zap.Logger
+	history  *storage.History
 }
 
 // NewFileStorage creates a new instance of FileStorage.
@@ -27,12 +39,13 @@ func NewFileStorage(filePath string, logger *zap.Logger) (*FileStorage, error) {
 	fs := &FileStorage{
 		filePath: filePath,
 		logger:   logger,
-		metrics: struct {
-			Counters map[string]int64   `json:"counters"`
-			Gauges   map[string]float64 `json:"gauges"`
-		}{
-			Counters: make(map[string]int64),
-			Gauges:   make(map[string]float64),
+		metrics: snapshot{
+			Counters:   make(map[string]int64),
+			Gauges:     make(map[string]float64),
+			Histograms: make(map[string]*storage.HistogramValue),
+			Summaries:  make(map[string]*storage.SummaryValue),
+			Sets:       make(map[string]*hll.Sketch),
+			Batches:    storage.NewAppliedBatches(storage.DefaultBatchHistory),
 		},
 	}
 
@@ -44,6 +57,42 @@ func NewFileStorage(filePath string, logger *zap.Logger) (*FileStorage, error) {
 	return fs, nil
 }
 
+// historyPath is the file history is saved to.
+func (fs *FileStorage) historyPath() string {
+	return fs.filePath + ".history"
+}
+
+// EnableHistory turns on recording of timestamped samples kept for retention,
+// at most storage.DefaultHistorySize samples are kept per metric.
+// History is restored from its file and saved there only by SaveMetrics.
+func (fs *FileStorage) EnableHistory(retention time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.history = storage.NewHistory(retention, storage.DefaultHistorySize)
+	if err := fs.loadHistory(); err != nil {
+		fs.logger.Warn("failed to restore metric history from file", zap.Error(err))
+	}
+}
+
+// record adds the current metric value to history, the caller must hold the write lock.
+func (fs *FileStorage) record(id string, mType storage.MetricType, now time.Time) {
+	if fs.history == nil {
+		return
+	}
+	sample := storage.Sample{Time: now}
+	switch mType {
+	case storage.Counter:
+		total := fs.metrics.Counters[id]
+		sample.Delta = &total
+	case storage.Gauge:
+		value := fs.metrics.Gauges[id]
+		sample.Value = &value
+	default:
+		return
+	}
+	fs.history.Record(id, mType, sample)
+}
+
 // UpdateMetric updates or creates metric if it doesnt exist.
 func (fs *FileStorage) UpdateMetric(ctx context.Context, id string, mType storage.MetricType, delta *int64, value *float64) error {
 	fs.mu.Lock()
@@ -59,14 +108,22 @@ func (fs *FileStorage) UpdateMetric(ctx context.Context, id string, mType storag
 	case storage.Counter:
 		if delta != nil {
 			fs.metrics.Counters[id] += *delta
+			fs.record(id, mType, time.Now())
 		}
 	case storage.Gauge:
 		if value != nil {
 			fs.metrics.Gauges[id] = *value
+			fs.record(id, mType, time.Now())
 		}
+	case storage.Summary:
+		if value != nil {
+			fs.metrics.Summaries[id] = fs.metrics.Summaries[id].Observe(*value)
+		}
+	case storage.Histogram, storage.Set:
+		return fmt.Errorf("%s metrics can only be written in batches", mType)
 	}
 
-	if err := fs.SaveMetrics(); err != nil {
+	if err := fs.saveLocked(); err != nil {
 		fs.logger.Error("failed to save metrics to file", zap.Error(err))
 		return err
 	}
@@ -74,6 +131,56 @@ func (fs *FileStorage) UpdateMetric(ctx context.Context, id string, mType storag
 	return nil
 }
 
+// UpdateMetrics applies a batch of metrics at most once per batch ID and saves the file.
+func (fs *FileStorage) UpdateMetrics(ctx context.Context, batchID string, metrics []storage.Metric) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	default:
+	}
+
+	if batchID != "" && fs.metrics.Batches.Seen(batchID) {
+		return false, nil
+	}
+	for _, m := range metrics {
+		if err := m.Validate(); err != nil {
+			return false, err
+		}
+	}
+	histograms := storage.MergeHistograms(fs.metrics.Histograms, metrics)
+	now := time.Now()
+	for _, m := range metrics {
+		switch m.MType {
+		case storage.Counter:
+			fs.metrics.Counters[m.Key()] += *m.Delta
+		case storage.Gauge:
+			fs.metrics.Gauges[m.Key()] = *m.Value
+		case storage.Histogram:
+			if h, ok := histograms[m.Key()]; ok {
+				fs.metrics.Histograms[m.Key()] = h
+			}
+		case storage.Summary:
+			fs.metrics.Summaries[m.Key()] = fs.metrics.Summaries[m.Key()].Observe(*m.Value)
+		case storage.Set:
+			fs.metrics.Sets[m.Key()] = storage.AddSet(fs.metrics.Sets[m.Key()], m)
+		}
+		fs.record(m.Key(), m.MType, now)
+	}
+	if batchID != "" {
+		fs.metrics.Batches.Add(batchID)
+	}
+	// Пакет уже записан в журнал, поэтому повторная отправка после ошибки сохранения не применит его дважды
+	if err := fs.saveLocked(); err != nil {
+		fs.logger.Error("failed to save metrics to file", zap.Error(err))
+		return false, err
+	}
+
+	return true, nil
+}
+
 // GetMetric returns metric value from a storage.
 func (fs *FileStorage) GetMetric(ctx context.Context, id string, mType storage.MetricType) (*int64, *float64, error) {
 	fs.mu.RLock()
@@ -101,6 +208,136 @@ func (fs *FileStorage) GetMetric(ctx context.Context, id string, mType storage.M
 	return nil, nil, fmt.Errorf("metric not found")
 }
 
+// FindSeries returns current values of metrics matching all matchers.
+func (fs *FileStorage) FindSeries(ctx context.Context, matchers []*storage.Matcher) ([]storage.Metric, error) {
+	return storage.SelectSeries(ctx, fs, matchers)
+}
+
+// GetHistory returns samples of the metric recorded within [from, to].
+func (fs *FileStorage) GetHistory(ctx context.Context, id string, mType storage.MetricType, from, to time.Time) ([]storage.Sample, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	if fs.history == nil {
+		return nil, storage.ErrHistoryDisabled
+	}
+	return fs.history.Range(id, mType, from, to), nil
+}
+
+// GetHistogram returns a histogram from a storage.
+func (fs *FileStorage) GetHistogram(ctx context.Context, id string) (*storage.HistogramValue, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	h, ok := fs.metrics.Histograms[id]
+	if !ok {
+		return nil, storage.ErrHistogramNotFound
+	}
+	return h.Clone(), nil
+}
+
+// GetAllHistograms returns all histograms from a storage.
+func (fs *FileStorage) GetAllHistograms(ctx context.Context) (map[string]*storage.HistogramValue, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	histograms := make(map[string]*storage.HistogramValue, len(fs.metrics.Histograms))
+	for k, h := range fs.metrics.Histograms {
+		histograms[k] = h.Clone()
+	}
+	return histograms, nil
+}
+
+// GetSummary returns a summary snapshot from a storage.
+func (fs *FileStorage) GetSummary(ctx context.Context, id string) (*storage.SummaryValue, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	summary, ok := fs.metrics.Summaries[id]
+	if !ok {
+		return nil, storage.ErrSummaryNotFound
+	}
+	return summary.Snapshot(), nil
+}
+
+// GetAllSummaries returns snapshots of all summaries from a storage.
+func (fs *FileStorage) GetAllSummaries(ctx context.Context) (map[string]*storage.SummaryValue, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	summaries := make(map[string]*storage.SummaryValue, len(fs.metrics.Summaries))
+	for k, summary := range fs.metrics.Summaries {
+		summaries[k] = summary.Snapshot()
+	}
+	return summaries, nil
+}
+
+// GetSet returns a set snapshot from a storage.
+func (fs *FileStorage) GetSet(ctx context.Context, id string) (*storage.SetValue, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	set, ok := fs.metrics.Sets[id]
+	if !ok {
+		return nil, storage.ErrSetNotFound
+	}
+	return storage.SetSnapshot(set), nil
+}
+
+// GetAllSets returns snapshots of all sets from a storage.
+func (fs *FileStorage) GetAllSets(ctx context.Context) (map[string]*storage.SetValue, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	sets := make(map[string]*storage.SetValue, len(fs.metrics.Sets))
+	for k, set := range fs.metrics.Sets {
+		sets[k] = storage.SetSnapshot(set)
+	}
+	return sets, nil
+}
+
 // GetAllMetrics returns all metrics from a storage.
 func (fs *FileStorage) GetAllMetrics(ctx context.Context) (map[string]int64, map[string]float64, error) {
 	fs.mu.RLock()
@@ -140,7 +377,7 @@ func (fs *FileStorage) Ping(ctx context.Context) error {
 	return err
 }
 
-// LoadMetrics loads metrics from a file to RAM.
+// LoadMetrics loads metrics from a file to RAM, history is loaded too when it is enabled.
 func (fs *FileStorage) LoadMetrics() error {
 	data, err := os.ReadFile(fs.filePath)
 	if err != nil {
@@ -150,11 +387,67 @@ func (fs *FileStorage) LoadMetrics() error {
 		return err
 	}
 
-	return json.Unmarshal(data, &fs.metrics)
+	if err := json.Unmarshal(data, &fs.metrics); err != nil {
+		return err
+	}
+	// Файлы старых версий не содержат гистограмм, сводок и множеств
+	if fs.metrics.Histograms == nil {
+		fs.metrics.Histograms = make(map[string]*storage.HistogramValue)
+	}
+	if fs.metrics.Summaries == nil {
+		fs.metrics.Summaries = make(map[string]*storage.SummaryValue)
+	}
+	if fs.metrics.Sets == nil {
+		fs.metrics.Sets = make(map[string]*hll.Sketch)
+	}
+	if fs.history == nil {
+		return nil
+	}
+	return fs.loadHistory()
+}
+
+// loadHistory restores history from its file keeping the history limits.
+func (fs *FileStorage) loadHistory() error {
+	data, err := os.ReadFile(fs.historyPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, fs.history)
 }
 
-// SaveMetrics saves metrics to a file.
+// SaveMetrics saves metrics and enabled history to files, it is safe to call concurrently with writes.
+// The write lock also keeps concurrent saves from interleaving in the file.
 func (fs *FileStorage) SaveMetrics() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.saveLocked(); err != nil {
+		return err
+	}
+	if fs.history == nil {
+		return nil
+	}
+	data, err := json.Marshal(fs.history)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fs.historyPath(), data, 0644)
+}
+
+// saveLocked saves metric values to a file, the caller must hold the lock.
+func (fs *FileStorage) saveLocked() error {
+	start := time.Now()
+	err := fs.saveMetrics()
+	telemetry.FileSaveDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		telemetry.FileSaveErrors.Inc()
+	}
+	return err
+}
+
+func (fs *FileStorage) saveMetrics() error {
 	data, err := json.MarshalIndent(fs.metrics, "", "  ")
 	if err != nil {
 		return err
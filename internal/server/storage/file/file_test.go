@@ -2,9 +2,11 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
 	"github.com/stretchr/testify/assert"
@@ -118,6 +120,14 @@ func TestFileStorage_UpdateMetric(t *testing.T) {
 		_, exists := fs.metrics.Gauges["nil_gauge"]
 		assert.False(t, exists)
 	})
+
+	t.Run("rejects histograms and sets", func(t *testing.T) {
+		value := 1.0
+		for _, mType := range []storage.MetricType{storage.Histogram, storage.Set} {
+			err := fs.UpdateMetric(ctx, "batched", mType, nil, &value)
+			assert.EqualError(t, err, string(mType)+" metrics can only be written in batches")
+		}
+	})
 }
 
 func TestFileStorage_GetMetric(t *testing.T) {
@@ -343,6 +353,60 @@ func TestFileStorage_SaveMetrics(t *testing.T) {
 	})
 }
 
+func TestFileStorage_UpdateMetrics(t *testing.T) {
+	logger := zap.NewNop()
+	filePath := filepath.Join(t.TempDir(), "batches.json")
+	ctx := context.Background()
+
+	fs, err := NewFileStorage(filePath, logger)
+	require.NoError(t, err)
+
+	delta := int64(4)
+	batch := []storage.Metric{{ID: "requests", MType: storage.Counter, Delta: &delta}}
+
+	applied, err := fs.UpdateMetrics(ctx, "agent/1", batch)
+	require.NoError(t, err)
+	assert.True(t, applied)
+
+	t.Run("replay is ignored", func(t *testing.T) {
+		applied, err := fs.UpdateMetrics(ctx, "agent/1", batch)
+		require.NoError(t, err)
+		assert.False(t, applied)
+		assert.Equal(t, int64(4), fs.metrics.Counters["requests"])
+	})
+
+	t.Run("applied batches survive restart", func(t *testing.T) {
+		fs2, err := NewFileStorage(filePath, logger)
+		require.NoError(t, err)
+
+		applied, err := fs2.UpdateMetrics(ctx, "agent/1", batch)
+		require.NoError(t, err)
+		assert.False(t, applied)
+
+		applied, err = fs2.UpdateMetrics(ctx, "agent/2", batch)
+		require.NoError(t, err)
+		assert.True(t, applied)
+		assert.Equal(t, int64(8), fs2.metrics.Counters["requests"])
+	})
+
+	t.Run("save error is returned", func(t *testing.T) {
+		// Каталога нет, поэтому сохранение файла завершается ошибкой
+		fs3, err := NewFileStorage(filepath.Join(t.TempDir(), "missing", "batches.json"), logger)
+		require.NoError(t, err)
+
+		_, err = fs3.UpdateMetrics(ctx, "agent/1", batch)
+		require.Error(t, err)
+
+		// Повтор пакета агентом не применяет его второй раз
+		applied, err := fs3.UpdateMetrics(ctx, "agent/1", batch)
+		require.NoError(t, err)
+		assert.False(t, applied)
+		assert.Equal(t, int64(4), fs3.metrics.Counters["requests"])
+
+		assert.Error(t, fs3.UpdateMetric(ctx, "requests", storage.Counter, &delta, nil))
+	})
+}
+
 func TestFileStorage_Integration(t *testing.T) {
 	logger := zap.NewNop()
 	tempDir := t.TempDir()
@@ -388,3 +452,198 @@ func TestFileStorage_Integration(t *testing.T) {
 		assert.Len(t, gauges, 1)
 	})
 }
+
+func TestFileStorage_History(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+	from := time.Now().Add(-time.Minute)
+
+	fs, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	fs.EnableHistory(time.Hour)
+
+	value := 1.5
+	require.NoError(t, fs.UpdateMetric(ctx, "g", storage.Gauge, nil, &value))
+	value = 2.5
+	require.NoError(t, fs.UpdateMetric(ctx, "g", storage.Gauge, nil, &value))
+
+	// Запись сохраняет только значения, история сохраняется периодически
+	_, err = os.Stat(fs.historyPath())
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, fs.SaveMetrics())
+
+	t.Run("history is restored with history enabled", func(t *testing.T) {
+		restored, err := NewFileStorage(filePath, zap.NewNop())
+		require.NoError(t, err)
+		restored.EnableHistory(time.Hour)
+		require.NoError(t, restored.LoadMetrics())
+
+		samples, err := restored.GetHistory(ctx, "g", storage.Gauge, from, time.Now())
+		require.NoError(t, err)
+		require.Len(t, samples, 2)
+		assert.Equal(t, 1.5, *samples[0].Value)
+		assert.Equal(t, 2.5, *samples[1].Value)
+	})
+
+	t.Run("history is restored when enabled after loading", func(t *testing.T) {
+		// NewFileStorage загружает файл до того, как сервер включает историю
+		restored, err := NewFileStorage(filePath, zap.NewNop())
+		require.NoError(t, err)
+		restored.EnableHistory(time.Hour)
+
+		samples, err := restored.GetHistory(ctx, "g", storage.Gauge, from, time.Now())
+		require.NoError(t, err)
+		require.Len(t, samples, 2)
+		assert.Equal(t, 2.5, *samples[1].Value)
+	})
+
+	t.Run("history is ignored with history disabled", func(t *testing.T) {
+		restored, err := NewFileStorage(filePath, zap.NewNop())
+		require.NoError(t, err)
+
+		_, err = restored.GetHistory(ctx, "g", storage.Gauge, from, time.Now())
+		assert.ErrorIs(t, err, storage.ErrHistoryDisabled)
+		require.NoError(t, restored.SaveMetrics())
+
+		data, err := os.ReadFile(filePath)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "history")
+	})
+
+	t.Run("history is capped per metric", func(t *testing.T) {
+		capped, err := NewFileStorage(filepath.Join(t.TempDir(), "capped.json"), zap.NewNop())
+		require.NoError(t, err)
+		capped.EnableHistory(time.Hour)
+		for i := 0; i < storage.DefaultHistorySize+10; i++ {
+			v := float64(i)
+			require.NoError(t, capped.UpdateMetric(ctx, "g", storage.Gauge, nil, &v))
+		}
+
+		samples, err := capped.GetHistory(ctx, "g", storage.Gauge, from, time.Now())
+		require.NoError(t, err)
+		require.Len(t, samples, storage.DefaultHistorySize)
+		assert.Equal(t, float64(storage.DefaultHistorySize+9), *samples[len(samples)-1].Value)
+	})
+}
+
+func TestFileStorage_SaveOnWrite(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+	fs, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	fs.EnableHistory(time.Hour)
+
+	delta := int64(3)
+	require.NoError(t, fs.UpdateMetric(ctx, "c", storage.Counter, &delta, nil))
+	_, err = fs.UpdateMetrics(ctx, "agent/1", []storage.Metric{{ID: "c", MType: storage.Counter, Delta: &delta}})
+	require.NoError(t, err)
+
+	// Значения сохраняются при каждой записи, а история только периодическим сохранением
+	restored, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	value, _, err := restored.GetMetric(ctx, "c", storage.Counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *value)
+	_, err = os.Stat(fs.historyPath())
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, fs.SaveMetrics())
+	_, err = os.Stat(fs.historyPath())
+	assert.NoError(t, err)
+}
+
+func TestFileStorage_Histograms(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	report := storage.Metric{ID: "latency", MType: storage.Histogram,
+		Histogram: &storage.HistogramValue{Bounds: []float64{1}, Counts: []uint64{2, 1}, Sum: 3, Count: 3}}
+	for i := 0; i < 2; i++ {
+		_, err = fs.UpdateMetrics(ctx, "", []storage.Metric{report})
+		require.NoError(t, err)
+	}
+
+	restored, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	h, err := restored.GetHistogram(ctx, "latency")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{4, 2}, h.Counts)
+	assert.Equal(t, 6.0, h.Sum)
+}
+
+func TestFileStorage_Summaries(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	for _, v := range []float64{1, 2, 3, 4} {
+		require.NoError(t, fs.UpdateMetric(ctx, "rt", storage.Summary, nil, &v))
+	}
+
+	// Состояние оценщика квантилей сохраняется в файл
+	restored, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	v := 5.0
+	require.NoError(t, restored.UpdateMetric(ctx, "rt", storage.Summary, nil, &v))
+
+	summary, err := restored.GetSummary(ctx, "rt")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), summary.Count)
+	assert.Equal(t, 15.0, summary.Sum)
+	require.NotEmpty(t, summary.Quantiles)
+	assert.InEpsilon(t, 3, summary.Quantiles[0].Value, storage.SketchRelativeAccuracy)
+}
+
+func TestFileStorage_Sets(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	alice, bob := "alice", "bob"
+	_, err = fs.UpdateMetrics(ctx, "", []storage.Metric{
+		{ID: "users", MType: storage.Set, Member: &alice},
+		{ID: "users", MType: storage.Set, Member: &bob},
+	})
+	require.NoError(t, err)
+
+	// Скетч сохраняется в файл, повторный элемент не увеличивает мощность
+	restored, err := NewFileStorage(filePath, zap.NewNop())
+	require.NoError(t, err)
+	_, err = restored.UpdateMetrics(ctx, "", []storage.Metric{{ID: "users", MType: storage.Set, Member: &alice}})
+	require.NoError(t, err)
+
+	set, err := restored.GetSet(ctx, "users")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), set.Cardinality)
+}
+
+func TestFileStorage_SaveMetricsConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	fs, err := NewFileStorage(filepath.Join(t.TempDir(), "metrics.json"), zap.NewNop())
+	require.NoError(t, err)
+	fs.EnableHistory(time.Hour)
+
+	// Периодическое сохранение выполняется параллельно с записью пакетов
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			assert.NoError(t, fs.SaveMetrics())
+		}
+	}()
+	delta := int64(1)
+	for i := 0; i < 50; i++ {
+		batch := []storage.Metric{{ID: fmt.Sprintf("c%d", i), MType: storage.Counter, Delta: &delta}}
+		_, err := fs.UpdateMetrics(ctx, fmt.Sprintf("agent/%d", i), batch)
+		require.NoError(t, err)
+	}
+	<-done
+
+	counters, _, err := fs.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, counters, 50)
+}
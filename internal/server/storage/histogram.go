@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+var (
+	// ErrHistogramNotFound is returned when a histogram metric does not exist.
+	ErrHistogramNotFound = errors.New("metric not found")
+	// ErrHistogramsUnsupported is returned by wrappers of storages that do not keep histograms.
+	ErrHistogramsUnsupported = errors.New("histograms are not supported by the storage")
+	// ErrHistogramBounds is returned when a histogram report has other bounds than the stored histogram.
+	ErrHistogramBounds = errors.New("histogram bounds differ from the stored histogram")
+)
+
+// HistogramValue is a distribution of observations over fixed buckets.
+// Reports of a histogram carry observations made since the previous report and are merged by the server.
+type HistogramValue struct {
+	// Bounds are bucket upper bounds in increasing order, the last bucket has no upper bound.
+	Bounds []float64 `json:"bounds"`
+	// Counts are observation counts per bucket, one more than Bounds.
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+// Validate checks that bounds are increasing and counts match them.
+func (h *HistogramValue) Validate() error {
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("histogram bound %v is not finite", b)
+		}
+		if i > 0 && b <= h.Bounds[i-1] {
+			return fmt.Errorf("histogram bounds must be increasing")
+		}
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram has %d counts for %d bounds, want %d", len(h.Counts), len(h.Bounds), len(h.Bounds)+1)
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("histogram count %d does not match bucket counts %d", h.Count, total)
+	}
+	return nil
+}
+
+// Merge returns h with observations of other added.
+// Bucket counts can't be converted between bounds, so a report with different bounds is rejected with ErrHistogramBounds.
+func (h *HistogramValue) Merge(other *HistogramValue) (*HistogramValue, error) {
+	if h == nil {
+		return other.Clone(), nil
+	}
+	if !slices.Equal(h.Bounds, other.Bounds) {
+		return nil, fmt.Errorf("%w: got %v, want %v", ErrHistogramBounds, other.Bounds, h.Bounds)
+	}
+	merged := h.Clone()
+	for i, c := range other.Counts {
+		merged.Counts[i] += c
+	}
+	merged.Sum += other.Sum
+	merged.Count += other.Count
+	return merged, nil
+}
+
+// MergeHistograms merges histogram reports of metrics into stored without changing it and returns
+// merged histograms by series key. A report with other bounds than the stored histogram is skipped,
+// so a single series reported with new buckets does not block the rest of the batch.
+func MergeHistograms(stored map[string]*HistogramValue, metrics []Metric) map[string]*HistogramValue {
+	merged := make(map[string]*HistogramValue)
+	for _, m := range metrics {
+		if m.MType != Histogram {
+			continue
+		}
+		key := m.Key()
+		h, ok := merged[key]
+		if !ok {
+			h = stored[key]
+		}
+		if h, err := h.Merge(m.Histogram); err == nil {
+			merged[key] = h
+		}
+	}
+	return merged
+}
+
+// Clone returns a deep copy of h.
+func (h *HistogramValue) Clone() *HistogramValue {
+	return &HistogramValue{
+		Bounds: slices.Clone(h.Bounds),
+		Counts: slices.Clone(h.Counts),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// HistogramReader reads histogram metrics.
+type HistogramReader interface {
+	// GetHistogram returns the histogram with the series key id or ErrHistogramNotFound.
+	GetHistogram(ctx context.Context, id string) (*HistogramValue, error)
+
+	// GetAllHistograms returns all histograms by series key.
+	GetAllHistograms(ctx context.Context) (map[string]*HistogramValue, error)
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramValue_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       HistogramValue
+		wantErr bool
+	}{
+		{"valid", HistogramValue{Bounds: []float64{1, 2}, Counts: []uint64{1, 0, 2}, Sum: 7, Count: 3}, false},
+		{"no bounds", HistogramValue{Counts: []uint64{2}, Sum: 1, Count: 2}, false},
+		{"bounds not increasing", HistogramValue{Bounds: []float64{2, 1}, Counts: []uint64{0, 0, 0}}, true},
+		{"too few counts", HistogramValue{Bounds: []float64{1, 2}, Counts: []uint64{1, 1}, Count: 2}, true},
+		{"count mismatch", HistogramValue{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHistogramValue_Merge(t *testing.T) {
+	a := &HistogramValue{Bounds: []float64{1, 2}, Counts: []uint64{1, 0, 0}, Sum: 0.5, Count: 1}
+	b := &HistogramValue{Bounds: []float64{1, 2}, Counts: []uint64{0, 2, 1}, Sum: 6, Count: 3}
+
+	merged, err := a.Merge(b)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 1}, merged.Counts)
+	assert.Equal(t, 6.5, merged.Sum)
+	assert.Equal(t, uint64(4), merged.Count)
+	// Исходные гистограммы не изменяются
+	assert.Equal(t, []uint64{1, 0, 0}, a.Counts)
+
+	t.Run("nil histogram takes the report", func(t *testing.T) {
+		var empty *HistogramValue
+		merged, err := empty.Merge(b)
+		require.NoError(t, err)
+		require.Equal(t, b, merged)
+		assert.NotSame(t, b, merged)
+	})
+
+	t.Run("different bounds are rejected", func(t *testing.T) {
+		c := &HistogramValue{Bounds: []float64{5}, Counts: []uint64{1, 0}, Sum: 3, Count: 1}
+		_, err := a.Merge(c)
+		assert.ErrorIs(t, err, ErrHistogramBounds)
+	})
+}
+
+func TestMergeHistograms(t *testing.T) {
+	stored := map[string]*HistogramValue{
+		"latency": {Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1},
+	}
+	report := func(id string, bounds []float64) Metric {
+		counts := make([]uint64, len(bounds)+1)
+		counts[0] = 1
+		return Metric{ID: id, MType: Histogram, Histogram: &HistogramValue{Bounds: bounds, Counts: counts, Sum: 0.5, Count: 1}}
+	}
+
+	t.Run("merges reports of a batch", func(t *testing.T) {
+		merged := MergeHistograms(stored, []Metric{
+			report("latency", []float64{1}),
+			report("latency", []float64{1}),
+			report("size", []float64{10, 100}),
+		})
+		assert.Equal(t, uint64(3), merged["latency"].Count)
+		assert.Equal(t, uint64(1), merged["size"].Count)
+		// Сохраненная гистограмма не изменяется
+		assert.Equal(t, uint64(1), stored["latency"].Count)
+	})
+
+	t.Run("skips other bounds than stored", func(t *testing.T) {
+		merged := MergeHistograms(stored, []Metric{report("latency", []float64{2}), report("size", []float64{10})})
+		assert.NotContains(t, merged, "latency")
+		assert.Equal(t, uint64(1), merged["size"].Count)
+	})
+
+	t.Run("skips other bounds within a batch", func(t *testing.T) {
+		merged := MergeHistograms(stored, []Metric{report("size", []float64{10}), report("size", []float64{20})})
+		assert.Equal(t, []float64{10}, merged["size"].Bounds)
+		assert.Equal(t, uint64(1), merged["size"].Count)
+	})
+}
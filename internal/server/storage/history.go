@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrHistoryDisabled is returned by HistoryReader when the storage does not record history.
+var ErrHistoryDisabled = errors.New("metric history is disabled")
+
+// Sample is a metric value recorded at a point in time.
+// Counter samples carry the accumulated counter value, the same as GetMetric returns, not the increment.
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Delta *int64    `json:"delta,omitempty"`
+	Value *float64  `json:"value,omitempty"`
+}
+
+type HistoryReader interface {
+	// GetHistory returns samples of the metric recorded within [from, to] ordered by time.
+	GetHistory(ctx context.Context, id string, mType MetricType, from, to time.Time) ([]Sample, error)
+}
+
+// DefaultHistorySize is the number of recent samples memory and file storages keep per metric.
+const DefaultHistorySize = 1000
+
+// historyPruneInterval is how often Record prunes all metrics, so metrics that are no longer
+// written do not keep expired samples.
+const historyPruneInterval = time.Minute
+
+// History keeps timestamped samples of every metric for the retention period.
+// Each metric has a ring buffer of at most size samples, the oldest are overwritten first.
+// It is not safe for concurrent use.
+type History struct {
+	retention time.Duration
+	size      int
+	series    map[string]*ring
+	// pruned is the time of the last Prune.
+	pruned time.Time
+}
+
+// NewHistory creates a history that keeps samples for retention and at most size samples per metric.
+// Zero retention or size means no limit.
+func NewHistory(retention time.Duration, size int) *History {
+	return &History{
+		retention: retention,
+		size:      size,
+		series:    make(map[string]*ring),
+	}
+}
+
+// SetRetention changes the retention period, already expired samples are dropped on next access.
+func (h *History) SetRetention(retention time.Duration) {
+	h.retention = retention
+}
+
+// seriesKey identifies a metric in the history, metric types never contain a slash.
+func seriesKey(id string, mType MetricType) string {
+	return string(mType) + "/" + id
+}
+
+// Record appends a sample and drops expired samples of the same metric.
+// Other metrics are pruned at most once per minute.
+// Samples are expected in time order.
+func (h *History) Record(id string, mType MetricType, s Sample) {
+	key := seriesKey(id, mType)
+	r, ok := h.series[key]
+	if !ok {
+		r = &ring{}
+		h.series[key] = r
+	}
+	r.push(s, h.size)
+	h.expire(r, s.Time)
+	if s.Time.Sub(h.pruned) >= historyPruneInterval {
+		h.Prune(s.Time)
+	}
+}
+
+// Range returns samples of the metric within [from, to], expired samples are skipped.
+func (h *History) Range(id string, mType MetricType, from, to time.Time) []Sample {
+	if h.retention > 0 {
+		if cutoff := time.Now().Add(-h.retention); from.Before(cutoff) {
+			from = cutoff
+		}
+	}
+	r, ok := h.series[seriesKey(id, mType)]
+	if !ok {
+		return nil
+	}
+	start := sort.Search(r.len(), func(i int) bool { return !r.at(i).Time.Before(from) })
+	end := sort.Search(r.len(), func(i int) bool { return r.at(i).Time.After(to) })
+	if start >= end {
+		return nil
+	}
+	samples := make([]Sample, 0, end-start)
+	for i := start; i < end; i++ {
+		samples = append(samples, r.at(i))
+	}
+	return samples
+}
+
+// Prune drops samples older than the retention period from all metrics,
+// metrics left without samples are removed.
+func (h *History) Prune(now time.Time) {
+	h.pruned = now
+	for key, r := range h.series {
+		if h.expire(r, now); r.len() == 0 {
+			delete(h.series, key)
+		}
+	}
+}
+
+// expire removes the oldest samples older than now minus retention.
+func (h *History) expire(r *ring, now time.Time) {
+	if h.retention <= 0 {
+		return
+	}
+	cutoff := now.Add(-h.retention)
+	r.drop(sort.Search(r.len(), func(i int) bool { return !r.at(i).Time.Before(cutoff) }))
+}
+
+// MarshalJSON encodes samples keyed by "type/id".
+func (h *History) MarshalJSON() ([]byte, error) {
+	series := make(map[string][]Sample, len(h.series))
+	for key, r := range h.series {
+		series[key] = r.slice()
+	}
+	return json.Marshal(series)
+}
+
+// UnmarshalJSON restores samples keeping the configured limits, expired samples are dropped.
+func (h *History) UnmarshalJSON(data []byte) error {
+	var series map[string][]Sample
+	if err := json.Unmarshal(data, &series); err != nil {
+		return err
+	}
+	h.series = make(map[string]*ring, len(series))
+	for key, samples := range series {
+		if !strings.Contains(key, "/") {
+			continue
+		}
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+		r := &ring{}
+		for _, s := range samples {
+			r.push(s, h.size)
+		}
+		h.series[key] = r
+	}
+	h.Prune(time.Now())
+	return nil
+}
+
+// ring is a growable ring buffer of samples ordered from the oldest to the newest.
+type ring struct {
+	buf   []Sample
+	start int
+	n     int
+}
+
+func (r *ring) len() int {
+	return r.n
+}
+
+// at returns the i-th oldest sample.
+func (r *ring) at(i int) Sample {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+// push appends a sample, with a positive limit the oldest sample is overwritten when the buffer is full.
+func (r *ring) push(s Sample, limit int) {
+	if limit > 0 && r.n == limit {
+		r.buf[r.start] = s
+		r.start = (r.start + 1) % len(r.buf)
+		return
+	}
+	if r.n == len(r.buf) {
+		grown := make([]Sample, max(2*len(r.buf), 4))
+		if limit > 0 && len(grown) > limit {
+			grown = grown[:limit]
+		}
+		copy(grown, r.slice())
+		r.buf = grown
+		r.start = 0
+	}
+	r.buf[(r.start+r.n)%len(r.buf)] = s
+	r.n++
+}
+
+// drop removes k oldest samples.
+func (r *ring) drop(k int) {
+	if k <= 0 {
+		return
+	}
+	if k >= r.n {
+		r.buf, r.start, r.n = nil, 0, 0
+		return
+	}
+	for i := 0; i < k; i++ {
+		r.buf[(r.start+i)%len(r.buf)] = Sample{}
+	}
+	r.start = (r.start + k) % len(r.buf)
+	r.n -= k
+}
+
+// slice returns samples from the oldest to the newest.
+func (r *ring) slice() []Sample {
+	samples := make([]Sample, r.n)
+	for i := range samples {
+		samples[i] = r.at(i)
+	}
+	return samples
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gaugeSample(ts time.Time, v float64) Sample {
+	return Sample{Time: ts, Value: &v}
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Now()
+
+	t.Run("range returns samples within bounds", func(t *testing.T) {
+		h := NewHistory(time.Hour, 0)
+		for i := 5; i >= 0; i-- {
+			h.Record("g", Gauge, gaugeSample(now.Add(-time.Duration(i)*time.Minute), float64(i)))
+		}
+
+		got := h.Range("g", Gauge, now.Add(-3*time.Minute), now.Add(-time.Minute))
+		require.Len(t, got, 3)
+		assert.Equal(t, 3.0, *got[0].Value)
+		assert.Equal(t, 1.0, *got[2].Value)
+
+		// Метрики разных типов с одинаковым именем не смешиваются
+		assert.Empty(t, h.Range("g", Counter, now.Add(-time.Hour), now))
+	})
+
+	t.Run("expired samples are dropped", func(t *testing.T) {
+		h := NewHistory(10*time.Minute, 0)
+		h.Record("g", Gauge, gaugeSample(now.Add(-20*time.Minute), 1))
+		h.Record("g", Gauge, gaugeSample(now.Add(-5*time.Minute), 2))
+
+		got := h.Range("g", Gauge, now.Add(-time.Hour), now)
+		require.Len(t, got, 1)
+		assert.Equal(t, 2.0, *got[0].Value)
+
+		h.Prune(now.Add(time.Hour))
+		assert.Empty(t, h.series)
+	})
+
+	t.Run("metrics no longer written are pruned on record", func(t *testing.T) {
+		h := NewHistory(10*time.Minute, 0)
+		h.Record("old", Gauge, gaugeSample(now.Add(-20*time.Minute), 1))
+		h.Record("g", Gauge, gaugeSample(now.Add(-10*time.Minute-30*time.Second), 2))
+		require.Len(t, h.series, 2)
+
+		// Отсчет old уже устарел, но запись других метрик удаляет такие отсчеты не чаще раза в минуту
+		h.Record("g", Gauge, gaugeSample(now.Add(-10*time.Minute+10*time.Second), 3))
+		assert.Len(t, h.series, 2)
+		h.Record("g", Gauge, gaugeSample(now, 4))
+		assert.Len(t, h.series, 1)
+		assert.Contains(t, h.series, seriesKey("g", Gauge))
+	})
+
+	t.Run("ring buffer keeps the newest samples", func(t *testing.T) {
+		h := NewHistory(0, 3)
+		for i := 0; i < 10; i++ {
+			h.Record("g", Gauge, gaugeSample(now.Add(time.Duration(i-10)*time.Second), float64(i)))
+		}
+
+		got := h.Range("g", Gauge, now.Add(-time.Hour), now)
+		require.Len(t, got, 3)
+		assert.Equal(t, 7.0, *got[0].Value)
+		assert.Equal(t, 9.0, *got[2].Value)
+
+		// Фильтрация по времени работает поверх кольцевого буфера
+		got = h.Range("g", Gauge, now.Add(-1500*time.Millisecond), now)
+		require.Len(t, got, 1)
+		assert.Equal(t, 9.0, *got[0].Value)
+	})
+
+	t.Run("json round trip keeps retention", func(t *testing.T) {
+		h := NewHistory(time.Hour, 0)
+		h.Record("g", Gauge, gaugeSample(now.Add(-time.Minute), 1))
+		data, err := json.Marshal(h)
+		require.NoError(t, err)
+
+		restored := NewHistory(30*time.Second, 0)
+		require.NoError(t, json.Unmarshal(data, restored))
+		// Сэмпл старше нового периода хранения отбрасывается
+		assert.Empty(t, restored.Range("g", Gauge, now.Add(-time.Hour), now))
+
+		restored = NewHistory(time.Hour, 0)
+		require.NoError(t, json.Unmarshal(data, restored))
+		assert.Len(t, restored.Range("g", Gauge, now.Add(-time.Hour), now), 1)
+	})
+}
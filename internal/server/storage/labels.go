@@ -0,0 +1,440 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// NameLabel is the pseudo label matchers use to select the metric name.
+const NameLabel = "__name__"
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidateSeries checks the metric name and label names of a series.
+func ValidateSeries(name string, labels map[string]string) error {
+	if strings.ContainsAny(name, "{}") {
+		return fmt.Errorf("metric id must not contain braces")
+	}
+	return ValidateLabels(labels)
+}
+
+// ValidateName checks a metric name given without labels, such as a URL path segment.
+// Besides braces it rejects '=' and ',', so the name cannot pass for a series key with labels.
+func ValidateName(name string) error {
+	if strings.ContainsAny(name, "{}=,") {
+		return fmt.Errorf("metric id must not contain any of %q", "{}=,")
+	}
+	return nil
+}
+
+// ValidateLabels checks label names, names starting with "__" are reserved.
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRe.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name: %q", name)
+		}
+	}
+	return nil
+}
+
+// SeriesKey returns the canonical storage key of a labelled metric: name{k1="v1",k2="v2"} with labels
+// sorted by name. Metrics without labels are keyed by their name, so they are stored the same way as before labels.
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ParseSeriesKey splits a key built by SeriesKey into metric name and labels.
+// Keys without labels yield nil labels.
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 {
+		return key, nil, nil
+	}
+	name := key[:i]
+	p := &selectorParser{s: key, pos: i}
+	labels := make(map[string]string)
+	err := p.parseBraces(func(label, op, value string) error {
+		if op != string(MatchEqual) {
+			return fmt.Errorf("unexpected operator %q in series key", op)
+		}
+		labels[label] = value
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if p.pos != len(key) {
+		return "", nil, fmt.Errorf("unexpected trailing characters in series key %q", key)
+	}
+	return name, labels, nil
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// MatchType is a label matcher operator.
+type MatchType string
+
+// Label matcher operators, the same as in Prometheus selectors.
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher selects metrics by a label value, missing labels match as empty values.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher creates a matcher, regular expressions are anchored to the whole value.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Name: name, Type: t, Value: value}
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unknown match type: %s", t)
+	}
+	return m, nil
+}
+
+// Matches reports whether the label value satisfies the matcher.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	default:
+		return false
+	}
+}
+
+// MatchSeries reports whether the metric name and labels satisfy all matchers.
+func MatchSeries(name string, labels map[string]string, matchers []*Matcher) bool {
+	for _, m := range matchers {
+		v := labels[m.Name]
+		if m.Name == NameLabel {
+			v = name
+		}
+		if !m.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parses a Prometheus style selector such as CPUutilization{host="a",cpu=~"0|1"}.
+// Both the metric name and the braces are optional, but the selector must not be empty.
+func ParseSelector(s string) ([]*Matcher, error) {
+	s = strings.TrimSpace(s)
+	p := &selectorParser{s: s}
+	var matchers []*Matcher
+
+	if name := p.ident(); name != "" {
+		m, _ := NewMatcher(MatchEqual, NameLabel, name)
+		matchers = append(matchers, m)
+	}
+	if p.pos < len(s) && s[p.pos] == '{' {
+		err := p.parseBraces(func(label, op, value string) error {
+			m, err := NewMatcher(MatchType(op), label, value)
+			if err != nil {
+				return err
+			}
+			matchers = append(matchers, m)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.pos != len(s) {
+		return nil, fmt.Errorf("unexpected characters in selector %q at %d", s, p.pos)
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return matchers, nil
+}
+
+// selectorParser reads label lists in braces shared by series keys and selectors.
+type selectorParser struct {
+	s   string
+	pos int
+}
+
+func (p *selectorParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// ident reads a metric or label name.
+func (p *selectorParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '_' || c == ':' || c == '.' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.pos]
+}
+
+// parseBraces reads {label op "value", ...} and calls fn for every pair.
+func (p *selectorParser) parseBraces(fn func(label, op, value string) error) error {
+	p.pos++ // '{'
+	for {
+		p.skipSpaces()
+		if p.pos < len(p.s) && p.s[p.pos] == '}' {
+			p.pos++
+			return nil
+		}
+		label := p.ident()
+		if label == "" {
+			return fmt.Errorf("expected label name at %d", p.pos)
+		}
+		p.skipSpaces()
+		var op string
+		for _, candidate := range []MatchType{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual} {
+			if strings.HasPrefix(p.s[p.pos:], string(candidate)) {
+				op = string(candidate)
+				break
+			}
+		}
+		if op == "" {
+			return fmt.Errorf("expected match operator at %d", p.pos)
+		}
+		p.pos += len(op)
+		p.skipSpaces()
+		value, err := p.quoted()
+		if err != nil {
+			return err
+		}
+		if err := fn(label, op, value); err != nil {
+			return err
+		}
+		p.skipSpaces()
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if p.pos < len(p.s) && p.s[p.pos] == '}' {
+			p.pos++
+			return nil
+		}
+		return fmt.Errorf("expected ',' or '}' at %d", p.pos)
+	}
+}
+
+// quoted reads a double quoted value with \\, \" and \n escapes.
+func (p *selectorParser) quoted() (string, error) {
+	if p.pos >= len(p.s) || p.s[p.pos] != '"' {
+		return "", fmt.Errorf("expected quoted value at %d", p.pos)
+	}
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\\':
+			if p.pos+1 >= len(p.s) {
+				return "", fmt.Errorf("unterminated escape at %d", p.pos)
+			}
+			p.pos++
+			if p.s[p.pos] == 'n' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(p.s[p.pos])
+			}
+		default:
+			b.WriteByte(c)
+		}
+		p.pos++
+	}
+	return "", fmt.Errorf("unterminated quoted value")
+}
+
+type SeriesReader interface {
+	// FindSeries returns current values of metrics matching all matchers ordered by type and key.
+	FindSeries(ctx context.Context, matchers []*Matcher) ([]Metric, error)
+}
+
+// SelectSeries implements SeriesReader on top of MetricReader by filtering all metrics.
+func SelectSeries(ctx context.Context, r MetricReader, matchers []*Matcher) ([]Metric, error) {
+	counters, gauges, err := r.GetAllMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return FilterSeries(counters, gauges, matchers), nil
+}
+
+// FilterSeries returns metrics from the maps whose keys satisfy all matchers ordered by type and key.
+func FilterSeries(counters map[string]int64, gauges map[string]float64, matchers []*Matcher) []Metric {
+	var series []Metric
+	for _, key := range sortedKeys(counters) {
+		name, labels, err := ParseSeriesKey(key)
+		if err != nil || !MatchSeries(name, labels, matchers) {
+			continue
+		}
+		delta := counters[key]
+		series = append(series, Metric{ID: name, MType: Counter, Delta: &delta, Labels: labels})
+	}
+	for _, key := range sortedKeys(gauges) {
+		name, labels, err := ParseSeriesKey(key)
+		if err != nil || !MatchSeries(name, labels, matchers) {
+			continue
+		}
+		value := gauges[key]
+		series = append(series, Metric{ID: name, MType: Gauge, Value: &value, Labels: labels})
+	}
+	return series
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ErrAmbiguousSeries is returned when a bare metric name matches several labelled series.
+var ErrAmbiguousSeries = errors.New("several series match, select one with labels")
+
+// PickSeries returns the key among keys of series a read of id refers to. The key equal to id wins,
+// otherwise a single key is picked and several keys are ambiguous. Without keys id is returned as is.
+func PickSeries(id string, keys []string) (string, error) {
+	if slices.Contains(keys, id) {
+		return id, nil
+	}
+	switch len(keys) {
+	case 0:
+		return id, nil
+	case 1:
+		return keys[0], nil
+	default:
+		return "", ErrAmbiguousSeries
+	}
+}
+
+// ResolveSeries returns the key of the series of mType a single metric read refers to.
+// An id with labels is a series key and is returned as is. A bare name resolves to the series without labels
+// if it exists, otherwise to the only series with that name, such as an agent metric tagged with
+// host and instance. A bare name of no current series is returned as is.
+func ResolveSeries(ctx context.Context, r MetricReader, id string, mType MetricType) (string, error) {
+	if _, labels, err := ParseSeriesKey(id); err != nil || labels != nil {
+		return id, nil
+	}
+	var keys []string
+	switch mType {
+	case Counter, Gauge:
+		name, err := NewMatcher(MatchEqual, NameLabel, id)
+		if err != nil {
+			return "", err
+		}
+		var series []Metric
+		if sr, ok := r.(SeriesReader); ok {
+			series, err = sr.FindSeries(ctx, []*Matcher{name})
+		} else {
+			series, err = SelectSeries(ctx, r, []*Matcher{name})
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, m := range series {
+			if m.MType == mType {
+				keys = append(keys, m.Key())
+			}
+		}
+	default:
+		all, err := seriesKeys(ctx, r, mType)
+		if err != nil {
+			return "", err
+		}
+		for _, key := range all {
+			if name, _, err := ParseSeriesKey(key); err == nil && name == id {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return PickSeries(id, keys)
+}
+
+// seriesKeys returns keys of all histograms, summaries or sets, storages that do not keep the type have none.
+func seriesKeys(ctx context.Context, r MetricReader, mType MetricType) ([]string, error) {
+	var keys []string
+	var err error
+	switch mType {
+	case Histogram:
+		if hr, ok := r.(HistogramReader); ok {
+			var all map[string]*HistogramValue
+			all, err = hr.GetAllHistograms(ctx)
+			keys = sortedKeys(all)
+		}
+	case Summary:
+		if sr, ok := r.(SummaryReader); ok {
+			var all map[string]*SummaryValue
+			all, err = sr.GetAllSummaries(ctx)
+			keys = sortedKeys(all)
+		}
+	case Set:
+		if sr, ok := r.(SetReader); ok {
+			var all map[string]*SetValue
+			all, err = sr.GetAllSets(ctx)
+			keys = sortedKeys(all)
+		}
+	}
+	if errors.Is(err, ErrHistogramsUnsupported) || errors.Is(err, ErrSummariesUnsupported) || errors.Is(err, ErrSetsUnsupported) {
+		return nil, nil
+	}
+	return keys, err
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesKey(t *testing.T) {
+	t.Run("metric without labels is keyed by name", func(t *testing.T) {
+		assert.Equal(t, "Alloc", SeriesKey("Alloc", nil))
+		name, labels, err := ParseSeriesKey("Alloc")
+		require.NoError(t, err)
+		assert.Equal(t, "Alloc", name)
+		assert.Nil(t, labels)
+	})
+
+	t.Run("labels are sorted and escaped", func(t *testing.T) {
+		labels := map[string]string{"host": "a", "cpu": `0"\` + "\n"}
+		key := SeriesKey("CPU", labels)
+		assert.Equal(t, `CPU{cpu="0\"\\\n",host="a"}`, key)
+
+		name, parsed, err := ParseSeriesKey(key)
+		require.NoError(t, err)
+		assert.Equal(t, "CPU", name)
+		assert.Equal(t, labels, parsed)
+	})
+
+	t.Run("malformed keys", func(t *testing.T) {
+		for _, key := range []string{`a{b="c"`, `a{b=~"c"}`, `a{b="c"}x`, `a{="c"}`} {
+			_, _, err := ParseSeriesKey(key)
+			assert.Error(t, err, key)
+		}
+	})
+}
+
+func TestMetric_ValidateLabels(t *testing.T) {
+	value := 1.0
+	assert.NoError(t, Metric{ID: "g", MType: Gauge, Value: &value, Labels: map[string]string{"host": "a"}}.Validate())
+	assert.Error(t, Metric{ID: "g{x}", MType: Gauge, Value: &value}.Validate())
+	assert.Error(t, Metric{ID: "g", MType: Gauge, Value: &value, Labels: map[string]string{"1host": "a"}}.Validate())
+	assert.Error(t, Metric{ID: "g", MType: Gauge, Value: &value, Labels: map[string]string{"__name__": "a"}}.Validate())
+}
+
+func TestValidateName(t *testing.T) {
+	assert.NoError(t, ValidateName("go.gc_duration-seconds"))
+	for _, name := range []string{`g{host="a"}`, "g}", "g,host=a", "host=a"} {
+		assert.Error(t, ValidateName(name), name)
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	matchers, err := ParseSelector(`CPU{host="a", cpu=~"0|1", env!="dev", zone!~"eu.*"}`)
+	require.NoError(t, err)
+	require.Len(t, matchers, 5)
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   bool
+	}{
+		{"CPU", map[string]string{"host": "a", "cpu": "1", "zone": "us"}, true},
+		{"CPU", map[string]string{"host": "a", "cpu": "2"}, false},
+		{"CPU", map[string]string{"host": "b", "cpu": "0"}, false},
+		{"CPU", map[string]string{"host": "a", "cpu": "0", "env": "dev"}, false},
+		{"CPU", map[string]string{"host": "a", "cpu": "0", "zone": "eu-west"}, false},
+		{"Alloc", map[string]string{"host": "a", "cpu": "0"}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, MatchSeries(tt.name, tt.labels, matchers), "%s %v", tt.name, tt.labels)
+	}
+
+	t.Run("name only and labels only", func(t *testing.T) {
+		matchers, err := ParseSelector("Alloc")
+		require.NoError(t, err)
+		assert.True(t, MatchSeries("Alloc", nil, matchers))
+
+		matchers, err = ParseSelector(`{host="a"}`)
+		require.NoError(t, err)
+		assert.True(t, MatchSeries("Alloc", map[string]string{"host": "a"}, matchers))
+	})
+
+	t.Run("invalid selectors", func(t *testing.T) {
+		for _, s := range []string{"", "{}", `a{b="c"`, `a{b~"c"}`, `a{b=c}`, `a{b=~"("}`, `a b`} {
+			_, err := ParseSelector(s)
+			assert.Error(t, err, s)
+		}
+	})
+}
+
+type mapReader struct {
+	counters map[string]int64
+	gauges   map[string]float64
+}
+
+func (r mapReader) GetMetric(context.Context, string, MetricType) (*int64, *float64, error) {
+	return nil, nil, nil
+}
+
+func (r mapReader) GetAllMetrics(context.Context) (map[string]int64, map[string]float64, error) {
+	return r.counters, r.gauges, nil
+}
+
+func TestSelectSeries(t *testing.T) {
+	r := mapReader{
+		counters: map[string]int64{`PollCount{host="a"}`: 1, `PollCount{host="b"}`: 2},
+		gauges:   map[string]float64{`Alloc{host="a"}`: 10, "Alloc": 5},
+	}
+	matchers, err := ParseSelector(`{host="a"}`)
+	require.NoError(t, err)
+
+	series, err := SelectSeries(context.Background(), r, matchers)
+	require.NoError(t, err)
+	require.Len(t, series, 2)
+	assert.Equal(t, "PollCount", series[0].ID)
+	assert.Equal(t, Counter, series[0].MType)
+	assert.Equal(t, int64(1), *series[0].Delta)
+	assert.Equal(t, "Alloc", series[1].ID)
+	assert.Equal(t, map[string]string{"host": "a"}, series[1].Labels)
+}
+
+func TestPickSeries(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		keys    []string
+		want    string
+		wantErr error
+	}{
+		{"no series", "Alloc", nil, "Alloc", nil},
+		{"single labelled series", "Alloc", []string{`Alloc{host="a"}`}, `Alloc{host="a"}`, nil},
+		{"series without labels wins", "Alloc", []string{"Alloc", `Alloc{host="a"}`}, "Alloc", nil},
+		{"several series", "Alloc", []string{`Alloc{host="a"}`, `Alloc{host="b"}`}, "", ErrAmbiguousSeries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PickSeries(tt.id, tt.keys)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/antonminaichev/metricscollector/internal/hll"
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
 )
 
@@ -13,16 +15,35 @@ type MemoryStorage struct {
 	mu       sync.RWMutex
 	counters map[string]int64
 	gauges   map[string]float64
+	// histograms are keyed by series key like counters and gauges.
+	histograms map[string]*storage.HistogramValue
+	summaries  map[string]*storage.SummaryValue
+	sets       map[string]*hll.Sketch
+	batches    *storage.AppliedBatches
+	history    *storage.History
 }
 
 // NewMemoryStorage creates new in-memory storage.
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		counters: make(map[string]int64),
-		gauges:   make(map[string]float64),
+		counters:   make(map[string]int64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*storage.HistogramValue),
+		summaries:  make(map[string]*storage.SummaryValue),
+		sets:       make(map[string]*hll.Sketch),
+		batches:    storage.NewAppliedBatches(storage.DefaultBatchHistory),
+		history:    storage.NewHistory(0, storage.DefaultHistorySize),
 	}
 }
 
+// EnableHistory limits how long recent samples are kept, expired samples are pruned on write.
+// Memory storage always keeps up to storage.DefaultHistorySize recent samples per metric.
+func (s *MemoryStorage) EnableHistory(retention time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history.SetRetention(retention)
+}
+
 // UpdateMetric updates or creates a metric in a in-memory storage.
 func (s *MemoryStorage) UpdateMetric(ctx context.Context, id string, mType storage.MetricType, delta *int64, value *float64) error {
 	s.mu.Lock()
@@ -34,21 +55,83 @@ func (s *MemoryStorage) UpdateMetric(ctx context.Context, id string, mType stora
 	default:
 	}
 
+	return s.update(id, mType, delta, value, time.Now())
+}
+
+// UpdateMetrics applies a batch of metrics to in-memory storage at most once per batch ID.
+func (s *MemoryStorage) UpdateMetrics(ctx context.Context, batchID string, metrics []storage.Metric) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	default:
+	}
+
+	if batchID != "" && s.batches.Seen(batchID) {
+		return false, nil
+	}
+	for _, m := range metrics {
+		if err := m.Validate(); err != nil {
+			return false, err
+		}
+	}
+	histograms := storage.MergeHistograms(s.histograms, metrics)
+	now := time.Now()
+	for _, m := range metrics {
+		switch m.MType {
+		case storage.Histogram:
+			if h, ok := histograms[m.Key()]; ok {
+				s.histograms[m.Key()] = h
+			}
+			continue
+		case storage.Set:
+			s.sets[m.Key()] = storage.AddSet(s.sets[m.Key()], m)
+			continue
+		}
+		if err := s.update(m.Key(), m.MType, m.Delta, m.Value, now); err != nil {
+			return false, err
+		}
+	}
+	if batchID != "" {
+		s.batches.Add(batchID)
+	}
+
+	return true, nil
+}
+
+// update applies a single metric and records it in history, the caller must hold the write lock.
+func (s *MemoryStorage) update(id string, mType storage.MetricType, delta *int64, value *float64, now time.Time) error {
+	sample := storage.Sample{Time: now}
 	switch mType {
 	case storage.Counter:
 		if delta == nil {
 			return fmt.Errorf("delta value is required for counter metric")
 		}
 		s.counters[id] += *delta
+		total := s.counters[id]
+		sample.Delta = &total
 	case storage.Gauge:
 		if value == nil {
 			return fmt.Errorf("value is required for gauge metric")
 		}
 		s.gauges[id] = *value
+		v := *value
+		sample.Value = &v
+	case storage.Histogram, storage.Set:
+		return fmt.Errorf("%s metrics can only be written in batches", mType)
+	case storage.Summary:
+		if value == nil {
+			return fmt.Errorf("value is required for summary metric")
+		}
+		s.summaries[id] = s.summaries[id].Observe(*value)
+		return nil
 	default:
 		return fmt.Errorf("unknown metric type: %s", mType)
 	}
 
+	s.history.Record(id, mType, sample)
 	return nil
 }
 
@@ -79,6 +162,133 @@ func (s *MemoryStorage) GetMetric(ctx context.Context, id string, mType storage.
 	return nil, nil, fmt.Errorf("metric not found")
 }
 
+// FindSeries returns current values of metrics matching all matchers.
+func (s *MemoryStorage) FindSeries(ctx context.Context, matchers []*storage.Matcher) ([]storage.Metric, error) {
+	return storage.SelectSeries(ctx, s, matchers)
+}
+
+// GetHistory returns samples of the metric recorded within [from, to].
+func (s *MemoryStorage) GetHistory(ctx context.Context, id string, mType storage.MetricType, from, to time.Time) ([]storage.Sample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	return s.history.Range(id, mType, from, to), nil
+}
+
+// GetHistogram returns a histogram from in-memory storage.
+func (s *MemoryStorage) GetHistogram(ctx context.Context, id string) (*storage.HistogramValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	h, ok := s.histograms[id]
+	if !ok {
+		return nil, storage.ErrHistogramNotFound
+	}
+	return h.Clone(), nil
+}
+
+// GetAllHistograms returns all histograms from in-memory storage.
+func (s *MemoryStorage) GetAllHistograms(ctx context.Context) (map[string]*storage.HistogramValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	histograms := make(map[string]*storage.HistogramValue, len(s.histograms))
+	for k, h := range s.histograms {
+		histograms[k] = h.Clone()
+	}
+	return histograms, nil
+}
+
+// GetSummary returns a summary snapshot from in-memory storage.
+func (s *MemoryStorage) GetSummary(ctx context.Context, id string) (*storage.SummaryValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	summary, ok := s.summaries[id]
+	if !ok {
+		return nil, storage.ErrSummaryNotFound
+	}
+	return summary.Snapshot(), nil
+}
+
+// GetAllSummaries returns snapshots of all summaries from in-memory storage.
+func (s *MemoryStorage) GetAllSummaries(ctx context.Context) (map[string]*storage.SummaryValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	summaries := make(map[string]*storage.SummaryValue, len(s.summaries))
+	for k, summary := range s.summaries {
+		summaries[k] = summary.Snapshot()
+	}
+	return summaries, nil
+}
+
+// GetSet returns a set snapshot from in-memory storage.
+func (s *MemoryStorage) GetSet(ctx context.Context, id string) (*storage.SetValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	set, ok := s.sets[id]
+	if !ok {
+		return nil, storage.ErrSetNotFound
+	}
+	return storage.SetSnapshot(set), nil
+}
+
+// GetAllSets returns snapshots of all sets from in-memory storage.
+func (s *MemoryStorage) GetAllSets(ctx context.Context) (map[string]*storage.SetValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	sets := make(map[string]*storage.SetValue, len(s.sets))
+	for k, set := range s.sets {
+		sets[k] = storage.SetSnapshot(set)
+	}
+	return sets, nil
+}
+
 // GetAllMetrics returns all metrics from a in-memory storage.
 func (s *MemoryStorage) GetAllMetrics(ctx context.Context) (map[string]int64, map[string]float64, error) {
 	s.mu.RLock()
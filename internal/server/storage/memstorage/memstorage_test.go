@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/antonminaichev/metricscollector/internal/server/storage"
 	"github.com/stretchr/testify/assert"
@@ -238,5 +239,188 @@ func TestMemoryStorage_ConcurrentAccess(t *testing.T) {
 	}
 }
 
+func TestMemoryStorage_UpdateMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("applies batch once per batch ID", func(t *testing.T) {
+		s := NewMemoryStorage()
+		batch := []storage.Metric{
+			{ID: "c1", MType: storage.Counter, Delta: ptrInt64(2)},
+			{ID: "g1", MType: storage.Gauge, Value: ptrFloat64(1.5)},
+		}
+
+		applied, err := s.UpdateMetrics(ctx, "agent/1", batch)
+		require.NoError(t, err)
+		assert.True(t, applied)
+
+		applied, err = s.UpdateMetrics(ctx, "agent/1", batch)
+		require.NoError(t, err)
+		assert.False(t, applied)
+
+		delta, _, err := s.GetMetric(ctx, "c1", storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), *delta)
+	})
+
+	t.Run("empty batch ID is never deduplicated", func(t *testing.T) {
+		s := NewMemoryStorage()
+		batch := []storage.Metric{{ID: "c1", MType: storage.Counter, Delta: ptrInt64(2)}}
+
+		for i := 0; i < 2; i++ {
+			applied, err := s.UpdateMetrics(ctx, "", batch)
+			require.NoError(t, err)
+			assert.True(t, applied)
+		}
+
+		delta, _, err := s.GetMetric(ctx, "c1", storage.Counter)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), *delta)
+	})
+
+	t.Run("invalid metric rejects whole batch", func(t *testing.T) {
+		s := NewMemoryStorage()
+		batch := []storage.Metric{
+			{ID: "c1", MType: storage.Counter, Delta: ptrInt64(2)},
+			{ID: "g1", MType: storage.Gauge},
+		}
+
+		_, err := s.UpdateMetrics(ctx, "agent/2", batch)
+		assert.Error(t, err)
+
+		_, _, err = s.GetMetric(ctx, "c1", storage.Counter)
+		assert.Error(t, err)
+
+		// Батч с ошибкой не запоминается
+		applied, err := s.UpdateMetrics(ctx, "agent/2", batch[:1])
+		require.NoError(t, err)
+		assert.True(t, applied)
+	})
+}
+
+func TestMemoryStorage_Histograms(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	report := func(counts ...uint64) storage.Metric {
+		var count uint64
+		for _, c := range counts {
+			count += c
+		}
+		return storage.Metric{ID: "latency", MType: storage.Histogram, Labels: map[string]string{"host": "a"},
+			Histogram: &storage.HistogramValue{Bounds: []float64{0.1, 1}, Counts: counts, Sum: float64(count), Count: count}}
+	}
+
+	_, err := s.UpdateMetrics(ctx, "", []storage.Metric{report(1, 2, 0)})
+	require.NoError(t, err)
+	_, err = s.UpdateMetrics(ctx, "", []storage.Metric{report(0, 1, 1)})
+	require.NoError(t, err)
+
+	h, err := s.GetHistogram(ctx, `latency{host="a"}`)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 3, 1}, h.Counts)
+	assert.Equal(t, uint64(5), h.Count)
+
+	all, err := s.GetAllHistograms(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+
+	_, err = s.GetHistogram(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrHistogramNotFound)
+
+	// Гистограмму нельзя записать одиночным обновлением
+	assert.Error(t, s.UpdateMetric(ctx, "latency", storage.Histogram, nil, nil))
+}
+
+func TestMemoryStorage_Summaries(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	require.NoError(t, s.UpdateMetric(ctx, "rt", storage.Summary, nil, ptrFloat64(0.2)))
+	_, err := s.UpdateMetrics(ctx, "", []storage.Metric{
+		{ID: "rt", MType: storage.Summary, Value: ptrFloat64(0.1)},
+		{ID: "rt", MType: storage.Summary, Value: ptrFloat64(0.3)},
+	})
+	require.NoError(t, err)
+
+	summary, err := s.GetSummary(ctx, "rt")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), summary.Count)
+	assert.InDelta(t, 0.6, summary.Sum, 1e-9)
+	assert.Equal(t, 0.1, summary.Min)
+	assert.Equal(t, 0.3, summary.Max)
+	assert.Len(t, summary.Quantiles, len(storage.SummaryQuantiles))
+
+	_, err = s.GetSummary(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrSummaryNotFound)
+	assert.Error(t, s.UpdateMetric(ctx, "rt", storage.Summary, nil, nil))
+}
+
+func TestMemoryStorage_Sets(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	members := []string{"alice", "bob", "alice", "carol"}
+	batch := make([]storage.Metric, 0, len(members))
+	for i := range members {
+		batch = append(batch, storage.Metric{ID: "users", MType: storage.Set, Member: &members[i]})
+	}
+	_, err := s.UpdateMetrics(ctx, "", batch)
+	require.NoError(t, err)
+
+	set, err := s.GetSet(ctx, "users")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), set.Cardinality)
+
+	all, err := s.GetAllSets(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, all, "users")
+
+	_, err = s.GetSet(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrSetNotFound)
+	// Элемент множества нельзя передать через UpdateMetric
+	assert.Error(t, s.UpdateMetric(ctx, "users", storage.Set, nil, nil))
+}
+
 func ptrInt64(v int64) *int64       { return &v }
 func ptrFloat64(v float64) *float64 { return &v }
+
+func TestMemoryStorage_History(t *testing.T) {
+	ctx := context.Background()
+	from := time.Now().Add(-time.Minute)
+
+	t.Run("records accumulated counter and gauge values", func(t *testing.T) {
+		s := NewMemoryStorage()
+		delta := int64(2)
+		value := 1.5
+
+		require.NoError(t, s.UpdateMetric(ctx, "c", storage.Counter, &delta, nil))
+		_, err := s.UpdateMetrics(ctx, "", []storage.Metric{
+			{ID: "c", MType: storage.Counter, Delta: &delta},
+			{ID: "g", MType: storage.Gauge, Value: &value},
+		})
+		require.NoError(t, err)
+
+		counters, err := s.GetHistory(ctx, "c", storage.Counter, from, time.Now())
+		require.NoError(t, err)
+		require.Len(t, counters, 2)
+		assert.Equal(t, int64(2), *counters[0].Delta)
+		assert.Equal(t, int64(4), *counters[1].Delta)
+
+		gauges, err := s.GetHistory(ctx, "g", storage.Gauge, from, time.Now())
+		require.NoError(t, err)
+		require.Len(t, gauges, 1)
+		assert.Equal(t, value, *gauges[0].Value)
+	})
+
+	t.Run("keeps a bounded number of samples", func(t *testing.T) {
+		s := NewMemoryStorage()
+		for i := 0; i < storage.DefaultHistorySize+10; i++ {
+			value := float64(i)
+			require.NoError(t, s.UpdateMetric(ctx, "g", storage.Gauge, nil, &value))
+		}
+
+		samples, err := s.GetHistory(ctx, "g", storage.Gauge, from, time.Now())
+		require.NoError(t, err)
+		require.Len(t, samples, storage.DefaultHistorySize)
+		assert.Equal(t, 10.0, *samples[0].Value)
+	})
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRollupsDisabled is returned by RollupReader when the storage does not maintain rollups.
+var ErrRollupsDisabled = errors.New("metric rollups are disabled")
+
+// Resolution is the width of a rollup bucket.
+type Resolution string
+
+// Supported rollup resolutions.
+const (
+	RollupMinute Resolution = "1m"
+	RollupHour   Resolution = "1h"
+)
+
+// ParseResolution converts a query value to Resolution.
+func ParseResolution(s string) (Resolution, error) {
+	switch r := Resolution(s); r {
+	case RollupMinute, RollupHour:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unknown rollup resolution: %s", s)
+	}
+}
+
+// Duration returns the bucket width.
+func (r Resolution) Duration() time.Duration {
+	switch r {
+	case RollupMinute:
+		return time.Minute
+	case RollupHour:
+		return time.Hour
+	default:
+		return 0
+	}
+}
+
+// Rollup aggregates metric values written within a bucket.
+// Min, Max, Avg and Last of counters are taken over accumulated counter values, the same as Sample,
+// the counter growth within the bucket is Increase.
+type Rollup struct {
+	// Time is the bucket start.
+	Time  time.Time `json:"time"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Count int64     `json:"count"`
+	Last  float64   `json:"last"`
+	// Increase is the sum of counter increments written within the bucket, zero for gauges.
+	Increase float64 `json:"increase,omitempty"`
+}
+
+type RollupReader interface {
+	// GetRollups returns rollups of the metric with buckets starting within [from, to] ordered by time.
+	GetRollups(ctx context.Context, id string, mType MetricType, res Resolution, from, to time.Time) ([]Rollup, error)
+}
@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseResolution(t *testing.T) {
+	res, err := ParseResolution("1m")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, res.Duration())
+
+	res, err = ParseResolution("1h")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, res.Duration())
+
+	_, err = ParseResolution("1d")
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/antonminaichev/metricscollector/internal/hll"
+)
+
+var (
+	// ErrSetNotFound is returned when a set metric does not exist.
+	ErrSetNotFound = errors.New("metric not found")
+	// ErrSetsUnsupported is returned by wrappers of storages that do not keep sets.
+	ErrSetsUnsupported = errors.New("sets are not supported by the storage")
+)
+
+// SetValue is the state of a set metric, members are counted in a HyperLogLog sketch
+// so only the approximate number of unique members is known.
+type SetValue struct {
+	// Cardinality is the estimated number of unique members, it is filled in by Snapshot.
+	Cardinality uint64 `json:"cardinality"`
+	// Sketch counts members, clients may send sketches built with the hll package
+	// instead of single members. Snapshot drops it.
+	Sketch *hll.Sketch `json:"sketch,omitempty"`
+}
+
+// AddSet returns the sketch s with the member or the sketch of m added, s may be nil.
+// The metric must be valid.
+func AddSet(s *hll.Sketch, m Metric) *hll.Sketch {
+	if s == nil {
+		s = hll.New()
+	}
+	if m.Member != nil {
+		s.Add(*m.Member)
+	}
+	if m.Set != nil && m.Set.Sketch != nil {
+		// Точность проверена при валидации метрики
+		_ = s.Merge(m.Set.Sketch)
+	}
+	return s
+}
+
+// SetSnapshot returns the set state with the estimated cardinality and without the sketch.
+func SetSnapshot(s *hll.Sketch) *SetValue {
+	return &SetValue{Cardinality: s.Estimate()}
+}
+
+// SetReader reads set metrics.
+type SetReader interface {
+	// GetSet returns a snapshot of the set with the series key id or ErrSetNotFound.
+	GetSet(ctx context.Context, id string) (*SetValue, error)
+
+	// GetAllSets returns snapshots of all sets by series key.
+	GetAllSets(ctx context.Context) (map[string]*SetValue, error)
+}
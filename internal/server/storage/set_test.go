@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/antonminaichev/metricscollector/internal/hll"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddSet(t *testing.T) {
+	alice, bob := "alice", "bob"
+	s := AddSet(nil, Metric{ID: "users", MType: Set, Member: &alice})
+	s = AddSet(s, Metric{ID: "users", MType: Set, Member: &alice})
+
+	// Скетч клиента объединяется с накопленным состоянием
+	client := hll.New()
+	client.Add(alice)
+	client.Add(bob)
+	s = AddSet(s, Metric{ID: "users", MType: Set, Set: &SetValue{Sketch: client}})
+
+	snapshot := SetSnapshot(s)
+	assert.Equal(t, uint64(2), snapshot.Cardinality)
+	assert.Nil(t, snapshot.Sketch)
+}
+
+func TestMetric_ValidateSet(t *testing.T) {
+	member := "alice"
+	tests := []struct {
+		name    string
+		m       Metric
+		wantErr bool
+	}{
+		{"member", Metric{ID: "users", MType: Set, Member: &member}, false},
+		{"sketch", Metric{ID: "users", MType: Set, Set: &SetValue{Sketch: hll.New()}}, false},
+		{"empty", Metric{ID: "users", MType: Set}, true},
+		{"no sketch", Metric{ID: "users", MType: Set, Set: &SetValue{Cardinality: 3}}, true},
+		{"bad precision", Metric{ID: "users", MType: Set, Set: &SetValue{Sketch: &hll.Sketch{Precision: 4, Registers: make([]byte, 16)}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.m.Validate()
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
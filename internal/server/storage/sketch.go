@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"math"
+	"sort"
+)
+
+// Quantile sketch parameters.
+const (
+	// SketchRelativeAccuracy bounds the relative error of quantile estimates.
+	SketchRelativeAccuracy = 0.01
+	// sketchMaxBuckets limits buckets per sign, the smallest magnitudes are collapsed beyond it.
+	sketchMaxBuckets = 2048
+	// sketchMinValue is the smallest magnitude told apart from zero.
+	sketchMinValue = 1e-9
+)
+
+var (
+	sketchGamma    = (1 + SketchRelativeAccuracy) / (1 - SketchRelativeAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// QuantileSketch estimates quantiles of a stream of values with bounded relative error.
+// Values are counted in logarithmic buckets, so the sketch size grows with the value range
+// rather than the number of values.
+type QuantileSketch struct {
+	Positive map[int]uint64 `json:"positive,omitempty"`
+	Negative map[int]uint64 `json:"negative,omitempty"`
+	Zero     uint64         `json:"zero,omitempty"`
+	Count    uint64         `json:"count"`
+}
+
+// NewQuantileSketch creates an empty sketch.
+func NewQuantileSketch() *QuantileSketch {
+	return &QuantileSketch{Positive: make(map[int]uint64), Negative: make(map[int]uint64)}
+}
+
+// Add counts v in the sketch.
+func (s *QuantileSketch) Add(v float64) {
+	if s.Positive == nil {
+		s.Positive = make(map[int]uint64)
+	}
+	if s.Negative == nil {
+		s.Negative = make(map[int]uint64)
+	}
+	switch {
+	case v >= sketchMinValue:
+		s.Positive[sketchIndex(v)]++
+		collapse(s.Positive)
+	case v <= -sketchMinValue:
+		s.Negative[sketchIndex(-v)]++
+		collapse(s.Negative)
+	default:
+		s.Zero++
+	}
+	s.Count++
+}
+
+// Quantile returns the estimate of the q-quantile, q in [0, 1]. An empty sketch yields NaN.
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	rank := uint64(q * float64(s.Count-1))
+
+	var seen uint64
+	// Отрицательные значения по возрастанию идут от больших модулей к меньшим
+	negative := sortedIndexes(s.Negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		seen += s.Negative[negative[i]]
+		if seen > rank {
+			return -sketchValue(negative[i])
+		}
+	}
+	seen += s.Zero
+	if seen > rank {
+		return 0
+	}
+	positive := sortedIndexes(s.Positive)
+	for _, i := range positive {
+		seen += s.Positive[i]
+		if seen > rank {
+			return sketchValue(i)
+		}
+	}
+	return sketchValue(positive[len(positive)-1])
+}
+
+// sketchIndex returns the bucket of a positive value.
+func sketchIndex(v float64) int {
+	return int(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// sketchValue returns the representative value of a bucket, within the relative accuracy of all its values.
+func sketchValue(i int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+}
+
+// collapse merges the smallest magnitude buckets once there are more than sketchMaxBuckets.
+func collapse(buckets map[int]uint64) {
+	if len(buckets) <= sketchMaxBuckets {
+		return
+	}
+	indexes := sortedIndexes(buckets)
+	excess := indexes[:len(indexes)-sketchMaxBuckets]
+	target := indexes[len(excess)]
+	for _, i := range excess {
+		buckets[target] += buckets[i]
+		delete(buckets, i)
+	}
+}
+
+func sortedIndexes(buckets map[int]uint64) []int {
+	indexes := make([]int, 0, len(buckets))
+	for i := range buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
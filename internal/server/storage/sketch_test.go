@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuantileSketch(t *testing.T) {
+	t.Run("quantiles are within relative accuracy", func(t *testing.T) {
+		s := NewQuantileSketch()
+		for i := 1; i <= 10000; i++ {
+			s.Add(float64(i))
+		}
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			want := q * 9999
+			assert.InEpsilon(t, want+1, s.Quantile(q), 2*SketchRelativeAccuracy, "q=%v", q)
+		}
+	})
+
+	t.Run("negative and zero values", func(t *testing.T) {
+		s := NewQuantileSketch()
+		for _, v := range []float64{-100, -10, 0, 10, 100} {
+			s.Add(v)
+		}
+		assert.InEpsilon(t, -100, s.Quantile(0), SketchRelativeAccuracy)
+		assert.Equal(t, 0.0, s.Quantile(0.5))
+		assert.InEpsilon(t, 100, s.Quantile(1), SketchRelativeAccuracy)
+	})
+
+	t.Run("empty sketch", func(t *testing.T) {
+		assert.True(t, math.IsNaN(NewQuantileSketch().Quantile(0.5)))
+	})
+
+	t.Run("bucket count is bounded", func(t *testing.T) {
+		s := NewQuantileSketch()
+		// Значения от 1e-8 до 1e8 дают больше бакетов, чем допустимо
+		for v := 1e-8; v < 1e8; v *= 1.01 {
+			s.Add(v)
+		}
+		assert.LessOrEqual(t, len(s.Positive), sketchMaxBuckets)
+		// Верхние квантили не страдают от схлопывания
+		assert.InEpsilon(t, 1e8, s.Quantile(1), 2*SketchRelativeAccuracy)
+	})
+}
+
+func TestSummaryValue(t *testing.T) {
+	var s *SummaryValue
+	for _, v := range []float64{3, 1, 2} {
+		s = s.Observe(v)
+	}
+
+	snapshot := s.Snapshot()
+	assert.Equal(t, uint64(3), snapshot.Count)
+	assert.Equal(t, 6.0, snapshot.Sum)
+	assert.Equal(t, 1.0, snapshot.Min)
+	assert.Equal(t, 3.0, snapshot.Max)
+	assert.Nil(t, snapshot.Sketch)
+	assert.Len(t, snapshot.Quantiles, len(SummaryQuantiles))
+	assert.InEpsilon(t, 2, snapshot.Quantiles[0].Value, SketchRelativeAccuracy)
+	// Оценки не выходят за наблюдаемый диапазон
+	for _, q := range snapshot.Quantiles {
+		assert.GreaterOrEqual(t, q.Value, 1.0)
+		assert.LessOrEqual(t, q.Value, 3.0)
+	}
+}
@@ -1,15 +1,25 @@
 // Storage package is used for creating and operating different metric storage types.
 package storage
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"math"
+)
 
 // MetricType defines metric type.
 type MetricType string
 
-// Two main metric types.
+// Supported metric types.
 const (
 	Counter MetricType = "counter"
 	Gauge   MetricType = "gauge"
+	// Histogram metrics are written in batches only, see HistogramValue.
+	Histogram MetricType = "histogram"
+	// Summary metrics aggregate observations reported in Value, see SummaryValue.
+	Summary MetricType = "summary"
+	// Set metrics count unique members reported in Member or Set, see SetValue.
+	Set MetricType = "set"
 )
 
 // Metric presents single metric type and its value.
@@ -18,6 +28,60 @@ type Metric struct {
 	MType MetricType `json:"type"`            // параметр, принимающий значение gauge или counter
 	Delta *int64     `json:"delta,omitempty"` // значение метрики в случае передачи counter
 	Value *float64   `json:"value,omitempty"`
+	// Labels are optional key/value dimensions, metrics with different labels are stored separately.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Histogram carries observations of a histogram metric.
+	Histogram *HistogramValue `json:"histogram,omitempty"`
+	// Summary is the aggregated state of a summary metric returned by the server.
+	Summary *SummaryValue `json:"summary,omitempty"`
+	// Member is a member of a set metric.
+	Member *string `json:"member,omitempty"`
+	// Set carries a sketch of set members or the set state returned by the server.
+	Set *SetValue `json:"set,omitempty"`
+}
+
+// Key returns the storage key of the metric, see SeriesKey.
+func (m Metric) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// Validate checks that the metric has a known type and carries the matching value.
+func (m Metric) Validate() error {
+	if err := ValidateSeries(m.ID, m.Labels); err != nil {
+		return err
+	}
+	switch m.MType {
+	case Counter:
+		if m.Delta == nil {
+			return fmt.Errorf("delta value is required for counter metric")
+		}
+	case Gauge:
+		if m.Value == nil {
+			return fmt.Errorf("value is required for gauge metric")
+		}
+	case Histogram:
+		if m.Histogram == nil {
+			return fmt.Errorf("histogram is required for histogram metric")
+		}
+		return m.Histogram.Validate()
+	case Summary:
+		if m.Value == nil {
+			return fmt.Errorf("value is required for summary metric")
+		}
+		if math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return fmt.Errorf("summary observation must be finite")
+		}
+	case Set:
+		if m.Member == nil && (m.Set == nil || m.Set.Sketch == nil) {
+			return fmt.Errorf("member or sketch is required for set metric")
+		}
+		if m.Set != nil && m.Set.Sketch != nil {
+			return m.Set.Sketch.Validate()
+		}
+	default:
+		return fmt.Errorf("unknown metric type: %s", m.MType)
+	}
+	return nil
 }
 
 type MetricReader interface {
@@ -33,10 +97,18 @@ type MetricWriter interface {
 	UpdateMetric(ctx context.Context, id string, mType MetricType, delta *int64, value *float64) error
 }
 
+// BatchWriter applies batches of metrics at most once.
+type BatchWriter interface {
+	// UpdateMetrics applies all metrics of a batch atomically.
+	// A batch with a non-empty batchID that was already applied is ignored and false is returned.
+	UpdateMetrics(ctx context.Context, batchID string, metrics []Metric) (bool, error)
+}
+
 // Storage defines an interface for metric operations.
 type Storage interface {
 	MetricReader
 	MetricWriter
+	BatchWriter
 	// Ping checks database availability.
 	Ping(ctx context.Context) error
 }
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+var (
+	// ErrSummaryNotFound is returned when a summary metric does not exist.
+	ErrSummaryNotFound = errors.New("metric not found")
+	// ErrSummariesUnsupported is returned by wrappers of storages that do not keep summaries.
+	ErrSummariesUnsupported = errors.New("summaries are not supported by the storage")
+)
+
+// SummaryQuantiles are the quantiles reported for every summary.
+var SummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Quantile is an estimated quantile of observed values.
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// SummaryValue aggregates observations of a summary (timer) metric.
+// Every report of a summary is a single observation carried in Metric.Value.
+type SummaryValue struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	// Quantiles are estimates of SummaryQuantiles, they are filled in by Snapshot.
+	Quantiles []Quantile `json:"quantiles,omitempty"`
+	// Sketch is the quantile estimator state, it is kept by storages and dropped by Snapshot.
+	Sketch *QuantileSketch `json:"sketch,omitempty"`
+}
+
+// Observe adds an observation to the summary, s may be nil.
+func (s *SummaryValue) Observe(v float64) *SummaryValue {
+	if s == nil {
+		s = &SummaryValue{Min: v, Max: v, Sketch: NewQuantileSketch()}
+	}
+	if s.Sketch == nil {
+		s.Sketch = NewQuantileSketch()
+	}
+	s.Count++
+	s.Sum += v
+	s.Min = math.Min(s.Min, v)
+	s.Max = math.Max(s.Max, v)
+	s.Sketch.Add(v)
+	return s
+}
+
+// Snapshot returns the summary with quantile estimates and without the sketch.
+// Estimates are clamped to the observed range.
+func (s *SummaryValue) Snapshot() *SummaryValue {
+	snapshot := &SummaryValue{Count: s.Count, Sum: s.Sum, Min: s.Min, Max: s.Max}
+	if s.Sketch == nil || s.Sketch.Count == 0 {
+		return snapshot
+	}
+	for _, q := range SummaryQuantiles {
+		v := math.Max(s.Min, math.Min(s.Max, s.Sketch.Quantile(q)))
+		snapshot.Quantiles = append(snapshot.Quantiles, Quantile{Quantile: q, Value: v})
+	}
+	return snapshot
+}
+
+// SummaryReader reads summary metrics.
+type SummaryReader interface {
+	// GetSummary returns a snapshot of the summary with the series key id or ErrSummaryNotFound.
+	GetSummary(ctx context.Context, id string) (*SummaryValue, error)
+
+	// GetAllSummaries returns snapshots of all summaries by series key.
+	GetAllSummaries(ctx context.Context) (map[string]*SummaryValue, error)
+}
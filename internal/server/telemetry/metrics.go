@@ -0,0 +1,24 @@
+package telemetry
+
+// Server self-instrumentation metrics registered in Default.
+var (
+	// HTTPRequests counts HTTP requests by method, route pattern and status.
+	HTTPRequests = Default.Counter("http_requests_total", "Total number of HTTP requests.", "method", "route", "status")
+	// HTTPRequestDuration tracks HTTP request latency by method, route pattern and status.
+	HTTPRequestDuration = Default.Histogram("http_request_duration_seconds", "HTTP request latency in seconds.", nil, "method", "route", "status")
+
+	// StorageOperationDuration tracks storage call latency by backend and operation.
+	StorageOperationDuration = Default.Histogram("storage_operation_duration_seconds", "Storage operation latency in seconds.", nil, "backend", "operation")
+	// StorageOperationErrors counts failed storage calls by backend and operation.
+	StorageOperationErrors = Default.Counter("storage_operation_errors_total", "Total number of failed storage operations.", "backend", "operation")
+
+	// SignatureFailures counts rejected request signatures by transport and reason.
+	SignatureFailures = Default.Counter("signature_failures_total", "Total number of rejected request signatures.", "transport", "reason")
+	// DecryptFailures counts request bodies that could not be decrypted by reason.
+	DecryptFailures = Default.Counter("decrypt_failures_total", "Total number of request bodies that failed to decrypt.", "reason")
+
+	// FileSaveDuration tracks how long saving the file storage snapshot takes.
+	FileSaveDuration = Default.Histogram("file_save_duration_seconds", "File storage snapshot save duration in seconds.", nil)
+	// FileSaveErrors counts failed file storage snapshot saves.
+	FileSaveErrors = Default.Counter("file_save_errors_total", "Total number of failed file storage snapshot saves.")
+)
@@ -0,0 +1,186 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+)
+
+// InstrumentedStorage wraps a storage and records latency and errors of every call.
+// It implements every reader interface of the storage package, readers the wrapped storage lacks
+// return the matching unsupported or disabled error, so callers check errors rather than interfaces.
+type InstrumentedStorage struct {
+	storage.Storage
+	backend string
+}
+
+// NewInstrumentedStorage wraps s, backend is used as the label value of recorded metrics.
+func NewInstrumentedStorage(s storage.Storage, backend string) *InstrumentedStorage {
+	return &InstrumentedStorage{Storage: s, backend: backend}
+}
+
+func (s *InstrumentedStorage) observe(op string, start time.Time, err error) {
+	StorageOperationDuration.Observe(time.Since(start).Seconds(), s.backend, op)
+	if err != nil {
+		StorageOperationErrors.Inc(s.backend, op)
+	}
+}
+
+// GetMetric returns metric values from the wrapped storage.
+func (s *InstrumentedStorage) GetMetric(ctx context.Context, id string, mType storage.MetricType) (*int64, *float64, error) {
+	start := time.Now()
+	delta, value, err := s.Storage.GetMetric(ctx, id, mType)
+	s.observe("get_metric", start, err)
+	return delta, value, err
+}
+
+// GetAllMetrics returns all metrics from the wrapped storage.
+func (s *InstrumentedStorage) GetAllMetrics(ctx context.Context) (map[string]int64, map[string]float64, error) {
+	start := time.Now()
+	counters, gauges, err := s.Storage.GetAllMetrics(ctx)
+	s.observe("get_all_metrics", start, err)
+	return counters, gauges, err
+}
+
+// UpdateMetric updates a metric in the wrapped storage.
+func (s *InstrumentedStorage) UpdateMetric(ctx context.Context, id string, mType storage.MetricType, delta *int64, value *float64) error {
+	start := time.Now()
+	err := s.Storage.UpdateMetric(ctx, id, mType, delta, value)
+	s.observe("update_metric", start, err)
+	return err
+}
+
+// UpdateMetrics applies a batch to the wrapped storage.
+func (s *InstrumentedStorage) UpdateMetrics(ctx context.Context, batchID string, metrics []storage.Metric) (bool, error) {
+	start := time.Now()
+	applied, err := s.Storage.UpdateMetrics(ctx, batchID, metrics)
+	s.observe("update_metrics", start, err)
+	return applied, err
+}
+
+// GetHistory returns metric samples from the wrapped storage.
+// storage.ErrHistoryDisabled is returned if the wrapped storage does not keep history.
+func (s *InstrumentedStorage) GetHistory(ctx context.Context, id string, mType storage.MetricType, from, to time.Time) ([]storage.Sample, error) {
+	hr, ok := s.Storage.(storage.HistoryReader)
+	if !ok {
+		return nil, storage.ErrHistoryDisabled
+	}
+	start := time.Now()
+	samples, err := hr.GetHistory(ctx, id, mType, from, to)
+	s.observe("get_history", start, err)
+	return samples, err
+}
+
+// GetRollups returns metric rollups from the wrapped storage.
+// storage.ErrRollupsDisabled is returned if the wrapped storage does not maintain rollups.
+func (s *InstrumentedStorage) GetRollups(ctx context.Context, id string, mType storage.MetricType, res storage.Resolution, from, to time.Time) ([]storage.Rollup, error) {
+	rr, ok := s.Storage.(storage.RollupReader)
+	if !ok {
+		return nil, storage.ErrRollupsDisabled
+	}
+	start := time.Now()
+	rollups, err := rr.GetRollups(ctx, id, mType, res, from, to)
+	s.observe("get_rollups", start, err)
+	return rollups, err
+}
+
+// GetHistogram returns a histogram from the wrapped storage.
+// storage.ErrHistogramsUnsupported is returned if the wrapped storage does not keep histograms.
+func (s *InstrumentedStorage) GetHistogram(ctx context.Context, id string) (*storage.HistogramValue, error) {
+	hr, ok := s.Storage.(storage.HistogramReader)
+	if !ok {
+		return nil, storage.ErrHistogramsUnsupported
+	}
+	start := time.Now()
+	h, err := hr.GetHistogram(ctx, id)
+	s.observe("get_histogram", start, err)
+	return h, err
+}
+
+// GetAllHistograms returns all histograms from the wrapped storage.
+// storage.ErrHistogramsUnsupported is returned if the wrapped storage does not keep histograms.
+func (s *InstrumentedStorage) GetAllHistograms(ctx context.Context) (map[string]*storage.HistogramValue, error) {
+	hr, ok := s.Storage.(storage.HistogramReader)
+	if !ok {
+		return nil, storage.ErrHistogramsUnsupported
+	}
+	start := time.Now()
+	histograms, err := hr.GetAllHistograms(ctx)
+	s.observe("get_all_histograms", start, err)
+	return histograms, err
+}
+
+// GetSummary returns a summary from the wrapped storage.
+// storage.ErrSummariesUnsupported is returned if the wrapped storage does not keep summaries.
+func (s *InstrumentedStorage) GetSummary(ctx context.Context, id string) (*storage.SummaryValue, error) {
+	sr, ok := s.Storage.(storage.SummaryReader)
+	if !ok {
+		return nil, storage.ErrSummariesUnsupported
+	}
+	start := time.Now()
+	summary, err := sr.GetSummary(ctx, id)
+	s.observe("get_summary", start, err)
+	return summary, err
+}
+
+// GetAllSummaries returns all summaries from the wrapped storage.
+// storage.ErrSummariesUnsupported is returned if the wrapped storage does not keep summaries.
+func (s *InstrumentedStorage) GetAllSummaries(ctx context.Context) (map[string]*storage.SummaryValue, error) {
+	sr, ok := s.Storage.(storage.SummaryReader)
+	if !ok {
+		return nil, storage.ErrSummariesUnsupported
+	}
+	start := time.Now()
+	summaries, err := sr.GetAllSummaries(ctx)
+	s.observe("get_all_summaries", start, err)
+	return summaries, err
+}
+
+// GetSet returns a set from the wrapped storage.
+// storage.ErrSetsUnsupported is returned if the wrapped storage does not keep sets.
+func (s *InstrumentedStorage) GetSet(ctx context.Context, id string) (*storage.SetValue, error) {
+	sr, ok := s.Storage.(storage.SetReader)
+	if !ok {
+		return nil, storage.ErrSetsUnsupported
+	}
+	start := time.Now()
+	set, err := sr.GetSet(ctx, id)
+	s.observe("get_set", start, err)
+	return set, err
+}
+
+// GetAllSets returns all sets from the wrapped storage.
+// storage.ErrSetsUnsupported is returned if the wrapped storage does not keep sets.
+func (s *InstrumentedStorage) GetAllSets(ctx context.Context) (map[string]*storage.SetValue, error) {
+	sr, ok := s.Storage.(storage.SetReader)
+	if !ok {
+		return nil, storage.ErrSetsUnsupported
+	}
+	start := time.Now()
+	sets, err := sr.GetAllSets(ctx)
+	s.observe("get_all_sets", start, err)
+	return sets, err
+}
+
+// FindSeries returns metrics matching all matchers from the wrapped storage.
+func (s *InstrumentedStorage) FindSeries(ctx context.Context, matchers []*storage.Matcher) ([]storage.Metric, error) {
+	start := time.Now()
+	var series []storage.Metric
+	var err error
+	if sr, ok := s.Storage.(storage.SeriesReader); ok {
+		series, err = sr.FindSeries(ctx, matchers)
+	} else {
+		series, err = storage.SelectSeries(ctx, s.Storage, matchers)
+	}
+	s.observe("find_series", start, err)
+	return series, err
+}
+
+// Ping checks availability of the wrapped storage.
+func (s *InstrumentedStorage) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.Storage.Ping(ctx)
+	s.observe("ping", start, err)
+	return err
+}
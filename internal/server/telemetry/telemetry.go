@@ -0,0 +1,271 @@
+// Package telemetry collects server self-instrumentation metrics and renders them
+// in the Prometheus text exposition format.
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Namespace prefixes names of all self-instrumentation metrics.
+const Namespace = "metricscollector_"
+
+// DefaultBuckets are latency histogram buckets in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry used by the server.
+var Default = NewRegistry()
+
+// Registry keeps counters and histograms. It is safe for concurrent use.
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[string]*CounterVec
+	histograms map[string]*HistogramVec
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]*CounterVec),
+		histograms: make(map[string]*HistogramVec),
+	}
+}
+
+// Counter returns the counter with the given name, registering it on first use.
+// Name is prefixed with Namespace.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = Namespace + name
+	if c, ok := r.counters[name]; ok {
+		return c
+	}
+	c := &CounterVec{desc: desc{name: name, help: help, labels: labels}, values: make(map[string]*counterValue)}
+	r.counters[name] = c
+	return c
+}
+
+// Histogram returns the histogram with the given name, registering it on first use.
+// Name is prefixed with Namespace, nil buckets mean DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = Namespace + name
+	if h, ok := r.histograms[name]; ok {
+		return h
+	}
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{desc: desc{name: name, help: help, labels: labels}, buckets: buckets, values: make(map[string]*histogramValue)}
+	r.histograms[name] = h
+	return h
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format ordered by name.
+func (r *Registry) WritePrometheus(out io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.counters)+len(r.histograms))
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	counters, histograms := r.counters, r.histograms
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	w := bufio.NewWriter(out)
+	for _, name := range names {
+		if c, ok := counters[name]; ok {
+			c.write(w)
+		} else {
+			histograms[name].write(w)
+		}
+	}
+	return w.Flush()
+}
+
+// Handler serves the registry in the Prometheus text exposition format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WritePrometheus(rw); err != nil {
+			http.Error(rw, "Failed to write metrics", http.StatusInternalServerError)
+		}
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("telemetry: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs renders {k="v",...} with extra appended after the metric labels.
+func (d desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d desc) writeHeader(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, typ)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	v float64
+}
+
+// Inc increments the counter for the label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the label values by v.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{}
+		c.values[key] = cv
+	}
+	cv.v += v
+}
+
+// Value returns the current counter value for the label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cv, ok := c.values[key]; ok {
+		return cv.v
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.values[key].v))
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe records a value for the label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Count returns the number of observations for the label values.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hv, ok := h.values[key]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), hv.count)
+	}
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
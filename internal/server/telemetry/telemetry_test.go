@@ -0,0 +1,100 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antonminaichev/metricscollector/internal/server/storage"
+	ms "github.com/antonminaichev/metricscollector/internal/server/storage/memstorage"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests.", "code")
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc(`a"b`)
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	// Повторная регистрация возвращает ту же метрику
+	assert.Same(t, c, r.Counter("requests_total", "Requests.", "code"))
+	assert.Equal(t, float64(3), c.Value("200"))
+	assert.Equal(t, uint64(3), h.Count())
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WritePrometheus(&buf))
+	assert.Equal(t, `# HELP metricscollector_latency_seconds Latency.
+# TYPE metricscollector_latency_seconds histogram
+metricscollector_latency_seconds_bucket{le="0.1"} 1
+metricscollector_latency_seconds_bucket{le="1"} 2
+metricscollector_latency_seconds_bucket{le="+Inf"} 3
+metricscollector_latency_seconds_sum 5.55
+metricscollector_latency_seconds_count 3
+# HELP metricscollector_requests_total Requests.
+# TYPE metricscollector_requests_total counter
+metricscollector_requests_total{code="200"} 3
+metricscollector_requests_total{code="a\"b"} 1
+`, buf.String())
+}
+
+func TestCounterVec_WrongLabelCount(t *testing.T) {
+	c := NewRegistry().Counter("x_total", "X.", "a", "b")
+	assert.Panics(t, func() { c.Inc("only-one") })
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(HTTPMiddleware)
+	r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	before := HTTPRequests.Value(http.MethodGet, "/items/{id}", "418")
+	unmatched := HTTPRequests.Value(http.MethodGet, unmatchedRoute, "404")
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/42", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	assert.Equal(t, before+1, HTTPRequests.Value(http.MethodGet, "/items/{id}", "418"))
+	assert.Equal(t, unmatched+1, HTTPRequests.Value(http.MethodGet, unmatchedRoute, "404"))
+	assert.NotZero(t, HTTPRequestDuration.Count(http.MethodGet, "/items/{id}", "418"))
+}
+
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) Ping(context.Context) error {
+	return errors.New("unavailable")
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	s := NewInstrumentedStorage(failingStorage{ms.NewMemoryStorage()}, "test")
+	delta := int64(1)
+
+	require.NoError(t, s.UpdateMetric(context.Background(), "c", storage.Counter, &delta, nil))
+	got, _, err := s.GetMetric(context.Background(), "c", storage.Counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *got)
+	assert.Error(t, s.Ping(context.Background()))
+
+	assert.Equal(t, uint64(1), StorageOperationDuration.Count("test", "update_metric"))
+	assert.Equal(t, uint64(1), StorageOperationDuration.Count("test", "get_metric"))
+	assert.Zero(t, StorageOperationErrors.Value("test", "get_metric"))
+	assert.Equal(t, float64(1), StorageOperationErrors.Value("test", "ping"))
+
+	// Обертка не скрывает отсутствие истории у хранилища
+	_, err = s.GetHistory(context.Background(), "c", storage.Counter, time.Time{}, time.Now())
+	assert.ErrorIs(t, err, storage.ErrHistoryDisabled)
+}